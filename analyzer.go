@@ -0,0 +1,97 @@
+package emailsearch
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Analyzer describes how the text of emails is turned into the words that
+// are indexed. The query words go through the same analysis, so an index
+// can only be searched by a program that analyzes text the same way as the
+// one that built it. The analyzer is recorded in the index metadata and
+// checked when the index is loaded, see AnalyzerError.
+type Analyzer struct {
+	// Tokenizer names how text is split into words. "unicode" splits it into
+	// runs of letters and digits.
+	Tokenizer string `json:"tokenizer"`
+
+	// Lowercase is true if words are indexed in lower case.
+	Lowercase bool `json:"lowercase"`
+
+	// MinWordLength is the length in bytes of the shortest indexed word.
+	MinWordLength int `json:"min_word_length"`
+
+	// StopWords are the words that are not indexed.
+	StopWords []string `json:"stop_words"`
+
+	// Stemming names the stemmer words are reduced with, "none" if they are
+	// indexed as they are.
+	Stemming string `json:"stemming"`
+
+	// Normalizers lists the kinds of text that are also indexed under a
+	// canonical token, see NormalizeQuery.
+	Normalizers []string `json:"normalizers"`
+}
+
+// minWordLength is the length of the shortest word that is indexed.
+const minWordLength = 3
+
+// DefaultAnalyzer returns the analyzer this package indexes and searches
+// text with.
+func DefaultAnalyzer() Analyzer {
+	return Analyzer{
+		Tokenizer:     "unicode",
+		Lowercase:     true,
+		MinWordLength: minWordLength,
+		StopWords:     slices.Clone(stopWords),
+		Stemming:      "none",
+		Normalizers:   []string{"dates", "numbers"},
+	}
+}
+
+// diff returns the name of the first setting that differs between a and b,
+// or "" if they are the same.
+func (a Analyzer) diff(b Analyzer) string {
+	switch {
+	case a.Tokenizer != b.Tokenizer:
+		return "tokenizer"
+	case a.Lowercase != b.Lowercase:
+		return "lowercase"
+	case a.MinWordLength != b.MinWordLength:
+		return "min_word_length"
+	case !slices.Equal(slices.Sorted(slices.Values(a.StopWords)), slices.Sorted(slices.Values(b.StopWords))):
+		return "stop_words"
+	case a.Stemming != b.Stemming:
+		return "stemming"
+	case !slices.Equal(a.Normalizers, b.Normalizers):
+		return "normalizers"
+	}
+	return ""
+}
+
+// checkAnalyzer returns an *AnalyzerError if the index described by meta
+// was built with a different analyzer than DefaultAnalyzer. Indexes built
+// before the analyzer was recorded are assumed to match.
+func checkAnalyzer(meta IndexMetadata) error {
+	if meta.Analyzer == nil {
+		return nil
+	}
+	want := DefaultAnalyzer()
+	if setting := meta.Analyzer.diff(want); setting != "" {
+		return &AnalyzerError{Setting: setting, Got: *meta.Analyzer, Want: want}
+	}
+	return nil
+}
+
+// AnalyzerError reports an index that was built with a different Analyzer
+// than the one this package searches with. Its queries wouldn't find the
+// words they should, so the index has to be rebuilt.
+type AnalyzerError struct {
+	Setting string   // JSON name of the first setting that differs
+	Got     Analyzer // Analyzer the index was built with
+	Want    Analyzer // Analyzer of this package
+}
+
+func (e *AnalyzerError) Error() string {
+	return fmt.Sprintf("index was built with a different analyzer, its %s setting doesn't match, the index has to be rebuilt", e.Setting)
+}
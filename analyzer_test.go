@@ -0,0 +1,76 @@
+package emailsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzerRecorded(t *testing.T) {
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, map[string]string{"1": "Subject: one\n\nThe quarterly budget.\n"})
+	metaPath := filepath.Join(dir, IndexMetadataFile)
+	rewrite := func(f func(meta *IndexMetadata)) {
+		t.Helper()
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta IndexMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		f(&meta)
+		if data, err = json.Marshal(&meta); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(metaPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx, err := LoadIndexFromDisk(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.IndexMetadata().Analyzer; got == nil || !reflect.DeepEqual(*got, DefaultAnalyzer()) {
+		t.Errorf("expected the default analyzer to be recorded, got %+v", got)
+	}
+	idx.Close()
+
+	// A different analyzer fails to load
+	rewrite(func(meta *IndexMetadata) { meta.Analyzer.StopWords = append(meta.Analyzer.StopWords, "budget") })
+	var aerr *AnalyzerError
+	if _, err := LoadIndexFromDisk(dir, nil); !errors.As(err, &aerr) || aerr.Setting != "stop_words" {
+		t.Errorf("expected an analyzer error for the stop words, got %v", err)
+	}
+	rewrite(func(meta *IndexMetadata) {
+		*meta.Analyzer = DefaultAnalyzer()
+		meta.Analyzer.Stemming = "porter"
+	})
+	if _, err := LoadIndexFromDisk(dir, nil); !errors.As(err, &aerr) || aerr.Setting != "stemming" || aerr.Got.Stemming != "porter" {
+		t.Errorf("expected an analyzer error for stemming, got %v", err)
+	}
+
+	// The order of the stop words doesn't matter
+	rewrite(func(meta *IndexMetadata) {
+		*meta.Analyzer = DefaultAnalyzer()
+		words := meta.Analyzer.StopWords
+		words[0], words[len(words)-1] = words[len(words)-1], words[0]
+	})
+	if idx, err := LoadIndexFromDisk(dir, nil); err != nil {
+		t.Errorf("expected reordered stop words to load, got %v", err)
+	} else {
+		idx.Close()
+	}
+
+	// Indexes from before the analyzer was recorded still load
+	rewrite(func(meta *IndexMetadata) { meta.Analyzer = nil })
+	if idx, err := LoadIndexFromDisk(dir, nil); err != nil {
+		t.Errorf("expected an index without an analyzer to load, got %v", err)
+	} else {
+		idx.Close()
+	}
+}
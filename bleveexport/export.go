@@ -0,0 +1,100 @@
+// Package bleveexport copies the emails of an emailsearch index into a
+// Bleve index, so that the ranking and features of the two can be compared
+// or a deployment can move to Bleve. The emails are read from the catalog
+// of the built index, which already holds the parsed body and headers, so
+// the original maildir is not needed.
+//
+//	idx, _ := emailsearch.LoadIndexFromDisk("email_index", io.Discard)
+//	b, _ := bleve.New("email.bleve", bleveexport.NewMapping())
+//	err := bleveexport.Export(ctx, idx, b, bleveexport.DefaultBatchSize)
+package bleveexport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/chriskillpack/emailsearch"
+)
+
+// DefaultBatchSize is a reasonable number of emails to index in each Bleve
+// batch.
+const DefaultBatchSize = 1000
+
+// Email is the document Export indexes into Bleve for each email, with the
+// filename as its ID.
+type Email struct {
+	Body    string    `json:"body"`
+	Subject string    `json:"subject"`
+	From    string    `json:"from"`
+	Date    time.Time `json:"date"`
+	Labels  []string  `json:"labels"`
+}
+
+// BleveType tells Bleve to index Email with the "email" document mapping.
+func (Email) BleveType() string {
+	return "email"
+}
+
+// NewMapping returns an index mapping for Email documents. The body and
+// subject are analyzed as English text, the sender and labels are stored
+// as they are so that they can be matched exactly and used as facets.
+func NewMapping() mapping.IndexMapping {
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = "en"
+	keyword := bleve.NewKeywordFieldMapping()
+
+	email := bleve.NewDocumentMapping()
+	email.AddFieldMappingsAt("body", text)
+	email.AddFieldMappingsAt("subject", text)
+	email.AddFieldMappingsAt("from", keyword)
+	email.AddFieldMappingsAt("date", bleve.NewDateTimeFieldMapping())
+	email.AddFieldMappingsAt("labels", keyword)
+
+	m := bleve.NewIndexMapping()
+	m.AddDocumentMapping("email", email)
+	m.DefaultMapping = email
+	return m
+}
+
+// Export indexes every email of idx into b, batchSize emails at a time.
+// Emails whose content can't be read from the catalog are skipped, but a
+// catalog that doesn't match its checksum is an error.
+func Export(ctx context.Context, idx *emailsearch.Index, b bleve.Index, batchSize int) error {
+	batchSize = max(batchSize, 1)
+	batch := b.NewBatch()
+	for fidx := range idx.CorpusSize {
+		content, filename, err := idx.ReadContent(ctx, fidx)
+		var cerr *emailsearch.ChecksumError
+		if errors.Is(err, emailsearch.ErrCorrupt) && !errors.As(err, &cerr) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		meta, _ := idx.Metadata(fidx)
+		email := Email{
+			Body:    string(content),
+			Subject: meta.Subject,
+			From:    meta.From,
+			Date:    meta.Date,
+			Labels:  idx.Labels(fidx),
+		}
+		if err := batch.Index(filename, email); err != nil {
+			return fmt.Errorf("failed to index %s: %w", filename, err)
+		}
+
+		if batch.Size() >= batchSize {
+			if err := b.Batch(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if batch.Size() > 0 {
+		return b.Batch(batch)
+	}
+	return nil
+}
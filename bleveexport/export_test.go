@@ -0,0 +1,75 @@
+package bleveexport
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/chriskillpack/emailsearch"
+)
+
+func TestExport(t *testing.T) {
+	emails := map[string]string{
+		"1": "From: lay@enron.com\nSubject: Budget\nX-Gmail-Labels: Important\n\nThe quarterly budget is attached.\n",
+		"2": "Subject: Lunch\n\nLunch on Friday with the lawyer?\n",
+		"3": "Subject: Travel\n\nBook the travel before the budget meeting.\n",
+	}
+	corpus := t.TempDir()
+	var names []string
+	for name, content := range emails {
+		if err := os.WriteFile(filepath.Join(corpus, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	ib := &emailsearch.IndexBuilder{NThreads: 1, InputPath: corpus}
+	ib.Init()
+	if err := ib.InjestFiles(names, 1024); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := ib.Serialize(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := emailsearch.LoadIndexFromDisk(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	b, err := bleve.NewMemOnly(NewMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := Export(t.Context(), idx, b, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := b.DocCount(); n != 3 {
+		t.Errorf("expected 3 documents, got %d", n)
+	}
+	search := func(q string) []string {
+		t.Helper()
+		res, err := b.Search(bleve.NewSearchRequest(bleve.NewQueryStringQuery(q)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, hit := range res.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return ids
+	}
+	if ids := search("budget"); len(ids) != 2 {
+		t.Errorf("expected 2 emails about the budget, got %v", ids)
+	}
+	if ids := search("labels:Important"); len(ids) != 1 || ids[0] != "1" {
+		t.Errorf("expected email 1 to be labelled, got %v", ids)
+	}
+	if ids := search("subject:lunch"); len(ids) != 1 || ids[0] != "2" {
+		t.Errorf("expected email 2 to match the subject, got %v", ids)
+	}
+}
@@ -0,0 +1,57 @@
+package emailsearch
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Browse lists the indexed files whose filename starts with prefix, in
+// filename order, for paging through the corpus without a query. It returns
+// up to limit files starting from the offset'th, or all of the rest if limit
+// is negative, along with the total number of files under prefix. An empty
+// prefix lists every file. The results have no word matches and no score.
+func (idx *Index) Browse(prefix string, offset, limit int) ([]QueryResults, int) {
+	release, ok := idx.acquire()
+	if !ok {
+		return nil, 0
+	}
+	defer release()
+
+	sorted := idx.filenameOrder()
+	lo, _ := slices.BinarySearchFunc(sorted, prefix, func(fidx int, prefix string) int {
+		return strings.Compare(idx.filenames.At(fidx), prefix)
+	})
+	// Filenames with the prefix are together in filename order
+	hi := lo + sort.Search(len(sorted)-lo, func(i int) bool {
+		return !strings.HasPrefix(idx.filenames.At(sorted[lo+i]), prefix)
+	})
+	total := hi - lo
+
+	start := lo + min(max(offset, 0), total)
+	end := hi
+	if limit >= 0 {
+		end = min(start+limit, hi)
+	}
+
+	results := make([]QueryResults, 0, end-start)
+	for _, fidx := range sorted[start:end] {
+		meta, _ := idx.metadata(fidx)
+		results = append(results, QueryResults{
+			Filename:         idx.filenames.At(fidx),
+			Folders:          idx.folders(fidx),
+			DocumentMetadata: meta,
+			FilenameIndex:    fidx,
+		})
+	}
+	return results, total
+}
+
+// filenameOrder returns the filename indices sorted by filename. It is worked
+// out on first use, as most uses of an index never browse it.
+func (idx *Index) filenameOrder() []int {
+	idx.filenameOrderOnce.Do(func() {
+		idx.sortedFilenames = idx.filenames.sortedOrder()
+	})
+	return idx.sortedFilenames
+}
@@ -0,0 +1,53 @@
+package emailsearch
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBrowse(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"bob/inbox/2":   "Subject: lunch\n\nLunch on Friday?\n",
+		"alice/sent/1":  "Subject: re: budget\n\nThanks for the budget.\n",
+		"alice/inbox/1": "From: Bob <bob@example.com>\nSubject: budget\n\nThe budget is attached.\n",
+		"alice/inbox/2": "Subject: travel\n\nBook the travel.\n",
+		"bob/inbox/1":   "Subject: meeting\n\nThe meeting is off.\n",
+	})
+
+	filenames := func(results []QueryResults) []string {
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Filename)
+		}
+		return names
+	}
+
+	cases := []struct {
+		Name          string
+		Prefix        string
+		Offset, Limit int
+		Expected      []string
+		Total         int
+	}{
+		{"All", "", 0, -1, []string{"alice/inbox/1", "alice/inbox/2", "alice/sent/1", "bob/inbox/1", "bob/inbox/2"}, 5},
+		{"First page", "", 0, 2, []string{"alice/inbox/1", "alice/inbox/2"}, 5},
+		{"Last page", "", 4, 2, []string{"bob/inbox/2"}, 5},
+		{"Past the end", "", 10, 2, nil, 5},
+		{"Prefix", "alice/", 0, -1, []string{"alice/inbox/1", "alice/inbox/2", "alice/sent/1"}, 3},
+		{"Prefix page", "alice/inbox", 1, 5, []string{"alice/inbox/2"}, 2},
+		{"No matches", "carol/", 0, -1, nil, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			results, total := idx.Browse(tc.Prefix, tc.Offset, tc.Limit)
+			if got := filenames(results); !slices.Equal(got, tc.Expected) || total != tc.Total {
+				t.Errorf("expected %v of %d, got %v of %d", tc.Expected, tc.Total, got, total)
+			}
+		})
+	}
+
+	results, _ := idx.Browse("alice/inbox/1", 0, 1)
+	if len(results) != 1 || results[0].Subject != "budget" || !slices.Equal(results[0].Folders, []string{"alice/inbox"}) {
+		t.Errorf("expected the metadata and folders of the file, got %+v", results)
+	}
+}
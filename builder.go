@@ -3,22 +3,26 @@ package emailsearch
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"iter"
 	"maps"
+	"math"
+	"mime"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
-	"unsafe"
 
-	"github.com/chriskillpack/compressedtrie"
+	"github.com/RoaringBitmap/roaring/v2"
+	"github.com/klauspost/compress/s2"
 )
 
 const (
@@ -28,6 +32,19 @@ const (
 	IndexWordOffsets     = "word.offsets"
 	CorpusCatalog        = "corpus.cat"
 	QueryPrefixTree      = "query.trie"
+	LabelsStringTable    = "labels.sid"
+	DocumentLabels       = "document.labels"
+	ErrorReport          = "errors.json"
+	IndexMetadataFile    = "metadata.json"
+)
+
+// ErrorPolicy controls how InjestFiles reacts to files that fail to injest.
+type ErrorPolicy int
+
+const (
+	ErrorPolicy_Skip     ErrorPolicy = iota // Record the failure and continue with the next file
+	ErrorPolicy_FailFast                    // Stop injestion and return the first failure
+	ErrorPolicy_Retry                       // Retry up to MaxRetries times, then skip
 )
 
 type IndexBuilder struct {
@@ -35,43 +52,151 @@ type IndexBuilder struct {
 	InputPath           string
 	InjestProgressCh    chan<- InjestUpdate
 	SerializeProgressCh chan<- SerializeUpdate
+	Progress            func(ProgressEvent) // Called with each update as well as sending it, see ProgressEvent
+	ErrorPolicy         ErrorPolicy
+	MaxRetries          int      // Number of retries for ErrorPolicy_Retry
+	IncludePatterns     []string // Only injest files matching one of these glob patterns, see Accept
+	ExcludePatterns     []string // Skip files matching any of these glob patterns, see Accept
+	Codec               Codec    // Compression of the email content stored in the catalog
+
+	// MaxCatalogShardSize is the maximum size in bytes of a catalog shard. If
+	// it is greater than 0 the email content is split across as many shard
+	// files as needed, otherwise it is stored in the catalog itself.
+	MaxCatalogShardSize int64
+
+	// EncryptionKey encrypts the catalog with AES-GCM if it is set, it must
+	// be 16, 24 or 32 bytes. If EncryptIndex is also set the rest of the
+	// index is encrypted too, but for the metadata. The index is loaded
+	// with LoadEncryptedIndexFromDisk.
+	EncryptionKey []byte
+	EncryptIndex  bool
+
+	// Synonyms maps words to their synonyms, see ParseSynonyms. The words
+	// an entry lists are synonyms of it and it of them, occurrences of a
+	// word are also indexed under each of its synonyms. It must be set
+	// before calling Init.
+	Synonyms map[string][]string
+
+	// ContentFilters are applied in order to the body of each email before
+	// it is indexed, e.g. to strip disclaimers or normalize whitespace. The
+	// filtered body is what is stored in the catalog, so that the offsets of
+	// the words match it. A filter is called from several goroutines at
+	// once, and must not keep the slice it is given, which is reused.
+	ContentFilters []func([]byte) []byte
 
 	filenames *StringSet
 	words     *StringSet
-	wordIndex wordIndex
+	wordIndex *wordIndex
+	labels    *StringSet
+	docLabels [][]int // Label string indices for each document, by filename index
+	synonyms  map[string][]string
 	injested  []injestedFile
-	nDocs     int // Number of documents successfully processed and merged into index
+	nDocs     int      // Number of documents successfully processed and merged into index
+	docLens   []uint32 // Number of words in each document, by filename index
+
+	catalogShards []CatalogShard // Manifest of the catalog shards written, without their sizes
+
+	fileWords sizeEstimate // Distinct words per byte of email body
+
+	injestProgress    progress
+	serializeProgress progress
 
 	initOnce sync.Once
 }
 
-// fileIndex tracks the positions of words in a specific file
-type fileIndex map[string][]int
+// occurrence is the location of a single instance of a word in a file
+type occurrence struct {
+	Field    Field // The part of the email the word was found in
+	Offset   int   // Byte offset from the start of the field
+	Length   int   // Byte length of the text that was indexed
+	Position int   // Ordinal of the word amongst all the words of the field
+}
+
+// compareOccurrences orders occurrences by field and then offset
+func compareOccurrences(a, b occurrence) int {
+	if a.Field != b.Field {
+		return int(a.Field) - int(b.Field)
+	}
+	return a.Offset - b.Offset
+}
+
+// fileIndex tracks the positions of words in a specific file. The
+// occurrences of each word are ordered by compareOccurrences.
+type fileIndex map[string][]occurrence
 
+// match holds the occurrences of a word in one field of a file
 type match struct {
 	FilenameStringIndex int
-	Offsets             []int
+	Field               Field
+	Occurrences         []occurrence
 }
 
-// wordIndex is the global index for all the files in the corpus
-// As such it tracks more information than LocalIndex does.
-type wordIndex map[string][]match
-
 // Holds the output of one of the injestion workers
 type injestedFile struct {
 	Filename   string
 	Index      fileIndex
-	Len        int    // length of the indexed content in the file
-	Compressed []byte // gzip compressed copy of filedata that was injested
-	Err        error  // error during processing
+	Len        int      // length of the indexed content in the file
+	Compressed []byte   // Compressed copy of filedata that was injested, see IndexBuilder.Codec
+	Labels     []string // Gmail labels, from the X-Gmail-Labels header
+	Meta       DocumentMetadata
+	Tokens     int   // Number of words in the indexed fields
+	Err        error // error during processing
+	Attempts   int   // Number of times injestion was attempted
 }
 
-type InjestUpdate struct {
+// InjestFailure describes a file that could not be injested. Failures are
+// written to the ErrorReport artifact by Serialize.
+type InjestFailure struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+}
+
+// InjestError is returned by InjestFiles under ErrorPolicy_FailFast.
+type InjestError struct {
+	Filename string
+	Err      error
+}
+
+func (e *InjestError) Error() string {
+	return fmt.Sprintf("failed to injest %s: %s", e.Filename, e.Err)
+}
+
+func (e *InjestError) Unwrap() error {
+	return e.Err
+}
+
+// injestWork is a unit of work for the injestion workers. Usually it names a
+// file on disk to be read, but messages split out of an mbox carry their
+// content in Data.
+type injestWork struct {
 	Filename string
-	Success  bool
-	Phase    int
+	Size     int64 // Size of the file if known
+	Data     []byte
+	Err      error
 }
 
+// ProgressEvent is an InjestUpdate or a SerializeUpdate. IndexBuilder.Progress
+// is a simpler way to follow progress than the channels, which the caller
+// has to read from another goroutine until they are closed. It is called
+// on the goroutine running InjestFiles or Serialize, one update at a time,
+// so it should return quickly.
+type ProgressEvent interface {
+	progressEvent()
+}
+
+type InjestUpdate struct {
+	Filename  string
+	Success   bool
+	Phase     int
+	Done      int           // Number of files processed so far in this phase
+	Total     int           // Number of files in this phase, 0 if not known
+	Rate      float64       // Average files per second in this phase
+	Remaining time.Duration // Estimated time left in this phase, 0 if not known
+}
+
+func (InjestUpdate) progressEvent() {}
+
 type SerializePhase int
 
 const (
@@ -81,6 +206,9 @@ const (
 	SerializePhase_Catalog
 	SerializePhase_WordOffsets
 	SerializePhase_PrefixTree
+	SerializePhase_Labels
+	SerializePhase_ErrorReport
+	SerializePhase_Metadata
 )
 
 const (
@@ -95,13 +223,21 @@ type SerializeUpdate struct {
 	Event int            // See SerializeEvent_* constants
 	Phase SerializePhase // See SerializePhase_* constants
 	N     int            // Number of items
+
+	// Set for SerializeEvent_ProgressPhase events
+	Rate      float64       // Average items per second in this phase
+	Remaining time.Duration // Estimated time left in this phase
 }
 
+func (SerializeUpdate) progressEvent() {}
+
 func (i *IndexBuilder) Init() {
 	i.initOnce.Do(func() {
 		i.filenames = NewStringSet()
 		i.words = NewStringSet()
-		i.wordIndex = make(wordIndex)
+		i.wordIndex = newWordIndex()
+		i.labels = NewStringSet()
+		i.synonyms = expandSynonyms(i.Synonyms)
 	})
 }
 
@@ -111,9 +247,67 @@ func (ib *IndexBuilder) InjestFiles(filenames []string, maxSize int64) error {
 		panic("number of files exceeds file format limits")
 	}
 
-	inCh := make(chan string, ib.NThreads)
+	// The number of files is only known up front if there are no mbox files
+	total := 0
+	for _, file := range filenames {
+		if isMbox(file) {
+			total = 0
+			break
+		}
+		if ib.Accept(file) {
+			total++
+		}
+	}
+
+	return ib.injest(func(yield func(string, int64) bool) {
+		for _, file := range filenames {
+			if !yield(file, 0) {
+				return
+			}
+		}
+	}, len(filenames), total, maxSize)
+}
+
+// InjestStream is InjestFiles for files that are still being found, such as
+// those Walk sends. Each file is injested as it arrives, until files is
+// closed, and is read into a buffer of its Size. If injestion fails early
+// the rest of files is read and discarded, so the sender is never blocked.
+func (ib *IndexBuilder) InjestStream(files <-chan WalkedFile) error {
+	return ib.injest(func(yield func(string, int64) bool) {
+		for f := range files {
+			if !yield(f.Name, f.Size) {
+				go func() {
+					for range files {
+					}
+				}()
+				return
+			}
+		}
+	}, 0, 0, 0)
+}
+
+// injest injests the files, and their sizes, of filenames. n is the number
+// of files if known, total the number of emails in them if known, and
+// maxSize the size of the largest file if the sizes are not given.
+func (ib *IndexBuilder) injest(filenames iter.Seq2[string, int64], n, total int, maxSize int64) error {
+	if ib.Codec >= numCodecs {
+		return fmt.Errorf("unsupported codec %v", ib.Codec)
+	}
+
+	inCh := make(chan injestWork, ib.NThreads)
 	outCh := make(chan injestedFile)
 
+	// stop is closed to abandon the remaining work under ErrorPolicy_FailFast
+	stop := make(chan struct{})
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(ib.NThreads)
 
@@ -131,39 +325,42 @@ func (ib *IndexBuilder) InjestFiles(filenames []string, maxSize int64) error {
 			// builds a LocalIndex of the email body and then sends result
 			// through the output channel.
 			for work := range inCh {
-				outData := injestedFile{Filename: work}
-
-				f, err := os.Open(filepath.Join(ib.InputPath, work))
-				if err != nil {
-					outData.Err = err
-					outCh <- outData
-					continue
+				if stopped() {
+					continue // drain the input channel
 				}
 
-				if m, err := mail.ReadMessage(f); err == nil {
-					compbody := &bytes.Buffer{}
-					gzw := gzip.NewWriter(compbody)
-					n, err := readAllInto(scratch, io.TeeReader(m.Body, gzw))
-					if err == nil {
-						outData.Index = ib.computeFileIndex(scratch[:n])
-						gzw.Close()
-						outData.Compressed = compbody.Bytes()
-						outData.Len = int(n)
-					}
+				// Messages split out of an mbox can be larger than any file
+				// on disk that the scratch buffer was sized for, and files
+				// found as they are injested were not known about.
+				if need := max(len(work.Data), int(work.Size)); need > len(scratch) {
+					scratch = make([]byte, need)
 				}
-				f.Close()
-				outData.Err = err
-				outCh <- outData
+				outCh <- ib.injestWithRetries(work, scratch)
 			}
 		}(scratch)
 	}
 
-	// Spin up a goroutine to insert the filenames
+	// Spin up a goroutine to insert the filenames. Mbox files are expanded
+	// into one work item per message.
 	go func() {
-		for _, file := range filenames {
-			inCh <- file
+		defer close(inCh)
+		for file, size := range filenames {
+			if stopped() {
+				return
+			}
+			if !ib.Accept(file) {
+				continue
+			}
+
+			if !isMbox(file) {
+				inCh <- injestWork{Filename: file, Size: size}
+				continue
+			}
+
+			if err := ib.expandMbox(file, inCh); err != nil {
+				inCh <- injestWork{Filename: file, Err: err}
+			}
 		}
-		close(inCh)
 	}()
 
 	// Spin up a goroutine to wait for the worker and insertion goroutine to
@@ -174,51 +371,305 @@ func (ib *IndexBuilder) InjestFiles(filenames []string, maxSize int64) error {
 		close(outCh)
 	}()
 
+	ib.injestProgress.reset(total)
+
 	// Retrieve the injested results and sort for a deterministic building of
 	// the main index.
-	ib.injested = make([]injestedFile, 0, len(filenames))
+	var failure error
+	ib.injested = make([]injestedFile, 0, n)
 	for result := range outCh {
 		ib.injested = append(ib.injested, result)
 
 		success := result.Err == nil
-		ib.injestUpdate(InjestUpdate{result.Filename, success, 1})
+		ib.injestUpdate(InjestUpdate{Filename: result.Filename, Success: success, Phase: 1})
+
+		if !success && ib.ErrorPolicy == ErrorPolicy_FailFast && failure == nil {
+			failure = &InjestError{result.Filename, result.Err}
+			close(stop)
+		}
+	}
+	if failure != nil {
+		if ib.InjestProgressCh != nil {
+			close(ib.InjestProgressCh)
+		}
+		return failure
+	}
+	if int(uint32(len(ib.injested))) != len(ib.injested) {
+		panic("number of files exceeds file format limits")
+	}
+	ib.mergeInjested()
+	if ib.InjestProgressCh != nil {
+		close(ib.InjestProgressCh)
 	}
+
+	return nil
+}
+
+// mergeInjested merges the successfully injested files into the main index
+// in filename order.
+func (ib *IndexBuilder) mergeInjested() {
 	slices.SortFunc(ib.injested, func(a, b injestedFile) int {
 		return strings.Compare(a.Filename, b.Filename)
 	})
 
+	// Size the word index for the whole corpus up front. Every file's words
+	// are an upper bound on the vocabulary, but most are shared.
+	var tokens, words int
+	for _, result := range ib.injested {
+		tokens += result.Tokens
+		words += len(result.Index)
+	}
+	ib.wordIndex.grow(min(words, estimateVocabulary(tokens)))
+
 	// This is all single threaded for now
+	ib.injestProgress.reset(len(ib.injested) - len(ib.Failures()))
 	for _, result := range ib.injested {
 		if result.Err != nil {
-			fmt.Printf("Encountered error processing %s\n", result.Filename)
 			continue
 		}
 
 		// Merge the file index into the main index
 		ib.MergeInFileIndex(result.Index, result.Filename)
+		ib.mergeLabels(result.Labels)
+		ib.docLens = append(ib.docLens, uint32(min(result.Tokens, math.MaxUint32)))
 		ib.nDocs++
 
-		ib.injestUpdate(InjestUpdate{result.Filename, true, 2})
+		ib.injestUpdate(InjestUpdate{Filename: result.Filename, Success: true, Phase: 2})
 	}
-	if ib.InjestProgressCh != nil {
-		close(ib.InjestProgressCh)
+}
+
+// Failures returns every file that failed injestion, in filename order.
+func (ib *IndexBuilder) Failures() []InjestFailure {
+	failures := []InjestFailure{}
+	for _, result := range ib.injested {
+		if result.Err != nil {
+			failures = append(failures, InjestFailure{result.Filename, result.Err.Error(), result.Attempts})
+		}
+	}
+	return failures
+}
+
+// InjestTotals count what an IndexBuilder has injested.
+type InjestTotals struct {
+	Documents int    // Files successfully injested
+	Tokens    uint64 // Words indexed in all the documents
+	Words     int    // Distinct words indexed
+	Failures  int    // Files that failed injestion
+}
+
+// Totals returns the totals of the files injested so far, which is what
+// would be serialized.
+func (ib *IndexBuilder) Totals() InjestTotals {
+	t := InjestTotals{Documents: ib.nDocs, Words: ib.wordIndex.len(), Failures: len(ib.injested) - ib.nDocs}
+	for _, l := range ib.docLens {
+		t.Tokens += uint64(l)
+	}
+	return t
+}
+
+// injestWithRetries calls injestOne, retrying failures as allowed by the
+// error policy.
+func (ib *IndexBuilder) injestWithRetries(work injestWork, scratch []byte) injestedFile {
+	attempts := 1
+	if ib.ErrorPolicy == ErrorPolicy_Retry {
+		attempts += max(ib.MaxRetries, 0)
+	}
+
+	var result injestedFile
+	for i := range attempts {
+		result = ib.injestOne(work, scratch)
+		result.Attempts = i + 1
+		if result.Err == nil || work.Err != nil {
+			break
+		}
+	}
+	return result
+}
+
+// injestOne parses a single email, either read from disk or already split
+// out of an mbox, and computes its file index.
+func (ib *IndexBuilder) injestOne(work injestWork, scratch []byte) injestedFile {
+	outData := injestedFile{Filename: work.Filename, Err: work.Err}
+	if work.Err != nil {
+		return outData
+	}
+
+	var r io.Reader
+	if work.Data != nil {
+		r = bytes.NewReader(work.Data)
+	} else {
+		f, err := os.Open(filepath.Join(ib.InputPath, work.Filename))
+		if err != nil {
+			outData.Err = err
+			return outData
+		}
+		defer f.Close()
+		r = f
+	}
+
+	cr := &countingReader{r: r}
+	m, err := mail.ReadMessage(cr)
+	if err != nil {
+		outData.Err = err
+		return outData
+	}
+	bodyOffset := cr.n
+	if br, ok := m.Body.(*bufio.Reader); ok {
+		bodyOffset -= int64(br.Buffered())
+	} else {
+		bodyOffset = 0
+	}
+
+	n, err := readAllInto(scratch, m.Body)
+	if err != nil {
+		outData.Err = err
+		return outData
+	}
+	body := scratch[:n]
+	if len(ib.ContentFilters) > 0 {
+		// The offsets of the words only match the file if the filters
+		// left the body alone, or only cut off its end
+		original := bytes.Clone(body)
+		for _, filter := range ib.ContentFilters {
+			body = filter(body)
+		}
+		if !bytes.HasPrefix(original, body) {
+			bodyOffset = 0
+		}
+	}
+	outData.Index, outData.Tokens = ib.indexEmail(m.Header, body)
+	if outData.Compressed, err = compress(body, ib.Codec); err != nil {
+		outData.Err = err
+		return outData
+	}
+	outData.Len = len(body)
+	outData.Labels = parseGmailLabels(m.Header.Get("X-Gmail-Labels"))
+	outData.Meta = parseMetadata(m.Header)
+	outData.Meta.BodyOffset = bodyOffset
+
+	return outData
+}
+
+// indexEmail indexes the body and the headers of an email. It also returns
+// the number of words in the indexed fields.
+func (ib *IndexBuilder) indexEmail(h mail.Header, body []byte) (fileIndex, int) {
+	index, n := ib.computeFileIndex(body)
+	var ends [numFields]fieldEnd
+	n += computeHeaderIndex(index, h, &ends)
+
+	// Leave the MIME structure and the headers of embedded emails out of the
+	// body, indexing the headers as fields of this email instead. They are
+	// placed after the headers of this email, so that their words don't
+	// collide with its words.
+	structure := parseBodyStructure(h, string(body))
+	dropSpans(index, Field_Body, structure.skip)
+	for _, h := range structure.headers {
+		nested := make(fileIndex)
+		computeHeaderIndex(nested, h, &ends)
+		mergeFileIndex(index, nested)
+	}
+	return index, n
+}
+
+// expandMbox reads the mbox file filename and sends each message it contains
+// to ch as a separate piece of work.
+func (ib *IndexBuilder) expandMbox(filename string, ch chan<- injestWork) error {
+	f, err := os.Open(filepath.Join(ib.InputPath, filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n := 0
+	for msg, err := range readMbox(f) {
+		if err != nil {
+			return err
+		}
+		n++
+		ch <- injestWork{Filename: mboxDocumentName(filename, n), Data: msg}
 	}
 
 	return nil
 }
 
+// mergeLabels records the labels of the most recently merged document.
+func (ib *IndexBuilder) mergeLabels(labels []string) {
+	ids := make([]int, len(labels))
+	for i, label := range labels {
+		ids[i] = ib.labels.Insert(label)
+	}
+	ib.docLabels = append(ib.docLabels, ids)
+}
+
+// computeFileIndex indexes the words of an email body. It also returns the
+// number of words in the body.
 // TODO: It doesn't handle lines that end with =XX where XX is a number
-func (idx *IndexBuilder) computeFileIndex(content []byte) fileIndex {
+func (idx *IndexBuilder) computeFileIndex(content []byte) (fileIndex, int) {
 	// Find all the words in the email body
-	index := make(fileIndex)
+	index := make(fileIndex, idx.fileWords.hint(len(content)))
+	n := indexField(index, Field_Body, string(content)) // TODO: investigate memory / perf hit of this
+	idx.fileWords.record(len(content), len(index))
+
+	return index, n
+}
+
+// headerGap is the number of positions left between the values of a header
+// field taken from an email and from the emails embedded in it, so that
+// phrases and all but the widest NEAR queries don't match across them.
+const headerGap = 100
+
+// fieldEnd is where the text indexed in a field so far ends.
+type fieldEnd struct {
+	offset   int // Byte offset just past the text
+	position int // Position after the last word
+}
 
-	s := string(content) // TODO: investigate memory / perf hit of this
+// computeHeaderIndex adds the words of the indexed header fields of an email
+// to index. A field that already has text in ends, from another email the
+// headers are indexed alongside, is continued after that text and a gap, and
+// ends is updated. It returns the number of words in those fields.
+func computeHeaderIndex(index fileIndex, h mail.Header, ends *[numFields]fieldEnd) int {
+	dec := new(mime.WordDecoder)
+	n := 0
+	for _, field := range headerFields {
+		value := h.Get(field.Header())
+		if value == "" {
+			continue
+		}
+		value = decodeHeader(dec, value)
+
+		var at fieldEnd
+		if end := ends[field]; end.offset > 0 {
+			at = fieldEnd{end.offset + 1, end.position + headerGap}
+		}
+		words := indexFieldAt(index, field, value, at)
+		ends[field] = fieldEnd{at.offset + len(value), at.position + words}
+		n += words
+	}
+	return n
+}
+
+// indexField adds the words in s, which is the text of field, to index. It
+// returns the number of words in s, including ones that are not indexed.
+func indexField(index fileIndex, field Field, s string) int {
+	return indexFieldAt(index, field, s, fieldEnd{})
+}
+
+// indexFieldAt is indexField for text that starts at the offset and position
+// at in the field.
+func indexFieldAt(index fileIndex, field Field, s string, at fieldEnd) int {
+	var starts []int // Start offset of every word, indexed by position
 	for span := range splitText(s) {
 		word := s[span.start:span.end]
 		txt := strings.ToLower(word)
 
+		// Every word counts towards the position, including the ones that
+		// are not indexed, so that the distance between words is preserved.
+		occ := occurrence{field, at.offset + span.start, span.end - span.start, at.position + len(starts)}
+		starts = append(starts, span.start)
+
 		// Ignore short words
-		if len(word) < 3 {
+		if len(word) < minWordLength {
 			continue
 		}
 
@@ -227,14 +678,26 @@ func (idx *IndexBuilder) computeFileIndex(content []byte) fileIndex {
 			continue
 		}
 
-		if _, ok := index[txt]; !ok {
-			index[txt] = []int{span.start}
-		} else {
-			index[txt] = append(index[txt], span.start)
-		}
+		index[txt] = append(index[txt], occ)
 	}
 
-	return index
+	// Add the canonical tokens of dates and numbers. They take the position
+	// of the first word they span.
+	normalized := make(map[string]struct{})
+	for span, token := range normalizedSpans(s) {
+		pos, _ := slices.BinarySearch(starts, span.start)
+		index[token] = append(index[token], occurrence{field, at.offset + span.start, span.end - span.start, at.position + pos})
+		normalized[token] = struct{}{}
+	}
+	for token := range normalized {
+		// A canonical token that is also a word in the text, e.g. "1000000",
+		// may now have occurrences out of order.
+		occs := index[token]
+		slices.SortFunc(occs, compareOccurrences)
+		index[token] = slices.CompactFunc(occs, func(a, b occurrence) bool { return compareOccurrences(a, b) == 0 })
+	}
+
+	return len(starts)
 }
 
 type wordSpan struct {
@@ -268,14 +731,15 @@ var (
 	swMap   map[string]struct{}
 )
 
+// Top 20 taken from https://en.wikipedia.org/wiki/Most_common_words_in_English
+var stopWords = []string{
+	"the", "be", "to", "of", "and",
+	"a", "in", "that", "have", "i",
+	"it", "for", "not", "on", "with",
+	"he", "as", "you", "do", "at",
+}
+
 func isStopWord(s string) bool {
-	// Top 20 taken from https://en.wikipedia.org/wiki/Most_common_words_in_English
-	var stopWords = []string{
-		"the", "be", "to", "of", "and",
-		"a", "in", "that", "have", "i",
-		"it", "for", "not", "on", "with",
-		"he", "as", "you", "do", "at",
-	}
 	iswOnce.Do(func() {
 		swMap = make(map[string]struct{})
 		for _, s := range stopWords {
@@ -289,17 +753,23 @@ func isStopWord(s string) bool {
 
 func (c *IndexBuilder) MergeInFileIndex(fileIndex fileIndex, filename string) {
 	fidx := c.filenames.Insert(filename)
+	injectSynonyms(fileIndex, c.synonyms)
 
 	sortedWords := slices.Sorted(maps.Keys(fileIndex))
 	for _, word := range sortedWords {
-		offsets := fileIndex[word]
+		occurrences := fileIndex[word]
 		c.words.Insert(word)
 
-		if _, ok := c.wordIndex[word]; !ok {
-			// If the word is not in the corpus, add the word to the index
-			c.wordIndex[word] = []match{{fidx, offsets}}
-		} else {
-			c.wordIndex[word] = append(c.wordIndex[word], match{fidx, offsets})
+		// Split the occurrences into one match per field
+		for len(occurrences) > 0 {
+			field := occurrences[0].Field
+			n := 1
+			for n < len(occurrences) && occurrences[n].Field == field {
+				n++
+			}
+
+			c.wordIndex.add(word, match{fidx, field, occurrences[:n]})
+			occurrences = occurrences[n:]
 		}
 	}
 }
@@ -311,31 +781,81 @@ func (ib *IndexBuilder) Serialize(dir string) error {
 		return err
 	}
 
+	return ib.SerializeTo(DirFS(dir))
+}
+
+// SerializeTo writes the index files to fsys, see Serialize.
+func (ib *IndexBuilder) SerializeTo(fsys WriteFS) error {
+	// Checksum everything the index loads as it is stored, see
+	// verifyChecksums, after encrypting what needs to be
+	checkFS := newChecksumFS(fsys)
+	var indexFS WriteFS = checkFS
+	var encFS *encryptFS
+	if ib.EncryptionKey != nil {
+		aead, err := newAEAD(ib.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		encFS = &encryptFS{fsys: checkFS, aead: aead, encrypt: ib.encrypts}
+		indexFS = encFS
+	}
+	reportFS := fsys
+	if encFS != nil && ib.EncryptIndex {
+		reportFS = encFS
+	}
+
+	// The prefix tree only needs the words, so it is built while the files
+	// before it are written. The files are still written one at a time, in
+	// order, as bundles and tar streams need.
+	prefixTree := ib.buildPrefixTree()
+
 	// Filename stringset (phase 1)
-	if err := ib.serializeStringSet(ib.filenames, filepath.Join(dir, FilenamesStringTable), SerializePhase_FilenameSet); err != nil {
+	if err := ib.serializeStringSet(ib.filenames, indexFS, FilenamesStringTable, SerializePhase_FilenameSet); err != nil {
 		return fmt.Errorf("failed to serialize filename string set: %w", err)
 	}
 
 	// Word stringset (phase 2)
-	if err := ib.serializeStringSet(ib.words, filepath.Join(dir, WordsStringTable), SerializePhase_WordsSet); err != nil {
+	if err := ib.serializeStringSet(ib.words, indexFS, WordsStringTable, SerializePhase_WordsSet); err != nil {
 		return fmt.Errorf("failed to serialize word string set: %w", err)
 	}
 
 	// Index and offsets file (phase 3)
-	if err := ib.writeIndexAndOffsets(filepath.Join(dir, CorpusIndex), filepath.Join(dir, IndexWordOffsets)); err != nil {
+	if err := ib.writeIndexAndOffsets(indexFS); err != nil {
 		return fmt.Errorf("failed to serialize: %w", err)
 	}
 
 	// Compressed corpus catalog (phase 4)
-	if err := ib.writeCatalog(filepath.Join(dir, CorpusCatalog)); err != nil {
+	if err := ib.writeCatalog(indexFS); err != nil {
 		return fmt.Errorf("failed to serialize: %w", err)
 	}
 
-	// Build and serialize the prefix tree (phase 5)
-	if err := ib.buildAndWritePrefixTree(filepath.Join(dir, QueryPrefixTree)); err != nil {
+	// Serialize the prefix tree once it is built (phase 5)
+	if err := writeFile(indexFS, QueryPrefixTree, prefixTree); err != nil {
 		return fmt.Errorf("failed to serialize: %w", err)
 	}
 
+	// Labels stringset and per document labels (phase 6)
+	if err := ib.writeLabels(indexFS); err != nil {
+		return fmt.Errorf("failed to serialize labels: %w", err)
+	}
+
+	// Report of files that failed injestion (phase 7)
+	if err := writeFile(reportFS, ErrorReport, ib.writeErrorReport); err != nil {
+		return fmt.Errorf("failed to serialize error report: %w", err)
+	}
+
+	// Index metadata (phase 8)
+	var encrypted []string
+	if encFS != nil {
+		encrypted = encFS.encrypted()
+	}
+	err := writeFile(fsys, IndexMetadataFile, func(w io.Writer) error {
+		return ib.writeIndexMetadata(w, checkFS.checksums(), checkFS.sizes(), encrypted)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize index metadata: %w", err)
+	}
+
 	if ib.SerializeProgressCh != nil {
 		close(ib.SerializeProgressCh)
 	}
@@ -343,7 +863,7 @@ func (ib *IndexBuilder) Serialize(dir string) error {
 	return nil
 }
 
-func (ib *IndexBuilder) serializeStringSet(set *StringSet, filepath string, phase SerializePhase) error {
+func (ib *IndexBuilder) serializeStringSet(set *StringSet, fsys WriteFS, name string, phase SerializePhase) error {
 	update := SerializeUpdate{
 		Event: SerializeEvent_BeginPhase,
 		Phase: phase,
@@ -351,7 +871,7 @@ func (ib *IndexBuilder) serializeStringSet(set *StringSet, filepath string, phas
 	}
 	ib.serializeUpdate(update)
 
-	err := set.Serialize(filepath)
+	err := writeFile(fsys, name, set.SerializeTo)
 
 	update.Event = SerializeEvent_EndPhase
 	ib.serializeUpdate(update)
@@ -359,27 +879,60 @@ func (ib *IndexBuilder) serializeStringSet(set *StringSet, filepath string, phas
 	return err
 }
 
-func (ib *IndexBuilder) writeIndexAndOffsets(indexFname, offsetsFname string) error {
-	f, err := os.Create(indexFname)
+func (ib *IndexBuilder) writeIndexAndOffsets(fsys WriteFS) error {
+	var wordCorpusOffsets []serializedWordIndexOffset
+	err := writeFile(fsys, CorpusIndex, func(w io.Writer) (err error) {
+		wordCorpusOffsets, err = ib.writeIndex(w)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	wordCorpusOffsets := make([]serializedWordIndexOffset, len(ib.wordIndex))
+	return writeFile(fsys, IndexWordOffsets, func(w io.Writer) error {
+		return ib.writeIndexOffsetsFile(wordCorpusOffsets, w)
+	})
+}
+
+// writeIndex writes the search index to w. It returns the byte offset of
+// each word's matches in the index.
+func (ib *IndexBuilder) writeIndex(w io.Writer) ([]serializedWordIndexOffset, error) {
+	wordCorpusOffsets := make([]serializedWordIndexOffset, ib.wordIndex.len())
 
+	// The number of bytes written to w so far
+	var foff int64
 	out := &bytes.Buffer{}
+	flush := func() error {
+		n, err := out.WriteTo(w)
+		foff += n
+		return err
+	}
+
+	var totalTokens uint64
+	for _, l := range ib.docLens {
+		totalTokens += uint64(l)
+	}
+	var avgDocLen float64
+	if len(ib.docLens) > 0 {
+		avgDocLen = float64(totalTokens) / float64(len(ib.docLens))
+	}
 
 	bc := serializedIndexHeader{
-		Magic:      indexMagic,
-		Version:    1,
-		NumEntries: uint64(len(ib.wordIndex)),
-		CorpusSize: uint32(ib.nDocs), // guaranteed value won't overflow uint32
+		Magic:        indexMagic,
+		Version:      indexVersion,
+		NumEntries:   uint64(ib.wordIndex.len()),
+		CorpusSize:   uint32(ib.nDocs), // guaranteed value won't overflow uint32
+		TotalTokens:  totalTokens,
+		AvgDocLength: avgDocLen,
 	}
 	binary.Write(out, binary.BigEndian, bc)
-	out.WriteTo(f)
+	// Followed by the number of words in each document
+	binary.Write(out, binary.BigEndian, ib.docLens)
+	if err := flush(); err != nil {
+		return nil, err
+	}
 
-	sortedWords := slices.Sorted(maps.Keys(ib.wordIndex))
+	sortedWords := ib.wordIndex.sortedWords()
 
 	ib.serializeUpdate(SerializeUpdate{
 		Event: SerializeEvent_BeginPhase,
@@ -387,132 +940,304 @@ func (ib *IndexBuilder) writeIndexAndOffsets(indexFname, offsetsFname string) er
 		N:     len(sortedWords),
 	})
 
-	scratch := make([]byte, binary.MaxVarintLen64*2)
-	for _, word := range sortedWords {
-		widx, _ := ib.words.Index(word)
-		wordCorpusOffsets[widx].WordIndex = uint32(widx)
-		foff, err := f.Seek(0, io.SeekCurrent) // TODO - replace with something else
-		if err != nil {
-			return err
-		}
-		wordCorpusOffsets[widx].Offset = foff
-
-		matches := ib.wordIndex[word]
-		n := binary.PutUvarint(scratch, uint64(len(matches)))
-		if _, err := out.Write(scratch[:n]); err != nil {
-			return err
+	// The entries of the words are encoded by workers, a batch of words at
+	// a time, while they are written in order here. Encoding is CPU bound,
+	// the workers only get so far ahead to bound the memory held.
+	workers := ib.NThreads
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan *postingBatch)
+	pending := make(chan *postingBatch, 2*workers)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for chunk := range slices.Chunk(sortedWords, postingBatchSize) {
+			batch := &postingBatch{words: chunk, done: make(chan struct{})}
+			select {
+			case pending <- batch:
+			case <-stop:
+				return
+			}
+			jobs <- batch
 		}
-
-		for i := range matches {
-			// FilenameIndex
-			n = binary.PutUvarint(scratch, uint64(matches[i].FilenameStringIndex))
-			// NumOffsets
-			n += binary.PutUvarint(scratch[n:], uint64(len(matches[i].Offsets)))
-			if _, err := out.Write(scratch[:n]); err != nil {
-				return err
+	}()
+	for range workers {
+		go func() {
+			var enc postingEncoder
+			for batch := range jobs {
+				batch.data, batch.ends, batch.err = enc.encode(ib.wordIndex, batch.words)
+				close(batch.done)
 			}
+		}()
+	}
 
-			for _, off := range matches[i].Offsets {
-				n = binary.PutUvarint(scratch, uint64(off))
-				if _, err := out.Write(scratch[:n]); err != nil {
-					return err
-				}
-			}
+	for batch := range pending {
+		<-batch.done
+		if batch.err != nil {
+			return nil, batch.err
+		}
+		start := 0
+		for i, word := range batch.words {
+			widx, _ := ib.words.Index(word)
+			wordCorpusOffsets[widx].WordIndex = uint32(widx)
+			wordCorpusOffsets[widx].Offset = foff + int64(start)
+			start = batch.ends[i]
+		}
+		n, err := w.Write(batch.data)
+		foff += int64(n)
+		if err != nil {
+			return nil, err
 		}
-
-		out.WriteTo(f)
 
 		ib.serializeUpdate(SerializeUpdate{
 			Event: SerializeEvent_ProgressPhase,
 			Phase: SerializePhase_Index,
-			N:     1,
+			N:     len(batch.words),
 		})
 	}
-	f.Close()
 
 	ib.serializeUpdate(SerializeUpdate{
 		Event: SerializeEvent_EndPhase,
 		Phase: SerializePhase_Index,
 	})
 
-	if err := ib.writeIndexOffsetsFile(wordCorpusOffsets, offsetsFname); err != nil {
+	return wordCorpusOffsets, nil
+}
+
+// Number of words in each batch encoded by the workers of writeIndex.
+const postingBatchSize = 256
+
+// postingBatch is a run of consecutive words of the search index, encoded
+// by one of the workers of writeIndex.
+type postingBatch struct {
+	words []string
+	data  []byte        // The entries of the words one after another
+	ends  []int         // End of the entry of each word in data
+	err   error         // Set if encoding failed
+	done  chan struct{} // Closed once data, ends and err are set
+}
+
+// postingEncoder encodes the entries of words in the search index. It keeps
+// its buffers between words, each worker has its own.
+type postingEncoder struct {
+	scratch              [binary.MaxVarintLen64 * 4]byte
+	occs, hdrs, allOccs  bytes.Buffer
+	block, table, blocks bytes.Buffer
+	encoded              []byte
+}
+
+// encode returns the entries of words, one after another, and the end of
+// each in the returned data.
+func (e *postingEncoder) encode(index *wordIndex, words []string) ([]byte, []int, error) {
+	out := &bytes.Buffer{}
+	ends := make([]int, len(words))
+	for i, word := range words {
+		if err := e.encodeWord(out, index.get(word)); err != nil {
+			return nil, nil, err
+		}
+		ends[i] = out.Len()
+	}
+	return out.Bytes(), ends, nil
+}
+
+// encodeWord appends the entry of a word with matches to out.
+func (e *postingEncoder) encodeWord(out *bytes.Buffer, matches []match) error {
+	scratch := e.scratch[:]
+	occs, hdrs, allOccs := &e.occs, &e.hdrs, &e.allOccs
+	block, table, blocks := &e.block, &e.table, &e.blocks
+
+	// Matches are in filename index order so that the indices can be
+	// delta encoded, a file's fields stay in field order
+	slices.SortStableFunc(matches, func(a, b match) int {
+		return a.FilenameStringIndex - b.FilenameStringIndex
+	})
+
+	// The set of files containing the word, for fast set operations
+	docs := roaring.New()
+	for i := range matches {
+		docs.Add(uint32(matches[i].FilenameStringIndex))
+	}
+	docs.RunOptimize()
+	n := binary.PutUvarint(scratch, docs.GetSerializedSizeInBytes())
+	out.Write(scratch[:n])
+	if _, err := docs.WriteTo(out); err != nil {
 		return err
 	}
 
+	// The matches are split into blocks of postingBlockSize, each
+	// compressed separately. The table of blocks comes first so that
+	// readers can skip the blocks of files they are not interested in.
+	table.Reset()
+	blocks.Reset()
+	prevFidx, lastFidx := 0, 0
+	for chunk := range slices.Chunk(matches, postingBlockSize) {
+		// The match headers and the occurrences are written separately so
+		// that readers can pick out the matches without reading the
+		// occurrences
+		hdrs.Reset()
+		allOccs.Reset()
+		for i := range chunk {
+			// Offset, word position and length of each occurrence, encoded
+			// first so that the size of the block is known.
+			occs.Reset()
+			for _, occ := range chunk[i].Occurrences {
+				n = binary.PutUvarint(scratch, uint64(occ.Offset))
+				n += binary.PutUvarint(scratch[n:], uint64(occ.Position))
+				n += binary.PutUvarint(scratch[n:], uint64(occ.Length))
+				occs.Write(scratch[:n])
+			}
+
+			// FilenameIndex, as the difference from the previous match
+			n = binary.PutUvarint(scratch, uint64(chunk[i].FilenameStringIndex-prevFidx))
+			prevFidx = chunk[i].FilenameStringIndex
+			// Field
+			n += binary.PutUvarint(scratch[n:], uint64(chunk[i].Field))
+			// NumOccurrences, the term frequency
+			n += binary.PutUvarint(scratch[n:], uint64(len(chunk[i].Occurrences)))
+			// Size in bytes of the occurrences, so readers can find them
+			n += binary.PutUvarint(scratch[n:], uint64(occs.Len()))
+			hdrs.Write(scratch[:n])
+			occs.WriteTo(allOccs)
+		}
+
+		block.Reset()
+		n = binary.PutUvarint(scratch, uint64(hdrs.Len()))
+		block.Write(scratch[:n])
+		hdrs.WriteTo(block)
+		allOccs.WriteTo(block)
+
+		// Blocks of rare words are often too small to compress, those are
+		// stored as they are
+		data, compressed := block.Bytes(), uint64(0)
+		if enc := s2.EncodeBetter(e.encoded[:cap(e.encoded)], data); len(enc) < len(data) {
+			data, compressed, e.encoded = enc, 1, enc
+		}
+
+		// The last filename index of the block, as the difference from
+		// the previous block, and the stored size of the block
+		last := chunk[len(chunk)-1].FilenameStringIndex
+		n = binary.PutUvarint(scratch, uint64(last-lastFidx))
+		lastFidx = last
+		n += binary.PutUvarint(scratch[n:], uint64(len(data))<<1|compressed)
+		table.Write(scratch[:n])
+		blocks.Write(data)
+	}
+
+	n = binary.PutUvarint(scratch, uint64(len(matches)))
+	out.Write(scratch[:n])
+	table.WriteTo(out)
+	blocks.WriteTo(out)
 	return nil
 }
 
-func (ib *IndexBuilder) writeCatalog(filename string) error {
+func (ib *IndexBuilder) writeCatalog(fsys WriteFS) error {
 	if int(uint32(len(ib.injested))) != len(ib.injested) {
 		panic("number of catalog items exceeds file format limits")
 	}
 
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	wr := bufio.NewWriter(f)
-
 	// File format of the catalog
 	// 0x00: u32 Magic number 'CTLG'
-	// 0x04: u32 Version number
+	// 0x04: u32 Version number (currently 6)
 	// 0x08: u32 Number of catalog entries (N) in offset table
-	// 0x0C: u32 File offset to compressed content of file index 0
-	// 0x10: u32 Length of uncompressed content of file index 0
-	// 0x14: u32 File offset to compressed content of file index 1
-	// 0x18: u32 Length of uncompressed content of file index 1
+	// 0x0C: u32 Codec the content is compressed with
+	// 0x10: u32 Number of shard files holding the content (S), 0 if unsharded
+	// 0x14: u64 File offset to compressed content of file index 0
+	// 0x1C: u64 Length of uncompressed content of file index 0
+	// 0x24: u64 Length of compressed content of file index 0
+	// 0x2C: u64 File offset to metadata of file index 0
+	// 0x34: u32 Shard holding the content of file index 0
+	// 0x38: u64 File offset to compressed content of file index 1
+	// ....:
+	// ....: u32 Shard holding the content of file index N-1
+	// ....: Metadata of file index 0
 	// ....:
-	// ....: u32 File offset to compressed content of file index N-1
-	// ....: u32 Length of uncompressed content of file index N-1
-	// ....: Compressed content of file index 0
+	// ....: Metadata of file index N-1
+	// ....: Compressed content of file index 0 (unsharded only)
 	// ....:
-	// ....: Compressed content of file index N-1
+	// ....: Compressed content of file index N-1 (unsharded only)
 	// EOF
-	// If an offset and length are 0 it means that there is no stored content
+	// When sharded the compressed content is instead written to S shard files,
+	// see CatalogShardName, and content offsets are relative to the start of
+	// the shard. A shard is a concatenation of compressed content.
+	// If the metadata offset is 0 it means that there is no stored content
 	// for the corresponding file. This can happen because there was an error
 	// indexing the files content.
+	// Metadata is stored as a varint Date (seconds since the Unix epoch, 0 if
+	// unknown) followed by the From, Subject, To, Content-Type and
+	// Content-Transfer-Encoding headers, each as a uvarint byte length and
+	// then the UTF-8 bytes, and then the uvarint byte offset of the body in
+	// the original file (0 if unknown).
 	hdr := serializedCatalogHeader{
 		Magic:      catalogMagic,
-		Version:    1,
+		Version:    catalogVersion,
 		NumEntries: uint32(len(ib.injested)),
+		Codec:      uint32(ib.Codec),
 	}
-	if err := binary.Write(wr, binary.BigEndian, &hdr); err != nil {
-		return err
+	hdrSize := binary.Size(hdr)
+
+	entries := make([]catalogContentEntry, len(ib.injested))
+
+	// Encode the metadata of every file, it is small enough to hold in memory
+	var meta []byte
+	for _, injested := range ib.injested {
+		if injested.Err != nil {
+			continue
+		}
+		fidx, _ := ib.filenames.Index(injested.Filename)
+		entries[fidx].MetaOffset = uint64(len(meta)) // relative for now
+		meta = appendMetadata(meta, injested.Meta)
 	}
-	hdrSize := int(unsafe.Sizeof(hdr))
 
-	// Compute the offsets for the compressed content
-	offlens := make([]uint32, len(ib.injested)*2)
 	// offset holds the byte offset into the file of the initial byte of the
 	// first injested file.
-	offset := hdrSize + len(ib.injested)*2*4 // *4 for byte size of a uint32
+	sharded := ib.MaxCatalogShardSize > 0
+	metaStart := int64(hdrSize + binary.Size(entries))
+	offset := metaStart + int64(len(meta))
+	if sharded {
+		offset = 0
+	}
 
-	// Walk the injested content to fill out the offlens table
-	for _, injested := range ib.injested {
+	// Walk the injested content to fill out the entries table. shardEnds
+	// holds the index into ib.injested that ends each shard, and shards the
+	// files whose content is in each.
+	var shardEnds []int
+	ib.catalogShards = nil
+	shards := []CatalogShard{{Name: CatalogShardName(0)}}
+	for i, injested := range ib.injested {
 		if injested.Err != nil {
 			continue
 		}
 
-		if int(uint32(injested.Len)) != injested.Len {
-			panic("content length overflow")
+		// Start a new shard if this content would overflow the current one.
+		// Content larger than a shard gets a shard of its own.
+		if sharded && offset > 0 && offset+int64(len(injested.Compressed)) > ib.MaxCatalogShardSize {
+			shardEnds = append(shardEnds, i)
+			shards = append(shards, CatalogShard{Name: CatalogShardName(len(shardEnds))})
+			offset = 0
 		}
 
 		fidx, _ := ib.filenames.Index(injested.Filename)
-		offlens[fidx*2+0] = uint32(offset)
-		offlens[fidx*2+1] = uint32(injested.Len)
-
-		// Check that advancing offset by data length does not overflow uint32
-		if uint32(offset+len(injested.Compressed)) < uint32(offset) {
-			panic("offset overflow")
+		shard := &shards[len(shards)-1]
+		if shard.Documents == 0 {
+			shard.FirstDocument = fidx
 		}
-		offset += len(injested.Compressed)
+		shard.LastDocument = fidx
+		shard.Documents++
+
+		entries[fidx].Offset = uint64(offset)
+		entries[fidx].Length = uint64(injested.Len)
+		entries[fidx].CompressedLength = uint64(len(injested.Compressed))
+		entries[fidx].MetaOffset += uint64(metaStart)
+		entries[fidx].Shard = uint32(len(shardEnds))
+		offset += int64(len(injested.Compressed))
 	}
-
-	// Write out the offlens table
-	if err := binary.Write(wr, binary.BigEndian, offlens); err != nil {
-		return err
+	if sharded {
+		shardEnds = append(shardEnds, len(ib.injested))
+		hdr.NumShards = uint32(len(shardEnds))
+		ib.catalogShards = shards
 	}
 
 	ib.serializeUpdate(SerializeUpdate{
@@ -521,12 +1246,60 @@ func (ib *IndexBuilder) writeCatalog(filename string) error {
 		N:     len(ib.injested),
 	})
 
-	// Now walk the injested files again, this time writing out their content
-	for _, injested := range ib.injested {
-		_, err := wr.Write(injested.Compressed)
+	err := writeFile(fsys, CorpusCatalog, func(w io.Writer) error {
+		wr := bufio.NewWriter(w)
+
+		// Write out the header, entries table and the metadata
+		if err := binary.Write(wr, binary.BigEndian, &hdr); err != nil {
+			return err
+		}
+		if err := binary.Write(wr, binary.BigEndian, entries); err != nil {
+			return err
+		}
+		if _, err := wr.Write(meta); err != nil {
+			return err
+		}
+
+		if !sharded {
+			if err := ib.writeCatalogContent(wr, ib.injested); err != nil {
+				return err
+			}
+		}
+		return wr.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	start := 0
+	for shard, end := range shardEnds {
+		err := writeFile(fsys, CatalogShardName(shard), func(w io.Writer) error {
+			wr := bufio.NewWriter(w)
+			if err := ib.writeCatalogContent(wr, ib.injested[start:end]); err != nil {
+				return err
+			}
+			return wr.Flush()
+		})
 		if err != nil {
 			return err
 		}
+		start = end
+	}
+
+	ib.serializeUpdate(SerializeUpdate{
+		Event: SerializeEvent_EndPhase,
+		Phase: SerializePhase_Catalog,
+	})
+
+	return nil
+}
+
+// writeCatalogContent writes out the compressed content of injested files.
+func (ib *IndexBuilder) writeCatalogContent(w io.Writer, files []injestedFile) error {
+	for _, injested := range files {
+		if _, err := w.Write(injested.Compressed); err != nil {
+			return err
+		}
 
 		ib.serializeUpdate(SerializeUpdate{
 			Event: SerializeEvent_ProgressPhase,
@@ -534,61 +1307,204 @@ func (ib *IndexBuilder) writeCatalog(filename string) error {
 			N:     1,
 		})
 	}
+	return nil
+}
 
-	ib.serializeUpdate(SerializeUpdate{
-		Event: SerializeEvent_EndPhase,
-		Phase: SerializePhase_Catalog,
-	})
+// encrypts reports whether the file name is encrypted, see EncryptionKey.
+func (ib *IndexBuilder) encrypts(name string) bool {
+	return ib.EncryptIndex || name == CorpusCatalog || strings.HasPrefix(name, CorpusCatalog+".")
+}
 
-	return wr.Flush()
+// CatalogShardName returns the name of the nth catalog shard file, e.g.
+// corpus.cat.000.
+func CatalogShardName(n int) string {
+	return fmt.Sprintf("%s.%03d", CorpusCatalog, n)
 }
 
-func (ib *IndexBuilder) buildAndWritePrefixTree(filename string) error {
+// buildPrefixTree starts building and serializing the prefix tree in the
+// background. The returned function waits for it to finish and writes it
+// to w, reporting the phase as it does.
+func (ib *IndexBuilder) buildPrefixTree() func(w io.Writer) error {
+	var (
+		buf bytes.Buffer
+		err error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		words, _ := ib.words.Flatten()
+		_, err = NewTrie(words).WriteTo(&buf)
+	}()
+
+	return func(w io.Writer) error {
+		update := SerializeUpdate{
+			Event: SerializeEvent_BeginPhase,
+			Phase: SerializePhase_PrefixTree,
+			N:     1,
+		}
+		ib.serializeUpdate(update)
+
+		<-done
+		if err != nil {
+			return err
+		}
+		if _, err := buf.WriteTo(w); err != nil {
+			return err
+		}
+
+		update.Event = SerializeEvent_EndPhase
+		ib.serializeUpdate(update)
+
+		return nil
+	}
+}
+
+func (ib *IndexBuilder) writeLabels(fsys WriteFS) error {
 	update := SerializeUpdate{
 		Event: SerializeEvent_BeginPhase,
-		Phase: SerializePhase_PrefixTree,
+		Phase: SerializePhase_Labels,
 		N:     1,
 	}
 	ib.serializeUpdate(update)
 
-	trie := compressedtrie.NewTree()
+	if err := writeFile(fsys, LabelsStringTable, ib.labels.SerializeTo); err != nil {
+		return err
+	}
+	if err := writeFile(fsys, DocumentLabels, ib.writeDocumentLabels); err != nil {
+		return err
+	}
+
+	update.Event = SerializeEvent_EndPhase
+	ib.serializeUpdate(update)
+
+	return nil
+}
 
-	words, _ := ib.words.Flatten()
-	for _, word := range words {
-		trie.Insert(word)
+func (ib *IndexBuilder) writeDocumentLabels(w io.Writer) error {
+	wr := bufio.NewWriter(w)
+
+	// File format of the document labels file
+	// 0x00: u32 Magic number 'LBLS'
+	// 0x04: u32 Version number (currently 1)
+	// 0x08: u32 Number of documents (N)
+	// 0x0C: Labels of file index 0: uvarint count, uvarint label index...
+	// ....:
+	// ....: Labels of file index N-1
+	hdr := serializedLabelsHeader{
+		Magic:      labelsMagic,
+		Version:    1,
+		NumEntries: uint32(len(ib.docLabels)),
+	}
+	if err := binary.Write(wr, binary.BigEndian, &hdr); err != nil {
+		return err
 	}
 
-	// Write out the prefix tree
-	f, err := os.Create(filename)
-	if err != nil {
+	scratch := make([]byte, 0, binary.MaxVarintLen64)
+	for _, labels := range ib.docLabels {
+		scratch = binary.AppendUvarint(scratch[:0], uint64(len(labels)))
+		for _, l := range labels {
+			scratch = binary.AppendUvarint(scratch, uint64(l))
+		}
+		if _, err := wr.Write(scratch); err != nil {
+			return err
+		}
+	}
+
+	return wr.Flush()
+}
+
+func (ib *IndexBuilder) writeErrorReport(w io.Writer) error {
+	update := SerializeUpdate{
+		Event: SerializeEvent_BeginPhase,
+		Phase: SerializePhase_ErrorReport,
+		N:     1,
+	}
+	ib.serializeUpdate(update)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ib.Failures()); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	err = trie.Serialize(f)
-	if err != nil {
+	update.Event = SerializeEvent_EndPhase
+	ib.serializeUpdate(update)
+
+	return nil
+}
+
+// writeIndexMetadata writes the index metadata to w. checksums and sizes
+// are those of the index files as stored.
+func (ib *IndexBuilder) writeIndexMetadata(w io.Writer, checksums map[string]string, sizes map[string]int64, encrypted []string) error {
+	update := SerializeUpdate{
+		Event: SerializeEvent_BeginPhase,
+		Phase: SerializePhase_Metadata,
+		N:     1,
+	}
+	ib.serializeUpdate(update)
+
+	analyzer := DefaultAnalyzer()
+	meta := IndexMetadata{
+		Analyzer:  &analyzer,
+		Synonyms:  ib.synonyms,
+		Checksums: checksums,
+		Encrypted: encrypted,
+	}
+	for _, shard := range ib.catalogShards {
+		shard.Size = sizes[shard.Name]
+		meta.CatalogShards = append(meta.CatalogShards, shard)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&meta); err != nil {
 		return err
 	}
 
 	update.Event = SerializeEvent_EndPhase
 	ib.serializeUpdate(update)
 
-	return err
+	return nil
 }
 
+// injestUpdate sends u, with the progress of the current phase filled in.
 func (ib *IndexBuilder) injestUpdate(u InjestUpdate) {
+	if ib.InjestProgressCh == nil && ib.Progress == nil {
+		return
+	}
+
+	u.Rate, u.Remaining = ib.injestProgress.advance(1)
+	u.Done, u.Total = ib.injestProgress.done, ib.injestProgress.total
+	if ib.Progress != nil {
+		ib.Progress(u)
+	}
 	if ib.InjestProgressCh != nil {
 		ib.InjestProgressCh <- u
 	}
 }
 
+// serializeUpdate sends u, with the progress of the current phase filled in
+// for SerializeEvent_ProgressPhase events.
 func (ib *IndexBuilder) serializeUpdate(u SerializeUpdate) {
+	if ib.SerializeProgressCh == nil && ib.Progress == nil {
+		return
+	}
+
+	switch u.Event {
+	case SerializeEvent_BeginPhase:
+		ib.serializeProgress.reset(u.N)
+	case SerializeEvent_ProgressPhase:
+		u.Rate, u.Remaining = ib.serializeProgress.advance(u.N)
+	}
+	if ib.Progress != nil {
+		ib.Progress(u)
+	}
 	if ib.SerializeProgressCh != nil {
 		ib.SerializeProgressCh <- u
 	}
 }
 
-func (ib *IndexBuilder) writeIndexOffsetsFile(wordCorpusOffsets []serializedWordIndexOffset, filename string) error {
+func (ib *IndexBuilder) writeIndexOffsetsFile(wordCorpusOffsets []serializedWordIndexOffset, w io.Writer) error {
 	if int(uint32(len(wordCorpusOffsets))) != len(wordCorpusOffsets) {
 		panic("number of documents exceeds file format limits")
 	}
@@ -600,13 +1516,7 @@ func (ib *IndexBuilder) writeIndexOffsetsFile(wordCorpusOffsets []serializedWord
 	}
 	ib.serializeUpdate(update)
 
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	wr := bufio.NewWriter(f)
+	wr := bufio.NewWriter(w)
 
 	// File format of the index offsets file
 	// 0x00: u32 Magic number 'WRDO'
@@ -655,6 +1565,18 @@ func readAllInto(data []byte, r io.Reader) (int, error) {
 	return n, nil
 }
 
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func createOutDir(dir string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err := os.MkdirAll(dir, 0755)
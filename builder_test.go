@@ -1,7 +1,17 @@
 package emailsearch
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
 	"slices"
+	"strings"
 	"testing"
 )
 
@@ -76,3 +86,645 @@ func TestIsStopWord(t *testing.T) {
 		})
 	}
 }
+
+// buildTestIndex writes emails into a temporary corpus directory, builds an
+// index from them and loads it back in. The keys of emails are the filenames.
+func buildTestIndex(t *testing.T, emails map[string]string) *Index {
+	t.Helper()
+	return buildTestIndexWith(t, &IndexBuilder{NThreads: 2}, emails)
+}
+
+// buildTestIndexWith is buildTestIndex with a caller configured builder. The
+// builder's InputPath is set to the directory of emails.
+func buildTestIndexWith(t *testing.T, ib *IndexBuilder, emails map[string]string) *Index {
+	t.Helper()
+
+	corpus := t.TempDir()
+	for name, content := range emails {
+		fname := filepath.Join(corpus, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ib.InputPath = corpus
+	ib.Init()
+	filenames := slices.Sorted(maps.Keys(emails))
+	if err := ib.InjestFiles(filenames, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if err := ib.Serialize(out); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+
+	return idx
+}
+
+func TestBuildAndQuery(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"lay-k/inbox/1.": "Subject: one\n\nThe quarterly budget presentation.\n",
+		"lay-k/sent/2.":  "Subject: two\n\nBudget forecast attached.\n",
+	})
+
+	results, err := idx.QueryIndex(t.Context(), []string{"budget"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if got, want := results[0].Folders, []string{"lay-k/inbox"}; !slices.Equal(got, want) {
+		t.Errorf("expected folders %v, got %v", want, got)
+	}
+	if got, want := results[0].WordMatches, []QueryWordMatch{{"budget", Field_Body, 14, 6, 2, "budget"}}; !slices.Equal(got, want) {
+		t.Errorf("expected matches %v, got %v", want, got)
+	}
+	if got, want := results[1].Subject, "two"; got != want {
+		t.Errorf("expected subject %q, got %q", want, got)
+	}
+
+	// "one" + "The quarterly budget presentation" and "two" + "Budget forecast attached"
+	if got, want := idx.DocumentLength(results[0].FilenameIndex), 5; got != want {
+		t.Errorf("expected document length %d, got %d", want, got)
+	}
+	if got, want := idx.AverageDocumentLength(), 4.5; got != want {
+		t.Errorf("expected average document length %v, got %v", want, got)
+	}
+
+	content, filename, ok := idx.CatalogContent(t.Context(), results[1].FilenameIndex)
+	if !ok {
+		t.Fatal("expected catalog content")
+	}
+	if filename != "lay-k/sent/2." || string(content) != "Budget forecast attached.\n" {
+		t.Errorf("unexpected catalog content %q for %q", content, filename)
+	}
+}
+
+func TestGmailTakeout(t *testing.T) {
+	mbox := "From 1@xxx Mon Jan 1 2001\n" +
+		"X-Gmail-Labels: Inbox,Important\n" +
+		"Subject: one\n\nLunch invoice\n\n" +
+		"From 2@xxx Tue Jan 2 2001\n" +
+		"X-Gmail-Labels: Archived\n" +
+		"Subject: two\n\nAnother invoice\n"
+	idx := buildTestIndex(t, map[string]string{"Takeout/Mail/All mail.mbox": mbox})
+
+	results, err := idx.QueryIndex(t.Context(), []string{"invoice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if got, want := results[0].Filename, "Takeout/Mail/All mail.mbox#1"; got != want {
+		t.Errorf("expected filename %q, got %q", want, got)
+	}
+	if got, want := results[0].Folders, []string{"Inbox", "Important"}; !slices.Equal(got, want) {
+		t.Errorf("expected folders %v, got %v", want, got)
+	}
+
+	if got, want := idx.DocumentsWithLabel("archived"), []int{results[1].FilenameIndex}; !slices.Equal(got, want) {
+		t.Errorf("expected documents %v, got %v", want, got)
+	}
+
+	results, err = idx.Search(t.Context(), ParseQuery("invoice label:important"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Filename != "Takeout/Mail/All mail.mbox#1" {
+		t.Errorf("expected only the important email, got %+v", results)
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	corpus := t.TempDir()
+	if err := os.WriteFile(filepath.Join(corpus, "good"), []byte("Subject: hi\n\nhello there\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"good", "missing"}
+
+	cases := []struct {
+		Name         string
+		Policy       ErrorPolicy
+		WantErr      bool
+		WantAttempts int
+	}{
+		{"Skip", ErrorPolicy_Skip, false, 1},
+		{"Fail fast", ErrorPolicy_FailFast, true, 1},
+		{"Retry", ErrorPolicy_Retry, false, 3},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ib := &IndexBuilder{NThreads: 1, InputPath: corpus, ErrorPolicy: tc.Policy, MaxRetries: 2}
+			ib.Init()
+
+			err := ib.InjestFiles(files, 1024)
+			if tc.WantErr {
+				var ierr *InjestError
+				if !errors.As(err, &ierr) || ierr.Filename != "missing" {
+					t.Fatalf("expected InjestError for missing, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if totals := ib.Totals(); totals != (InjestTotals{Documents: 1, Tokens: 3, Words: 2, Failures: 1}) {
+				t.Errorf("unexpected totals %+v", totals)
+			}
+
+			out := t.TempDir()
+			if err := ib.Serialize(out); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(out, ErrorReport))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var failures []InjestFailure
+			if err := json.Unmarshal(data, &failures); err != nil {
+				t.Fatal(err)
+			}
+			if len(failures) != 1 || failures[0].Filename != "missing" || failures[0].Attempts != tc.WantAttempts {
+				t.Errorf("unexpected error report %+v", failures)
+			}
+		})
+	}
+}
+
+func TestComputeFileIndex(t *testing.T) {
+	ib := &IndexBuilder{}
+	index, n := ib.computeFileIndex([]byte("The fraud, the fraud and a presentation"))
+	if n != 7 {
+		t.Errorf("Expected 7 words, got %d", n)
+	}
+
+	expected := fileIndex{
+		"fraud":        {{Field_Body, 4, 5, 1}, {Field_Body, 15, 5, 3}},
+		"presentation": {{Field_Body, 27, 12, 6}},
+	}
+	if !reflect.DeepEqual(index, expected) {
+		t.Errorf("Expected %v, got %v", expected, index)
+	}
+}
+
+func TestNormalizedQuery(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: a\n\nMeet on Jan 3 2001 about the $1,000,000 deal\n",
+		"2": "Subject: b\n\nThe 01/03/2001 meeting is off\n",
+	})
+
+	for _, query := range [][]string{{"2001-01-03"}, {"January", "3,", "2001"}} {
+		results, err := idx.QueryIndex(t.Context(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 {
+			t.Errorf("query %v: expected 2 results, got %d", query, len(results))
+		}
+	}
+
+	results, err := idx.QueryIndex(t.Context(), []string{"1000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].WordMatches[0].Offset != 30 || results[0].WordMatches[0].Length != 9 {
+		t.Errorf("unexpected results for number query %+v", results)
+	}
+}
+
+func TestSynonyms(t *testing.T) {
+	corpus := t.TempDir()
+	if err := os.WriteFile(filepath.Join(corpus, "1"), []byte("Subject: a\n\nCall your attorney\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ib := &IndexBuilder{NThreads: 1, InputPath: corpus, Synonyms: map[string][]string{"attorney": {"lawyer"}}}
+	ib.Init()
+	if err := ib.InjestFiles([]string{"1"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := ib.Serialize(out); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	results, err := idx.QueryIndex(t.Context(), []string{"lawyer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].WordMatches[0].Offset != 10 {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	if got, want := idx.IndexMetadata().Synonyms, map[string][]string{"attorney": {"lawyer"}, "lawyer": {"attorney"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected synonyms %v in metadata, got %v", want, got)
+	}
+}
+
+func TestContentFilters(t *testing.T) {
+	stripDisclaimer := func(body []byte) []byte {
+		if i := bytes.Index(body, []byte("CONFIDENTIALITY NOTICE")); i >= 0 {
+			return body[:i]
+		}
+		return body
+	}
+	collapseSpaces := func(body []byte) []byte {
+		return []byte(strings.Join(strings.Fields(string(body)), " "))
+	}
+	ib := &IndexBuilder{NThreads: 1, ContentFilters: []func([]byte) []byte{stripDisclaimer, collapseSpaces}}
+	dir := serializeTestIndex(t, ib, map[string]string{
+		"1": "Subject: a\n\nThe     quarterly\n\n  budget\nCONFIDENTIALITY NOTICE: privileged material\n",
+	})
+	idx, err := LoadIndexFromDisk(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if results, err := idx.QueryIndex(t.Context(), []string{"privileged"}); err != nil || len(results) != 0 {
+		t.Errorf("expected the disclaimer not to be indexed, got %+v (%v)", results, err)
+	}
+	results, err := idx.QueryIndex(t.Context(), []string{"budget"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected one result, got %+v (%v)", results, err)
+	}
+
+	// The filtered body is stored, so the offsets point into it
+	content, _, ok := idx.CatalogContent(t.Context(), results[0].FilenameIndex)
+	if !ok || string(content) != "The quarterly budget" {
+		t.Fatalf("expected the filtered body, got %q", content)
+	}
+	m := results[0].WordMatches[0]
+	if got := string(content[m.Offset : m.Offset+m.Length]); got != "budget" {
+		t.Errorf("expected the match to point at budget, got %q", got)
+	}
+
+	// The body no longer lines up with the file
+	if meta, _ := idx.Metadata(results[0].FilenameIndex); meta.BodyOffset != 0 {
+		t.Errorf("expected the body offset to be unknown, got %d", meta.BodyOffset)
+	}
+}
+
+func TestBodyOffset(t *testing.T) {
+	emails := map[string]string{
+		"1": "From: lay@enron.com\r\nSubject: Budget\r\n\r\nThe quarterly budget.\r\n",
+		"2": "Subject: two\nX-Folder: \\Lay\\Inbox\n\nLunch on Friday, then the budget.\nCONFIDENTIALITY NOTICE\n",
+	}
+	stripDisclaimer := func(body []byte) []byte {
+		if i := bytes.Index(body, []byte("CONFIDENTIALITY NOTICE")); i >= 0 {
+			return body[:i]
+		}
+		return body
+	}
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1, ContentFilters: []func([]byte) []byte{stripDisclaimer}}, emails)
+	idx, err := LoadIndexFromDisk(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// The offset of a body match plus the body offset is where the word is
+	// in the original file, even though the filter cut off the end
+	results, err := idx.QueryIndex(t.Context(), []string{"budget"})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("expected two results, got %+v (%v)", results, err)
+	}
+	for _, res := range results {
+		name := idx.filenames.At(res.FilenameIndex)
+		meta, ok := idx.Metadata(res.FilenameIndex)
+		if !ok || meta.BodyOffset == 0 {
+			t.Fatalf("%s: expected a body offset, got %+v", name, meta)
+		}
+		original := emails[name]
+		if !strings.HasSuffix(original[:meta.BodyOffset], "\n\n") && !strings.HasSuffix(original[:meta.BodyOffset], "\r\n\r\n") {
+			t.Errorf("%s: expected the body to start after the headers, got %d", name, meta.BodyOffset)
+		}
+		for _, m := range res.WordMatches {
+			if m.Field != Field_Body {
+				continue
+			}
+			start := int(meta.BodyOffset) + m.Offset
+			if got := original[start : start+m.Length]; got != "budget" {
+				t.Errorf("%s: expected the match to point at budget in the file, got %q", name, got)
+			}
+		}
+	}
+}
+
+func TestFieldQueries(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "From: kenneth.lay@enron.com\nTo: jeff.skilling@enron.com\nSubject: Budget review\n\nPlease see attached.\n",
+		"2": "From: jeff.skilling@enron.com\nTo: kenneth.lay@enron.com\nSubject: Re: lunch\n\nThe budget looks fine.\n",
+	})
+
+	cases := []struct {
+		Name     string
+		Words    []string
+		Fields   []Field
+		Expected []string
+	}{
+		{"All fields", []string{"budget"}, nil, []string{"1", "2"}},
+		{"Subject", []string{"budget"}, []Field{Field_Subject}, []string{"1"}},
+		{"Body", []string{"budget"}, []Field{Field_Body}, []string{"2"}},
+		{"From", []string{"kenneth"}, []Field{Field_From}, []string{"1"}},
+		{"To", []string{"kenneth"}, []Field{Field_To}, []string{"2"}},
+		{"Analyzed", []string{"Budget,"}, []Field{Field_Subject}, []string{"1"}},
+		{"Address", []string{"kenneth.lay@enron.com"}, []Field{Field_From}, []string{"1"}},
+		{"Short words", []string{"re:", "budget"}, []Field{Field_Subject}, []string{"1"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			results, err := idx.QueryIndexFields(t.Context(), tc.Words, tc.Fields...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Filename)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tc.Expected) {
+				t.Errorf("expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestTermFrequencies(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: budget budget\n\nThe budget, the budget and the budget.\n",
+		"2": "Subject: lunch\n\nThe budget looks fine.\n",
+	})
+
+	fidx := make(map[string]int)
+	for i := range idx.CorpusSize {
+		fidx[idx.filenames.At(i)] = i
+	}
+
+	cases := []struct {
+		Name     string
+		Fields   []Field
+		Expected map[int]int
+	}{
+		{"All fields", nil, map[int]int{fidx["1"]: 5, fidx["2"]: 1}},
+		{"Subject", []Field{Field_Subject}, map[int]int{fidx["1"]: 2}},
+		{"Body", []Field{Field_Body}, map[int]int{fidx["1"]: 3, fidx["2"]: 1}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := idx.TermFrequencies("Budget", tc.Fields...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tc.Expected) {
+				t.Errorf("expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+
+	// The field filter must skip over the occurrences it does not decode
+	results, err := idx.QueryIndexFields(t.Context(), []string{"budget"}, Field_Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || len(results[0].WordMatches) != 3 {
+		t.Errorf("unexpected body results %+v", results)
+	}
+}
+
+func TestCatalogCodecs(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget presentation.\n",
+		"2": "Subject: two\n\nBudget forecast attached.\n",
+	}
+
+	for _, codec := range []Codec{Codec_Gzip, Codec_Zstd, Codec_None} {
+		t.Run(codec.String(), func(t *testing.T) {
+			idx := buildTestIndexWith(t, &IndexBuilder{NThreads: 2, Codec: codec}, emails)
+			for i := range idx.CorpusSize {
+				content, fname, ok := idx.CatalogContent(t.Context(), i)
+				if !ok {
+					t.Fatalf("no content for file index %d", i)
+				}
+				if want := emails[fname][strings.Index(emails[fname], "\n\n")+2:]; string(content) != want {
+					t.Errorf("expected content %q, got %q", want, content)
+				}
+			}
+		})
+	}
+}
+
+func TestCatalogShards(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget presentation.\n",
+		"2": "Subject: two\n\nBudget forecast attached.\n",
+		"3": "Subject: three\n\nLunch on Friday?\n",
+	}
+
+	// Small enough that every email gets a shard of its own
+	idx := buildTestIndexWith(t, &IndexBuilder{NThreads: 2, Codec: Codec_None, MaxCatalogShardSize: 16}, emails)
+	if got := len(idx.shardRdrs); got != 3 {
+		t.Errorf("expected 3 shards, got %d", got)
+	}
+
+	for i := range idx.CorpusSize {
+		content, fname, ok := idx.CatalogContent(t.Context(), i)
+		if !ok {
+			t.Fatalf("no content for file index %d", i)
+		}
+		if want := emails[fname][strings.Index(emails[fname], "\n\n")+2:]; string(content) != want {
+			t.Errorf("expected content %q, got %q", want, content)
+		}
+		if meta, ok := idx.Metadata(i); !ok || meta.Subject == "" {
+			t.Errorf("expected metadata for %s, got %+v", fname, meta)
+		}
+	}
+
+	// The manifest lists each shard with its size and files
+	var want []CatalogShard
+	for i := range 3 {
+		want = append(want, CatalogShard{CatalogShardName(i), int64(idx.shardRdrs[i].Len()), i, i, 1})
+	}
+	if got := idx.IndexMetadata().CatalogShards; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected manifest %+v, got %+v", want, got)
+	}
+	report := &VerifyReport{}
+	if idx.checkIndex(report, true); !report.OK() {
+		t.Errorf("expected the shards to match the manifest, got %v", report)
+	}
+	idx.meta.CatalogShards[1].Size++
+	idx.meta.CatalogShards[2].Documents++
+	report = &VerifyReport{}
+	if idx.checkIndex(report, true); len(report.Problems) != 2 {
+		t.Errorf("expected a size and a file count not to match the manifest, got %v", report.Problems)
+	}
+
+	// Large enough for everything to fit in one shard
+	idx = buildTestIndexWith(t, &IndexBuilder{NThreads: 2, MaxCatalogShardSize: 1 << 20}, emails)
+	if got := len(idx.shardRdrs); got != 1 {
+		t.Errorf("expected 1 shard, got %d", got)
+	}
+	if _, _, ok := idx.CatalogContent(t.Context(), 2); !ok {
+		t.Errorf("expected content for file index 2")
+	}
+	if shards := idx.IndexMetadata().CatalogShards; len(shards) != 1 || shards[0].FirstDocument != 0 || shards[0].LastDocument != 2 || shards[0].Documents != 3 {
+		t.Errorf("expected one shard of every file, got %+v", shards)
+	}
+
+	// A manifest that lists different shards fails to load
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1, MaxCatalogShardSize: 16}, emails)
+	metaPath := filepath.Join(dir, IndexMetadataFile)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta IndexMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	meta.CatalogShards = meta.CatalogShards[1:]
+	data, _ = json.Marshal(meta)
+	if err := os.WriteFile(metaPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CorruptError
+	if _, err := LoadIndexFromDisk(dir, io.Discard); !errors.As(err, &cerr) || cerr.File != CorpusCatalog {
+		t.Errorf("expected the catalog not to match the manifest, got %v", err)
+	}
+
+	// Unsharded catalogs have no manifest
+	idx = buildTestIndexWith(t, &IndexBuilder{NThreads: 2}, emails)
+	if shards := idx.IndexMetadata().CatalogShards; shards != nil {
+		t.Errorf("expected no manifest, got %+v", shards)
+	}
+}
+
+func TestNestedEmails(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: FW: lunch\n\nSee below.\n\n-----Original Message-----\nFrom: kenneth.lay@enron.com\nSubject: Quarterly budget\n\nThe forecast is ready.\n",
+	})
+
+	cases := []struct {
+		Name   string
+		Words  []string
+		Fields []Field
+		Found  bool
+	}{
+		{"Forwarded body", []string{"forecast"}, []Field{Field_Body}, true},
+		{"Forwarded subject", []string{"budget"}, []Field{Field_Subject}, true},
+		{"Forwarded from", []string{"kenneth"}, []Field{Field_From}, true},
+		{"Header not in body", []string{"budget"}, []Field{Field_Body}, false},
+		{"Marker not in body", []string{"original"}, nil, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			results, err := idx.QueryIndexFields(t.Context(), tc.Words, tc.Fields...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := len(results) > 0; found != tc.Found {
+				t.Errorf("expected found %v, got %v", tc.Found, found)
+			}
+		})
+	}
+}
+
+func TestNestedHeaderPositions(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: Budget review\n\nSee below.\n\n-----Original Message-----\nSubject: Budget forecast\n\nThe numbers.\n",
+	})
+
+	// Both subjects start with budget, neither match is lost
+	results, err := idx.QueryIndexFields(t.Context(), []string{"budget"}, Field_Subject)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected one result, got %+v (%v)", results, err)
+	}
+	var offsets, positions []int
+	for _, m := range results[0].WordMatches {
+		offsets = append(offsets, m.Offset)
+		positions = append(positions, m.Position)
+	}
+	if want := []int{0, len("Budget review") + 1}; !slices.Equal(offsets, want) {
+		t.Errorf("expected offsets %v, got %v", want, offsets)
+	}
+	if want := []int{0, 2 + headerGap}; !slices.Equal(positions, want) {
+		t.Errorf("expected positions %v, got %v", want, positions)
+	}
+
+	// A phrase doesn't run from one subject into the other
+	for _, phrase := range []string{"budget forecast", "budget review"} {
+		if res, err := idx.Search(t.Context(), Phrase(phrase, Field_Subject)); err != nil || len(res) != 1 {
+			t.Errorf("expected %q to match, got %v (%v)", phrase, res, err)
+		}
+	}
+	if res, err := idx.Search(t.Context(), Phrase("review budget", Field_Subject)); err != nil || len(res) != 0 {
+		t.Errorf("expected no phrase across the subjects, got %v (%v)", res, err)
+	}
+}
+
+func TestSerializeConcurrently(t *testing.T) {
+	// Enough words for the index to be encoded in several batches
+	emails := make(map[string]string)
+	for i := range 40 {
+		var body strings.Builder
+		for j := range 50 {
+			n := i*50 + j
+			fmt.Fprintf(&body, "w%c%c%c budget ", 'a'+n/676, 'a'+n/26%26, 'a'+n%26)
+		}
+		emails[fmt.Sprintf("%02d", i)] = "Subject: budget\n\n" + body.String() + "\n"
+	}
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+	idx, err := LoadIndexFromDisk(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := idx.words.Len(); n <= 2*postingBatchSize {
+		t.Fatalf("expected more than %d words, got %d", 2*postingBatchSize, n)
+	}
+	idx.Close()
+
+	// The files are the same however many workers encode the index
+	other := serializeTestIndex(t, &IndexBuilder{NThreads: 8}, emails)
+	for _, name := range []string{CorpusIndex, IndexWordOffsets, QueryPrefixTree, WordsStringTable} {
+		want, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(other, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs with more workers", name)
+		}
+	}
+
+	report, err := VerifyIndex(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected the index to verify, got %v", report.Problems)
+	}
+}
@@ -0,0 +1,345 @@
+package emailsearch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/go-mmap/mmap"
+)
+
+// A bundle holds all the files of an index in a single file, which is
+// simpler to distribute and can be swapped for another atomically with a
+// rename. LoadIndexFromDisk accepts either a bundle or a directory.
+//
+// Bundle format
+//
+// 0x00: u32 Magic 'EBDL'
+// 0x04: u32 Version number (currently 1)
+// 0x08: The contents of each file, one after another
+// ....: Table of contents, u32 number of files then for each file:
+//       uvarint name length, name, u64 offset and u64 length of the contents
+// ....: u64 Offset of the table of contents
+// ....: u32 Magic 'EBDL'
+//
+// All integers are big endian.
+
+const bundleMagic uint32 = 'E'<<24 | 'B'<<16 | 'D'<<8 | 'L'
+
+const (
+	bundleVersion    = 1
+	bundleHeaderLen  = 8
+	bundleTrailerLen = 12
+)
+
+type bundleEntry struct {
+	name           string
+	offset, length int64
+}
+
+// BundleFS is a WriteFS that writes the files of an index into a bundle,
+// streamed to an io.Writer. Files must be written one at a time. Close must
+// be called after serialization to write the table of contents.
+type BundleFS struct {
+	w    io.Writer
+	off  int64 // Bytes written to w so far
+	toc  []bundleEntry
+	open bool // A file is being written
+}
+
+// NewBundleFS returns a BundleFS that writes a bundle to w.
+func NewBundleFS(w io.Writer) *BundleFS {
+	return &BundleFS{w: w}
+}
+
+func (b *BundleFS) Create(name string) (io.WriteCloser, error) {
+	if b.open {
+		return nil, fmt.Errorf("bundle: cannot create %s while another file is open", name)
+	}
+	if b.off == 0 {
+		if err := b.writeHeader(); err != nil {
+			return nil, err
+		}
+	}
+	b.open = true
+	b.toc = append(b.toc, bundleEntry{name: name, offset: b.off})
+	return &bundleFile{b}, nil
+}
+
+func (b *BundleFS) writeHeader() error {
+	return b.write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, bundleMagic), bundleVersion))
+}
+
+func (b *BundleFS) write(p []byte) error {
+	n, err := b.w.Write(p)
+	b.off += int64(n)
+	return err
+}
+
+// Close writes the table of contents. It does not close the underlying
+// writer.
+func (b *BundleFS) Close() error {
+	if b.open {
+		return errors.New("bundle: closed while a file is open")
+	}
+	if b.off == 0 {
+		if err := b.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	tocOffset := b.off
+	toc := binary.BigEndian.AppendUint32(nil, uint32(len(b.toc)))
+	for _, e := range b.toc {
+		toc = binary.AppendUvarint(toc, uint64(len(e.name)))
+		toc = append(toc, e.name...)
+		toc = binary.BigEndian.AppendUint64(toc, uint64(e.offset))
+		toc = binary.BigEndian.AppendUint64(toc, uint64(e.length))
+	}
+	toc = binary.BigEndian.AppendUint64(toc, uint64(tocOffset))
+	toc = binary.BigEndian.AppendUint32(toc, bundleMagic)
+	return b.write(toc)
+}
+
+type bundleFile struct {
+	b *BundleFS
+}
+
+func (f *bundleFile) Write(p []byte) (int, error) {
+	if !f.b.open {
+		return 0, os.ErrClosed
+	}
+	n, err := f.b.w.Write(p)
+	f.b.off += int64(n)
+	return n, err
+}
+
+func (f *bundleFile) Close() error {
+	if !f.b.open {
+		return os.ErrClosed
+	}
+	f.b.open = false
+	e := &f.b.toc[len(f.b.toc)-1]
+	e.length = f.b.off - e.offset
+	return nil
+}
+
+// SerializeBundle writes the index files into a bundle at path. The bundle
+// is written to a temporary file that then replaces path, so a search
+// server never sees a partly written bundle.
+func (ib *IndexBuilder) SerializeBundle(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails harmlessly once renamed
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	bfs := NewBundleFS(bw)
+	if err := ib.SerializeTo(bfs); err != nil {
+		return err
+	}
+	if err := bfs.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// indexFile is one file of a serialized index, read in place.
+type indexFile interface {
+	io.ReaderAt
+	Len() int
+	Close() error
+}
+
+// slicer is implemented by index files held in memory, whose bytes can be
+// used without copying them.
+type slicer interface {
+	slice(off, n int64) ([]byte, bool)
+}
+
+// indexSource opens the files of a serialized index. A missing file is
+// reported with an error that matches fs.ErrNotExist.
+type indexSource interface {
+	Open(name string) (indexFile, error)
+	Close() error
+}
+
+// openIndexSource returns the source of the index at path, which is a
+// directory, a bundle or a SQLite database, or the URL of a remote index.
+func openIndexSource(path string) (indexSource, error) {
+	if isRemote(path) {
+		return openRemote(path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fileError("", err)
+	}
+	if fi.IsDir() {
+		return dirSource(path), nil
+	}
+	if ok, err := isSQLite(path); err != nil {
+		return nil, err
+	} else if ok {
+		return openSQLite(path)
+	}
+	return openBundle(path)
+}
+
+// dirSource is an index written to a directory, each file is memory mapped.
+type dirSource string
+
+func (d dirSource) Open(name string) (indexFile, error) {
+	f, err := mmap.Open(filepath.Join(string(d), name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d dirSource) Close() error { return nil }
+
+// memSource reads the files of an index into memory as they are opened,
+// rather than memory mapping them, see LoadOptions.InMemory.
+type memSource struct {
+	indexSource
+}
+
+func (m memSource) Open(name string) (indexFile, error) {
+	f, err := m.indexSource.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, f.Len())
+	if n, err := f.ReadAt(data, 0); n < len(data) {
+		return nil, err
+	}
+	return newMemFile(data), nil
+}
+
+// bundleSource is an index bundle, memory mapped as a whole.
+type bundleSource struct {
+	path  string
+	f     indexFile
+	files map[string]bundleEntry
+}
+
+func openBundle(path string) (*bundleSource, error) {
+	f, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return newBundleSource(path, f)
+}
+
+// newBundleSource returns the source of the bundle in f, which it closes if
+// f is not a bundle.
+func newBundleSource(path string, f indexFile) (*bundleSource, error) {
+	b := &bundleSource{path: path, f: f}
+	if err := b.readTOC(); err != nil {
+		f.Close()
+		var verr *VersionError
+		if !errors.As(err, &verr) {
+			err = &CorruptError{Err: err}
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+func (b *bundleSource) readTOC() error {
+	size := int64(b.f.Len())
+	if size < bundleHeaderLen+bundleTrailerLen {
+		return errors.New("not an index bundle")
+	}
+
+	var hdr, trailer [bundleTrailerLen]byte
+	if _, err := b.f.ReadAt(hdr[:bundleHeaderLen], 0); err != nil {
+		return err
+	}
+	if _, err := b.f.ReadAt(trailer[:], size-bundleTrailerLen); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hdr[:]) != bundleMagic || binary.BigEndian.Uint32(trailer[8:]) != bundleMagic {
+		return errors.New("not an index bundle")
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != bundleVersion {
+		return &VersionError{Got: v, Want: bundleVersion}
+	}
+
+	tocOffset := int64(binary.BigEndian.Uint64(trailer[:]))
+	if tocOffset < bundleHeaderLen || tocOffset > size-bundleTrailerLen {
+		return errors.New("bundle table of contents out of range")
+	}
+	toc := make([]byte, size-bundleTrailerLen-tocOffset)
+	if _, err := b.f.ReadAt(toc, tocOffset); err != nil {
+		return err
+	}
+
+	rdr := bytes.NewReader(toc)
+	var n uint32
+	if err := binary.Read(rdr, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	b.files = make(map[string]bundleEntry, n)
+	for range n {
+		nameLen, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return err
+		}
+		if nameLen > uint64(rdr.Len()) {
+			return errors.New("bundle table of contents is truncated")
+		}
+		name := make([]byte, nameLen)
+		io.ReadFull(rdr, name)
+
+		var pos [2]uint64
+		if err := binary.Read(rdr, binary.BigEndian, &pos); err != nil {
+			return err
+		}
+		e := bundleEntry{string(name), int64(pos[0]), int64(pos[1])}
+		if e.offset < bundleHeaderLen || e.length < 0 || e.offset+e.length > tocOffset {
+			return fmt.Errorf("bundle file %s out of range", e.name)
+		}
+		b.files[e.name] = e
+	}
+	return nil
+}
+
+func (b *bundleSource) Open(name string) (indexFile, error) {
+	e, ok := b.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: b.path + ":" + name, Err: fs.ErrNotExist}
+	}
+	return bundleSection{io.NewSectionReader(b.f, e.offset, e.length)}, nil
+}
+
+func (b *bundleSource) Close() error {
+	return b.f.Close()
+}
+
+// bundleSection is a file in a bundle. Closing it leaves the bundle open.
+type bundleSection struct {
+	*io.SectionReader
+}
+
+func (s bundleSection) Len() int     { return int(s.Size()) }
+func (s bundleSection) Close() error { return nil }
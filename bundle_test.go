@@ -0,0 +1,120 @@
+package emailsearch
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	corpus := t.TempDir()
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget presentation.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+	for name, content := range emails {
+		if err := os.WriteFile(filepath.Join(corpus, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Small shards so that the content is spread across shard files
+	ib := &IndexBuilder{NThreads: 1, InputPath: corpus, MaxCatalogShardSize: 1}
+	ib.Init()
+	if err := ib.InjestFiles([]string{"1", "2"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "index.bundle")
+	f, err := os.Create(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bfs := NewBundleFS(f)
+	if err := ib.SerializeTo(bfs); err != nil {
+		t.Fatal(err)
+	}
+	if err := bfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := LoadIndexFromDisk(bundle, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	results, err := idx.QueryIndex(t.Context(), []string{"lunch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Filename != "2" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	content, _, ok := idx.CatalogContent(t.Context(), results[0].FilenameIndex)
+	if !ok || string(content) != "Lunch on Friday.\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if len(idx.IndexMetadata().Checksums) == 0 {
+		t.Error("expected the bundle to record checksums")
+	}
+}
+
+func TestBundleErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, files map[string]string) string {
+		t.Helper()
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		bfs := NewBundleFS(f)
+		for name, content := range files {
+			if err := writeFile(bfs, name, func(w io.Writer) error {
+				_, err := io.WriteString(w, content)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bfs.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+
+	b, err := openBundle(write("ok.bundle", map[string]string{"a": "hello"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if f, err := b.Open("a"); err != nil || f.Len() != 5 {
+		t.Errorf("expected file a of length 5, got %v", err)
+	}
+	if _, err := b.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+
+	notBundle := filepath.Join(dir, "not.bundle")
+	if err := os.WriteFile(notBundle, []byte("definitely not an index bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBundle(notBundle); err == nil {
+		t.Error("expected an error opening a file that is not a bundle")
+	}
+
+	bfs := NewBundleFS(io.Discard)
+	if _, err := bfs.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bfs.Create("b"); err == nil {
+		t.Error("expected an error creating a second file while one is open")
+	}
+}
@@ -0,0 +1,151 @@
+package emailsearch
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+)
+
+// QueryCache is a least recently used cache of ranked search results, keyed
+// on the normalized form of the query and the ranking settings of the index.
+// Set Index.Cache to use one. Repeated queries, such as those from a search
+// box that searches as the user types, are answered without touching the
+// index. A cache holds the results of one index at a time, it empties itself
+// when used with a different index such as one that has been reloaded.
+type QueryCache struct {
+	// MaxBytes bounds the estimated memory used by the cached results, the
+	// least recently used queries are evicted to keep under it and a query
+	// whose results alone are larger isn't cached. NewQueryCache sets it to
+	// DefaultQueryCacheBytes, 0 is no bound. Set it before the cache is used.
+	MaxBytes int64
+
+	mu      sync.Mutex
+	size    int
+	bytes   int64      // Estimated size of the entries
+	idx     *Index     // The index the cached results came from
+	order   *list.List // Of *cacheEntry, most recently used at the front
+	entries map[cacheKey]*list.Element
+}
+
+type cacheKey struct {
+	query     string
+	ranking   Ranking
+	bm25      BM25Parameters
+	proximity float64
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	ranked     []rankedFile // Every matching file, in rank order
+	matches    map[int][]QueryWordMatch
+	numMatches int
+	facets     Facets
+	bytes      int64 // Estimated size, see estimateBytes
+}
+
+// estimateBytes estimates the memory used by the results in e. Words are
+// shared with the index and queries, so only the matches themselves count.
+func (e *cacheEntry) estimateBytes() int64 {
+	n := int64(len(e.ranked)) * int64(unsafe.Sizeof(rankedFile{}))
+	n += int64(len(e.matches)) * int64(unsafe.Sizeof(0)+unsafe.Sizeof([]QueryWordMatch(nil))) * 5 / 4
+	for _, wordmatches := range e.matches {
+		n += int64(cap(wordmatches)) * int64(unsafe.Sizeof(QueryWordMatch{}))
+	}
+	for _, facets := range [][]Facet{e.facets.Folders, e.facets.Senders} {
+		for _, f := range facets {
+			n += int64(unsafe.Sizeof(f)) + int64(len(f.Value))
+		}
+	}
+	return n
+}
+
+// DefaultQueryCacheBytes is the MaxBytes of a new QueryCache.
+const DefaultQueryCacheBytes = 256 << 20
+
+// NewQueryCache returns a cache that holds the results of up to size
+// queries, and no more than DefaultQueryCacheBytes of them.
+func NewQueryCache(size int) *QueryCache {
+	return &QueryCache{
+		MaxBytes: DefaultQueryCacheBytes,
+		size:     max(size, 0),
+		order:    list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+	}
+}
+
+// Len returns the number of queries in the cache.
+func (c *QueryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Purge empties the cache.
+func (c *QueryCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge()
+}
+
+func (c *QueryCache) purge() {
+	c.order.Init()
+	clear(c.entries)
+	c.bytes = 0
+}
+
+// get returns the entry for q searched in idx. It is safe to call on a nil
+// cache.
+func (c *QueryCache) get(idx *Index, q Query) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := idx.cacheKey(q)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idx != idx {
+		c.purge()
+		c.idx = idx
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry), true
+}
+
+func (c *QueryCache) add(idx *Index, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idx != idx {
+		c.purge()
+		c.idx = idx
+	}
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	entry.bytes = entry.estimateBytes()
+	if c.MaxBytes > 0 && entry.bytes > c.MaxBytes {
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.bytes += entry.bytes
+	for c.order.Len() > c.size || (c.MaxBytes > 0 && c.bytes > c.MaxBytes) {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *QueryCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.bytes
+}
+
+// cacheKey returns the key of the results of q with the current ranking
+// settings.
+func (idx *Index) cacheKey(q Query) cacheKey {
+	return cacheKey{q.String(), idx.Ranking, idx.BM25, idx.Proximity}
+}
@@ -0,0 +1,122 @@
+package emailsearch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryCache(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: lunch\n\nThe budget meeting is over lunch.\n",
+		"2": "Subject: budget\n\nThe quarterly budget is attached.\n",
+		"3": "Subject: travel\n\nBook the travel before the meeting.\n",
+	}
+	idx := buildTestIndex(t, emails)
+
+	queries := []Query{Term("budget"), Term("meeting"), Or(Term("lunch"), Term("travel"))}
+	want := make([]SearchResults, len(queries))
+	for i, q := range queries {
+		var err error
+		if want[i], err = idx.SearchTop(t.Context(), q, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx.Cache = NewQueryCache(2)
+	for range 2 { // Fill the cache, then hit it
+		for i, q := range queries {
+			got, err := idx.SearchTop(t.Context(), q, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want[i]) {
+				t.Errorf("cached search for %s returned %v, expected %v", q, got, want[i])
+			}
+		}
+	}
+	if n := idx.Cache.Len(); n != 2 {
+		t.Errorf("expected the cache to hold 2 queries, got %d", n)
+	}
+
+	// A smaller k is answered from the cached ranking
+	top, err := idx.SearchTop(t.Context(), queries[2], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top.Results) != 1 || !reflect.DeepEqual(top.Results[0], want[2].Results[0]) || top.NumResults != want[2].NumResults {
+		t.Errorf("cached top 1 for %s returned %v, expected the first of %v", queries[2], top, want[2])
+	}
+
+	// Changing the returned matches leaves the cache alone
+	top.Results[0].WordMatches[0].Word = "changed"
+	if again, _ := idx.SearchTop(t.Context(), queries[2], 1); !reflect.DeepEqual(again.Results, want[2].Results[:1]) {
+		t.Errorf("cached results were modified by a caller: %v", again.Results)
+	}
+
+	// Different ranking settings are cached separately
+	idx.Ranking = Ranking_BM25
+	if _, err := idx.SearchTop(t.Context(), queries[2], -1); err != nil {
+		t.Fatal(err)
+	}
+	idx.Ranking = Ranking_TFIDF
+	if _, ok := idx.Cache.get(idx, queries[1]); ok {
+		t.Error("expected the least recently used query to be evicted")
+	}
+
+	// A reloaded index empties the cache
+	reloaded := buildTestIndex(t, emails)
+	reloaded.Cache = idx.Cache
+	if _, ok := reloaded.Cache.get(reloaded, queries[2]); ok {
+		t.Error("expected no cached results for a different index")
+	}
+	if n := idx.Cache.Len(); n != 0 {
+		t.Errorf("expected the cache to be emptied, it holds %d queries", n)
+	}
+
+	idx.Cache.add(idx, &cacheEntry{key: idx.cacheKey(queries[0])})
+	idx.Cache.Purge()
+	if n := idx.Cache.Len(); n != 0 {
+		t.Errorf("expected the cache to be empty after Purge, it holds %d queries", n)
+	}
+}
+
+func TestQueryCacheBytes(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: lunch\n\nThe budget meeting is over lunch.\n",
+		"2": "Subject: budget\n\nThe quarterly budget is attached.\n",
+	})
+	idx.Cache = NewQueryCache(10)
+	search := func(q Query) int64 {
+		t.Helper()
+		if _, err := idx.SearchTop(t.Context(), q, -1); err != nil {
+			t.Fatal(err)
+		}
+		e, ok := idx.Cache.get(idx, q)
+		if !ok {
+			return 0
+		}
+		return e.bytes
+	}
+
+	// Room for the results of one query, evicting the other
+	size := search(Term("budget"))
+	if size == 0 {
+		t.Fatal("expected the results to be cached with a size")
+	}
+	idx.Cache.Purge()
+	idx.Cache.MaxBytes = size
+	search(Term("budget"))
+	search(Term("lunch"))
+	if n := idx.Cache.Len(); n != 1 {
+		t.Errorf("expected the cache to hold 1 query, got %d", n)
+	}
+	if _, ok := idx.Cache.get(idx, Term("budget")); ok {
+		t.Error("expected the least recently used query to be evicted")
+	}
+
+	// Results larger than the whole cache aren't kept
+	idx.Cache.MaxBytes = 1
+	if search(Term("meeting")) != 0 {
+		t.Error("expected results larger than MaxBytes not to be cached")
+	}
+}
@@ -0,0 +1,196 @@
+package emailsearch
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Every file of a serialized index has a CRC-32C checksum recorded in the
+// index metadata. The checksums are verified when the index is loaded, so
+// that a file that was only partly written or has been damaged on disk is
+// reported instead of producing garbage results. The search index and the
+// catalog hold almost all of the data, reading them in full would make
+// loading as slow as the disk, so unless LoadOptions.Strict is set they are
+// only verified when they are first read after loading, see checkedFile.
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError reports an index file whose contents do not match the
+// checksum recorded when the index was built.
+type ChecksumError struct {
+	File string // Name of the file in the index directory
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("index file %s is corrupt, its checksum does not match", e.File)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// checksumFS is a WriteFS that records the checksum and size of every file
+// written through it.
+type checksumFS struct {
+	fsys WriteFS
+
+	mu   sync.Mutex
+	sums map[string]string
+	lens map[string]int64
+}
+
+func newChecksumFS(fsys WriteFS) *checksumFS {
+	return &checksumFS{fsys: fsys, sums: make(map[string]string), lens: make(map[string]int64)}
+}
+
+func (c *checksumFS) Create(name string) (io.WriteCloser, error) {
+	f, err := c.fsys.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumFile{f, crc32.New(crcTable), 0, c, name}, nil
+}
+
+// checksums returns the checksums of the files written so far.
+func (c *checksumFS) checksums() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.sums)
+}
+
+// sizes returns the sizes of the files written so far.
+func (c *checksumFS) sizes() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.lens)
+}
+
+type checksumFile struct {
+	io.WriteCloser
+	crc  hash.Hash32
+	size int64
+	fs   *checksumFS
+	name string
+}
+
+func (f *checksumFile) Write(p []byte) (int, error) {
+	n, err := f.WriteCloser.Write(p)
+	f.crc.Write(p[:n])
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *checksumFile) Close() error {
+	if err := f.WriteCloser.Close(); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	f.fs.sums[f.name] = formatChecksum(f.crc.Sum32())
+	f.fs.lens[f.name] = f.size
+	f.fs.mu.Unlock()
+	return nil
+}
+
+func formatChecksum(sum uint32) string {
+	return fmt.Sprintf("%08x", sum)
+}
+
+// verifyChecksums checks every file of src with a recorded checksum. It
+// returns a *ChecksumError for the first file that does not match.
+func verifyChecksums(src indexSource, checksums map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(checksums)) {
+		crc := crc32.New(crcTable)
+		err := readIndexFile(src, name, func(r *bufio.Reader) error {
+			_, err := io.Copy(crc, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if formatChecksum(crc.Sum32()) != checksums[name] {
+			return &ChecksumError{name}
+		}
+	}
+	return nil
+}
+
+// splitChecksums splits checksums into those of the files that are read in
+// full as the index loads, and those of the search index and the catalog,
+// which are read as they are searched.
+func splitChecksums(checksums map[string]string) (eager, lazy map[string]string) {
+	eager, lazy = make(map[string]string), make(map[string]string)
+	for name, sum := range checksums {
+		if name == CorpusIndex || strings.HasPrefix(name, CorpusCatalog) {
+			lazy[name] = sum
+		} else {
+			eager[name] = sum
+		}
+	}
+	return eager, lazy
+}
+
+// checkedFile is an index file whose checksum is verified on the first read
+// through it. If it doesn't match that read and every later one fails with
+// a *ChecksumError. The file that is open is checked, not the one in the
+// index now, which may have been rebuilt in place since.
+type checkedFile struct {
+	indexFile
+	name string
+	sum  string
+
+	once sync.Once
+	err  error
+}
+
+// checkLater returns f, the index file name, as a checkedFile if it has a
+// checksum in lazy.
+func checkLater(f indexFile, name string, lazy map[string]string) indexFile {
+	sum, ok := lazy[name]
+	if !ok {
+		return f
+	}
+	return &checkedFile{indexFile: f, name: name, sum: sum}
+}
+
+func (f *checkedFile) verify() error {
+	f.once.Do(func() {
+		crc := crc32.New(crcTable)
+		if _, err := io.Copy(crc, io.NewSectionReader(f.indexFile, 0, int64(f.Len()))); err != nil {
+			f.err = fileError(f.name, err)
+		} else if formatChecksum(crc.Sum32()) != f.sum {
+			f.err = &ChecksumError{f.name}
+		}
+	})
+	return f.err
+}
+
+// checksumError returns the *ChecksumError of f if it is a checkedFile
+// that doesn't match its checksum.
+func checksumError(f indexFile) error {
+	if cf, ok := f.(*checkedFile); ok {
+		return cf.verify()
+	}
+	return nil
+}
+
+func (f *checkedFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.verify(); err != nil {
+		return 0, err
+	}
+	return f.indexFile.ReadAt(p, off)
+}
+
+func (f *checkedFile) slice(off, n int64) ([]byte, bool) {
+	s, ok := f.indexFile.(slicer)
+	if !ok || f.verify() != nil {
+		return nil, false
+	}
+	return s.slice(off, n)
+}
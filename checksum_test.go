@@ -0,0 +1,71 @@
+package emailsearch
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	corpus := t.TempDir()
+	if err := os.WriteFile(filepath.Join(corpus, "1"), []byte("Subject: a\n\nThe budget meeting\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ib := &IndexBuilder{NThreads: 1, InputPath: corpus}
+	ib.Init()
+	if err := ib.InjestFiles([]string{"1"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := ib.Serialize(out); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+	for _, name := range []string{FilenamesStringTable, WordsStringTable, CorpusIndex, IndexWordOffsets, CorpusCatalog, QueryPrefixTree, LabelsStringTable, DocumentLabels} {
+		if _, ok := idx.IndexMetadata().Checksums[name]; !ok {
+			t.Errorf("expected a checksum for %s", name)
+		}
+	}
+	if _, ok := idx.IndexMetadata().Checksums[ErrorReport]; ok {
+		t.Errorf("expected no checksum for %s", ErrorReport)
+	}
+
+	// Damage the catalog
+	catalog := filepath.Join(out, CorpusCatalog)
+	data, err := os.ReadFile(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(catalog, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog is only verified when it is first read, unless the index
+	// is loaded with Strict
+	idx, err = LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatalf("expected the catalog to be verified on first read, got %v", err)
+	}
+	defer idx.Close()
+	var cerr *ChecksumError
+	if _, _, err := idx.ReadContent(t.Context(), 0); !errors.As(err, &cerr) || cerr.File != CorpusCatalog {
+		t.Errorf("expected a checksum error for %s reading content, got %v", CorpusCatalog, err)
+	}
+	if _, _, err := idx.ReadContent(t.Context(), 0); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected the checksum error again, got %v", err)
+	}
+
+	_, err = LoadIndex(out, io.Discard, LoadOptions{Strict: true})
+	if !errors.As(err, &cerr) || cerr.File != CorpusCatalog {
+		t.Errorf("expected a checksum error for %s with Strict, got %v", CorpusCatalog, err)
+	}
+}
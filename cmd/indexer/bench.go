@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chriskillpack/emailsearch"
+	"github.com/chriskillpack/emailsearch/queryparser"
+)
+
+// runBench measures how long the queries in a file take to run against an
+// index.
+func runBench(args []string) error {
+	fset := flag.NewFlagSet("bench", flag.ExitOnError)
+	runs := fset.Int("n", 10, "number of times to run each query")
+	concurrency := fset.Int("concurrency", 1, "number of queries to run at once")
+	limit := fset.Int("limit", 10, "results to return from each search, -1 for all of them")
+	rankingName := fset.String("ranking", "tfidf", "how to rank search results: tfidf or bm25")
+	keyFile := fset.String("key-file", "", "file holding the hex encoded AES key of an encrypted index")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer bench [flags] index queries\n\nRuns each query in the file queries, one per line in the search box syntax,\nagainst the index a number of times and reports the latency percentiles and\nthroughput. The first run of each query is included, results are not cached.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 2 || *runs <= 0 || *concurrency <= 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	ranking, err := emailsearch.ParseRanking(*rankingName)
+	if err != nil {
+		return err
+	}
+
+	queries, err := readQueries(fset.Arg(1))
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return fmt.Errorf("%s has no queries", fset.Arg(1))
+	}
+	// Queries are parsed as the search server parses them
+	parsed := make([]emailsearch.Query, len(queries))
+	for i, q := range queries {
+		if parsed[i], err = queryparser.Parse(q); err != nil {
+			return fmt.Errorf("%s: %w", q, err)
+		}
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		if key, err = emailsearch.ReadKeyFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	idx, err := emailsearch.LoadIndex(fset.Arg(0), io.Discard, emailsearch.LoadOptions{Key: key})
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	idx.Ranking = ranking
+
+	// Each query is run n times, interleaved with the others
+	latencies := make([]time.Duration, *runs*len(queries))
+	next := make(chan int)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				q := i % len(queries)
+				start := time.Now()
+				if _, err := idx.SearchPage(ctx, parsed[q], 0, *limit); err != nil {
+					cancel(fmt.Errorf("%s: %w", queries[q], err))
+				}
+				latencies[i] = time.Since(start)
+			}
+		}()
+	}
+
+	start := time.Now()
+	for i := range latencies {
+		if ctx.Err() != nil {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+
+	slices.Sort(latencies)
+	fmt.Printf("Ran %d queries %d times each with concurrency %d in %s\n", len(queries), *runs, *concurrency, elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput: %.1f queries/s\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("Latency: min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		latencies[0], percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+	return nil
+}
+
+// readQueries reads the queries in the file path, one per line. Blank lines
+// are skipped.
+func readQueries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if q := strings.TrimSpace(scanner.Text()); q != "" {
+			queries = append(queries, q)
+		}
+	}
+	return queries, scanner.Err()
+}
+
+// percentile returns the p'th percentile of the sorted durations by the
+// nearest rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/chriskillpack/emailsearch"
+	"github.com/chriskillpack/emailsearch/bleveexport"
+)
+
+// runBleve copies the emails of an index into a new Bleve index.
+func runBleve(args []string) error {
+	fset := flag.NewFlagSet("bleve", flag.ExitOnError)
+	out := fset.String("out", "email.bleve", "directory to create the Bleve index in, it must not exist")
+	batch := fset.Int("batch", bleveexport.DefaultBatchSize, "number of emails to index in each Bleve batch")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer bleve [flags] index\n\nCopies the emails of the index into a Bleve index, without reading the original emails.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	idx, err := emailsearch.LoadIndexFromDisk(fset.Arg(0), io.Discard)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	b, err := bleve.New(*out, bleveexport.NewMapping())
+	if err != nil {
+		return err
+	}
+	if err := bleveexport.Export(context.Background(), idx, b, *batch); err != nil {
+		b.Close()
+		return err
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d emails to %s\n", idx.CorpusSize, *out)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chriskillpack/emailsearch"
+)
+
+// runDump prints the decoded posting lists of words straight from an index.
+func runDump(args []string) error {
+	fset := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJSON := fset.Bool("json", false, "print each posting list as a line of JSON")
+	keyFile := fset.String("key-file", "", "file holding the hex encoded AES key of an encrypted index")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer dump [flags] index word...\n\nPrints the posting list of each word as it is stored in the index: the files and\nfields it occurs in, how often, and the offset, position and length of each\noccurrence.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 2 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = emailsearch.ReadKeyFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	idx, err := emailsearch.LoadIndex(fset.Arg(0), io.Discard, emailsearch.LoadOptions{Key: key, Minimal: true})
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	for _, word := range fset.Args()[1:] {
+		pl, err := idx.Postings(word)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(pl); err != nil {
+				return err
+			}
+			continue
+		}
+		printPostingList(os.Stdout, pl)
+	}
+	return nil
+}
+
+// printPostingList prints pl as a table with a posting on each line. Each
+// occurrence is printed as offset@position+length.
+func printPostingList(w io.Writer, pl emailsearch.PostingList) {
+	fmt.Fprintf(w, "%s: %d files, %d postings\n", pl.Term, pl.DF, len(pl.Postings))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "  FILE\tFIELD\tTF\tOCCURRENCES")
+	for _, p := range pl.Postings {
+		occs := make([]string, len(p.Occurrences))
+		for i, o := range p.Occurrences {
+			occs[i] = fmt.Sprintf("%d@%d+%d", o.Offset, o.Position, o.Length)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%d\t%s\n", p.File, p.Field, p.TF, strings.Join(occs, " "))
+	}
+	tw.Flush()
+}
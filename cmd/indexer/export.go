@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chriskillpack/emailsearch"
+)
+
+// runExport writes the words or documents of an index as JSON or CSV.
+func runExport(args []string) error {
+	fset := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fset.String("format", "json", "output format, json (JSON Lines) or csv")
+	docs := fset.Bool("documents", false, "export the metadata of every document instead of the words")
+	out := fset.String("o", "", "file to write to, standard output if empty")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer export [flags] index\n\nWrites every word of the index with its postings, or every document, as JSON or CSV.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	f, err := emailsearch.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	idx, err := emailsearch.LoadIndexFromDisk(fset.Arg(0), io.Discard)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	w := io.Writer(os.Stdout)
+	var file *os.File
+	if *out != "" {
+		if file, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if *docs {
+		err = idx.ExportDocuments(w, f)
+	} else {
+		err = idx.ExportWords(w, f)
+	}
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		return file.Close()
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/fs"
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,9 +18,19 @@ import (
 
 var (
 	flagInputPath = flag.String("emails", "", "directory of emails")
-	flagOutDir    = flag.String("out", "./out", "directory to place generated files")
+	flagOutDir    = flag.String("out", "./out", "directory to place generated files, or a .tar, .bundle or .sqlite file to write them into")
 	flagThreads   = flag.Int("threads", 10, "threads to use")
-	flagMaxFiles  = flag.Int("maxfiles", -1, "maximum number of files to inject, -1 to disable limit")
+	flagMaxFiles  = flag.Int("maxfiles", -1, "maximum number of files to inject, -1 to disable limit. The directories are walked concurrently, so which files are injested varies between runs")
+	flagOnError   = flag.String("on-error", "skip", "how to handle files that fail to injest: skip, fail or retry")
+	flagRetries   = flag.Int("retries", 3, "number of retries when -on-error=retry")
+	flagSynonyms  = flag.String("synonyms", "", "file of comma separated synonym groups, one group per line")
+	flagCodec     = flag.String("codec", "gzip", "compression of the stored emails: gzip, zstd or none")
+	flagShardMB   = flag.Int64("catalog-shard-mb", 0, "maximum size in MiB of each catalog shard file, 0 to store emails in a single catalog file")
+	flagKeyFile   = flag.String("key-file", "", "file holding a hex encoded AES key to encrypt the catalog with")
+	flagEncIndex  = flag.Bool("encrypt-index", false, "also encrypt the rest of the index with the -key-file key")
+	flagDryRun    = flag.Bool("dry-run", false, "walk, filter and parse the emails and report what would be indexed, without writing anything")
+	flagInclude   patternList
+	flagExclude   patternList
 
 	verboseOutput bool
 
@@ -29,70 +42,79 @@ var (
 		"Serializing catalog     ",
 		"Serializing word offsets",
 		"Serializing prefix tree ",
+		"Serializing labels      ",
+		"Serializing error report",
+		"Serializing metadata    ",
 	}
-)
 
-func verbose(format string, a ...any) {
-	if verboseOutput {
-		fmt.Printf(format, a...)
+	errorPolicies = map[string]emailsearch.ErrorPolicy{
+		"skip":  emailsearch.ErrorPolicy_Skip,
+		"fail":  emailsearch.ErrorPolicy_FailFast,
+		"retry": emailsearch.ErrorPolicy_Retry,
 	}
-}
-
-// Walk a path of the filesystem and return the set of files in that path
-// The names of the files are relative to the walk path, so Walk("/home/chris")
-// will return ["foo/cat.txt"] for /home/chris/foo/cat.txt
-func walk(path string, n int) ([]string, int64, error) {
-	files := []string{}
-
-	bar := progressbar.NewOptions(
-		n,
-		progressbar.OptionSetDescription("Enumerating files       "),
-		progressbar.OptionSpinnerType(14),
-		progressbar.OptionThrottle(50*time.Millisecond),
-		progressbar.OptionShowCount(),
-		progressbar.OptionOnCompletion(func() { fmt.Println() }),
-	)
-
-	var maxSize int64
-	err := filepath.WalkDir(path, func(wpath string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if d.IsDir() {
-			return nil
-		}
-
-		bar.Add(1)
-		finfo, err := d.Info()
-		if err != nil {
-			return err
-		}
-		maxSize = max(maxSize, finfo.Size())
+)
 
-		relpath, err := filepath.Rel(path, wpath)
-		if err != nil {
-			return err
-		}
+// subcommands run instead of indexing when named by the first argument, e.g.
+// "indexer migrate email_index". Each has its own flags.
+var subcommands = map[string]func(args []string) error{
+	"bench":   runBench,
+	"bleve":   runBleve,
+	"dump":    runDump,
+	"export":  runExport,
+	"merge":   runMerge,
+	"migrate": runMigrate,
+	"repair":  runRepair,
+}
 
-		files = append(files, relpath)
+// patternList is a flag that can be given multiple times to build up a list
+// of glob patterns.
+type patternList []string
 
-		// If a limit was set and the limit has been exceeded stop walking
-		if n >= 0 && len(files) >= n {
-			return fs.SkipAll
-		}
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
 
-		return nil // Continue walking
-	})
+func (p *patternList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
 
-	bar.Finish()
+func verbose(format string, a ...any) {
+	if verboseOutput {
+		fmt.Printf(format, a...)
+	}
+}
 
-	return files, maxSize, err
+// walk finds the files under path that ib accepts, reading up to threads
+// directories at once, and sends them to files as they are found. It stops
+// after n files unless n is negative. The names of the files are relative
+// to path, so walking /home/chris sends foo/cat.txt for
+// /home/chris/foo/cat.txt. It returns a function that waits for the walk to
+// finish and returns any error.
+func walk(ctx context.Context, path string, threads, n int, ib *emailsearch.IndexBuilder, files chan<- emailsearch.WalkedFile) func() error {
+	done := make(chan error, 1)
+	go func() {
+		done <- ib.Walk(ctx, path, threads, n, files)
+	}()
+	return func() error {
+		return <-done
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	flag.BoolVar(&verboseOutput, "v", false, "Verbose output")
 	flag.BoolVar(&verboseOutput, "verbose", false, "Verbose output")
+	flag.Var(&flagInclude, "include", "only index files matching this glob pattern, may be repeated")
+	flag.Var(&flagExclude, "exclude", "skip files and directories matching this glob pattern, may be repeated")
 	flag.Parse()
 
 	if *flagInputPath == "" {
@@ -101,11 +123,54 @@ func main() {
 	if *flagThreads <= 0 || *flagThreads > 100 {
 		log.Fatal("Threads needs to be between 1 and 100")
 	}
+	if err := emailsearch.ValidatePatterns(append(flagInclude, flagExclude...)); err != nil {
+		log.Fatal(err)
+	}
+	errorPolicy, ok := errorPolicies[*flagOnError]
+	if !ok {
+		log.Fatalf("Unknown -on-error policy %q", *flagOnError)
+	}
+	codec, err := emailsearch.ParseCodec(*flagCodec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var key []byte
+	if *flagKeyFile != "" {
+		if key, err = emailsearch.ReadKeyFile(*flagKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	} else if *flagEncIndex {
+		log.Fatal("-encrypt-index needs a -key-file")
+	}
 	verbose("Running with %d threads\n", *flagThreads)
 
+	var synonyms map[string][]string
+	if *flagSynonyms != "" {
+		f, err := os.Open(*flagSynonyms)
+		if err != nil {
+			log.Fatal(err)
+		}
+		synonyms, err = emailsearch.ParseSynonyms(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read synonyms: %s", err)
+		}
+		verbose("Loaded %d synonym groups\n", len(synonyms))
+	}
+
 	index := emailsearch.IndexBuilder{
-		NThreads:  *flagThreads,
-		InputPath: *flagInputPath,
+		NThreads:        *flagThreads,
+		InputPath:       *flagInputPath,
+		ErrorPolicy:     errorPolicy,
+		MaxRetries:      *flagRetries,
+		IncludePatterns: flagInclude,
+		ExcludePatterns: flagExclude,
+		Synonyms:        synonyms,
+		Codec:           codec,
+
+		MaxCatalogShardSize: *flagShardMB << 20,
+		EncryptionKey:       key,
+		EncryptIndex:        *flagEncIndex,
 	}
 	index.Init()
 
@@ -116,39 +181,67 @@ func main() {
 
 	start := time.Now()
 
-	files, maxSize, err := walk(*flagInputPath, *flagMaxFiles)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// The emails are injested as the walk finds them, so the walk and the
+	// injestion both run at the speed of the slower. The walk is stopped if
+	// injestion fails.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	files := make(chan emailsearch.WalkedFile, *flagThreads)
+	walked := walk(ctx, *flagInputPath, *flagThreads, *flagMaxFiles, &index, files)
 
-	// The injestion progress bar
+	// The injestion progress bar. The number of emails is not known until
+	// the walk is done.
 	bar := progressbar.NewOptions(
-		len(files),
+		-1,
 		progressbar.OptionSetDescription("Injesting files 1/2     "),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionShowCount(),
 		progressbar.OptionThrottle(50*time.Millisecond),
 		progressbar.OptionOnCompletion(func() { fmt.Println() }),
 	)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
+		desc := "Injesting files 1/2     "
 		fn := sync.OnceFunc(func() {
 			bar.Reset()
-			bar.Describe("Injesting files 2/2     ")
+			desc = "Injesting files 2/2     "
 		})
 
 		for p := range indexProgressChan {
-			bar.Add(1)
-
 			if p.Phase == 2 {
 				fn()
 			}
+
+			bar.Add(1)
+			bar.Describe(desc + " " + progressDetail("docs", p.Rate, p.Remaining))
 		}
 
 		bar.Finish()
 		wg.Done()
 	}()
-	index.InjestFiles(files, maxSize)
+	err = index.InjestStream(files)
 	wg.Wait() // allow progress bar to catch up
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := walked(); err != nil {
+		log.Fatal(err)
+	}
+	if *flagDryRun {
+		report(&index, time.Since(start))
+		return
+	}
+	if failures := index.Failures(); len(failures) > 0 {
+		report := filepath.Join(*flagOutDir, emailsearch.ErrorReport)
+		if ext := filepath.Ext(*flagOutDir); ext == ".tar" || ext == ".bundle" || ext == ".sqlite" {
+			report = emailsearch.ErrorReport + " in " + *flagOutDir
+		}
+		fmt.Printf("%d files failed to injest, see %s\n", len(failures), report)
+		for _, f := range failures {
+			verbose("  %s: %s\n", f.Filename, f.Error)
+		}
+	}
 
 	// The serialize progress bar
 	bar = progressbar.NewOptions(
@@ -170,13 +263,14 @@ func main() {
 				bar.Finish()
 			case emailsearch.SerializeEvent_ProgressPhase:
 				bar.Add(p.N)
+				bar.Describe(serializePhaseDescriptions[p.Phase] + " " + progressDetail("items", p.Rate, p.Remaining))
 			}
 		}
 
 		wg.Done()
 	}()
 
-	if err := index.Serialize(*flagOutDir); err != nil {
+	if err := serialize(&index, *flagOutDir); err != nil {
 		log.Fatal(err)
 	}
 
@@ -185,3 +279,72 @@ func main() {
 
 	fmt.Printf("Success. Took %s to run.\n", duration.String())
 }
+
+// report prints what a dry run would have indexed and every file that
+// failed.
+func report(index *emailsearch.IndexBuilder, duration time.Duration) {
+	totals := index.Totals()
+	fmt.Printf("Dry run, nothing was written. Took %s to run.\n", duration.String())
+	fmt.Printf("Would index %s documents of %s words, %s of them distinct\n", formatCount(totals.Documents), formatCount(int(totals.Tokens)), formatCount(totals.Words))
+	if totals.Failures == 0 {
+		return
+	}
+	fmt.Printf("%s files would fail to injest:\n", formatCount(totals.Failures))
+	for _, f := range index.Failures() {
+		fmt.Printf("  %s: %s\n", f.Filename, f.Error)
+	}
+}
+
+// progressDetail describes the rate of progress and the time remaining, e.g.
+// "12,345 docs/s, ~4m left".
+func progressDetail(unit string, rate float64, remaining time.Duration) string {
+	detail := fmt.Sprintf("%s %s/s", formatCount(int(rate)), unit)
+	switch {
+	case remaining < time.Second:
+		return detail
+	case remaining >= time.Hour:
+		return fmt.Sprintf("%s, ~%dh%02dm left", detail, int(remaining.Hours()), int(remaining.Minutes())%60)
+	case remaining >= time.Minute:
+		return fmt.Sprintf("%s, ~%dm left", detail, int(remaining.Round(time.Minute).Minutes()))
+	default:
+		return fmt.Sprintf("%s, ~%ds left", detail, int(remaining.Round(time.Second).Seconds()))
+	}
+}
+
+// formatCount formats n with thousands separators.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// serialize writes the index to out, which is either a directory or, if it
+// ends in .tar, a tar file or, if it ends in .bundle, an index bundle, see
+// IndexBuilder.SerializeBundle, or if it ends in .sqlite, a SQLite database.
+func serialize(index *emailsearch.IndexBuilder, out string) error {
+	switch filepath.Ext(out) {
+	case ".tar":
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		tfs := emailsearch.NewTarFS(f)
+		if err := index.SerializeTo(tfs); err != nil {
+			return err
+		}
+		if err := tfs.Close(); err != nil {
+			return err
+		}
+		return f.Close()
+	case ".bundle":
+		return index.SerializeBundle(out)
+	case ".sqlite":
+		return index.SerializeSQLite(out)
+	default:
+		return index.Serialize(out)
+	}
+}
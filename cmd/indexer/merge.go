@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chriskillpack/emailsearch"
+)
+
+// runMerge combines separately built indexes into one.
+func runMerge(args []string) error {
+	fset := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fset.String("out", "", "directory to write the merged index to, or a .tar, .bundle or .sqlite file to write it into")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer merge -out combined index...\n\nMerges index directories or bundles, e.g. built for each mailbox in parallel\njobs, into a single index. A file may only be in one of them.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if *out == "" || fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	start := time.Now()
+	index := &emailsearch.IndexBuilder{}
+	index.Init()
+	if err := index.Merge(fset.Args()...); err != nil {
+		return err
+	}
+	if err := serialize(index, *out); err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d indexes into %s. Took %s to run.\n", fset.NArg(), *out, time.Since(start))
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/chriskillpack/emailsearch"
+)
+
+// runMigrate upgrades indexes to the current file format in place.
+func runMigrate(args []string) error {
+	fset := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer migrate index...\n\nUpgrades each index directory, bundle or SQLite database to the current file format in place.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range fset.Args() {
+		migrated, err := emailsearch.MigrateIndex(path)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", path, err)
+		}
+		if migrated {
+			fmt.Printf("Migrated %s\n", path)
+		} else {
+			fmt.Printf("%s is already current\n", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chriskillpack/emailsearch"
+)
+
+// runRepair regenerates the files of indexes that can be derived from the
+// rest of the index.
+func runRepair(args []string) error {
+	fset := flag.NewFlagSet("repair", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: indexer repair index...\n\nRegenerates the word offsets table and prefix tree of each index directory or\nbundle from the rest of the index if they are missing or damaged.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range fset.Args() {
+		repaired, err := emailsearch.RepairIndex(path)
+		if err != nil {
+			return fmt.Errorf("failed to repair %s: %w", path, err)
+		}
+		if len(repaired) > 0 {
+			fmt.Printf("Repaired %s: %s\n", path, strings.Join(repaired, ", "))
+		} else {
+			fmt.Printf("%s has nothing to repair\n", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io/fs"
+	"os"
+)
+
+// overlayFS serves files from the directory dir, falling back to base for
+// those it doesn't have. It lets a deployment replace some of the templates
+// or static files built into the binary.
+type overlayFS struct {
+	dir  fs.FS
+	base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.base.Open(name)
+	}
+	return f, err
+}
+
+// assets returns the files built into the binary under root, overlaid with
+// those in dir if it isn't "".
+func assets(root, dir string) (fs.FS, error) {
+	embedded, err := fs.Sub(embedFS, root)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return embedded, nil
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: errors.New("not a directory")}
+	}
+	return overlayFS{os.DirFS(dir), embedded}, nil
+}
+
+// useAssets makes the server use the templates in templatesDir and the
+// static files in staticDir in place of the ones built into the binary.
+// Either can be "" to use the built in ones, as can any file missing from
+// them. It must be called before the server is created.
+func useAssets(templatesDir, staticDir string) error {
+	tmpls, err := assets("tmpl", templatesDir)
+	if err != nil {
+		return err
+	}
+	static, err := assets("static", staticDir)
+	if err != nil {
+		return err
+	}
+	if err := parseTemplates(tmpls); err != nil {
+		return err
+	}
+	staticFS = static
+	return nil
+}
+
+// parseTemplates parses the page templates in fsys. If any fails to parse
+// the current templates are kept.
+func parseTemplates(fsys fs.FS) error {
+	index, err := template.ParseFS(fsys, "index.html")
+	if err != nil {
+		return err
+	}
+	results, err := template.ParseFS(fsys, "_results.html")
+	if err != nil {
+		return err
+	}
+	email, err := template.ParseFS(fsys, "email.html")
+	if err != nil {
+		return err
+	}
+	indexTmpl, resultsPartialTmpl, emailTmpl = index, results, email
+	return nil
+}
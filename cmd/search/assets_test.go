@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUseAssets(t *testing.T) {
+	t.Cleanup(func() { useAssets("", "") })
+
+	tmpls, static := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpls, "index.html"), []byte("<h1>Acme Email Search</h1>{{.Query}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(static, "logo.svg"), []byte("<svg></svg>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := useAssets(tmpls, static); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nThe budget.\n"})
+	handler := srv.serveHandler()
+	get := func(target string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != 200 {
+			t.Errorf("%s: expected OK, got %d", target, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	if body := get("/?q=budget"); body != "<h1>Acme Email Search</h1>budget" {
+		t.Errorf("expected the overriding template, got %q", body)
+	}
+	if body := get("/search?q=budget"); !strings.Contains(body, "across 1 documents") {
+		t.Errorf("expected the built in results template, got %q", body)
+	}
+	if body := get("/static/logo.svg"); body != "<svg></svg>" {
+		t.Errorf("expected the added static file, got %q", body)
+	}
+	if body := get("/static/page.js"); !strings.Contains(body, "runQuery") {
+		t.Errorf("expected the built in static file, got %q", body)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpls, "email.html"), []byte("{{.Missing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := useAssets(tmpls, ""); err == nil {
+		t.Error("expected an error for a broken template")
+	}
+	if err := useAssets(filepath.Join(tmpls, "missing"), ""); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
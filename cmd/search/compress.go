@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	gzipWriters  = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	flateWriters = sync.Pool{New: func() any { w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression); return w }}
+)
+
+// compressible returns whether responses of the media type are worth
+// compressing. Images are already compressed and event streams have to
+// reach the client as they are written.
+func compressible(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediatype == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediatype, "text/"):
+		return true
+	}
+	return mediatype == "application/json" || mediatype == "application/javascript" || mediatype == "image/svg+xml"
+}
+
+// acceptedEncoding returns the content encoding to compress the response to
+// req with, gzip or deflate, or "" if the client accepts neither.
+func acceptedEncoding(req *http.Request) string {
+	var gzipOK, deflateOK bool
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue // Explicitly not accepted
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip":
+			gzipOK = true
+		case "deflate":
+			deflateOK = true
+		}
+	}
+	switch {
+	case gzipOK:
+		return "gzip"
+	case deflateOK:
+		return "deflate"
+	}
+	return ""
+}
+
+// compress compresses the responses of next with gzip or deflate, whichever
+// the client accepts, if their content type is compressible.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(req)
+		if encoding == "" || req.Method == http.MethodHead || req.Header.Get("Range") != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// compressWriter compresses what is written to it once it knows from the
+// headers that the response is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	w           io.WriteCloser // Compressor, nil if the response isn't compressed
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.w = gz
+		} else {
+			fw := flateWriters.Get().(*flate.Writer)
+			fw.Reset(cw.ResponseWriter)
+			cw.w = fw
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.w != nil {
+		return cw.w.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been compressed so far to the client.
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close finishes the compressed response.
+func (cw *compressWriter) Close() error {
+	if cw.w == nil {
+		return nil
+	}
+	err := cw.w.Close()
+	switch w := cw.w.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(w)
+	case *flate.Writer:
+		flateWriters.Put(w)
+	}
+	cw.w = nil
+	return err
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"})
+	handler := srv.serveHandler()
+
+	cases := []struct {
+		Name, Target, AcceptEncoding, Expected string
+	}{
+		{"gzip", "/search?q=lunch", "deflate, gzip", "gzip"},
+		{"deflate", "/search?q=lunch", "deflate", "deflate"},
+		{"Refused", "/search?q=lunch", "gzip;q=0, identity", ""},
+		{"None", "/search?q=lunch", "", ""},
+		{"JSON", "/prefix?q=lun", "gzip", "gzip"},
+		{"Script", "/static/page.js", "gzip", "gzip"},
+		{"Image", "/static/enron-16.png", "gzip", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.Target, nil)
+		if tc.AcceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.AcceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != tc.Expected {
+			t.Errorf("%s: expected encoding %q, got %q", tc.Name, tc.Expected, got)
+			continue
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected to vary by Accept-Encoding", tc.Name)
+		}
+
+		var r io.Reader = rec.Body
+		switch tc.Expected {
+		case "gzip":
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.Name, err)
+			}
+			r = gz
+		case "deflate":
+			r = flate.NewReader(rec.Body)
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: failed to decompress: %v", tc.Name, err)
+		}
+		if strings.HasPrefix(tc.Target, "/search") && !strings.Contains(string(body), "across 1 documents") {
+			t.Errorf("%s: unexpected body %q", tc.Name, body)
+		}
+	}
+}
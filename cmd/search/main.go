@@ -8,37 +8,125 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/chriskillpack/emailsearch"
+	"github.com/chriskillpack/emailsearch/queryparser"
 )
 
 var (
-	flagIndexDir = flag.String("indexdir", "out/", "Directory that holds the search index")
+	flagIndexDir = flag.String("indexdir", "out/", "Directory that holds the search index, an index bundle or SQLite database, or the http(s):// or s3:// URL of a remote index")
+	flagIndexes  = flag.String("indexes", "", "comma separated name=path indexes to serve under /index/name/ as well as -indexdir, e.g. 2001=out/2001,2002=out/2002")
 	flagQuery    = flag.String("query", "", "query index, print results, quit")
+	flagRanking  = flag.String("ranking", "tfidf", "how to rank search results: tfidf or bm25")
+	flagBM25K1   = flag.Float64("bm25-k1", emailsearch.DefaultBM25.K1, "BM25 term frequency saturation")
+	flagBM25B    = flag.Float64("bm25-b", emailsearch.DefaultBM25.B, "BM25 document length normalization, 0 to 1")
+	flagProx     = flag.Float64("proximity", emailsearch.DefaultProximity, "weight of the ranking boost for query words found close together, 0 to disable")
+	flagCache    = flag.Int("cache", 256, "number of recent queries whose ranked results are cached, 0 to disable")
+	flagCacheMB  = flag.Int("cache-mb", emailsearch.DefaultQueryCacheBytes>>20, "most megabytes of ranked results the query cache holds, 0 for no limit")
+	flagKeyFile  = flag.String("key-file", "", "file holding the hex encoded AES key of an encrypted index")
+	flagInMemory = flag.Bool("in-memory", false, "read the whole index into memory rather than memory mapping it")
+	flagStrict   = flag.Bool("strict", false, "verify the checksums of every index file, and that they agree, before serving rather than as they are first read")
+	flagWatch    = flag.Duration("watch", 0, "how often to check the index for changes and reload it, 0 to only reload on SIGHUP")
+	flagTLSCert  = flag.String("tls-cert", os.Getenv("TLS_CERT"), "PEM file of the certificate chain to serve HTTPS with")
+	flagTLSKey   = flag.String("tls-key", os.Getenv("TLS_KEY"), "PEM file of the private key of -tls-cert")
+	flagAutocert = flag.String("autocert", os.Getenv("AUTOCERT_HOSTS"), "comma separated host names to serve HTTPS for with certificates from Let's Encrypt")
+	flagCertDir  = flag.String("autocert-cache", "autocert", "directory to keep Let's Encrypt certificates in")
+	flagAPIKeys  = flag.String("api-keys", "", "file of API keys, one per line, one of which the JSON API requires")
+	flagAllow    = flag.String("allow", "", "comma separated IP addresses and CIDR networks allowed to use the search page, others need an API key")
+	flagSocket   = flag.String("socket", os.Getenv("SOCKET"), "Unix domain socket to listen on instead of a TCP port")
+	flagAllowSck = flag.Bool("allow-socket", false, "allow clients of -socket to use the search page, for a reverse proxy that does its own access control")
+	flagRecent   = flag.String("recent-searches", "", "file to keep each browser's recent searches in, to offer them on the search page")
+	flagCSP      = flag.String("csp", DefaultContentSecurityPolicy, "Content-Security-Policy header to send with every response, \"\" to not send one")
+	flagTmplDir  = flag.String("templates", "", "directory of page templates to use in place of the built in ones, missing templates are the built in ones")
+	flagStatic   = flag.String("static", "", "directory of files to serve under /static/ in place of the built in ones, missing files are the built in ones")
 )
 
 func main() {
 	flag.Parse()
 
-	start := time.Now()
-	idx, err := emailsearch.LoadIndexFromDisk(*flagIndexDir, os.Stdout)
+	tlsConfig := TLSConfig{CertFile: *flagTLSCert, KeyFile: *flagTLSKey, AutocertCache: *flagCertDir}
+	if *flagAutocert != "" {
+		tlsConfig.AutocertHosts = strings.Split(*flagAutocert, ",")
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if tlsConfig.CertFile != "" && len(tlsConfig.AutocertHosts) > 0 {
+		log.Fatal("-tls-cert and -autocert can't both be given")
+	}
+
+	ranking, err := emailsearch.ParseRanking(*flagRanking)
 	if err != nil {
 		log.Fatal(err)
 	}
-	duration := time.Since(start)
-	log.Printf("Ready, took %s to load index", duration.String())
+
+	if err := useAssets(*flagTmplDir, *flagStatic); err != nil {
+		log.Fatalf("Failed to load the templates and static files: %s", err)
+	}
+
+	allow, err := parseAllowList(*flagAllow)
+	if err != nil {
+		log.Fatalf("-allow: %s", err)
+	}
+	var apiKeys []string
+	if *flagAPIKeys != "" {
+		if apiKeys, err = readAPIKeys(*flagAPIKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(apiKeys) > 0 && len(allow) == 0 && !*flagAllowSck {
+		log.Fatal("-api-keys requires -allow or -allow-socket, the clients that can use the search page without a key")
+	}
+
+	named, err := parseIndexList(*flagIndexes)
+	if err != nil {
+		log.Fatalf("-indexes: %s", err)
+	}
+
+	opts := emailsearch.LoadOptions{InMemory: *flagInMemory, Strict: *flagStrict, Logger: log.Default()}
+	if *flagKeyFile != "" {
+		if opts.Key, err = emailsearch.ReadKeyFile(*flagKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	loadIndex := func(path string) *emailsearch.Index {
+		start := time.Now()
+		idx, err := emailsearch.LoadIndex(path, nil, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		idx.Ranking = ranking
+		idx.BM25 = emailsearch.BM25Parameters{K1: *flagBM25K1, B: *flagBM25B}
+		idx.Proximity = *flagProx
+		if *flagCache > 0 {
+			idx.Cache = emailsearch.NewQueryCache(*flagCache)
+			idx.Cache.MaxBytes = int64(*flagCacheMB) << 20
+		}
+		duration := time.Since(start)
+		log.Printf("Ready, took %s to load index %s", duration.String(), path)
+		log.Printf("Index uses %s", idx.Stats())
+		return idx
+	}
+
+	idx := loadIndex(*flagIndexDir)
 
 	if *flagQuery != "" {
-		results, err := idx.QueryIndex([]string{*flagQuery})
+		q, err := queryparser.Parse(*flagQuery)
+		if err != nil {
+			log.Fatalf("Invalid query: %s", err)
+		}
+		results, err := idx.Search(context.Background(), q)
 		if err != nil {
 			log.Fatal(err)
 		}
 		// TODO: prettier printing of results
 		fmt.Printf("%+v\n", results)
 
-		idx.Finish()
+		idx.Close()
 		os.Exit(0)
 	}
 
@@ -49,8 +137,58 @@ func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
+		if tlsConfig.Enabled() {
+			port = "443"
+		}
+	}
+	newWatcher := func(path string, idx *emailsearch.Index) *emailsearch.IndexWatcher {
+		w := emailsearch.NewIndexWatcher(path, idx)
+		w.Load = func(path string) (*emailsearch.Index, error) {
+			return emailsearch.LoadIndex(path, nil, opts)
+		}
+		return w
+	}
+	indexes := newWatcher(*flagIndexDir, idx)
+	defer indexes.Close()
+	srv := NewServer(indexes, port)
+	paths, watchers := []string{*flagIndexDir}, []*emailsearch.IndexWatcher{indexes}
+	for _, ni := range named {
+		w := newWatcher(ni.Path, loadIndex(ni.Path))
+		defer w.Close()
+		srv.AddIndex(ni.Name, w)
+		paths, watchers = append(paths, ni.Path), append(watchers, w)
+	}
+	srv.AdminToken = os.Getenv("ADMIN_TOKEN")
+	srv.TLS = tlsConfig
+	srv.SocketPath = *flagSocket
+	srv.Security.ContentSecurityPolicy = *flagCSP
+	srv.APIKeys, srv.Allow, srv.AllowSocket = apiKeys, allow, *flagAllowSck
+	if *flagRecent != "" {
+		if srv.Recent, err = openRecentSearches(*flagRecent); err != nil {
+			log.Fatalf("Failed to load recent searches: %s", err)
+		}
+	}
+
+	// Reload the indexes on SIGHUP, an index on a POST to its
+	// /admin/reload, or whenever one changes with -watch
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for i, w := range watchers {
+				if err := w.Reload(""); err != nil {
+					log.Printf("Failed to reload index %s: %s", paths[i], err)
+					continue
+				}
+				log.Printf("Reloaded index %s", paths[i])
+			}
+		}
+	}()
+	if *flagWatch > 0 {
+		for _, w := range watchers {
+			go w.Watch(ctx, *flagWatch, log.Writer())
+		}
 	}
-	srv := NewServer(idx, port)
 
 	go func() {
 		if err := srv.Start(); err != nil && err != http.ErrServerClosed {
@@ -71,6 +209,30 @@ func main() {
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			log.Printf("Error at server shutdown: %s", err)
 		}
+		if srv.Recent != nil {
+			if err := srv.Recent.Close(); err != nil {
+				log.Printf("Failed to save recent searches: %s", err)
+			}
+		}
 	}()
 	wg.Wait()
 }
+
+// readAPIKeys reads the API keys in the file at path, one per line. Blank
+// lines and lines starting with # are skipped.
+func readAPIKeys(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no API keys", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	maxRecentSessions = 1000 // Sessions whose searches are kept, the least recently used are dropped
+	maxRecentQueries  = 10   // Searches kept for each session
+	maxRecentQueryLen = 256  // Longer searches are not kept
+
+	// recentSaveDelay is how long after a search the searches are saved, so
+	// that a burst of searches is written once and searches don't wait on
+	// the disk.
+	recentSaveDelay = time.Second
+
+	sessionCookie = "session"
+)
+
+// recentSearches keeps the most recent searches of each browser session in
+// a JSON file, so the landing page can offer them again. The file is
+// rewritten in the background shortly after a search and is bounded by
+// maxRecentSessions, maxRecentQueries and maxRecentQueryLen. Sessions are
+// only accepted if they carry the signature of the key kept in the file, so
+// clients can't make up sessions.
+type recentSearches struct {
+	path string
+
+	saveMu sync.Mutex // Held while the file is written, so saves are in order
+
+	mu       sync.Mutex
+	key      []byte // Signs the session IDs
+	sessions map[string]*recentSession
+	pending  *time.Timer // Save that is due, nil if there is none
+}
+
+type recentSession struct {
+	Queries []string  `json:"queries"` // Most recent first
+	Used    time.Time `json:"used"`
+}
+
+// recentFile is the contents of the file. Files written before the session
+// IDs were signed held only the sessions, whose IDs are no longer accepted.
+type recentFile struct {
+	Key      string                    `json:"key"`
+	Sessions map[string]*recentSession `json:"sessions"`
+}
+
+// openRecentSearches loads the recent searches kept in the file at path, or
+// starts afresh with a new key if it doesn't exist.
+func openRecentSearches(path string) (*recentSearches, error) {
+	r := &recentSearches{path: path, sessions: make(map[string]*recentSession)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var f recentFile
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+	}
+	if r.key, err = hex.DecodeString(f.Key); err != nil || len(r.key) == 0 {
+		// Save the new key straight away, the sessions signed with it
+		// must outlive a restart
+		r.key = make([]byte, 32)
+		rand.Read(r.key)
+		if err := r.save(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	if f.Sessions != nil {
+		r.sessions = f.Sessions
+	}
+	return r, nil
+}
+
+// newSession returns a new session ID: random bytes followed by their
+// signature, in hex.
+func (r *recentSearches) newSession() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(r.sign(id))
+}
+
+// validSession returns whether session is an ID returned by newSession.
+func (r *recentSearches) validSession(session string) bool {
+	b, err := hex.DecodeString(session)
+	if err != nil || len(b) != 32 {
+		return false
+	}
+	return hmac.Equal(r.sign(b[:16]), b)
+}
+
+// sign appends the signature of id to it.
+func (r *recentSearches) sign(id []byte) []byte {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(id)
+	return append(id[:len(id):len(id)], mac.Sum(nil)[:16]...)
+}
+
+// add records query as the most recent search of session and schedules the
+// searches to be saved. Invalid sessions and long queries are ignored.
+func (r *recentSearches) add(session, query string) {
+	if len(query) > maxRecentQueryLen || !r.validSession(session) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[session]
+	if !ok {
+		s = &recentSession{}
+		r.sessions[session] = s
+	}
+	s.Queries = slices.DeleteFunc(s.Queries, func(q string) bool { return q == query })
+	s.Queries = slices.Insert(s.Queries, 0, query)
+	s.Queries = s.Queries[:min(len(s.Queries), maxRecentQueries)]
+	s.Used = time.Now()
+
+	if len(r.sessions) > maxRecentSessions {
+		oldest := slices.MinFunc(slices.Collect(maps.Keys(r.sessions)), func(a, b string) int {
+			return r.sessions[a].Used.Compare(r.sessions[b].Used)
+		})
+		delete(r.sessions, oldest)
+	}
+
+	if r.pending == nil {
+		r.pending = time.AfterFunc(recentSaveDelay, func() {
+			if err := r.save(); err != nil {
+				log.Printf("Failed to save recent searches - %s", err)
+			}
+		})
+	}
+}
+
+// get returns the recent searches of session, most recent first.
+func (r *recentSearches) get(session string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.sessions[session]; ok {
+		return slices.Clone(s.Queries)
+	}
+	return nil
+}
+
+// Close stops the save that is waiting, if any, and saves the searches.
+func (r *recentSearches) Close() error {
+	r.mu.Lock()
+	if r.pending != nil {
+		r.pending.Stop()
+	}
+	r.mu.Unlock()
+	return r.save()
+}
+
+// save writes the searches to a temporary file that then replaces the file,
+// so a crash never leaves it partly written.
+func (r *recentSearches) save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	r.pending = nil
+	data, err := json.Marshal(recentFile{hex.EncodeToString(r.key), r.sessions})
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// session returns the session of the browser that made req, starting a new
+// one if it doesn't have one or it wasn't issued by the server.
+func (s *Server) session(w http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(sessionCookie); err == nil && s.Recent.validSession(c.Value) {
+		return c.Value
+	}
+	id := s.Recent.newSession()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   s.TLS.Enabled(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentSearches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recent.json")
+	r, err := openRecentSearches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := r.newSession(), r.newSession()
+	for i := range maxRecentQueries + 2 {
+		r.add(a, fmt.Sprint("query ", i))
+	}
+	r.add(b, "budget")
+	r.add(b, "forecast")
+	r.add(b, "budget")
+	r.add(b, strings.Repeat("x", maxRecentQueryLen+1))
+
+	// Sessions the server didn't issue are ignored
+	forged := strings.Repeat("0", len(a))
+	r.add(forged, "lunch")
+	r.add("session", "lunch")
+	if r.get(forged) != nil || r.get("session") != nil {
+		t.Error("expected made up sessions to be ignored")
+	}
+
+	// Searches and sessions survive a restart once saved
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = openRecentSearches(path); err != nil {
+		t.Fatal(err)
+	}
+	if !r.validSession(a) {
+		t.Error("expected a session to be valid after a restart")
+	}
+	if got := r.get(a); len(got) != maxRecentQueries || got[0] != fmt.Sprint("query ", maxRecentQueries+1) {
+		t.Errorf("expected the %d most recent searches, got %v", maxRecentQueries, got)
+	}
+	if got := r.get(b); !slices.Equal(got, []string{"budget", "forecast"}) {
+		t.Errorf("expected a repeated search to move to the front and long searches to be left out, got %v", got)
+	}
+
+	// The least recently used sessions are dropped
+	for range maxRecentSessions - 1 {
+		r.add(r.newSession(), "lunch")
+	}
+	if r.get(a) != nil || r.get(b) == nil {
+		t.Errorf("expected only the oldest session to be dropped")
+	}
+
+	// Searches are saved in the background
+	r.add(b, "forecast")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		saved, err := openRecentSearches(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := saved.get(b); len(got) > 0 && got[0] == "forecast" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the searches to be saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecentEndpoint(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"})
+	var err error
+	if srv.Recent, err = openRecentSearches(filepath.Join(t.TempDir(), "recent.json")); err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.serveHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/search?q=lunch", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/recent", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"searches":["lunch"]}` {
+		t.Errorf("unexpected recent searches %s", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/recent", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"searches":[]}` {
+		t.Errorf("expected no searches without a session, got %s", got)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "net/http"
+
+// DefaultContentSecurityPolicy only lets pages load scripts, styles and
+// other resources from the server itself and stops them being framed, so
+// that markup which makes it out of an email can't run or load anything.
+// The pages have no inline scripts or styles for it to allow.
+const DefaultContentSecurityPolicy = "default-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// SecurityHeaders are the headers sent with every response to limit what a
+// browser lets the pages do, since they show the contents of untrusted
+// emails. A header is not sent if its field is "".
+type SecurityHeaders struct {
+	ContentSecurityPolicy string
+	ReferrerPolicy        string // Search queries are in URLs, so they shouldn't leak to other sites
+	FrameOptions          string // For browsers that don't support frame-ancestors
+
+	// Set, if not nil, is called for every response after the headers are
+	// set, to add to or change them for some requests
+	Set func(h http.Header, req *http.Request)
+}
+
+// DefaultSecurityHeaders are the headers a server sends unless configured
+// otherwise.
+var DefaultSecurityHeaders = SecurityHeaders{
+	ContentSecurityPolicy: DefaultContentSecurityPolicy,
+	ReferrerPolicy:        "same-origin",
+	FrameOptions:          "DENY",
+}
+
+// secureHeaders sets the security headers on the responses of next.
+// Responses are never content sniffed, and browsers are told to only use
+// HTTPS once the server is serving it.
+func (s *Server) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		for name, value := range map[string]string{
+			"Content-Security-Policy": s.Security.ContentSecurityPolicy,
+			"Referrer-Policy":         s.Security.ReferrerPolicy,
+			"X-Frame-Options":         s.Security.FrameOptions,
+		} {
+			if value != "" {
+				h.Set(name, value)
+			}
+		}
+		if req.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		if s.Security.Set != nil {
+			s.Security.Set(h, req)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nThe budget.\n"})
+	handler := srv.serveHandler()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	for _, target := range []string{"/", "/?q=budget", "/search?q=budget", "/static/page.js", "/missing/email"} {
+		h := get(target).Header()
+		for name, want := range map[string]string{
+			"Content-Security-Policy": DefaultContentSecurityPolicy,
+			"X-Content-Type-Options":  "nosniff",
+			"Referrer-Policy":         "same-origin",
+			"X-Frame-Options":         "DENY",
+		} {
+			if got := h.Get(name); got != want {
+				t.Errorf("%s: expected %s %q, got %q", target, name, want, got)
+			}
+		}
+		if h.Get("Strict-Transport-Security") != "" {
+			t.Errorf("%s: expected no HSTS without TLS", target)
+		}
+	}
+
+	// The pages work under the default policy, which allows no inline
+	// scripts, event handlers or styles
+	inline := regexp.MustCompile(`<script>|<style|\son[a-z]+=|\sstyle=`)
+	for _, target := range []string{"/", "/?q=budget", "/search?q=budget"} {
+		if body := get(target).Body.String(); inline.MatchString(body) {
+			t.Errorf("%s: expected no inline scripts or styles, got %q", target, inline.FindString(body))
+		}
+	}
+
+	srv.Security = SecurityHeaders{
+		ReferrerPolicy: "no-referrer",
+		Set: func(h http.Header, req *http.Request) {
+			if strings.HasPrefix(req.URL.Path, "/static/") {
+				h.Set("Cache-Control", "max-age=3600")
+			}
+		},
+	}
+	h := get("/static/page.js").Header()
+	if h.Get("Content-Security-Policy") != "" || h.Get("Referrer-Policy") != "no-referrer" || h.Get("Cache-Control") != "max-age=3600" {
+		t.Errorf("expected the configured headers, got %v", h)
+	}
+	if h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("expected responses never to be sniffed")
+	}
+}
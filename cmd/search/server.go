@@ -5,39 +5,117 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"embed"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/chriskillpack/emailsearch"
+	"github.com/chriskillpack/emailsearch/queryparser"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	//go:embed tmpl/*.html
-	tmplFS embed.FS
+	//go:embed tmpl/*.html static
+	embedFS embed.FS
 
-	//go:embed static
-	staticFS embed.FS
+	// staticFS holds the files served under /static/, see useAssets
+	staticFS fs.FS
 
 	indexTmpl          *template.Template
 	resultsPartialTmpl *template.Template
 	emailTmpl          *template.Template
 )
 
+const (
+	maxResults    = 10              // The number of search results shown on a page by default
+	maxPageSize   = 100             // The most search results a page can show
+	searchTimeout = 3 * time.Second // How long a search can take
+	snippetWidth  = 240             // Bytes of the body shown with each search result, about three lines
+	maxFacets     = 5               // The number of folders and senders shown
+)
+
 type Server struct {
 	hs     *http.Server
 	logger *log.Logger
 
-	Index *emailsearch.Index
+	// Indexes serves the current generation of the default index, which
+	// can be reloaded while the server is running
+	Indexes *emailsearch.IndexWatcher
+
+	// Named are more indexes to serve, each under /index/{name}/, added by
+	// AddIndex
+	Named map[string]*emailsearch.IndexWatcher
+
+	// AdminToken is the bearer token that authorizes requests to /admin.
+	// If it is empty the admin endpoints are disabled.
+	AdminToken string
+
+	// TLS configures the server to serve HTTPS, see TLSConfig
+	TLS TLSConfig
+
+	// SocketPath, if set, is a Unix domain socket to listen on instead of
+	// the TCP port, for running behind a reverse proxy on the same host
+	SocketPath string
+
+	// APIKeys, if set, are the keys one of which must be sent with requests
+	// to the JSON API, in the X-API-Key header or the api_key parameter.
+	// Allow or AllowSocket must be set too, for the search page to be
+	// restricted and its autocomplete to work, see ErrAPIKeysWithoutAllow.
+	APIKeys []string
+
+	// Allow, if set, restricts the HTML interface to clients with addresses
+	// in these networks. Clients elsewhere need an API key. Allowed clients
+	// can use the JSON API without a key, the search page does.
+	Allow []netip.Prefix
+
+	// AllowSocket allows clients connecting to the SocketPath as if they
+	// were in Allow, for a reverse proxy that does its own access control.
+	// Clients of a socket have no address, so otherwise they need an API
+	// key whenever the server is restricted to allowed clients.
+	AllowSocket bool
+
+	// Recent, if set, keeps the recent searches of each browser session
+	Recent *recentSearches
+
+	// Security are the security headers sent with every response,
+	// DefaultSecurityHeaders unless changed
+	Security SecurityHeaders
+
+	redirect *http.Server // Answers ACME challenges when using autocert
+}
+
+// TLSConfig is how the server gets its certificate. With neither a
+// certificate file nor autocert hosts the server serves plain HTTP.
+type TLSConfig struct {
+	CertFile, KeyFile string // PEM encoded certificate chain and private key
+
+	// AutocertHosts are the host names to get certificates for from Let's
+	// Encrypt. Requests for other hosts are refused.
+	AutocertHosts []string
+	AutocertCache string // Directory certificates are kept in between runs
+}
+
+// Enabled returns whether the server is configured to serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || len(c.AutocertHosts) > 0
 }
 
 type matchHighlight struct {
@@ -51,95 +129,341 @@ type emailMatch struct {
 }
 
 func init() {
-	indexTmpl = template.Must(template.ParseFS(tmplFS, "tmpl/index.html"))
-	resultsPartialTmpl = template.Must(template.ParseFS(tmplFS, "tmpl/_results.html"))
-	emailTmpl = template.Must(template.ParseFS(tmplFS, "tmpl/email.html"))
+	if err := useAssets("", ""); err != nil {
+		panic(err)
+	}
 }
 
-func NewServer(idx *emailsearch.Index, port string) *Server {
-	srv := &Server{Index: idx, logger: log.Default()}
+func NewServer(indexes *emailsearch.IndexWatcher, port string) *Server {
+	srv := &Server{Indexes: indexes, Security: DefaultSecurityHeaders, logger: log.Default()}
 	srv.hs = &http.Server{
 		Addr:         net.JoinHostPort("0.0.0.0", port),
 		Handler:      srv.serveHandler(),
 		ReadTimeout:  3 * time.Second,
 		WriteTimeout: 6 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		ConnContext:  markSocketConn,
 	}
 	return srv
 }
 
+// socketConnKey is the context key marking requests that came over the
+// SocketPath.
+type socketConnKey struct{}
+
+// markSocketConn marks the context of a connection accepted on a Unix
+// domain socket, whose requests have no remote address to check.
+func markSocketConn(ctx context.Context, c net.Conn) context.Context {
+	if c.LocalAddr().Network() == "unix" {
+		return context.WithValue(ctx, socketConnKey{}, true)
+	}
+	return ctx
+}
+
+// AddIndex serves another index under /index/{name}/, with the same pages
+// and API as the default index.
+func (s *Server) AddIndex(name string, indexes *emailsearch.IndexWatcher) {
+	if s.Named == nil {
+		s.Named = make(map[string]*emailsearch.IndexWatcher)
+	}
+	s.Named[name] = indexes
+}
+
+// indexKey is the context key of the name of the index a request is for.
+type indexKey struct{}
+
+// index returns the index a request is for, along with the path its pages
+// are served under.
+func (s *Server) index(req *http.Request) (*emailsearch.IndexWatcher, string) {
+	if name, ok := req.Context().Value(indexKey{}).(string); ok {
+		return s.Named[name], "/index/" + name
+	}
+	return s.Indexes, ""
+}
+
+// indexNames returns the names of the indexes served besides the default,
+// sorted.
+func (s *Server) indexNames() []string {
+	return slices.Sorted(maps.Keys(s.Named))
+}
+
+// ErrAPIKeysWithoutAllow is returned by Start if the server has APIKeys but
+// no Allow list or AllowSocket. The search page would then be open to
+// everyone while its autocomplete, which doesn't send a key, would be
+// refused.
+var ErrAPIKeysWithoutAllow = errors.New("API keys require an allow list of the clients that can use the search page")
+
 func (s *Server) Start() error {
-	return s.hs.ListenAndServe()
+	if len(s.APIKeys) > 0 && !s.restricted() {
+		return ErrAPIKeysWithoutAllow
+	}
+	if s.SocketPath != "" && len(s.Allow) > 0 && !s.AllowSocket {
+		s.logger.Printf("Clients of %s are not in the allow list and need an API key, see AllowSocket", s.SocketPath)
+	}
+
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(s.TLS.AutocertHosts) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.TLS.AutocertHosts...),
+		}
+		if s.TLS.AutocertCache != "" {
+			m.Cache = autocert.DirCache(s.TLS.AutocertCache)
+		}
+		s.hs.TLSConfig = m.TLSConfig()
+
+		// Let's Encrypt checks the http-01 challenge on port 80, which
+		// also redirects browsers to HTTPS
+		s.redirect = &http.Server{
+			Addr:         ":http",
+			Handler:      m.HTTPHandler(nil),
+			ReadTimeout:  s.hs.ReadTimeout,
+			WriteTimeout: s.hs.WriteTimeout,
+		}
+		go func() {
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Printf("HTTP challenge server failed - %s", err)
+			}
+		}()
+		return s.hs.ServeTLS(l, "", "")
+	case s.TLS.CertFile != "":
+		return s.hs.ServeTLS(l, s.TLS.CertFile, s.TLS.KeyFile)
+	default:
+		return s.hs.Serve(l)
+	}
+}
+
+// listen listens on the SocketPath or else the TCP address of the server. A
+// socket left behind by a server that didn't shut down cleanly is replaced,
+// the socket is removed when the server shuts down.
+func (s *Server) listen() (net.Listener, error) {
+	if s.SocketPath == "" {
+		return net.Listen("tcp", s.hs.Addr)
+	}
+	if fi, err := os.Lstat(s.SocketPath); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		os.Remove(s.SocketPath)
+	}
+	return net.Listen("unix", s.SocketPath)
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.redirect != nil {
+		s.redirect.Shutdown(ctx)
+	}
 	return s.hs.Shutdown(ctx)
 }
 
 func (s *Server) serveHandler() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("GET /static/", http.FileServerFS(staticFS))
-	mux.Handle("GET /search", s.logRequest(s.serveSearch()))
-	mux.Handle("GET /prefix", s.queryPrefix())
-	mux.Handle("GET /email/{email}", s.logRequest(s.retrieveEmail()))
-	mux.Handle("GET /", s.logRequest(s.serveRoot()))
+	mux.Handle("GET /static/", http.StripPrefix("/static", http.FileServerFS(staticFS)))
+	mux.Handle("GET /search", s.logRequest(s.requireAllowed(s.serveSearch())))
+	mux.Handle("GET /search/stream", s.logRequest(s.requireAllowed(s.serveSearchStream())))
+	mux.Handle("GET /prefix", s.requireAPIKey(s.requireAllowed(s.queryPrefix())))
+	mux.Handle("GET /recent", s.requireAPIKey(s.requireAllowed(s.recentSearches())))
+	mux.Handle("GET /email/{email}", s.logRequest(s.requireAllowed(s.retrieveEmail())))
+	mux.Handle("POST /admin/reload", s.logRequest(s.requireAdmin(s.reloadIndex())))
+	mux.Handle("GET /", s.logRequest(s.requireAllowed(s.serveRoot())))
+
+	// The other indexes are served by the same handlers under their names
+	top := http.NewServeMux()
+	top.Handle("/index/{name}/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.PathValue("name")
+		if _, ok := s.Named[name]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		prefix := "/index/" + name
+		req = req.WithContext(context.WithValue(req.Context(), indexKey{}, name))
+		http.StripPrefix(prefix, mux).ServeHTTP(w, req)
+	}))
+	top.Handle("/", mux)
 
-	return mux
+	return s.secureHeaders(compress(top))
 }
 
-func (s *Server) serveSearch() http.HandlerFunc {
-	type SearchResult struct {
-		Result      emailsearch.QueryResults
-		PathSegment string
+// searchResult is a result on the search page.
+type searchResult struct {
+	Base        string // Path the index's pages are under
+	Result      emailsearch.QueryResults
+	PathSegment string
+	Snippet     template.HTML // An excerpt of the body with the matches highlighted
+}
+
+// facetLink is a facet of the search results on the search page.
+type facetLink struct {
+	emailsearch.Facet
+	Query string // The search narrowed down to the facet, if it can be
+}
+
+// resultsPage is the data of the search results template.
+type resultsPage struct {
+	Base         string // Path the index's pages are under
+	Query        string
+	NumResults   int
+	NumMatches   int
+	ResponseTime string
+	Results      []searchResult
+	NDocuments   int
+	Correction   string // The query with misspellings corrected, if any
+	Folders      []facetLink
+	Senders      []facetLink
+	Pages        pagination
+	Error        string
+}
+
+// search is a search requested of serveSearch or serveSearchStream.
+type search struct {
+	idx         *emailsearch.Index
+	base        string
+	query       string
+	q           emailsearch.Query
+	err         error // Why the query couldn't be parsed, if it couldn't
+	page, limit int
+}
+
+// parseSearch parses the search requested by req, which is run against
+// the index it is for. If there's nothing to search for it responds itself
+// and returns false. The caller must call release once it is done with the
+// index.
+func (s *Server) parseSearch(w http.ResponseWriter, req *http.Request) (srch search, release func(), ok bool) {
+	indexes, base := s.index(req)
+	if indexes == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return search{}, nil, false
 	}
 
-	return func(w http.ResponseWriter, req *http.Request) {
-		if s.Index == nil {
-			w.WriteHeader(http.StatusNoContent)
-			return
+	qvals := req.URL.Query()
+	query, ok := qvals["q"]
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return search{}, nil, false
+	}
+
+	page, limit, err := parsePage(qvals)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return search{}, nil, false
+	}
+
+	srch = search{base: base, query: query[0], page: page, limit: limit}
+	srch.q, srch.err = queryparser.Parse(query[0])
+	srch.idx, release = indexes.Acquire()
+	return srch, release, true
+}
+
+// summary returns the search results template data for the totals of res,
+// without the results. numShown is the number of results on the page.
+func (s *Server) summary(w http.ResponseWriter, req *http.Request, srch search, res emailsearch.SearchResults, numShown int) (resultsPage, error) {
+	if s.Recent != nil && srch.page == 1 {
+		s.Recent.add(s.session(w, req), srch.query)
+	}
+
+	suggestions, err := srch.idx.Suggest(srch.q)
+	if err != nil {
+		return resultsPage{}, err
+	}
+	var correction string
+	if len(suggestions) > 0 {
+		correction = emailsearch.CorrectQuery(srch.query, suggestions)
+	}
+
+	folders := make([]facetLink, min(len(res.Facets.Folders), maxFacets))
+	for i := range folders {
+		folders[i].Facet = res.Facets.Folders[i]
+	}
+	senders := make([]facetLink, min(len(res.Facets.Senders), maxFacets))
+	for i := range senders {
+		f := res.Facets.Senders[i]
+		senders[i] = facetLink{f, fmt.Sprintf("%s from:%q", srch.query, f.Value)}
+	}
+
+	return resultsPage{
+		Base:       srch.base,
+		Query:      srch.query,
+		NumResults: res.NumResults,
+		NumMatches: res.NumMatches,
+		NDocuments: srch.idx.CorpusSize,
+		Correction: correction,
+		Folders:    folders,
+		Senders:    senders,
+		Pages:      newPagination(srch.page, srch.limit, res.NumResults, numShown),
+	}, nil
+}
+
+// searchResult returns a result on the search page, with a snippet of the
+// email around its matches.
+func (s *Server) searchResult(srch search, result emailsearch.QueryResults) searchResult {
+	sr := searchResult{Base: srch.base, Result: result}
+	sr.PathSegment = base64.URLEncoding.EncodeToString(generateEmailURL(result))
+	if snip, ok := srch.idx.Snippet(result.FilenameIndex, result.WordMatches, snippetWidth); ok {
+		highlights := make([]matchHighlight, len(snip.Matches))
+		for j, m := range snip.Matches {
+			highlights[j] = matchHighlight{m.Offset, m.Length}
 		}
+		sr.Snippet = template.HTML(highlightContent([]byte(snip.Text), highlights))
+	}
+	return sr
+}
 
+// searchStatus returns the status code to respond with for a failed search.
+func searchStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) serveSearch() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Cache-Control", "no-store, no-cache")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		qvals := req.URL.Query()
-		query, ok := qvals["q"]
+		srch, release, ok := s.parseSearch(w, req)
 		if !ok {
-			w.WriteHeader(http.StatusNoContent)
 			return
 		}
+		defer release()
+		if srch.err != nil {
+			// Tell the user what is wrong with their query
+			w.WriteHeader(http.StatusOK)
+			data := resultsPage{Query: srch.query, Error: srch.err.Error()}
+			if err := resultsPartialTmpl.Execute(w, data); err != nil {
+				s.logger.Printf("Error rendering template %s\n", err)
+			}
+			return
+		}
+
+		// Give up on the search if it takes too long or the client goes away
+		ctx, cancel := context.WithTimeout(req.Context(), searchTimeout)
+		defer cancel()
 
 		start := time.Now()
-		queryparts := strings.Split(query[0], " ")
-		queryresults, err := s.Index.QueryIndex(queryparts)
+		res, err := srch.idx.SearchPage(ctx, srch.q, (srch.page-1)*srch.limit, srch.limit)
 		duration := time.Since(start)
-		s.logger.Printf("serveSearch query=%v", queryparts)
+		s.logger.Printf("serveSearch query=%v", srch.q)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			s.logger.Printf("Search failed - %s", err)
+			w.WriteHeader(searchStatus(err))
 			return
 		}
 
-		// Compute total number of matches
-		var totMatches int
-		for i := range queryresults {
-			totMatches += len(queryresults[i].WordMatches)
+		data, err := s.summary(w, req, srch, res, len(res.Results))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-
-		searchResults := make([]SearchResult, min(len(queryresults), 10))
-		for i := range searchResults {
-			searchResults[i].Result = queryresults[i]
-			searchResults[i].PathSegment = base64.URLEncoding.EncodeToString(generateEmailURL(queryresults[i]))
+		data.ResponseTime = duration.String()
+		data.Results = make([]searchResult, len(res.Results))
+		for i, result := range res.Results {
+			data.Results[i] = s.searchResult(srch, result)
 		}
 
 		w.WriteHeader(http.StatusOK)
-
-		data := struct {
-			Query        string
-			NumResults   int
-			NumMatches   int
-			ResponseTime string
-			Results      []SearchResult
-			NDocuments   int
-		}{query[0], len(queryresults), totMatches, duration.String(), searchResults, s.Index.CorpusSize}
 		if err := resultsPartialTmpl.Execute(w, data); err != nil {
 			s.logger.Printf("Error rendering template %s\n", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -147,6 +471,98 @@ func (s *Server) serveSearch() http.HandlerFunc {
 	}
 }
 
+// serveSearchStream is like serveSearch but sends the results page as
+// Server-Sent Events, so the search page can show the first results while
+// the rest are ranked. It sends a "summary" event with the totals, a
+// "result" event for each result in rank order, and finishes with a "pages"
+// event with the links to the other pages, each holding the HTML to show.
+// An invalid query gets an "error" event instead, and a search that fails
+// part way through a "failed" event with the status code.
+func (s *Server) serveSearchStream() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		srch, release, ok := s.parseSearch(w, req)
+		if !ok {
+			return
+		}
+		defer release()
+
+		w.Header().Set("Cache-Control", "no-store, no-cache")
+		w.Header().Set("Content-Type", "text/event-stream")
+		rc := http.NewResponseController(w)
+		send := func(event, tmpl string, data any) bool {
+			var sb strings.Builder
+			if err := resultsPartialTmpl.ExecuteTemplate(&sb, tmpl, data); err != nil {
+				s.logger.Printf("Error rendering template %s\n", err)
+				return false
+			}
+			if err := writeEvent(w, event, sb.String()); err != nil {
+				return false
+			}
+			return rc.Flush() == nil
+		}
+		if srch.err != nil {
+			w.WriteHeader(http.StatusOK)
+			send("error", "error", resultsPage{Query: srch.query, Error: srch.err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), searchTimeout)
+		defer cancel()
+
+		start := time.Now()
+		offset := (srch.page - 1) * srch.limit
+		res, results, err := srch.idx.SearchStream(ctx, srch.q, offset, srch.limit)
+		s.logger.Printf("serveSearchStream query=%v", srch.q)
+		if err != nil {
+			s.logger.Printf("Search failed - %s", err)
+			w.WriteHeader(searchStatus(err))
+			return
+		}
+
+		numShown := min(max(res.NumResults-offset, 0), srch.limit)
+		data, err := s.summary(w, req, srch, res, numShown)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data.ResponseTime = time.Since(start).String()
+
+		w.WriteHeader(http.StatusOK)
+		if !send("summary", "summary", data) {
+			return
+		}
+		for result := range results {
+			if !send("result", "result", s.searchResult(srch, result)) {
+				return
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			s.logger.Printf("Search failed - %s", err)
+			writeEvent(w, "failed", strconv.Itoa(searchStatus(err)))
+			return
+		}
+		send("pages", "pages", data)
+	}
+}
+
+// writeEvent writes a Server-Sent Event to w. An event stream ends lines at
+// a CR as well as an LF, so both are turned into data lines, or a CR in the
+// data could end the event or start another.
+func writeEvent(w io.Writer, event, data string) error {
+	data = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(data)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "event: %s\n", event)
+	for line := range strings.Lines(data) {
+		fmt.Fprintf(&sb, "data: %s\n", strings.TrimSuffix(line, "\n"))
+	}
+	if data == "" {
+		sb.WriteString("data:\n")
+	}
+	sb.WriteString("\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
 // We need a URL format that will contain everything we need
 // File Index varuint32
 // Number of matches uint16
@@ -174,20 +590,43 @@ func (s *Server) retrieveEmail() http.HandlerFunc {
 			return
 		}
 
-		content, filename, ok := s.Index.CatalogContent(highlights.FilenameIndex)
-		if !ok {
-			s.logger.Printf("Failed to find content for file index %d\n", highlights.FilenameIndex)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		indexes, _ := s.index(req)
+		idx, release := indexes.Acquire()
+		defer release()
+
+		// An email never changes while the index is loaded, so browsers
+		// only need to check that it is the same index
+		etag := fmt.Sprintf(`"%s-%d"`, idx.Fingerprint(), highlights.FilenameIndex)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(req.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		content, filename, err := idx.ReadContent(req.Context(), highlights.FilenameIndex)
+		switch {
+		case req.Context().Err() != nil:
+			return // The client has gone
+		case errors.Is(err, emailsearch.ErrNotFound):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		case err != nil:
+			s.logger.Printf("Failed to read content for file index %d - %s\n", highlights.FilenameIndex, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 		s.logger.Printf("retrieveEmail %q", filename)
 
-		hc := highlightContent(content, highlights.Highlights)
+		meta, _ := idx.Metadata(highlights.FilenameIndex)
+		parts, attachments := renderParts(content, meta, highlights.Highlights)
 		data := struct {
-			Contents   template.HTML
-			Filename   string
-			NumMatches int
-		}{template.HTML(string(hc)), filename, len(highlights.Highlights)}
+			emailsearch.DocumentMetadata
+			Parts       []emailPart
+			Attachments []emailPart
+			Filename    string
+			NumMatches  int
+		}{meta, parts, attachments, filename, len(highlights.Highlights)}
 		if err := emailTmpl.Execute(w, data); err != nil {
 			s.logger.Printf("Error rendering template %s\n", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -195,6 +634,18 @@ func (s *Server) retrieveEmail() http.HandlerFunc {
 	}
 }
 
+// etagMatches returns whether an If-None-Match header matches etag. Weak
+// validators match too, as If-None-Match uses the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) queryPrefix() http.HandlerFunc {
 	type queryResults struct {
 		Matches []string `json:"matches"`
@@ -210,7 +661,10 @@ func (s *Server) queryPrefix() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 		if ok && len(query) >= 1 && len(query[0]) >= 3 {
-			res.Matches = s.Index.Prefix(query[0], 15)
+			indexes, _ := s.index(req)
+			idx, release := indexes.Acquire()
+			res.Matches = idx.Prefix(query[0], 15)
+			release()
 		}
 		if err := enc.Encode(&res); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -219,18 +673,246 @@ func (s *Server) queryPrefix() http.HandlerFunc {
 	}
 }
 
+// reloadIndex reloads the index from where it was loaded, so a rebuilt
+// index goes live without restarting the server. It responds once the old
+// index has been closed.
+func (s *Server) reloadIndex() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		indexes, _ := s.index(req)
+		if err := indexes.Reload(""); err != nil {
+			s.logger.Printf("Failed to reload index: %s", err)
+			http.Error(w, fmt.Sprintf("Failed to reload index: %s", err), http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("Reloaded index")
+		w.Write([]byte("Reloaded index\n"))
+	}
+}
+
+// recentSearches responds with the recent searches of the browser session,
+// most recent first.
+func (s *Server) recentSearches() http.HandlerFunc {
+	type recent struct {
+		Searches []string `json:"searches"`
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		res := recent{Searches: []string{}}
+		if s.Recent != nil {
+			if c, err := req.Cookie(sessionCookie); err == nil {
+				res.Searches = append(res.Searches, s.Recent.get(c.Value)...)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
 func (s *Server) serveRoot() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		escQuery := req.URL.Query().Get("q")
 		query, _ := url.QueryUnescape(escQuery)
+		page, limit, err := parsePage(req.URL.Query())
+		if err != nil {
+			page, limit = 1, maxResults
+		}
 
+		_, base := s.index(req)
 		data := struct {
-			Query string
-		}{query}
+			Base        string
+			Query       string
+			Page, Limit int
+			Indexes     []string // Names of the other indexes
+		}{base, query, page, limit, s.indexNames()}
 		indexTmpl.Execute(w, data)
 	}
 }
 
+// parsePage returns the page of results asked for by the page and limit
+// parameters, which default to the first page of maxResults results. Pages
+// are numbered from 1.
+func parsePage(qvals url.Values) (page, limit int, err error) {
+	page, limit = 1, maxResults
+	if v := qvals.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("invalid page %q", v)
+		}
+	}
+	if v := qvals.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid limit %q, it must be between 1 and %d", v, maxPageSize)
+		}
+	}
+	return page, limit, nil
+}
+
+// pagination is the position of a page of results, for navigating between
+// pages. Prev and Next are 0 if there is no such page.
+type pagination struct {
+	Page, Limit int
+	First, Last int // Positions of the results on the page, counting from 1
+	Prev, Next  int
+}
+
+func newPagination(page, limit, numResults, numShown int) pagination {
+	p := pagination{Page: page, Limit: limit}
+	if numShown > 0 {
+		p.First = (page-1)*limit + 1
+		p.Last = p.First + numShown - 1
+	}
+	if page > 1 {
+		// Going back from past the end lands on the last page
+		p.Prev = min(page-1, (numResults+limit-1)/limit)
+	}
+	if page*limit < numResults {
+		p.Next = page + 1
+	}
+	return p
+}
+
+// requireAdmin only passes on requests that carry the AdminToken as a
+// bearer token. The admin endpoints don't exist if there is no token.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.AdminToken == "" {
+			http.NotFound(w, req)
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// requireAPIKey only passes on requests to the JSON API that carry one of
+// the APIKeys or come from an allowed client.
+func (s *Server) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(s.APIKeys) > 0 && !s.hasAPIKey(req) && !s.allowed(req) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// requireAllowed only passes on requests to the HTML interface from allowed
+// clients or that carry one of the APIKeys.
+func (s *Server) requireAllowed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.restricted() && !s.allowed(req) && !s.hasAPIKey(req) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// hasAPIKey returns whether the request carries one of the APIKeys.
+func (s *Server) hasAPIKey(req *http.Request) bool {
+	key := req.Header.Get("X-API-Key")
+	if key == "" {
+		key = req.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		return false
+	}
+	found := 0
+	for _, k := range s.APIKeys {
+		// Compare against every key so the time taken doesn't tell which
+		found |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return found == 1
+}
+
+// restricted returns whether the HTML interface is restricted to allowed
+// clients.
+func (s *Server) restricted() bool {
+	return len(s.Allow) > 0 || s.AllowSocket
+}
+
+// allowed returns whether the request comes from a client in one of the
+// Allow networks, or over the socket if AllowSocket is set.
+func (s *Server) allowed(req *http.Request) bool {
+	if req.Context().Value(socketConnKey{}) != nil {
+		return s.AllowSocket
+	}
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	for _, p := range s.Allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowList parses a comma separated list of IP addresses and CIDR
+// networks, e.g. "10.0.0.0/8,192.168.1.20".
+func parseAllowList(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or network %q", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// namedIndex is an index to serve under /index/{Name}/.
+type namedIndex struct {
+	Name, Path string
+}
+
+// parseIndexList parses a comma separated list of name=path indexes. Names
+// are used in URLs so are limited to letters, digits, '-', '_' and '.'.
+func parseIndexList(list string) ([]namedIndex, error) {
+	var indexes []namedIndex
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(s, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("%q is not name=path", s)
+		}
+		if strings.Trim(name, ".") == "" || strings.ContainsFunc(name, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+		}) {
+			return nil, fmt.Errorf("invalid index name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("index %q given twice", name)
+		}
+		seen[name] = true
+		indexes = append(indexes, namedIndex{name, path})
+	}
+	return indexes, nil
+}
+
 // Request logging middleware
 func (s *Server) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -266,28 +948,104 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
-// Encode the search result and all match locations into []byte
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// Encode the search result and all match locations into []byte. Only matches
+// in the message body can be highlighted.
 func generateEmailURL(result emailsearch.QueryResults) []byte {
+	var body []emailsearch.QueryWordMatch
+	for _, match := range result.WordMatches {
+		if match.Field == emailsearch.Field_Body {
+			body = append(body, match)
+		}
+	}
+
 	blob := make([]byte, 0, 256)
 	blob = binary.AppendUvarint(blob, uint64(result.FilenameIndex))
-	blob = binary.AppendUvarint(blob, uint64(len(result.WordMatches)))
-	for _, match := range result.WordMatches {
+	blob = binary.AppendUvarint(blob, uint64(len(body)))
+	for _, match := range body {
 		blob = binary.AppendUvarint(blob, uint64(match.Offset))
-		blob = binary.AppendUvarint(blob, uint64(len(match.Word)))
+		blob = binary.AppendUvarint(blob, uint64(match.Length))
 	}
 
 	return blob
 }
 
+// emailPart is a part of an email ready to show, either text or an attachment.
+type emailPart struct {
+	Contents template.HTML // Text with the matches highlighted
+	Headers  bool          // Contents are the headers of an embedded email
+
+	Filename, ContentType string // Of an attachment
+	Size                  int
+}
+
+// renderParts takes content, the body of an email, apart into the text to
+// show and the attachments. Matches can only be highlighted in text that
+// isn't transfer encoded, as the highlights are offsets into the body.
+func renderParts(content []byte, meta emailsearch.DocumentMetadata, highlights []matchHighlight) (parts, attachments []emailPart) {
+	for _, p := range emailsearch.BodyParts(meta, content) {
+		if p.Attachment {
+			a := emailPart{Filename: p.Filename, ContentType: p.ContentType, Size: p.Length}
+			if data, err := p.Decode(content); err == nil {
+				a.Size = len(data)
+			}
+			attachments = append(attachments, a)
+			continue
+		}
+
+		part := emailPart{Headers: p.ContentType == emailsearch.RFC822HeadersType}
+		switch p.Encoding {
+		case "", "7bit", "8bit", "binary":
+			var inPart []matchHighlight
+			for _, h := range highlights {
+				if h.Offset >= p.Offset && h.Length >= 0 && h.Length <= p.Offset+p.Length-h.Offset {
+					inPart = append(inPart, matchHighlight{h.Offset - p.Offset, h.Length})
+				}
+			}
+			part.Contents = template.HTML(highlightContent(content[p.Offset:p.Offset+p.Length], inPart))
+		default:
+			data, err := p.Decode(content)
+			if err != nil {
+				data = content[p.Offset : p.Offset+p.Length]
+			}
+			part.Contents = template.HTML(highlightContent(data, nil))
+		}
+		parts = append(parts, part)
+	}
+	return parts, attachments
+}
+
 const (
-	openMarkTag  = `<mark class="matchhighlight">`
+	openMarkTag  = "<mark>"
 	closeMarkTag = "</mark>"
 )
 
+// highlightContent returns content as HTML with the highlights marked.
+// Content comes from untrusted emails, so all of it is escaped and the only
+// markup in the result are the <mark> tags. The result is safe to use as
+// template.HTML.
 func highlightContent(content []byte, highlights []matchHighlight) []byte {
-	if len(highlights) == 0 {
-		return content
+	// Highlights can overlap, a date also contains the words it is made of,
+	// so merge them. Drop any that are out of range.
+	highlights = slices.Clone(highlights)
+	slices.SortFunc(highlights, func(a, b matchHighlight) int { return a.Offset - b.Offset })
+	merged := highlights[:0]
+	for _, h := range highlights {
+		// Highlights come from the URL, check them without overflowing
+		if h.Offset < 0 || h.Offset > len(content) || h.Length < 0 || h.Length > len(content)-h.Offset {
+			continue
+		}
+		if n := len(merged); n > 0 && h.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			last := &merged[n-1]
+			last.Length = max(last.Length, h.Offset+h.Length-last.Offset)
+			continue
+		}
+		merged = append(merged, h)
 	}
+	highlights = merged
 
 	totalSize := len(content) + (len(openMarkTag)+len(closeMarkTag))*len(highlights)
 
@@ -296,14 +1054,14 @@ func highlightContent(content []byte, highlights []matchHighlight) []byte {
 
 	lastPos := 0
 	for _, h := range highlights {
-		buf.Write(content[lastPos:h.Offset])
+		template.HTMLEscape(&buf, content[lastPos:h.Offset])
 		buf.WriteString(openMarkTag)
-		buf.Write(content[h.Offset : h.Offset+h.Length])
+		template.HTMLEscape(&buf, content[h.Offset:h.Offset+h.Length])
 		buf.WriteString(closeMarkTag)
 
 		lastPos = h.Offset + h.Length
 	}
-	buf.Write(content[lastPos:])
+	template.HTMLEscape(&buf, content[lastPos:])
 
 	return buf.Bytes()
 }
@@ -1,9 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/chriskillpack/emailsearch"
 )
 
 func TestHighlightContent(t *testing.T) {
@@ -17,6 +33,12 @@ func TestHighlightContent(t *testing.T) {
 		{"Two highlights", "Hello world under world", []matchHighlight{{6, 5}, {18, 5}}, "Hello <mark>world</mark> under <mark>world</mark>"},
 		{"Midword", "Helloworld", []matchHighlight{{5, 5}}, "Hello<mark>world</mark>"},
 		{"After last", "Hello world this is a fine day", []matchHighlight{{6, 5}}, "Hello <mark>world</mark> this is a fine day"},
+		{"Overlapping", "Met on Jan 3 2001 at noon", []matchHighlight{{7, 10}, {7, 3}}, "Met on " + openMarkTag + "Jan 3 2001</mark> at noon"},
+		{"Unordered", "Hello world", []matchHighlight{{6, 5}, {0, 5}}, openMarkTag + "Hello</mark> " + openMarkTag + "world</mark>"},
+		{"Out of range", "Hello world", []matchHighlight{{6, 50}}, "Hello world"},
+		{"Overflowing", "Hello world", []matchHighlight{{6, math.MaxInt}, {math.MaxInt, 1}, {6, math.MinInt}}, "Hello world"},
+		{"Escaped", "<b>Hello</b> & world", []matchHighlight{{3, 5}}, "&lt;b&gt;" + openMarkTag + "Hello</mark>&lt;/b&gt; &amp; world"},
+		{"No highlights", "a < b", nil, "a &lt; b"},
 	}
 
 	for _, tc := range cases {
@@ -29,6 +51,18 @@ func TestHighlightContent(t *testing.T) {
 	}
 }
 
+func TestRenderPartsOverflow(t *testing.T) {
+	// Highlights are decoded from the URL and can be anything
+	highlights := []matchHighlight{{6, math.MaxInt}, {math.MaxInt, math.MaxInt}, {0, 5}}
+	parts, _ := renderParts([]byte("Hello world"), emailsearch.DocumentMetadata{}, highlights)
+	if len(parts) != 1 {
+		t.Fatalf("Expected 1 part, got %d", len(parts))
+	}
+	if want := openMarkTag + "Hello</mark> world"; string(parts[0].Contents) != want {
+		t.Errorf("Expected %q, got %q", want, parts[0].Contents)
+	}
+}
+
 func createTestData(filenameIdx int, highlights []matchHighlight) []byte {
 	buf := make([]byte, 0, 64)
 
@@ -118,3 +152,484 @@ func TestDecodeEmailURL(t *testing.T) {
 		})
 	}
 }
+
+func TestResultsSyntaxError(t *testing.T) {
+	data := struct {
+		Query string
+		Error string
+	}{"(budget", `missing ")" to close "(" at column 1`}
+
+	var sb strings.Builder
+	if err := resultsPartialTmpl.Execute(&sb, data); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "could not be understood: missing &#34;)&#34; to close") {
+		t.Errorf("expected the error in the output, got %q", sb.String())
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	cases := []struct {
+		Query       string
+		Page, Limit int
+		WantErr     bool
+	}{
+		{"", 1, maxResults, false},
+		{"page=3", 3, maxResults, false},
+		{"page=2&limit=25", 2, 25, false},
+		{"page=0", 0, 0, true},
+		{"page=two", 0, 0, true},
+		{"limit=0", 0, 0, true},
+		{"limit=1000", 0, 0, true},
+	}
+
+	for _, tc := range cases {
+		qvals, _ := url.ParseQuery(tc.Query)
+		page, limit, err := parsePage(qvals)
+		if (err != nil) != tc.WantErr || page != tc.Page || limit != tc.Limit {
+			t.Errorf("%q: got page %d, limit %d (%v)", tc.Query, page, limit, err)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	cases := []struct {
+		Page, Limit, NumResults, NumShown int
+		Expected                          pagination
+	}{
+		{1, 10, 5, 5, pagination{Page: 1, Limit: 10, First: 1, Last: 5}},
+		{1, 10, 25, 10, pagination{Page: 1, Limit: 10, First: 1, Last: 10, Next: 2}},
+		{2, 10, 25, 10, pagination{Page: 2, Limit: 10, First: 11, Last: 20, Prev: 1, Next: 3}},
+		{3, 10, 25, 5, pagination{Page: 3, Limit: 10, First: 21, Last: 25, Prev: 2}},
+		{9, 10, 25, 0, pagination{Page: 9, Limit: 10, Prev: 3}},
+	}
+
+	for _, tc := range cases {
+		if got := newPagination(tc.Page, tc.Limit, tc.NumResults, tc.NumShown); got != tc.Expected {
+			t.Errorf("page %d of %d results: expected %+v, got %+v", tc.Page, tc.NumResults, tc.Expected, got)
+		}
+	}
+
+	data := resultsPage{Query: "budget forecast", NumResults: 25, Results: make([]searchResult, 10), Pages: newPagination(2, 10, 25, 10)}
+	var sb strings.Builder
+	if err := resultsPartialTmpl.Execute(&sb, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Showing results 11 to 20", `href="/?q=budget%20forecast&page=1&limit=10"`, `href="/?q=budget%20forecast&page=3&limit=10"`} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("expected %s in the output", want)
+		}
+	}
+}
+
+// writeTestBundle indexes emails, a map of filename to contents, into a
+// bundle at path.
+func writeTestBundle(t *testing.T, path string, emails map[string]string) {
+	t.Helper()
+
+	corpus := t.TempDir()
+	var names []string
+	for name, content := range emails {
+		if err := os.WriteFile(filepath.Join(corpus, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	ib := &emailsearch.IndexBuilder{InputPath: corpus, NThreads: 1}
+	ib.Init()
+	if err := ib.InjestFiles(names, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.SerializeBundle(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServer returns a server for an index of emails, along with the
+// path of the index.
+func newTestServer(t *testing.T, emails map[string]string) (*Server, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "index.bundle")
+	writeTestBundle(t, path, emails)
+	idx, err := emailsearch.LoadIndexFromDisk(path, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := emailsearch.NewIndexWatcher(path, idx)
+	t.Cleanup(func() { indexes.Close() })
+	srv := NewServer(indexes, "0")
+	srv.logger = log.New(io.Discard, "", 0)
+	return srv, path
+}
+
+func TestAdminReload(t *testing.T) {
+	srv, path := newTestServer(t, map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"})
+	handler := srv.serveHandler()
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("POST", "/admin/reload", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the endpoint to be disabled without a token, got %d", rec.Code)
+	}
+	srv.AdminToken = "secret"
+	for _, token := range []string{"", "wrong"} {
+		if rec := do("POST", "/admin/reload", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected to be refused, got %d", token, rec.Code)
+		}
+	}
+
+	writeTestBundle(t, path, map[string]string{"2": "Subject: two\n\nDinner on Saturday.\n"})
+	if rec := do("POST", "/admin/reload", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the index to reload, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("GET", "/search?q=dinner", ""); !strings.Contains(rec.Body.String(), "across 1 documents") {
+		t.Errorf("expected the reloaded index to be searched, got %q", rec.Body)
+	}
+}
+
+func TestNamedIndexes(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"})
+	other, _ := newTestServer(t, map[string]string{"2": "Subject: two\n\nDinner on Saturday.\n"})
+	srv.AddIndex("2002", other.Indexes)
+	handler := srv.serveHandler()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	if rec := get("/search?q=dinner"); !strings.Contains(rec.Body.String(), "across 0 documents") {
+		t.Errorf("expected the default index to be searched, got %q", rec.Body)
+	}
+	rec := get("/index/2002/search?q=dinner")
+	if !strings.Contains(rec.Body.String(), "across 1 documents") {
+		t.Fatalf("expected the named index to be searched, got %q", rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `href="/index/2002/email/`) {
+		t.Errorf("expected links to stay within the named index, got %q", rec.Body)
+	}
+	if rec := get("/index/2002/prefix?q=din"); !strings.Contains(rec.Body.String(), "dinner") {
+		t.Errorf("expected the named index's words, got %q", rec.Body)
+	}
+	if rec := get("/index/2002/"); !strings.Contains(rec.Body.String(), `data-base="/index/2002"`) {
+		t.Errorf("expected the landing page to search the named index, got %q", rec.Body)
+	}
+	if rec := get("/"); !strings.Contains(rec.Body.String(), `href="/index/2002/"`) {
+		t.Errorf("expected the landing page to list the indexes, got %q", rec.Body)
+	}
+	if rec := get("/index/2003/search?q=dinner"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown index to be not found, got %d", rec.Code)
+	}
+}
+
+func TestParseIndexList(t *testing.T) {
+	indexes, err := parseIndexList("2001=out/2001, lay.k=s3://bucket/lay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []namedIndex{{"2001", "out/2001"}, {"lay.k", "s3://bucket/lay"}}; !slices.Equal(indexes, want) {
+		t.Errorf("expected %v, got %v", want, indexes)
+	}
+	for _, list := range []string{"out/2001", "=out", "a/b=out", "..=out", "a=x,a=y"} {
+		if _, err := parseIndexList(list); err == nil {
+			t.Errorf("%q: expected an error", list)
+		}
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"})
+	srv.APIKeys = []string{"key1", "key2"}
+	var err error
+	if srv.Allow, err = parseAllowList("10.0.0.0/8, 192.168.1.20"); err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.serveHandler()
+
+	cases := []struct {
+		Name, Target, RemoteAddr, Header string
+		Expected                         int
+	}{
+		{"API without key", "/prefix?q=lun", "203.0.113.1:1234", "", http.StatusUnauthorized},
+		{"API with wrong key", "/prefix?q=lun", "203.0.113.1:1234", "key3", http.StatusUnauthorized},
+		{"API with header key", "/prefix?q=lun", "203.0.113.1:1234", "key2", http.StatusOK},
+		{"API with parameter key", "/prefix?q=lun&api_key=key1", "203.0.113.1:1234", "", http.StatusOK},
+		{"API from allowed client", "/prefix?q=lun", "10.1.2.3:1234", "", http.StatusOK},
+		{"Recent without key", "/recent", "203.0.113.1:1234", "", http.StatusUnauthorized},
+		{"Recent with key", "/recent", "203.0.113.1:1234", "key1", http.StatusOK},
+		{"Recent from allowed client", "/recent", "10.1.2.3:1234", "", http.StatusOK},
+		{"UI from other client", "/search?q=lunch", "192.168.1.21:1234", "", http.StatusForbidden},
+		{"UI from allowed address", "/search?q=lunch", "192.168.1.20:1234", "", http.StatusOK},
+		{"UI from allowed network", "/", "[::ffff:10.9.9.9]:1234", "", http.StatusOK},
+		{"UI with key", "/search?q=lunch", "203.0.113.1:1234", "key1", http.StatusOK},
+		{"Static files", "/static/page.js", "203.0.113.1:1234", "", http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.Target, nil)
+		req.RemoteAddr = tc.RemoteAddr
+		if tc.Header != "" {
+			req.Header.Set("X-API-Key", tc.Header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.Expected {
+			t.Errorf("%s: expected %d, got %d", tc.Name, tc.Expected, rec.Code)
+		}
+	}
+
+	if _, err := parseAllowList("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid network to fail to parse")
+	}
+
+	// Keys without an allow list would leave the search page open and its
+	// autocomplete broken
+	srv.Allow = nil
+	if err := srv.Start(); err != ErrAPIKeysWithoutAllow {
+		t.Errorf("expected the server to refuse to start, got %v", err)
+	}
+}
+
+func TestSearchSnippets(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{
+		"1": "Subject: one\n\nThe <b>quarterly</b> budget is attached, please review it before Friday.\n",
+	})
+
+	rec := httptest.NewRecorder()
+	srv.serveHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/search?q=budget", nil))
+	want := "The &lt;b&gt;quarterly&lt;/b&gt; " + openMarkTag + "budget</mark> is attached"
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected the highlighted snippet %q, got %q", want, rec.Body)
+	}
+}
+
+func TestSearchStream(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{
+		"1": "Subject: one\revent: injected\n\nThe budget.\n",
+		"2": "Subject: two\n\nThe budget and the budget forecast.\n",
+		"3": "Subject: three\n\nThe budget forecast.\n",
+	})
+	handler := srv.serveHandler()
+	stream := func(target string) (*httptest.ResponseRecorder, []string) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var events []string
+		for line := range strings.Lines(rec.Body.String()) {
+			if event, ok := strings.CutPrefix(line, "event: "); ok {
+				events = append(events, strings.TrimSpace(event))
+			}
+		}
+		return rec, events
+	}
+
+	rec, events := stream("/search/stream?q=budget&limit=2")
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected an uncompressed event stream, got %q", ct)
+	}
+	if want := []string{"summary", "result", "result", "pages"}; !slices.Equal(events, want) {
+		t.Errorf("expected events %v, got %v", want, events)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"across 3 documents", "Showing results 1 to 2", `href="/email/`, `page=2&limit=2">Next`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in the stream, got %q", want, body)
+		}
+	}
+	if strings.Contains(body, "\r") {
+		t.Errorf("expected the CR in a subject not to reach the stream, got %q", body)
+	}
+	for line := range strings.Lines(body) {
+		if line != "\n" && !strings.HasPrefix(line, "event: ") && !strings.HasPrefix(line, "data:") {
+			t.Errorf("unexpected line %q in the stream", line)
+		}
+	}
+
+	if _, events := stream("/search/stream?q=(budget"); !slices.Equal(events, []string{"error"}) {
+		t.Errorf("expected an error event for an invalid query, got %v", events)
+	}
+	if rec, _ := stream("/search/stream?q=budget&page=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad page to be refused, got %d", rec.Code)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var sb strings.Builder
+	if err := writeEvent(&sb, "result", "Budget\revent: injected\r\ndata: x\nend"); err != nil {
+		t.Fatal(err)
+	}
+	want := "event: result\ndata: Budget\ndata: event: injected\ndata: data: x\ndata: end\n\n"
+	if got := sb.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestRetrieveEmail(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{
+		"1": "From: lay@enron.com\nTo: skilling@enron.com\nSubject: Budget\n" +
+			"Content-Type: multipart/mixed; boundary=b1\n\n" +
+			"--b1\nContent-Type: text/plain\n\nThe budget <draft> is attached.\n" +
+			"--b1\nContent-Type: application/pdf\nContent-Disposition: attachment; filename=budget.pdf\nContent-Transfer-Encoding: base64\n\nJVBERi0xLjQK\n" +
+			"--b1--\n",
+	})
+	idx, release := srv.Indexes.Acquire()
+	res, err := idx.SearchTop(t.Context(), emailsearch.Term("budget"), 1)
+	release()
+	if err != nil || len(res.Results) != 1 {
+		t.Fatalf("expected a result, got %v (%v)", res.Results, err)
+	}
+
+	rec := httptest.NewRecorder()
+	target := "/email/" + base64.URLEncoding.EncodeToString(generateEmailURL(res.Results[0]))
+	srv.serveHandler().ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<th>To</th><td>skilling@enron.com</td>",
+		"<p>The " + openMarkTag + "budget</mark> &lt;draft&gt; is attached.</p>",
+		"budget.pdf <span class=\"text-gray-400\">&middot; application/pdf &middot; 9 bytes</span>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the page, got %q", want, body)
+		}
+	}
+	if strings.Contains(body, "--b1") || strings.Contains(body, "JVBERi0x") {
+		t.Errorf("expected the MIME structure to be hidden, got %q", body)
+	}
+
+	// The email is only sent again if the index has changed
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+	for _, tc := range []struct {
+		IfNoneMatch string
+		Expected    int
+	}{
+		{etag, http.StatusNotModified},
+		{`"other", W/` + etag, http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("If-None-Match", tc.IfNoneMatch)
+		rec = httptest.NewRecorder()
+		srv.serveHandler().ServeHTTP(rec, req)
+		if rec.Code != tc.Expected {
+			t.Errorf("If-None-Match %s: expected %d, got %d", tc.IfNoneMatch, tc.Expected, rec.Code)
+		}
+	}
+
+	// An email that isn't in the index is not found
+	missing := res.Results[0]
+	missing.FilenameIndex = 5
+	rec = httptest.NewRecorder()
+	srv.serveHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/email/"+base64.URLEncoding.EncodeToString(generateEmailURL(missing)), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a missing email, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestUntrustedContent(t *testing.T) {
+	// Nothing in an email can add markup to the pages that show it
+	srv, _ := newTestServer(t, map[string]string{
+		"1": "From: <script>alert(1)</script>\nSubject: budget <script>alert(2)</script>\n" +
+			"Content-Type: multipart/mixed; boundary=b1\n\n" +
+			"--b1\nContent-Type: text/html\n\n<p onclick=\"alert(3)\">The budget</p><script>alert(4)</script>\n" +
+			"--b1\nContent-Type: text/html\nContent-Transfer-Encoding: quoted-printable\n\nThe budget <img src=3Dx onerror=3Dalert(5)>\n" +
+			"--b1\nContent-Type: message/rfc822\n\nSubject: <iframe src=x>\n\nThe embedded budget.\n" +
+			"--b1\nContent-Type: text/html\nContent-Disposition: attachment; filename=\"<svg onload=alert(6)>.html\"\n\n<script>alert(7)</script>\n" +
+			"--b1--\n",
+	})
+	idx, release := srv.Indexes.Acquire()
+	res, err := idx.SearchTop(t.Context(), emailsearch.Term("budget"), 1)
+	release()
+	if err != nil || len(res.Results) != 1 {
+		t.Fatalf("expected a result, got %v (%v)", res.Results, err)
+	}
+
+	handler := srv.serveHandler()
+	for _, target := range []string{
+		"/search?q=budget",
+		"/search/stream?q=budget",
+		"/email/" + base64.URLEncoding.EncodeToString(generateEmailURL(res.Results[0])),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		body := rec.Body.String()
+		if !strings.Contains(body, "alert(") {
+			t.Errorf("%s: expected the email in the page, got %q", target, body)
+		}
+		for _, tag := range []string{"<script", "<p onclick", "<img", "<iframe", "<svg onload"} {
+			if strings.Contains(body, tag) {
+				t.Errorf("%s: expected %s from the email to be escaped, got %q", target, tag, body)
+			}
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"})
+	dir, err := os.MkdirTemp("", "search") // t.TempDir can be too long for a socket path
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv.SocketPath = filepath.Join(dir, "search.sock")
+	srv.Allow = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	srv.AllowSocket = true
+
+	// A socket left behind is replaced
+	if l, err := net.Listen("unix", srv.SocketPath); err != nil {
+		t.Fatal(err)
+	} else {
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	done := make(chan error)
+	go func() { done <- srv.Start() }()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", srv.SocketPath)
+		},
+	}}
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if resp, err = client.Get("http://search/search?q=lunch"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "across 1 documents") {
+		t.Errorf("unexpected response %q", body)
+	}
+
+	// Clients of the socket have no address to match against Allow
+	srv.AllowSocket = false
+	if resp, err = client.Get("http://search/search?q=lunch"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected %d without AllowSocket, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	srv.Shutdown(t.Context())
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("expected the server to close, got %v", err)
+	}
+	if _, err := os.Stat(srv.SocketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -35,8 +35,12 @@ class RequestManager {
     }
 }
 
+// The path the pages of the index being searched are under
+const basePath = document.body.dataset.base;
+
 // Get DOM elements
 const searchInput = document.getElementById('searchInput');
+const searchButton = document.getElementById('searchButton');
 const resultsContainer = document.getElementById('resultsContainer');
 const requestManager = new RequestManager();
 const suggestionsDropDown = document.getElementById('suggestionsDropdown');
@@ -49,7 +53,7 @@ searchInput.addEventListener('input', async (event) => {
         const text = event.target.value;
         if (text.length >= 3) {
             const data = await requestManager.makeRequest(
-                `/prefix?q=${text}`,
+                `${basePath}/prefix?q=${text}`,
                 {
                     method: 'GET',
                     headers: {
@@ -106,6 +110,8 @@ function handleSearch() {
     runQuery(searchInput.value.trim());
 }
 
+searchButton.addEventListener('click', handleSearch);
+
 function clearSuggestions() {
     updateSuggestions([]);
 }
@@ -130,9 +136,22 @@ function updateHighlight() {
     }
 }
 
-function runQuery(query) {
+let currentStream = null;
+
+function runQuery(query, page = 1, limit = 0) {
     if (query) {
-        fetch(`/search?q=${encodeURIComponent(query)}`)
+        const params = new URLSearchParams({q: query});
+        if (page > 1) {
+            params.set('page', page);
+        }
+        if (limit > 0) {
+            params.set('limit', limit);
+        }
+        if (window.EventSource) {
+            streamQuery(params);
+            return;
+        }
+        fetch(`${basePath}/search?${params}`)
         .then((response) => {
             if (!response.ok) {
                 throw new Error(`HTTP error! status: ${response.status}`);
@@ -144,6 +163,79 @@ function runQuery(query) {
     }
 }
 
+// Show the results as the server ranks them, rather than waiting for all of
+// them
+function streamQuery(params) {
+    if (currentStream) {
+        currentStream.close();
+    }
+    const stream = new EventSource(`${basePath}/search/stream?${params}`);
+    currentStream = stream;
+
+    const results = document.createElement('div');
+    const finish = () => {
+        stream.close();
+        if (currentStream === stream) {
+            currentStream = null;
+        }
+    };
+    stream.addEventListener('summary', (event) => {
+        resultsContainer.innerHTML = event.data;
+        resultsContainer.appendChild(results);
+    });
+    stream.addEventListener('result', (event) => {
+        results.insertAdjacentHTML('beforeend', event.data);
+    });
+    stream.addEventListener('pages', (event) => {
+        resultsContainer.insertAdjacentHTML('beforeend', event.data);
+        finish();
+    });
+    stream.addEventListener('error', (event) => {
+        // Sent for an invalid query, or by the browser if the connection fails
+        if (event.data) {
+            resultsContainer.innerHTML = event.data;
+        } else {
+            console.error('Error streaming search results');
+        }
+        finish();
+    });
+    stream.addEventListener('failed', (event) => {
+        console.error(`Search failed with status ${event.data}`);
+        finish();
+    });
+}
+
+async function showRecentSearches() {
+    try {
+        const response = await fetch(`${basePath}/recent`);
+        if (!response.ok) {
+            throw new Error(`HTTP error! status: ${response.status}`);
+        }
+        const data = await response.json();
+        if (data.searches.length === 0 || searchInput.value) {
+            return;
+        }
+
+        const heading = document.createElement('div');
+        heading.textContent = 'Recent searches';
+        heading.className = 'text-sm text-gray-400 py-2';
+        const list = document.createElement('ul');
+        data.searches.forEach((search) => {
+            const a = document.createElement('a');
+            a.textContent = search;
+            a.href = `${basePath}/?q=${encodeURIComponent(search)}`;
+            a.className = 'hover:underline';
+            const li = document.createElement('li');
+            li.className = 'py-1';
+            li.appendChild(a);
+            list.appendChild(li);
+        });
+        resultsContainer.replaceChildren(heading, list);
+    } catch (error) {
+        console.error('Error fetching recent searches: ', error);
+    }
+}
+
 function updateSuggestions(suggestions) {
     suggestionsList.innerHTML = '';
 
@@ -166,4 +258,12 @@ function updateSuggestions(suggestions) {
     suggestionsDropDown.classList.remove('hidden');
 
     currentSuggestionIndex = -1;
-}
\ No newline at end of file
+}
+
+// Run the search the page was loaded for, if any
+if (document.body.dataset.query) {
+    searchInput.value = document.body.dataset.query;
+    runQuery(document.body.dataset.query, Number(document.body.dataset.page), Number(document.body.dataset.limit));
+} else {
+    showRecentSearches();
+}
@@ -0,0 +1,221 @@
+package emailsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression used for the email content stored in the catalog.
+type Codec uint8
+
+const (
+	Codec_Gzip Codec = iota
+	Codec_Zstd
+	Codec_None
+
+	numCodecs = iota
+)
+
+var codecNames = [numCodecs]string{"gzip", "zstd", "none"}
+
+func (c Codec) String() string {
+	if int(c) < len(codecNames) {
+		return codecNames[c]
+	}
+	return fmt.Sprintf("Codec(%d)", c)
+}
+
+// ParseCodec returns the Codec with the given name, e.g. "zstd". Names are
+// case insensitive.
+func ParseCodec(name string) (Codec, error) {
+	for i, n := range codecNames {
+		if strings.EqualFold(n, name) {
+			return Codec(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// The compressors and the buffers they compress into are pooled, building
+// a large index compresses every email and a gzip.Writer alone allocates
+// hundreds of kilobytes of state.
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zstdWriters = sync.Pool{New: func() any {
+		zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)) // Only fails for bad options
+		return zw
+	}}
+	compressBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// maxPooledBuffer is the largest capacity of a compress buffer that is put
+// back in the pool. The buffer of a larger email is dropped, rather than
+// held at that size for the life of the process.
+const maxPooledBuffer = 1 << 20
+
+// compress returns content compressed with codec.
+func compress(content []byte, codec Codec) ([]byte, error) {
+	buf := compressBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			compressBuffers.Put(buf)
+		}
+	}()
+	buf.Reset()
+
+	var (
+		cw      io.WriteCloser
+		release func()
+	)
+	switch codec {
+	case Codec_Gzip:
+		zw := gzipWriters.Get().(*gzip.Writer)
+		zw.Reset(buf)
+		cw, release = zw, func() { zw.Reset(nil); gzipWriters.Put(zw) }
+	case Codec_Zstd:
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(buf)
+		cw, release = zw, func() { zw.Reset(nil); zstdWriters.Put(zw) }
+	case Codec_None:
+		return bytes.Clone(content), nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %v", codec)
+	}
+	if _, err := cw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	// A writer that failed may be left in any state, only one that closed
+	// cleanly goes back in the pool, without a reference to the buffer
+	release()
+
+	// Copy out of the pooled buffer, the copy is kept until the index is
+	// serialized
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// The decompressors are pooled like the compressors, every search result
+// shown decompresses an email. A gzip.Reader can only be created from a
+// valid stream, so the pool starts empty.
+var (
+	gzipReaders sync.Pool
+	zstdReaders = sync.Pool{New: func() any {
+		zr, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)) // Only fails for bad options
+		return zr
+	}}
+)
+
+// newDecompressor returns a reader that decompresses content compressed with
+// codec from r. It must be closed after use, which returns the decompressor
+// to its pool.
+func newDecompressor(r io.Reader, codec Codec) (io.ReadCloser, error) {
+	switch codec {
+	case Codec_Gzip:
+		zr, _ := gzipReaders.Get().(*gzip.Reader)
+		if zr == nil {
+			var err error
+			if zr, err = gzip.NewReader(r); err != nil {
+				return nil, err
+			}
+		} else if err := zr.Reset(r); err != nil {
+			gzipReaders.Put(zr)
+			return nil, err
+		}
+		return &gzipReadCloser{zr}, nil
+	case Codec_Zstd:
+		zr := zstdReaders.Get().(*zstd.Decoder)
+		if err := zr.Reset(r); err != nil {
+			zstdReaders.Put(zr)
+			return nil, err
+		}
+		return &zstdReadCloser{zr}, nil
+	case Codec_None:
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unsupported codec %v", codec)
+}
+
+// decompress decompresses src, compressed with codec, into dst, which must
+// be the length of the content.
+func decompress(dst, src []byte, codec Codec) error {
+	if codec == Codec_Zstd {
+		// Decode in one go rather than streaming through the decoder's buffers
+		zr := zstdReaders.Get().(*zstd.Decoder)
+		defer zstdReaders.Put(zr)
+		out, err := zr.DecodeAll(src, dst[:0])
+		if err != nil {
+			return err
+		}
+		if len(out) != len(dst) {
+			return fmt.Errorf("content is %d bytes, expected %d", len(out), len(dst))
+		}
+		return nil
+	}
+
+	dr, err := newDecompressor(bytes.NewReader(src), codec)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	_, err = io.ReadFull(dr, dst)
+	return err
+}
+
+// gzipReadCloser returns its reader to the pool when closed.
+type gzipReadCloser struct {
+	zr *gzip.Reader
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		return 0, fs.ErrClosed
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipReadCloser) Close() error {
+	if g.zr == nil {
+		return nil
+	}
+	err := g.zr.Close()
+	gzipReaders.Put(g.zr)
+	g.zr = nil
+	return err
+}
+
+// zstdReadCloser returns its decoder to the pool when closed.
+type zstdReadCloser struct {
+	zr *zstd.Decoder
+}
+
+func (z *zstdReadCloser) Read(p []byte) (int, error) {
+	if z.zr == nil {
+		return 0, fs.ErrClosed
+	}
+	return z.zr.Read(p)
+}
+
+func (z *zstdReadCloser) Close() error {
+	if z.zr == nil {
+		return nil
+	}
+	z.zr.Reset(nil) // Drop the reference to the content
+	zstdReaders.Put(z.zr)
+	z.zr = nil
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,102 @@
+package emailsearch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseCodec(t *testing.T) {
+	for i := range Codec(numCodecs) {
+		c, err := ParseCodec(i.String())
+		if err != nil || c != i {
+			t.Errorf("ParseCodec(%q) = %v, %v", i.String(), c, err)
+		}
+	}
+	if c, err := ParseCodec("ZSTD"); err != nil || c != Codec_Zstd {
+		t.Errorf("expected case insensitive parse, got %v, %v", c, err)
+	}
+	if _, err := ParseCodec("lz4"); err == nil {
+		t.Errorf("expected error for unknown codec")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	content := []byte(strings.Repeat("The quarterly budget is attached. ", 100))
+	for codec := range Codec(numCodecs) {
+		// The pooled compressors and buffers are reused between calls
+		var first []byte
+		for i := range 3 {
+			compressed, err := compress(content, codec)
+			if err != nil {
+				t.Fatalf("%v: %v", codec, err)
+			}
+			if i == 0 {
+				first = compressed
+			} else if !bytes.Equal(compressed, first) {
+				t.Errorf("%v: expected the same output each time", codec)
+			}
+			dr, err := newDecompressor(bytes.NewReader(compressed), codec)
+			if err != nil {
+				t.Fatalf("%v: %v", codec, err)
+			}
+			got, err := io.ReadAll(dr)
+			dr.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%v: round trip failed: %v", codec, err)
+			}
+		}
+	}
+}
+
+func TestCompressDropsLargeBuffers(t *testing.T) {
+	// Random content doesn't compress, so the buffer grows past the limit
+	content := make([]byte, 2*maxPooledBuffer)
+	rand.Read(content)
+	for _, codec := range []Codec{Codec_Gzip, Codec_Zstd} {
+		if _, err := compress(content, codec); err != nil {
+			t.Fatalf("%v: %v", codec, err)
+		}
+		buf := compressBuffers.Get().(*bytes.Buffer)
+		if buf.Cap() > maxPooledBuffer {
+			t.Errorf("%v: expected the %d byte buffer to be dropped", codec, buf.Cap())
+		}
+		compressBuffers.Put(buf)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	content := []byte(strings.Repeat("The quarterly budget is attached. ", 100))
+	for codec := range Codec(numCodecs) {
+		compressed, err := compress(content, codec)
+		if err != nil {
+			t.Fatalf("%v: %v", codec, err)
+		}
+		for range 3 {
+			got := make([]byte, len(content))
+			if err := decompress(got, compressed, codec); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%v: decompress failed: %v", codec, err)
+			}
+		}
+
+		// Content shorter than expected is an error
+		if err := decompress(make([]byte, len(content)+1), compressed, codec); err == nil {
+			t.Errorf("%v: expected decompressing too little content to fail", codec)
+		}
+
+		// A closed decompressor goes back to the pool and can't be read
+		dr, err := newDecompressor(bytes.NewReader(compressed), codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr.Close()
+		dr.Close()
+		if codec != Codec_None {
+			if _, err := dr.Read(make([]byte, 1)); err == nil {
+				t.Errorf("%v: expected reading a closed decompressor to fail", codec)
+			}
+		}
+	}
+}
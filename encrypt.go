@@ -0,0 +1,317 @@
+package emailsearch
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// An index can be encrypted at rest with AES-GCM, for deployments where the
+// indexed email content can't sit unencrypted on shared disks. If
+// IndexBuilder.EncryptionKey is set the catalog and its shards are
+// encrypted, and if EncryptIndex is also set so is every other file but the
+// metadata, which lists the encrypted files. The checksums are of the
+// encrypted files, so an encrypted index can be verified without the key.
+// LoadEncryptedIndexFromDisk loads it with the same key.
+//
+// Each file is split into chunks of encryptionChunkSize that are sealed
+// separately, so the catalog and the search index can still be read in
+// place a chunk at a time. A file starts with an encryptedFileHeader. The
+// nonce of a chunk is the random prefix from the header, the chunk number
+// and a flag set on the last chunk, and its additional data is the header
+// and the name of the file, so that chunks can't be reordered, dropped or
+// moved between files without failing to decrypt. Decrypted chunks are kept
+// in a cache shared by all the files of the index.
+
+// DecryptedCacheSize is the most bytes of an encrypted index kept decrypted
+// in memory.
+var DecryptedCacheSize int64 = 64 << 20
+
+// encryptionChunkSize is the bytes of plaintext in each chunk of an
+// encrypted file. The last chunk may be shorter, or empty.
+const encryptionChunkSize = 64 << 10
+
+const encryptedFileMagic uint32 = 'E'<<24 | 'N'<<16 | 'C'<<8 | 'F'
+
+const encryptedFileVersion = 1
+
+// encryptedFileHeader starts every encrypted file.
+type encryptedFileHeader struct {
+	Magic   uint32
+	Version uint32
+	Prefix  [7]byte // Random, starts the nonce of every chunk
+	_       byte
+}
+
+var encryptedFileHeaderSize = int64(binary.Size(encryptedFileHeader{}))
+
+// newAEAD returns AES-GCM with key, which must be 16, 24 or 32 bytes.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadKeyFile reads an encryption key from the file at path. The key is hex
+// encoded, as written by openssl rand -hex 32.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: key is not hex encoded: %w", path, err)
+	}
+	if _, err := newAEAD(key); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// chunkNonce fills in the chunk number and last chunk flag of nonce, which
+// starts with the file's prefix.
+func chunkNonce(nonce []byte, chunk int64, last bool) {
+	binary.BigEndian.PutUint32(nonce[7:11], uint32(chunk))
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+}
+
+// encryptFS is a WriteFS that encrypts the files for which encrypt returns
+// true and records their names.
+type encryptFS struct {
+	fsys    WriteFS
+	aead    cipher.AEAD
+	encrypt func(name string) bool
+
+	mu    sync.Mutex
+	names []string
+}
+
+func (e *encryptFS) Create(name string) (io.WriteCloser, error) {
+	if !e.encrypt(name) {
+		return e.fsys.Create(name)
+	}
+
+	hdr := encryptedFileHeader{Magic: encryptedFileMagic, Version: encryptedFileVersion}
+	if _, err := rand.Read(hdr.Prefix[:]); err != nil {
+		return nil, err
+	}
+	var ad bytes.Buffer
+	binary.Write(&ad, binary.BigEndian, hdr)
+
+	f, err := e.fsys.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(ad.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	ad.WriteString(name)
+
+	e.mu.Lock()
+	e.names = append(e.names, name)
+	e.mu.Unlock()
+
+	ef := &encryptingFile{
+		w:     f,
+		aead:  e.aead,
+		ad:    ad.Bytes(),
+		nonce: make([]byte, e.aead.NonceSize()),
+		chunk: make([]byte, 0, encryptionChunkSize),
+	}
+	copy(ef.nonce, hdr.Prefix[:])
+	return ef, nil
+}
+
+// encrypted returns the names of the files encrypted so far, sorted.
+func (e *encryptFS) encrypted() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Sorted(slices.Values(e.names))
+}
+
+// encryptingFile seals what is written to it a chunk at a time. A full
+// chunk is only sealed once more is written, as until Close it isn't known
+// which chunk is the last.
+type encryptingFile struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	ad     []byte
+	nonce  []byte
+	chunk  []byte // Plaintext of the chunk being written
+	sealed []byte
+	n      int64 // Number of the chunk being written
+}
+
+func (f *encryptingFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(f.chunk) == encryptionChunkSize {
+			if err := f.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(f.chunk[len(f.chunk):cap(f.chunk)], p)
+		f.chunk = f.chunk[:len(f.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (f *encryptingFile) seal(last bool) error {
+	chunkNonce(f.nonce, f.n, last)
+	f.sealed = f.aead.Seal(f.sealed[:0], f.nonce, f.chunk, f.ad)
+	f.chunk = f.chunk[:0]
+	f.n++
+	_, err := f.w.Write(f.sealed)
+	return err
+}
+
+func (f *encryptingFile) Close() error {
+	if err := f.seal(true); err != nil {
+		f.w.Close()
+		return err
+	}
+	return f.w.Close()
+}
+
+// decryptSource is an index source that decrypts the encrypted files of
+// another source as they are read.
+type decryptSource struct {
+	src       indexSource
+	aead      cipher.AEAD
+	encrypted []string // Names of the encrypted files
+	cache     *blockCache
+}
+
+func newDecryptSource(src indexSource, key []byte, encrypted []string) (*decryptSource, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptSource{src: src, aead: aead, encrypted: encrypted, cache: newBlockCache(DecryptedCacheSize)}, nil
+}
+
+func (s *decryptSource) Open(name string) (indexFile, error) {
+	f, err := s.src.Open(name)
+	if err != nil || !slices.Contains(s.encrypted, name) {
+		return f, err
+	}
+	df, err := newDecryptFile(s, name, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+func (s *decryptSource) Close() error {
+	return s.src.Close()
+}
+
+// errDecrypt is returned when a chunk fails to decrypt, because the key is
+// wrong or the file has been tampered with.
+var errDecrypt = errors.New("failed to decrypt, the key is wrong or the file is damaged")
+
+// decryptFile is an encrypted file of an index, read through the cache of
+// decrypted chunks.
+type decryptFile struct {
+	f      indexFile
+	src    *decryptSource
+	name   string
+	ad     []byte
+	prefix []byte
+	chunks int64 // Number of chunks in the file
+	size   int64 // Bytes of plaintext
+}
+
+func newDecryptFile(src *decryptSource, name string, f indexFile) (*decryptFile, error) {
+	var hdr encryptedFileHeader
+	if err := binary.Read(io.NewSectionReader(f, 0, encryptedFileHeaderSize), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if hdr.Magic != encryptedFileMagic || hdr.Version != encryptedFileVersion {
+		return nil, fmt.Errorf("%s: not an encrypted file", name)
+	}
+
+	overhead := int64(src.aead.Overhead())
+	rest := int64(f.Len()) - encryptedFileHeaderSize
+	chunks := (rest + encryptionChunkSize + overhead - 1) / (encryptionChunkSize + overhead)
+	if chunks == 0 || rest-chunks*overhead < (chunks-1)*encryptionChunkSize {
+		return nil, fmt.Errorf("%s: encrypted file is truncated", name)
+	}
+
+	var ad bytes.Buffer
+	binary.Write(&ad, binary.BigEndian, hdr)
+	ad.WriteString(name)
+	return &decryptFile{f: f, src: src, name: name, ad: ad.Bytes(), prefix: hdr.Prefix[:], chunks: chunks, size: rest - chunks*overhead}, nil
+}
+
+func (d *decryptFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < d.size {
+		c := off / encryptionChunkSize
+		chunk, err := d.chunk(c)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], chunk[off-c*encryptionChunkSize:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk returns the plaintext of chunk c.
+func (d *decryptFile) chunk(c int64) ([]byte, error) {
+	if data := d.src.cache.get(d.name, c); data != nil {
+		return data, nil
+	}
+
+	stride := int64(encryptionChunkSize + d.src.aead.Overhead())
+	off := encryptedFileHeaderSize + c*stride
+	sealed := make([]byte, min(stride, int64(d.f.Len())-off))
+	if _, err := d.f.ReadAt(sealed, off); err != nil {
+		return nil, fmt.Errorf("%s: %w", d.name, err)
+	}
+	nonce := make([]byte, d.src.aead.NonceSize())
+	copy(nonce, d.prefix)
+	chunkNonce(nonce, c, c == d.chunks-1)
+	data, err := d.src.aead.Open(sealed[:0], nonce, sealed, d.ad)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.name, errDecrypt)
+	}
+	d.src.cache.add(d.name, c, data)
+	return data, nil
+}
+
+func (d *decryptFile) Len() int {
+	return int(d.size)
+}
+
+func (d *decryptFile) Close() error {
+	return d.f.Close()
+}
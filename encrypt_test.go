@@ -0,0 +1,128 @@
+package emailsearch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedIndex(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget presentation.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+
+	for _, all := range []bool{false, true} {
+		ib := &IndexBuilder{NThreads: 1, MaxCatalogShardSize: 1, EncryptionKey: key, EncryptIndex: all}
+		dir := serializeTestIndex(t, ib, emails)
+
+		idx, err := LoadEncryptedIndexFromDisk(dir, io.Discard, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := idx.QueryIndex(t.Context(), []string{"lunch"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Filename != "2" {
+			t.Fatalf("unexpected results %+v", results)
+		}
+		content, _, ok := idx.CatalogContent(t.Context(), results[0].FilenameIndex)
+		if !ok || string(content) != "Lunch on Friday.\n" {
+			t.Errorf("unexpected content %q", content)
+		}
+		if prefixes := idx.Prefix("bud", -1); len(prefixes) != 1 {
+			t.Errorf("expected the prefix tree to load, got %v", prefixes)
+		}
+		encrypted := idx.IndexMetadata().Encrypted
+		idx.Close()
+
+		if !slices.Contains(encrypted, CatalogShardName(1)) || slices.Contains(encrypted, CorpusIndex) != all {
+			t.Errorf("encrypt index %v: unexpected encrypted files %v", all, encrypted)
+		}
+		for _, name := range encrypted {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("Lunch")) || bytes.Contains(data, []byte("quarterly")) {
+				t.Errorf("%s holds plaintext", name)
+			}
+		}
+
+		if _, err := LoadIndexFromDisk(dir, io.Discard); err == nil || !strings.Contains(err.Error(), "encrypted") {
+			t.Errorf("expected an error loading without the key, got %v", err)
+		}
+		if _, err := LoadEncryptedIndexFromDisk(dir, io.Discard, bytes.Repeat([]byte{8}, 32)); !errors.Is(err, errDecrypt) {
+			t.Errorf("expected an error loading with the wrong key, got %v", err)
+		}
+		if report, err := VerifyIndex(dir); err != nil || !report.OK() {
+			t.Errorf("expected the checksums to verify without the key, got %v (%v)", report, err)
+		}
+	}
+}
+
+func TestEncryptedFile(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]*bytes.Buffer)
+	fsys := &encryptFS{
+		fsys: WriteFSFunc(func(name string) (io.WriteCloser, error) {
+			files[name] = &bytes.Buffer{}
+			return nopWriteCloser{files[name]}, nil
+		}),
+		aead:    aead,
+		encrypt: func(string) bool { return true },
+	}
+	src := &decryptSource{aead: aead, cache: newBlockCache(2 * encryptionChunkSize)}
+
+	for _, size := range []int{0, 10, encryptionChunkSize, 3*encryptionChunkSize + 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(rand.IntN(256))
+		}
+		name := filepath.Join("f", string(rune('a'+size%26)))
+		if err := writeFile(fsys, name, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := newDecryptFile(src, name, newMemFile(files[name].Bytes()))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if f.Len() != size {
+			t.Errorf("size %d: got a length of %d", size, f.Len())
+		}
+		got, err := io.ReadAll(io.NewSectionReader(f, 0, int64(f.Len())))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: decrypted data differs (%v)", size, err)
+		}
+
+		// A file truncated at a chunk boundary fails to decrypt its end, as its
+		// last chunk is not marked as last
+		if size > encryptionChunkSize {
+			enc := files[name].Bytes()
+			short := enc[:encryptedFileHeaderSize+int64(encryptionChunkSize+aead.Overhead())]
+			src.cache = newBlockCache(2 * encryptionChunkSize)
+			f, err := newDecryptFile(src, name, newMemFile(short))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.ReadAt(make([]byte, 1), 0); !errors.Is(err, errDecrypt) {
+				t.Errorf("size %d: expected the truncated file to fail, got %v", size, err)
+			}
+		}
+	}
+}
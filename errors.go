@@ -0,0 +1,129 @@
+package emailsearch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// The errors returned when an index fails to load tell apart an index that
+// hasn't been built, errors.Is(err, fs.ErrNotExist), one written by a
+// different version of this package, a *VersionError, and one that has been
+// damaged, errors.Is(err, ErrCorrupt).
+
+// ErrCorrupt is matched by the errors for an index file that is damaged,
+// a *CorruptError or a *ChecksumError.
+var ErrCorrupt = errors.New("index is corrupt")
+
+// ErrClosed is returned by searches and other reads of an index that start
+// after it has been closed, or while it is being closed, see Index.Close.
+var ErrClosed = errors.New("index is closed")
+
+// ErrNotFound is returned by reads of a file of the corpus, such as
+// ReadContent, given a file index that isn't in the index.
+var ErrNotFound = errors.New("file not found in the index")
+
+// MissingFileError reports a file of an index that doesn't exist, or the
+// index itself. It matches fs.ErrNotExist.
+type MissingFileError struct {
+	File string // Name of the file in the index, "" if the index is missing
+	Err  error
+}
+
+func (e *MissingFileError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("index not found: %s", e.Err)
+	}
+	return fmt.Sprintf("index file %s is missing", e.File)
+}
+
+func (e *MissingFileError) Unwrap() error {
+	return e.Err
+}
+
+// VersionError reports an index file in a format version this package
+// can't read. Every older version can be upgraded with MigrateIndex, newer
+// ones need a newer version of this package.
+type VersionError struct {
+	File string // Name of the file in the index, "" for a bundle
+	Got  uint32 // Version of the file
+	Want uint32 // Current version, older versions may still be read
+}
+
+func (e *VersionError) Error() string {
+	file := "index"
+	if e.File != "" {
+		file = "index file " + e.File
+	}
+	if e.Got > e.Want {
+		return fmt.Sprintf("%s is version %d, newer than version %d this program reads", file, e.Got, e.Want)
+	}
+	return fmt.Sprintf("%s is version %d, too old to read, the current version is %d: migrate the index to upgrade it", file, e.Got, e.Want)
+}
+
+// CorruptError reports an index file whose contents don't make sense, such
+// as one that is truncated or has the wrong magic number. It matches
+// ErrCorrupt.
+type CorruptError struct {
+	File string // Name of the file in the index, "" for a bundle
+	Err  error  // What is wrong with it
+}
+
+func (e *CorruptError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("index is corrupt: %s", e.Err)
+	}
+	return fmt.Sprintf("index file %s is corrupt: %s", e.File, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// checkHeader returns the error for a file header with the magic number
+// and version given, which should be want and between minVersion and
+// maxVersion.
+func checkHeader(magic, want, version, minVersion, maxVersion uint32) error {
+	if magic != want {
+		return &CorruptError{Err: fmt.Errorf("bad magic number %#x", magic)}
+	}
+	if version < minVersion || version > maxVersion {
+		return &VersionError{Got: version, Want: maxVersion}
+	}
+	return nil
+}
+
+// fileError turns err, from reading the index file name, into one of the
+// errors above where it can. Truncated files are corrupt.
+func fileError(name string, err error) error {
+	var (
+		merr *MissingFileError
+		verr *VersionError
+		cerr *CorruptError
+		serr *ChecksumError
+	)
+	switch {
+	case err == nil, errors.As(err, &merr), errors.As(err, &serr):
+		return err
+	case errors.As(err, &verr):
+		if verr.File == "" {
+			verr.File = name
+		}
+		return err
+	case errors.As(err, &cerr):
+		if cerr.File == "" {
+			cerr.File = name
+		}
+		return err
+	case errors.Is(err, fs.ErrNotExist):
+		return &MissingFileError{name, err}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return &CorruptError{name, errors.New("file is truncated")}
+	}
+	return err
+}
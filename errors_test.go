@@ -0,0 +1,94 @@
+package emailsearch
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadErrors(t *testing.T) {
+	emails := map[string]string{"1": "Subject: one\n\nThe quarterly budget.\n"}
+	build := func() string {
+		return serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+	}
+	load := func(path string) error {
+		t.Helper()
+		idx, err := LoadIndex(path, nil, LoadOptions{SkipChecksums: true})
+		if err == nil {
+			idx.Close()
+		}
+		return err
+	}
+	change := func(path string, f func([]byte) []byte) {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, f(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not built yet
+	var merr *MissingFileError
+	err := load(filepath.Join(t.TempDir(), "missing"))
+	if !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &merr) || merr.File != "" {
+		t.Errorf("expected the index to be missing, got %v", err)
+	}
+	dir := build()
+	os.Remove(filepath.Join(dir, CorpusCatalog))
+	if err := load(dir); !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &merr) || merr.File != CorpusCatalog {
+		t.Errorf("expected %s to be missing, got %v", CorpusCatalog, err)
+	}
+
+	// Written by a newer version
+	dir = build()
+	change(filepath.Join(dir, CorpusIndex), func(data []byte) []byte {
+		binary.BigEndian.PutUint32(data[4:], indexVersion+1)
+		return data
+	})
+	var verr *VersionError
+	err = load(dir)
+	if !errors.As(err, &verr) || *verr != (VersionError{CorpusIndex, indexVersion + 1, indexVersion}) {
+		t.Errorf("expected a version error, got %v", err)
+	}
+	if errors.Is(err, ErrCorrupt) {
+		t.Error("expected a newer version not to be corrupt")
+	}
+
+	// Written before the format break, which has to be migrated
+	dir = build()
+	change(filepath.Join(dir, CorpusIndex), func(data []byte) []byte {
+		binary.BigEndian.PutUint32(data[4:], minIndexVersion-1)
+		return data
+	})
+	err = load(dir)
+	if !errors.As(err, &verr) || verr.Got != minIndexVersion-1 || !strings.Contains(err.Error(), "migrate") {
+		t.Errorf("expected a version error saying to migrate the index, got %v", err)
+	}
+
+	// Damaged
+	dir = build()
+	change(filepath.Join(dir, WordsStringTable), func(data []byte) []byte { return data[:len(data)-2] })
+	var cerr *CorruptError
+	if err := load(dir); !errors.Is(err, ErrCorrupt) || !errors.As(err, &cerr) || cerr.File != WordsStringTable {
+		t.Errorf("expected %s to be corrupt, got %v", WordsStringTable, err)
+	}
+	if _, err := LoadIndex(dir, nil, LoadOptions{}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected a checksum mismatch to be corrupt, got %v", err)
+	}
+	change(filepath.Join(dir, IndexMetadataFile), func(data []byte) []byte { return data[1:] })
+	if err := load(dir); !errors.As(err, &cerr) || cerr.File != IndexMetadataFile {
+		t.Errorf("expected %s to be corrupt, got %v", IndexMetadataFile, err)
+	}
+	notBundle := filepath.Join(t.TempDir(), "index.bundle")
+	os.WriteFile(notBundle, []byte("definitely not an index bundle"), 0644)
+	if err := load(notBundle); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected a file that isn't a bundle to be corrupt, got %v", err)
+	}
+}
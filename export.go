@@ -0,0 +1,285 @@
+package emailsearch
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the format ExportWords and ExportDocuments write.
+type ExportFormat uint8
+
+const (
+	ExportFormat_JSON ExportFormat = iota // JSON Lines, one object per line
+	ExportFormat_CSV                      // CSV with a header row
+
+	numExportFormats = iota
+)
+
+var exportFormatNames = [numExportFormats]string{"json", "csv"}
+
+func (f ExportFormat) String() string {
+	if int(f) < len(exportFormatNames) {
+		return exportFormatNames[f]
+	}
+	return fmt.Sprintf("ExportFormat(%d)", f)
+}
+
+// ParseExportFormat returns the ExportFormat with the given name, e.g.
+// "csv". Names are case insensitive.
+func ParseExportFormat(name string) (ExportFormat, error) {
+	for i, n := range exportFormatNames {
+		if strings.EqualFold(n, name) {
+			return ExportFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown export format %q", name)
+}
+
+// ExportedPosting is a match of a word in ExportWords, the number of times
+// the word occurs in one field of a file.
+type ExportedPosting struct {
+	File  string `json:"file"`
+	Field string `json:"field"`
+	TF    int    `json:"tf"`
+}
+
+// PostingList is the posting list of a word as it is stored in the index,
+// see Index.Postings.
+type PostingList struct {
+	Term     string    `json:"term"`
+	DF       int       `json:"df"` // Number of files containing the word
+	Postings []Posting `json:"postings"`
+}
+
+// Posting is a match of a word in a PostingList, with where in the field
+// each occurrence is.
+type Posting struct {
+	ExportedPosting
+	Occurrences []Occurrence `json:"occurrences"`
+}
+
+// Occurrence is where a word occurs in a field of a file.
+type Occurrence struct {
+	Offset   int `json:"offset"`   // Byte offset from the start of the field
+	Position int `json:"position"` // Ordinal of the word amongst all the words in the field
+	Length   int `json:"length"`   // Byte length of the text, which can differ from the word
+}
+
+// ExportedWord is a word of the index in ExportWords.
+type ExportedWord struct {
+	Term     string            `json:"term"`
+	DF       int               `json:"df"` // Number of files containing the word
+	Postings []ExportedPosting `json:"postings"`
+}
+
+// ExportedDocument is a file of the index in ExportDocuments.
+type ExportedDocument struct {
+	File    string    `json:"file"`
+	Date    time.Time `json:"date,omitzero"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Words   int       `json:"words"`  // Number of words indexed
+	Length  int       `json:"length"` // Bytes of stored content
+	Labels  []string  `json:"labels"`
+}
+
+// ExportWords writes every word of the index with its document frequency
+// and postings to w, for analysis with other tools such as pandas or
+// DuckDB. Words are written in sorted order one at a time, so the index
+// does not need to fit in memory. In JSON each word is an ExportedWord on
+// a line of its own, in CSV each posting is a row of term, df, file, field
+// and tf.
+func (idx *Index) ExportWords(w io.Writer, format ExportFormat) error {
+	release, ok := idx.acquire()
+	if !ok {
+		return ErrClosed
+	}
+	defer release()
+
+	enc, err := newExportEncoder(w, format, []string{"term", "df", "file", "field", "tf"})
+	if err != nil {
+		return err
+	}
+	for _, widx := range idx.words.sortedOrder() {
+		ew, err := idx.exportWord(idx.words.At(widx))
+		if err != nil {
+			return err
+		}
+		if format == ExportFormat_JSON {
+			err = enc.json(ew)
+		} else {
+			for _, p := range ew.Postings {
+				if err = enc.csv(ew.Term, strconv.Itoa(ew.DF), p.File, p.Field, strconv.Itoa(p.TF)); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return enc.flush()
+}
+
+// Postings returns the posting list of word as it is stored in the index,
+// with the offset, position and length of every occurrence, for debugging
+// ranking and changes to the file format. The word is looked up as is,
+// apart from being lower cased, so it must be a word of the index rather
+// than a query.
+func (idx *Index) Postings(word string) (PostingList, error) {
+	release, ok := idx.acquire()
+	if !ok {
+		return PostingList{}, ErrClosed
+	}
+	defer release()
+	word = strings.ToLower(word)
+	if _, ok := idx.wordOffset(word); !ok {
+		return PostingList{}, fmt.Errorf("%q is not in the index", word)
+	}
+	pl := PostingList{Term: word}
+	err := idx.readPostings(word, func(h matchHeader, ep ExportedPosting) error {
+		matches, err := h.appendOccurrences(nil, word)
+		if err != nil {
+			return err
+		}
+		p := Posting{ExportedPosting: ep, Occurrences: make([]Occurrence, len(matches))}
+		for i, m := range matches {
+			p.Occurrences[i] = Occurrence{m.Offset, m.Position, m.Length}
+		}
+		pl.Postings = append(pl.Postings, p)
+		return nil
+	}, &pl.DF)
+	return pl, err
+}
+
+// exportWord reads the postings of word from the index.
+func (idx *Index) exportWord(word string) (ExportedWord, error) {
+	ew := ExportedWord{Term: word}
+	err := idx.readPostings(word, func(_ matchHeader, p ExportedPosting) error {
+		ew.Postings = append(ew.Postings, p)
+		return nil
+	}, &ew.DF)
+	return ew, err
+}
+
+// readPostings reads the postings of word from the index, calling yield
+// with each, and counts the files containing it in df.
+func (idx *Index) readPostings(word string, yield func(matchHeader, ExportedPosting) error, df *int) error {
+	if idx.closed() {
+		return ErrClosed
+	}
+	offset, _ := idx.wordOffset(word)
+	rdr := &readerAtCursor{r: idx.indexRdr, off: offset}
+	numMatches, err := skipWordFiles(rdr)
+	if err != nil {
+		return err
+	}
+	prev := -1
+	return idx.matchHeaders(rdr, numMatches, nil, func(h matchHeader) error {
+		if h.fidx >= idx.filenames.Len() {
+			return fmt.Errorf("word %q matches file index %d out of range", word, h.fidx)
+		}
+		if h.fidx != prev {
+			*df++
+			prev = h.fidx
+		}
+		return yield(h, ExportedPosting{idx.filenames.At(h.fidx), h.field.String(), h.tf})
+	})
+}
+
+// ExportDocuments writes the catalog metadata of every file of the index to
+// w in filename index order, see ExportWords. In JSON each file is an
+// ExportedDocument on a line of its own, in CSV the date is RFC 3339 and the
+// labels are separated by commas.
+func (idx *Index) ExportDocuments(w io.Writer, format ExportFormat) error {
+	release, ok := idx.acquire()
+	if !ok {
+		return ErrClosed
+	}
+	defer release()
+	enc, err := newExportEncoder(w, format, []string{"file", "date", "from", "subject", "words", "length", "labels"})
+	if err != nil {
+		return err
+	}
+	for fidx, name := range idx.filenames.All() {
+		meta, _ := idx.metadata(fidx)
+		doc := ExportedDocument{
+			File:    name,
+			Date:    meta.Date,
+			From:    meta.From,
+			Subject: meta.Subject,
+			Words:   idx.DocumentLength(fidx),
+			Labels:  idx.Labels(fidx),
+		}
+		if doc.Labels == nil {
+			doc.Labels = []string{} // Every document has the same fields
+		}
+		if fidx < len(idx.contentEntry) {
+			doc.Length = int(idx.contentEntry[fidx].Length)
+		}
+
+		if format == ExportFormat_JSON {
+			err = enc.json(doc)
+		} else {
+			var date string
+			if !doc.Date.IsZero() {
+				date = doc.Date.Format(time.RFC3339)
+			}
+			err = enc.csv(doc.File, date, doc.From, doc.Subject, strconv.Itoa(doc.Words), strconv.Itoa(doc.Length), strings.Join(doc.Labels, ","))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return enc.flush()
+}
+
+// exportEncoder writes records in an ExportFormat.
+type exportEncoder struct {
+	bw *bufio.Writer
+	je *json.Encoder
+	cw *csv.Writer
+}
+
+// newExportEncoder returns an encoder writing to w. CSV output starts with
+// header.
+func newExportEncoder(w io.Writer, format ExportFormat, header []string) (*exportEncoder, error) {
+	e := &exportEncoder{bw: bufio.NewWriter(w)}
+	switch format {
+	case ExportFormat_JSON:
+		e.je = json.NewEncoder(e.bw)
+		e.je.SetEscapeHTML(false)
+	case ExportFormat_CSV:
+		e.cw = csv.NewWriter(e.bw)
+		if err := e.cw.Write(header); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported export format %v", format)
+	}
+	return e, nil
+}
+
+func (e *exportEncoder) json(v any) error {
+	return e.je.Encode(v)
+}
+
+func (e *exportEncoder) csv(record ...string) error {
+	return e.cw.Write(record)
+}
+
+func (e *exportEncoder) flush() error {
+	if e.cw != nil {
+		e.cw.Flush()
+		if err := e.cw.Error(); err != nil {
+			return err
+		}
+	}
+	return e.bw.Flush()
+}
@@ -0,0 +1,111 @@
+package emailsearch
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	emails := map[string]string{
+		"1": "From: lay@enron.com\nSubject: Budget\nDate: Mon, 14 May 2001 16:39:00 -0700\nX-Gmail-Labels: Inbox\n\nThe budget, the budget.\n",
+		"2": "Subject: Lunch\n\nLunch and budget.\n",
+	}
+	idx := buildTestIndex(t, emails)
+
+	var buf bytes.Buffer
+	if err := idx.ExportWords(&buf, ExportFormat_JSON); err != nil {
+		t.Fatal(err)
+	}
+	words := make(map[string]ExportedWord)
+	for line := range strings.Lines(buf.String()) {
+		var w ExportedWord
+		if err := json.Unmarshal([]byte(line), &w); err != nil {
+			t.Fatal(err)
+		}
+		words[w.Term] = w
+	}
+	if len(words) != idx.words.Len() {
+		t.Errorf("expected %d words, got %d", idx.words.Len(), len(words))
+	}
+	want := ExportedWord{"budget", 2, []ExportedPosting{{"1", "body", 2}, {"1", "subject", 1}, {"2", "body", 1}}}
+	if !reflect.DeepEqual(words["budget"], want) {
+		t.Errorf("expected %v, got %v", want, words["budget"])
+	}
+
+	buf.Reset()
+	if err := idx.ExportWords(&buf, ExportFormat_CSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows[0], []string{"term", "df", "file", "field", "tf"}) {
+		t.Errorf("unexpected header %v", rows[0])
+	}
+	var budget [][]string
+	for _, row := range rows[1:] {
+		if row[0] == "budget" {
+			budget = append(budget, row)
+		}
+	}
+	if len(budget) != 3 || !reflect.DeepEqual(budget[0], []string{"budget", "2", "1", "body", "2"}) {
+		t.Errorf("unexpected rows for budget %v", budget)
+	}
+
+	buf.Reset()
+	if err := idx.ExportDocuments(&buf, ExportFormat_JSON); err != nil {
+		t.Fatal(err)
+	}
+	var doc ExportedDocument
+	if err := json.Unmarshal([]byte(strings.SplitN(buf.String(), "\n", 2)[0]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.File != "1" || doc.From != "lay@enron.com" || doc.Subject != "Budget" || doc.Date.Year() != 2001 || !reflect.DeepEqual(doc.Labels, []string{"Inbox"}) {
+		t.Errorf("unexpected document %+v", doc)
+	}
+
+	buf.Reset()
+	if err := idx.ExportDocuments(&buf, ExportFormat_CSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[2][0] != "2" || rows[2][1] != "" || rows[2][3] != "Lunch" {
+		t.Errorf("unexpected rows %v", rows)
+	}
+
+	if _, err := ParseExportFormat("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestPostings(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: Budget\n\nThe budget, the budget.\n",
+		"2": "Subject: Lunch\n\nLunch and budget.\n",
+	})
+
+	pl, err := idx.Postings("Budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PostingList{"budget", 2, []Posting{
+		{ExportedPosting{"1", "body", 2}, []Occurrence{{4, 1, 6}, {16, 3, 6}}},
+		{ExportedPosting{"1", "subject", 1}, []Occurrence{{0, 0, 6}}},
+		{ExportedPosting{"2", "body", 1}, []Occurrence{{10, 2, 6}}},
+	}}
+	if !reflect.DeepEqual(pl, want) {
+		t.Errorf("expected %v, got %v", want, pl)
+	}
+
+	if _, err := idx.Postings("forecast"); err == nil {
+		t.Error("expected an error for a word not in the index")
+	}
+}
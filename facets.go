@@ -0,0 +1,184 @@
+package emailsearch
+
+import (
+	"cmp"
+	"context"
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// Facet is a value shared by some of the files that matched a search, and
+// the number of those files.
+type Facet struct {
+	Value string
+	Count int
+}
+
+// Facets break down the files that matched a search, for offering filters
+// to narrow it down. Each list is ordered by decreasing count and then by
+// value.
+type Facets struct {
+	Folders []Facet // See Index.Folders, a file can be in several
+	Senders []Facet // Lowercased address of the From header
+}
+
+// facets counts the files of a search result by folder and by sender.
+func (idx *Index) facets(ctx context.Context, searchresults map[int][]QueryWordMatch) (Facets, error) {
+	if cols := idx.facetColumns(); cols != nil {
+		return idx.countFacets(ctx, cols, searchresults)
+	}
+	return idx.readFacets(ctx, searchresults)
+}
+
+// readFacets is facets counted from the metadata of every file, for an
+// index without the facet columns.
+func (idx *Index) readFacets(ctx context.Context, searchresults map[int][]QueryWordMatch) (Facets, error) {
+	folders := make(map[string]int)
+	senders := make(map[string]int)
+	i := 0
+	for fidx := range searchresults {
+		if i++; i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return Facets{}, err
+			}
+		}
+
+		for _, folder := range idx.folders(fidx) {
+			folders[folder]++
+		}
+		if meta, ok := idx.metadata(fidx); ok && meta.From != "" {
+			senders[senderAddress(meta.From)]++
+		}
+	}
+
+	return Facets{Folders: sortFacets(folders), Senders: sortFacets(senders)}, nil
+}
+
+// facetColumns are the sender and the directory of every file, so that the
+// facets of a search are counted without reading the metadata of each file
+// that matched. They are built in the background as the index loads, see
+// loadFacetColumns. The labels of a file are already in memory.
+type facetColumns struct {
+	senders     []uint32 // 1 + the index in senderNames of each file's sender, 0 for none
+	senderNames []string
+	dirs        []uint32 // Likewise for the directory of each file
+	dirNames    []string
+}
+
+// loadFacetColumns builds the facet columns from the metadata of every file,
+// unless ctx is cancelled first.
+func (idx *Index) loadFacetColumns(ctx context.Context) {
+	defer close(idx.facetColsReady)
+
+	n := idx.filenames.Len()
+	cols := &facetColumns{senders: make([]uint32, n), dirs: make([]uint32, n)}
+	senderIDs := make(map[string]uint32)
+	dirIDs := make(map[string]uint32)
+	intern := func(ids map[string]uint32, names *[]string, s string) uint32 {
+		id, ok := ids[s]
+		if !ok {
+			*names = append(*names, s)
+			id = uint32(len(*names))
+			ids[s] = id
+		}
+		return id
+	}
+	for fidx := range n {
+		if fidx%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return
+		}
+		if dir := idx.dir(fidx); dir != "" {
+			cols.dirs[fidx] = intern(dirIDs, &cols.dirNames, dir)
+		}
+		if meta, ok := idx.metadata(fidx); ok && meta.From != "" {
+			cols.senders[fidx] = intern(senderIDs, &cols.senderNames, senderAddress(meta.From))
+		}
+	}
+	idx.facetCols = cols
+}
+
+// facetColumns returns the facet columns, waiting for them to be built, or
+// nil if they aren't.
+func (idx *Index) facetColumns() *facetColumns {
+	if idx.facetColsReady == nil {
+		return nil
+	}
+	<-idx.facetColsReady
+	return idx.facetCols
+}
+
+// countFacets is facets counted from the facet columns.
+func (idx *Index) countFacets(ctx context.Context, cols *facetColumns, searchresults map[int][]QueryWordMatch) (Facets, error) {
+	labelCounts := make([]int, len(idx.labels))
+	dirCounts := make([]int, len(cols.dirNames))
+	senderCounts := make([]int, len(cols.senderNames))
+	i := 0
+	for fidx := range searchresults {
+		if i++; i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return Facets{}, err
+			}
+		}
+		if fidx < 0 || fidx >= len(cols.senders) {
+			continue
+		}
+
+		// Labels take the place of the directory, see Folders
+		var ids []uint32
+		if fidx+1 < len(idx.docLabelStart) {
+			ids = idx.docLabels[idx.docLabelStart[fidx]:idx.docLabelStart[fidx+1]]
+		}
+		for _, id := range ids {
+			labelCounts[id]++
+		}
+		if d := cols.dirs[fidx]; d > 0 && len(ids) == 0 {
+			dirCounts[d-1]++
+		}
+		if s := cols.senders[fidx]; s > 0 {
+			senderCounts[s-1]++
+		}
+	}
+
+	folders := make(map[string]int)
+	senders := make(map[string]int)
+	for id, count := range labelCounts {
+		if count > 0 {
+			folders[idx.labels[id]] += count
+		}
+	}
+	for id, count := range dirCounts {
+		if count > 0 {
+			folders[cols.dirNames[id]] += count
+		}
+	}
+	for id, count := range senderCounts {
+		if count > 0 {
+			senders[cols.senderNames[id]] = count
+		}
+	}
+	return Facets{Folders: sortFacets(folders), Senders: sortFacets(senders)}, nil
+}
+
+// senderAddress returns the lowercased email address of a From header, or
+// the whole header if it has no parsable address.
+func senderAddress(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	return strings.ToLower(strings.TrimSpace(from))
+}
+
+func sortFacets(counts map[string]int) []Facet {
+	if len(counts) == 0 {
+		return nil
+	}
+	facets := make([]Facet, 0, len(counts))
+	for value, count := range counts {
+		facets = append(facets, Facet{value, count})
+	}
+	slices.SortFunc(facets, func(a, b Facet) int {
+		return cmp.Or(b.Count-a.Count, strings.Compare(a.Value, b.Value))
+	})
+	return facets
+}
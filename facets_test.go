@@ -0,0 +1,82 @@
+package emailsearch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFacets(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"alice/inbox/1": "From: Alice <alice@example.com>\nSubject: budget\n\nThe budget is attached.\n",
+		"alice/inbox/2": "From: bob@example.com\nSubject: budget\n\nComments on the budget.\n",
+		"alice/sent/1":  "From: Alice <ALICE@example.com>\nSubject: re: budget\n\nThanks for the budget.\n",
+		"bob/inbox/1":   "From: Carol <carol@example.com>\nSubject: lunch\n\nLunch on Friday?\n",
+		"bob/inbox/2":   "Subject: budget\n\nNo sender, but a budget.\n",
+	})
+
+	res, err := idx.SearchTop(t.Context(), Term("budget"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Facets{
+		Folders: []Facet{{"alice/inbox", 2}, {"alice/sent", 1}, {"bob/inbox", 1}},
+		Senders: []Facet{{"alice@example.com", 2}, {"bob@example.com", 1}},
+	}
+	if !reflect.DeepEqual(res.Facets, expected) {
+		t.Errorf("expected facets %v, got %v", expected, res.Facets)
+	}
+
+	// The columns built as the index loads agree with the metadata
+	if idx.facetColumns() == nil {
+		t.Fatal("expected the facet columns to be built")
+	}
+	matches, err := Term("budget").eval(t.Context(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read, err := idx.readFacets(t.Context(), matches); err != nil || !reflect.DeepEqual(read, expected) {
+		t.Errorf("expected facets %v read from the metadata, got %v (%v)", expected, read, err)
+	}
+
+	res, err = idx.SearchTop(t.Context(), Term("nothing"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Facets, Facets{}) {
+		t.Errorf("expected no facets for no results, got %v", res.Facets)
+	}
+}
+
+func TestLabelFacets(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"takeout/1": "From: alice@example.com\nSubject: budget\nX-Gmail-Labels: Inbox,Important\n\nThe budget.\n",
+		"takeout/2": "From: alice@example.com\nSubject: budget\nX-Gmail-Labels: Inbox\n\nThe budget again.\n",
+		"other/1":   "From: bob@example.com\nSubject: budget\n\nNo labels, a budget.\n",
+	})
+
+	// Labels take the place of the directory of a file
+	res, err := idx.SearchTop(t.Context(), Term("budget"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Facets{
+		Folders: []Facet{{"Inbox", 2}, {"Important", 1}, {"other", 1}},
+		Senders: []Facet{{"alice@example.com", 2}, {"bob@example.com", 1}},
+	}
+	if !reflect.DeepEqual(res.Facets, expected) {
+		t.Errorf("expected facets %v, got %v", expected, res.Facets)
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	cases := map[string]string{
+		"Alice <Alice@Example.com>": "alice@example.com",
+		"bob@example.com":           "bob@example.com",
+		" Not an address ":          "not an address",
+	}
+	for from, expected := range cases {
+		if got := senderAddress(from); got != expected {
+			t.Errorf("senderAddress(%q) = %q, expected %q", from, got, expected)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package emailsearch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Field identifies the part of an email that a word was found in. Words in
+// the message body and in some of the headers are indexed.
+type Field uint8
+
+const (
+	Field_Body Field = iota
+	Field_Subject
+	Field_From
+	Field_To
+
+	numFields = iota
+)
+
+// headerFields are the fields indexed from email headers
+var headerFields = []Field{Field_Subject, Field_From, Field_To}
+
+var fieldNames = [numFields]string{"body", "subject", "from", "to"}
+
+func (f Field) String() string {
+	if int(f) < len(fieldNames) {
+		return fieldNames[f]
+	}
+	return fmt.Sprintf("Field(%d)", f)
+}
+
+// Header returns the name of the email header that the field is indexed
+// from, or "" for the body.
+func (f Field) Header() string {
+	switch f {
+	case Field_Subject:
+		return "Subject"
+	case Field_From:
+		return "From"
+	case Field_To:
+		return "To"
+	}
+	return ""
+}
+
+// ParseField returns the Field with the given name, e.g. "subject". Names are
+// case insensitive.
+func ParseField(name string) (Field, error) {
+	for i, n := range fieldNames {
+		if strings.EqualFold(n, name) {
+			return Field(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown field %q", name)
+}
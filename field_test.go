@@ -0,0 +1,19 @@
+package emailsearch
+
+import "testing"
+
+func TestParseField(t *testing.T) {
+	for _, f := range []Field{Field_Body, Field_Subject, Field_From, Field_To} {
+		got, err := ParseField(f.String())
+		if err != nil || got != f {
+			t.Errorf("ParseField(%q) = %v, %v; want %v", f.String(), got, err, f)
+		}
+	}
+
+	if f, err := ParseField("SUBJECT"); err != nil || f != Field_Subject {
+		t.Errorf("expected case insensitive match, got %v, %v", f, err)
+	}
+	if _, err := ParseField("cc"); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
@@ -0,0 +1,105 @@
+package emailsearch
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Glob patterns are matched against slash separated paths relative to the
+// input path. They use the path.Match syntax with two additions:
+//   - A "**" path segment matches zero or more path segments.
+//   - A pattern without a "/" is matched against every segment of the path,
+//     so "*.eml" matches "a/b/c.eml" and "attachments" matches
+//     "a/attachments/b".
+//
+// A pattern that matches a directory also matches everything beneath it, so
+// "*/deleted_items" excludes "lay-k/deleted_items/1.".
+
+// ValidatePatterns returns an error if any of the patterns is malformed.
+func ValidatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Accept reports whether the file name, relative to InputPath, passes the
+// builder's include and exclude patterns. A file is accepted if it matches
+// any include pattern (or there are none) and does not match any exclude
+// pattern.
+func (ib *IndexBuilder) Accept(name string) bool {
+	name = filepath.ToSlash(name)
+
+	if len(ib.IncludePatterns) > 0 && !matchAnyPattern(ib.IncludePatterns, name) {
+		return false
+	}
+	return !matchAnyPattern(ib.ExcludePatterns, name)
+}
+
+// ExcludesDir reports whether everything under the directory dir, relative to
+// InputPath, is excluded. Directory walkers can use this to avoid descending
+// into excluded directories.
+func (ib *IndexBuilder) ExcludesDir(dir string) bool {
+	return matchAnyPattern(ib.ExcludePatterns, filepath.ToSlash(dir))
+}
+
+func matchAnyPattern(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches name, or any of its parent directories, against
+// pattern.
+func matchPattern(pattern, name string) bool {
+	segs := strings.Split(name, "/")
+
+	if !strings.Contains(pattern, "/") {
+		for _, seg := range segs {
+			if ok, _ := path.Match(pattern, seg); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	psegs := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i := len(segs); i > 0; i-- {
+		if matchSegments(psegs, segs[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments, expanding
+// "**" to any number of segments.
+func matchSegments(psegs, segs []string) bool {
+	for len(psegs) > 0 {
+		if psegs[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(psegs[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(psegs[0], segs[0]); !ok {
+			return false
+		}
+		psegs, segs = psegs[1:], segs[1:]
+	}
+
+	return len(segs) == 0
+}
@@ -0,0 +1,63 @@
+package emailsearch
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		Pattern  string
+		Name     string
+		Expected bool
+	}{
+		{"*.eml", "a.eml", true},
+		{"*.eml", "dir/sub/a.eml", true},
+		{"*.eml", "dir/a.txt", false},
+		{"attachments", "lay-k/attachments/x.pdf", true},
+		{"attachments", "lay-k/inbox/attachments.txt", false},
+		{"*/deleted_items/*", "lay-k/deleted_items/1.", true},
+		{"*/deleted_items/*", "lay-k/deleted_items/sub/1.", true},
+		{"*/deleted_items/*", "lay-k/inbox/1.", false},
+		{"*/deleted_items", "lay-k/deleted_items/1.", true},
+		{"**/deleted_items", "a/b/c/deleted_items/1.", true},
+		{"lay-k/**/*.", "lay-k/inbox/2001/1.", true},
+		{"lay-k/**/*.", "skilling-j/inbox/1.", false},
+		{"/lay-k", "lay-k/inbox/1.", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Pattern+" "+tc.Name, func(t *testing.T) {
+			if got := matchPattern(tc.Pattern, tc.Name); got != tc.Expected {
+				t.Errorf("matchPattern(%q, %q) = %v; want %v", tc.Pattern, tc.Name, got, tc.Expected)
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	ib := &IndexBuilder{
+		IncludePatterns: []string{"*.eml", "*."},
+		ExcludePatterns: []string{"*/deleted_items"},
+	}
+
+	cases := []struct {
+		Name     string
+		Expected bool
+	}{
+		{"lay-k/inbox/1.", true},
+		{"lay-k/inbox/1.eml", true},
+		{"lay-k/inbox/1.txt", false},
+		{"lay-k/deleted_items/1.", false},
+	}
+	for _, tc := range cases {
+		if got := ib.Accept(tc.Name); got != tc.Expected {
+			t.Errorf("Accept(%q) = %v; want %v", tc.Name, got, tc.Expected)
+		}
+	}
+
+	if !ib.ExcludesDir("lay-k/deleted_items") || ib.ExcludesDir("lay-k/inbox") {
+		t.Error("ExcludesDir returned the wrong result")
+	}
+
+	if err := ValidatePatterns([]string{"[a-"}); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
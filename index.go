@@ -2,34 +2,75 @@ package emailsearch
 
 import (
 	"bufio"
-	"compress/gzip"
+	"bytes"
+	"cmp"
+	"container/heap"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"math"
-	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
 
-	"github.com/chriskillpack/compressedtrie"
-	"github.com/go-mmap/mmap"
+	"github.com/RoaringBitmap/roaring/v2"
+	"github.com/klauspost/compress/s2"
 )
 
 // Index file format structures
 const indexMagic uint32 = 'I'<<24 | 'N'<<16 | 'D'<<8 | 'X'
 
-type serializedIndexHeader struct {
-	Magic      uint32
-	Version    uint32
-	NumEntries uint64 // Number of words in the index
-	CorpusSize uint32 // Number of documents the index was built from
+// Version 2 added word positions to every occurrence
+// Version 3 added the field to every match
+// Version 4 added document length statistics
+// Version 5 added the byte length of the occurrences to every match
+// Version 6 added the byte length of the matched text to every occurrence
+// Version 7 added the set of files containing each word
+// Version 8 delta encodes the filename index of each match
+// Version 9 moved the occurrences of a word's matches after all the matches
+// Version 10 compresses the matches in blocks of postingBlockSize
+const indexVersion = 10
+
+// minIndexVersion is the oldest index version that can still be loaded.
+// Versions 1 to 6 are one format break, LoadIndex refuses them with a
+// *VersionError and MigrateIndex rebuilds them from their catalog.
+const minIndexVersion = 7
 
-	// Followed by NumEntries of serializedWord
+type serializedIndexHeader struct {
+	Magic        uint32
+	Version      uint32
+	NumEntries   uint64  // Number of words in the index
+	CorpusSize   uint32  // Number of documents the index was built from
+	TotalTokens  uint64  // Number of words in all the documents
+	AvgDocLength float64 // Average number of words in a document
+
+	// Followed by CorpusSize of u32 document lengths (number of words) in
+	// filename index order.
+
+	// Followed by NumEntries of serializedWord, each starting with a uvarint
+	// length and a roaring bitmap of the files containing the word. Then the
+	// number of matches and a table of the blocks the matches are split
+	// into, with the last filename index and the stored size of each block.
+	// Then the blocks, each S2 compressed unless that would make it larger.
+	// A block holds the byte length of its match headers, the match headers
+	// and then the occurrences of every match. Matches can be selected
+	// without reading any occurrences, and blocks without the files of
+	// interest are skipped without decompressing them.
 	//Entry      []serializedWord
 }
 
+// postingBlockSize is the number of matches in each block of a word's
+// matches, the last block can have fewer.
+const postingBlockSize = 128
+
 const wordOffsetMagic uint32 = 'W'<<24 | 'R'<<16 | 'D'<<8 | 'O'
 
 type serializedWordOffsetHeader struct {
@@ -45,386 +86,1781 @@ type serializedWordIndexOffset struct {
 
 const catalogMagic uint32 = 'C'<<24 | 'T'<<16 | 'L'<<8 | 'G'
 
+// Version 2 added document metadata
+// Version 3 added the compression codec
+// Version 4 added sharding of the content
+// Version 5 widened the offsets and lengths to 64 bits
+// Version 6 added the compressed length of the content
+// Version 7 added To and the MIME headers to the document metadata
+// Version 8 added the offset of the body to the document metadata
+const catalogVersion = 8
+
+// minCatalogVersion is the oldest catalog version that can still be loaded.
+// Catalogs before version 4 only come with search indexes older than
+// minIndexVersion, which MigrateIndex rebuilds from the catalog.
+const minCatalogVersion = 1
+
 type serializedCatalogHeader struct {
 	Magic      uint32
 	Version    uint32
 	NumEntries uint32
+	Codec      uint32 // Codec the content is compressed with
+	NumShards  uint32 // Number of content shard files, 0 if the content is in the catalog
+}
+
+// serializedCatalogHeaderV2 is the header of a catalog before version 3,
+// which was always gzip compressed. Version 3 added the codec to it and
+// version 4 the number of shards.
+type serializedCatalogHeaderV2 struct {
+	Magic      uint32
+	Version    uint32
+	NumEntries uint32
 }
 
 type catalogContentEntry struct {
-	Offset uint32 // Offset of the compressed content in the catalog
-	Length uint32 // Length of the uncompressed content
+	Offset           uint64 // Offset of the compressed content in the catalog
+	Length           uint64 // Length of the uncompressed content
+	CompressedLength uint64 // Length of the compressed content, 0 if unknown
+	MetaOffset       uint64 // Offset of the document metadata in the catalog
+	Shard            uint32 // Shard file holding the content, if the catalog is sharded
 }
 
-// Index represents a search index and corpus that can be queried.
-type Index struct {
-	filenames      []string
-	words          []string
-	offsets        []serializedWordIndexOffset
-	contentEntry   []catalogContentEntry
-	wordsToOffsets map[string]int64
-	prefixTree     *compressedtrie.Tree
-	CorpusSize     int
+// catalogContentEntryV5 is a catalogContentEntry of a version 5 catalog,
+// which didn't record the compressed length. The content of older catalogs
+// is read until the decompressor stops.
+type catalogContentEntryV5 struct {
+	Offset     uint64
+	Length     uint64
+	MetaOffset uint64
+	Shard      uint32
+}
+
+// catalogContentEntryV4 is a catalogContentEntry of a version 4 catalog,
+// which limited the catalog and its content to 4GB.
+type catalogContentEntryV4 struct {
+	Offset     uint32
+	Length     uint32
+	MetaOffset uint32
+	Shard      uint32
+}
 
-	indexRdr   *mmap.File // The search index is memory mapped
-	catalogRdr *mmap.File // The compressed catalog is memory mapped
+// catalogContentEntryV3 is a catalogContentEntry of a version 2 or 3
+// catalog, which wasn't sharded.
+type catalogContentEntryV3 struct {
+	Offset     uint32
+	Length     uint32
+	MetaOffset uint32
+}
+
+// catalogContentEntryV1 is a catalogContentEntry of a version 1 catalog,
+// which had no document metadata.
+type catalogContentEntryV1 struct {
+	Offset uint32
+	Length uint32
+}
+
+// catalogTableEnd returns the offset of the end of the table of entries of
+// a catalog of the given version with n entries.
+func catalogTableEnd(version uint32, n int) int64 {
+	hdr, entry := binary.Size(serializedCatalogHeader{}), binary.Size(catalogContentEntry{})
+	switch version {
+	case 1:
+		hdr, entry = binary.Size(serializedCatalogHeaderV2{}), binary.Size(catalogContentEntryV1{})
+	case 2:
+		hdr, entry = binary.Size(serializedCatalogHeaderV2{}), binary.Size(catalogContentEntryV3{})
+	case 3:
+		hdr, entry = binary.Size(serializedCatalogHeaderV2{})+4, binary.Size(catalogContentEntryV3{})
+	case 4:
+		entry = binary.Size(catalogContentEntryV4{})
+	case 5:
+		entry = binary.Size(catalogContentEntryV5{})
+	}
+	return int64(hdr) + int64(n)*int64(entry)
+}
+
+// maxMetadataLen bounds the bytes read when decoding document metadata
+const maxMetadataLen = 4096
+
+const labelsMagic uint32 = 'L'<<24 | 'B'<<16 | 'L'<<8 | 'S'
+
+type serializedLabelsHeader struct {
+	Magic      uint32
+	Version    uint32
+	NumEntries uint32 // Number of documents
+
+	// Followed by NumEntries of uvarint label count and uvarint label indices
+}
+
+// Index represents a search index and corpus that can be queried. Once
+// loaded an Index is safe for concurrent use by multiple goroutines, each
+// query reads the index files through its own cursor.
+type Index struct {
+	filenames       *stringTable
+	words           *stringTable
+	offsets         []serializedWordIndexOffset
+	contentEntry    []catalogContentEntry
+	codec           Codec   // Compression of the catalog content
+	wordOffsets     []int64 // Offset of the matches of each word in the search index, by word index
+	prefixTree      *Trie   // Only set once prefixTreeReady is closed, see trie
+	prefixTreeErr   error
+	prefixTreeReady chan struct{}
+	facetCols       *facetColumns // Only set once facetColsReady is closed, see facetColumns
+	facetColsReady  chan struct{}
+	stopFacetCols   context.CancelFunc
+	labels          []string
+	docLabelStart   []uint32 // docLabels[docLabelStart[i]:docLabelStart[i+1]] are the labels of file index i
+	docLabels       []uint32
+	meta            IndexMetadata
+	fingerprint     string   // See Fingerprint
+	docLens         []uint32 // Number of words in each document
+	avgDocLen       float64
+	CorpusSize      int
+	Ranking         Ranking        // How search results are scored and ordered
+	BM25            BM25Parameters // Used when Ranking is Ranking_BM25
+	Proximity       float64        // Weight of the boost for query words found close together, 0 to disable
+	Cache           *QueryCache    // Caches ranked search results if not nil
+	QueryThreads    int            // Query terms read at once, GOMAXPROCS if 0
+
+	src            indexSource // The directory or bundle the index was loaded from
+	indexRdr       indexFile   // The search index is memory mapped
+	indexVersion   uint32      // Format version of the search index
+	catalogVersion uint32      // Format version of the catalog
+	catalogRdr     indexFile   // The compressed catalog is memory mapped
+	shardRdrs      []indexFile // Catalog content shards, if the catalog is sharded
+	trieRdr        indexFile   // The prefix tree if it is searched in place
+	files          *openFiles  // Everything above that is open, see Close
+	cleanup        runtime.Cleanup
+
+	filenameOrderOnce sync.Once
+	sortedFilenames   []int // Filename indices in filename order, see filenameOrder
 }
 
 // LoadIndexFromDisk reads in data files generated by the indexer and wires
-// everything up in memory. It prints various pieces of information to w.
+// everything up in memory. indexdir is either the directory the index was
+// written to or an index bundle, see BundleFS. It writes a line to w as each
+// part of the index is loaded, w can be nil to load silently.
 func LoadIndexFromDisk(indexdir string, w io.Writer) (*Index, error) {
-	idx := &Index{}
+	return LoadIndex(indexdir, w, LoadOptions{})
+}
 
+// LoadEncryptedIndexFromDisk is LoadIndexFromDisk for an index that was
+// encrypted with IndexBuilder.EncryptionKey. key must be the same key.
+func LoadEncryptedIndexFromDisk(indexdir string, w io.Writer, key []byte) (*Index, error) {
+	return LoadIndex(indexdir, w, LoadOptions{Key: key})
+}
+
+// LoadOptions control how LoadIndex loads an index.
+type LoadOptions struct {
+	// Key decrypts an index encrypted with IndexBuilder.EncryptionKey.
+	Key []byte
+
+	// Minimal only loads what QueryIndex, Search and CatalogContent need, for
+	// batch jobs that are short of memory. The prefix tree and the labels are
+	// not loaded, so there is no autocomplete, spelling correction, folder
+	// facets or label filtering, and the word offsets table is dropped once
+	// the offset of each word is known.
+	Minimal bool
+
+	// Strict checks that the files of the index agree with each other as
+	// they are loaded: that the entry counts match, every offset is in
+	// range and the file versions were written together. Unlike
+	// VerifyIndex it doesn't read every match and email. The problems are
+	// returned together in a *VerifyReport. The checksums of the search
+	// index and the catalog are verified before loading too, rather than
+	// when they are first read.
+	Strict bool
+
+	// SkipChecksums doesn't verify the checksums in metadata.json. The
+	// files read as the index loads are otherwise verified before loading,
+	// and the search index and the catalog, which hold almost all of the
+	// data, by the first read of each. Damage is then only found if the
+	// damaged part is read.
+	SkipChecksums bool
+
+	// InMemory reads the files that are otherwise memory mapped, the search
+	// index, the catalog and the prefix tree, into memory. Searches never
+	// wait for pages to be read from disk, but the whole index has to fit
+	// in memory and takes longer to load.
+	InMemory bool
+
+	// SkipPrefixTree doesn't load the prefix tree, for programs that don't
+	// need autocomplete or spelling suggestions. Unlike Minimal the rest of
+	// the index is loaded.
+	SkipPrefixTree bool
+
+	// Logger, if not nil, receives the messages LoadIndex writes as each
+	// part of the index is loaded, in place of the w passed to it.
+	Logger Logger
+}
+
+// logger returns where LoadIndex writes its messages, nowhere if neither
+// Logger nor w are set.
+func (o LoadOptions) logger(w io.Writer) Logger {
+	switch {
+	case o.Logger != nil:
+		return o.Logger
+	case w != nil:
+		return writerLogger{w}
+	}
+	return discardLogger{}
+}
+
+// LoadIndex is LoadIndexFromDisk with options.
+func LoadIndex(indexdir string, w io.Writer, opts LoadOptions) (*Index, error) {
+	idx := &Index{BM25: DefaultBM25, Proximity: DefaultProximity, files: &openFiles{}}
+	if err := idx.load(indexdir, opts.logger(w), opts); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	// An index that is dropped without being closed has its files closed
+	// once it is garbage collected
+	idx.cleanup = runtime.AddCleanup(idx, func(files *openFiles) { files.close() }, idx.files)
+	return idx, nil
+}
+
+// load loads the index at indexdir into idx, see LoadIndex.
+func (idx *Index) load(indexdir string, log Logger, opts LoadOptions) error {
 	var (
 		err    error
 		mb, ma runtime.MemStats
 		ha     uint64
 	)
 
+	if idx.src, err = openIndexSource(indexdir); err != nil {
+		return err
+	}
+	idx.files.add(idx.src)
+
+	// Check the files are intact before reading any of them
+	if idx.meta, err = loadIndexMetadata(idx.src); err != nil {
+		return err
+	}
+	if err = checkAnalyzer(idx.meta); err != nil {
+		return err
+	}
+	idx.fingerprint = idx.meta.fingerprint()
+	if len(idx.meta.Synonyms) > 0 {
+		log.Printf("Loaded index metadata: %d words with synonyms", len(idx.meta.Synonyms))
+	}
+	var lazy map[string]string // Checksums verified on first read, see checkedFile
+	if !opts.SkipChecksums {
+		checksums := remoteChecksums(idx.src, idx.meta.Checksums)
+		if !opts.Strict {
+			checksums, lazy = splitChecksums(checksums)
+			// The checksums are of the encrypted files, whose chunks are
+			// authenticated as they are decrypted instead
+			for _, name := range idx.meta.Encrypted {
+				delete(lazy, name)
+			}
+		}
+		if err = verifyChecksums(idx.src, checksums); err != nil {
+			return err
+		}
+		if len(checksums) > 0 {
+			log.Printf("Verified checksums of %d files", len(checksums))
+		}
+	}
+	if len(idx.meta.Encrypted) > 0 {
+		if opts.Key == nil {
+			return errors.New("index is encrypted, a key is needed to load it")
+		}
+		if idx.src, err = newDecryptSource(idx.src, opts.Key, idx.meta.Encrypted); err != nil {
+			return err
+		}
+		log.Printf("Decrypting %d files", len(idx.meta.Encrypted))
+	}
+	if opts.InMemory {
+		idx.src = memSource{idx.src}
+	}
+
+	// The string tables are read in place where reading them is cheap
+	inPlace := readsInPlace(idx.src)
 	runtime.ReadMemStats(&mb)
-	if idx.filenames, err = loadStringTable(filepath.Join(indexdir, FilenamesStringTable)); err != nil {
-		return nil, err
+	if idx.filenames, err = idx.openStringTable(FilenamesStringTable, inPlace); err != nil {
+		return err
 	}
 	runtime.ReadMemStats(&ma)
 	ha = ma.HeapAlloc - mb.HeapAlloc
-	fmt.Fprintf(w, "Loaded filename strings table: %d entries (%s)\n", len(idx.filenames), memPretty(ha))
+	log.Printf("Loaded filename strings table: %d entries (%s)", idx.filenames.Len(), memPretty(ha))
 
 	mb = ma
-	if idx.words, err = loadStringTable(filepath.Join(indexdir, WordsStringTable)); err != nil {
-		return nil, err
+	if idx.words, err = idx.openStringTable(WordsStringTable, inPlace); err != nil {
+		return err
 	}
 	runtime.ReadMemStats(&ma)
 	ha = ma.HeapAlloc - mb.HeapAlloc
-	fmt.Fprintf(w, "Loaded words strings table: %d entries (%s)\n", len(idx.words), memPretty(ha))
+	log.Printf("Loaded words strings table: %d entries (%s)", idx.words.Len(), memPretty(ha))
 
 	mb = ma
-	idx.offsets, err = loadOffsetsTable(filepath.Join(indexdir, IndexWordOffsets))
+	err = readIndexFile(idx.src, IndexWordOffsets, func(r *bufio.Reader) (err error) {
+		idx.offsets, err = loadOffsetsTable(r)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 	runtime.ReadMemStats(&ma)
 	ha = ma.HeapAlloc - mb.HeapAlloc
-	fmt.Fprintf(w, "Loaded word offsets table: %d entries (%s)\n", len(idx.offsets), memPretty(ha))
+	log.Printf("Loaded word offsets table: %d entries (%s)", len(idx.offsets), memPretty(ha))
 
-	if len(idx.offsets) != len(idx.words) {
-		return nil, fmt.Errorf("data mismatch")
+	if len(idx.offsets) != idx.words.Len() && !opts.Strict {
+		return &CorruptError{IndexWordOffsets, fmt.Errorf("%d entries but %s has %d words", len(idx.offsets), WordsStringTable, idx.words.Len())}
 	}
 
-	idx.buildWordOffsetsMap()
+	idx.buildWordOffsets()
 
-	mb = ma
-	idx.prefixTree, err = loadPrefixTree(filepath.Join(indexdir, QueryPrefixTree))
-	if err != nil {
-		return nil, err
+	if !opts.Minimal {
+		if err = idx.loadTrieAndLabels(log, !opts.SkipPrefixTree); err != nil {
+			return err
+		}
 	}
-	runtime.ReadMemStats(&ma)
-	ha = ma.HeapAlloc - mb.HeapAlloc
-	fmt.Fprintf(w, "Loaded prefix tree: %d nodes (%s)\n", idx.prefixTree.N, memPretty(ha))
 
 	// Memory map the index in
-	if idx.indexRdr, err = mmap.Open(filepath.Join(indexdir, CorpusIndex)); err != nil {
-		return nil, err
+	if idx.indexRdr, err = idx.src.Open(CorpusIndex); err != nil {
+		return fileError(CorpusIndex, err)
 	}
+	idx.files.add(idx.indexRdr)
 	// Read in the index header
 	var header serializedIndexHeader
-	if err = binary.Read(idx.indexRdr, binary.BigEndian, &header); err != nil {
-		return nil, err
+	indexHdr := bufio.NewReader(&readerAtCursor{r: idx.indexRdr})
+	if err = binary.Read(indexHdr, binary.BigEndian, &header); err != nil {
+		return fileError(CorpusIndex, err)
 	}
-	if header.Magic != indexMagic || header.Version != 1 {
-		return nil, fmt.Errorf("unsupported index version number %d", header.Version)
+	if err = checkHeader(header.Magic, indexMagic, header.Version, minIndexVersion, indexVersion); err != nil {
+		return fileError(CorpusIndex, err)
 	}
+	idx.indexVersion = header.Version
 	idx.CorpusSize = int(header.CorpusSize)
+	idx.avgDocLen = header.AvgDocLength
+	idx.docLens = make([]uint32, header.CorpusSize)
+	if err = binary.Read(indexHdr, binary.BigEndian, idx.docLens); err != nil {
+		return fileError(CorpusIndex, err)
+	}
+	idx.indexRdr = checkLater(idx.indexRdr, CorpusIndex, lazy)
 
-	// Memory map the catalog in
-	if idx.catalogRdr, err = mmap.Open(filepath.Join(indexdir, CorpusCatalog)); err != nil {
-		return nil, err
+	if err = idx.openCatalog(lazy); err != nil {
+		return err
+	}
+
+	if opts.Strict {
+		report := &VerifyReport{}
+		idx.checkIndex(report, false)
+		if !report.OK() {
+			return report
+		}
+		log.Printf("Checked the index files agree")
+	}
+	if opts.Minimal {
+		idx.offsets = nil
+	} else if !isRemote(indexdir) {
+		// Reading the metadata of every file takes a while, and a remote
+		// index would download most of its catalog
+		var ctx context.Context
+		ctx, idx.stopFacetCols = context.WithCancel(context.Background())
+		idx.facetColsReady = make(chan struct{})
+		go idx.loadFacetColumns(ctx)
+	}
+
+	return nil
+}
+
+// openCatalog memory maps the catalog and its shards in and reads the
+// catalog header. The files with checksums in lazy are verified when they
+// are first read.
+func (idx *Index) openCatalog(lazy map[string]string) error {
+	var err error
+	if idx.catalogRdr, err = idx.src.Open(CorpusCatalog); err != nil {
+		return fileError(CorpusCatalog, err)
 	}
+	idx.files.add(idx.catalogRdr)
 	// Read in the catalog header
-	if err := idx.loadCatalogHeader(idx.catalogRdr); err != nil {
-		return nil, err
+	numShards, err := idx.loadCatalogHeader(bufio.NewReader(&readerAtCursor{r: idx.catalogRdr}))
+	if err != nil {
+		return fileError(CorpusCatalog, err)
+	}
+	for n := range numShards {
+		shard, err := idx.src.Open(CatalogShardName(n))
+		if err != nil {
+			return fileError(CatalogShardName(n), err)
+		}
+		idx.files.add(shard)
+		idx.shardRdrs = append(idx.shardRdrs, checkLater(shard, CatalogShardName(n), lazy))
+	}
+	idx.catalogRdr = checkLater(idx.catalogRdr, CorpusCatalog, lazy)
+	if manifest := idx.meta.CatalogShards; len(manifest) > 0 && len(manifest) != numShards {
+		return &CorruptError{CorpusCatalog, fmt.Errorf("has %d shards but %s lists %d", numShards, IndexMetadataFile, len(manifest))}
 	}
+	return nil
+}
 
-	return idx, nil
+// loadTrieAndLabels starts loading the prefix tree, if withTrie is true,
+// and loads the labels.
+func (idx *Index) loadTrieAndLabels(log Logger, withTrie bool) error {
+	// The prefix tree is searched in place, but older indexes have one that
+	// takes a while to read into memory. It is only needed for autocomplete
+	// and spelling suggestions, so it is opened in the background. Opening
+	// the file here reports a missing file straight away.
+	if withTrie {
+		trie, err := idx.src.Open(QueryPrefixTree)
+		if err != nil {
+			return fileError(QueryPrefixTree, err)
+		}
+		idx.prefixTreeReady = make(chan struct{})
+		go idx.loadPrefixTree(trie)
+		log.Printf("Loading prefix tree in the background")
+	}
+
+	var mb, ma runtime.MemStats
+	runtime.ReadMemStats(&mb)
+	if err := idx.loadLabels(idx.src); err != nil {
+		return err
+	}
+	runtime.ReadMemStats(&ma)
+	log.Printf("Loaded labels: %d labels (%s)", len(idx.labels), memPretty(ma.HeapAlloc-mb.HeapAlloc))
+	return nil
 }
 
-// Finish closes out file memory mappings. It does free up allocated memory.
-func (idx *Index) Finish() {
-	if idx.indexRdr != nil {
-		idx.indexRdr.Close()
+// Close closes the files of the index, once the prefix tree and the facets
+// have finished loading from them, and returns any errors closing them. Searches and
+// other reads that start after the index is closed fail with ErrClosed.
+// Closing an index again does nothing.
+//
+// Close waits for the reads of the index that are under way, such as
+// searches and CatalogContent, to finish before it unmaps the files. Reads
+// that start once Close has been called fail with ErrClosed, and those that
+// are under way may stop early with it.
+func (idx *Index) Close() error {
+	if idx.files == nil {
+		return nil // Not loaded from files
 	}
-	if idx.catalogRdr != nil {
-		idx.catalogRdr.Close()
+	idx.trie()
+	if idx.stopFacetCols != nil {
+		idx.stopFacetCols()
+		<-idx.facetColsReady
 	}
+	idx.cleanup.Stop()
+	return idx.files.close()
 }
 
-type QueryWordMatch struct {
-	Word   string
-	Offset int
+// Finish closes the index, ignoring any error.
+//
+// Deprecated: Use Close.
+func (idx *Index) Finish() {
+	idx.Close()
 }
 
-type QueryResults struct {
-	Filename    string
-	WordMatches []QueryWordMatch
+// closed reports whether the index has been closed, or is being closed.
+// Reads under way check it to stop early.
+func (idx *Index) closed() bool {
+	return idx.files != nil && idx.files.isClosed()
+}
 
-	FilenameIndex int
+// acquire starts a read of the files of the index, which Close waits for.
+// It returns false if the index is closed, otherwise release must be
+// called once the read has finished. Until then the index is kept
+// reachable, so that the garbage collector doesn't close it either.
+func (idx *Index) acquire() (release func(), ok bool) {
+	if idx.files == nil {
+		return func() {}, true
+	}
+	if !idx.files.acquire() {
+		return nil, false
+	}
+	return func() {
+		idx.files.release()
+		runtime.KeepAlive(idx)
+	}, true
 }
 
-// instead of grouping find results by file, should we group by word?
-// how do we prefer if file A has all 3 query words, vs B which has 2?
-func (idx *Index) QueryIndex(querywords []string) ([]QueryResults, error) {
-	qwres := make([]map[int][]QueryWordMatch, len(querywords))
-	for i := range len(querywords) {
-		qwres[i] = make(map[int][]QueryWordMatch)
+// openFiles are the files an index has open, in the order they were
+// opened, and the number of reads of them under way.
+type openFiles struct {
+	mu      sync.Mutex
+	files   []io.Closer
+	closed  bool
+	readers int
+	idle    sync.Cond // Signalled when readers drops to 0, L is mu
+}
+
+// acquire counts a read of the files, unless they are closed.
+func (o *openFiles) acquire() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return false
 	}
+	o.readers++
+	return true
+}
 
-	for qi, query := range querywords {
-		lquery := strings.ToLower(query)
+// release ends a read counted by acquire.
+func (o *openFiles) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.readers--; o.readers == 0 {
+		o.idle.Broadcast()
+	}
+}
 
-		// Skip stop words
-		if isStopWord(lquery) {
-			continue
-		}
+// add adds f to the open files, or closes it if they have been closed.
+func (o *openFiles) add(f io.Closer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		f.Close()
+		return
+	}
+	o.files = append(o.files, f)
+}
 
-		offset, exists := idx.wordsToOffsets[lquery]
-		if !exists {
-			break
+// close closes the files in the reverse of the order they were opened,
+// once the reads under way have finished. No more reads can start.
+func (o *openFiles) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.idle.L = &o.mu
+	for o.readers > 0 {
+		o.idle.Wait()
+	}
+	var errs []error
+	for _, f := range slices.Backward(o.files) {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
 		}
+	}
+	o.files, o.closed = nil, true
+	return errors.Join(errs...)
+}
 
-		// Not possible to have a valid offset of 0 because these are file offsets and there is a header
-		if offset == 0 {
-			// Word not found in the offsets table, this is an error, ignore for now
-			return nil, nil
-		}
+func (o *openFiles) isClosed() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closed
+}
 
-		if _, err := idx.indexRdr.Seek(offset, io.SeekStart); err != nil {
-			return nil, fmt.Errorf("seek into index failed - %w", err)
-		}
+type QueryWordMatch struct {
+	Word     string
+	Field    Field  // The part of the email the word was found in
+	Offset   int    // Byte offset of the word from the start of the field
+	Length   int    // Byte length of the matched text, which can differ from Word
+	Position int    // Ordinal of the word amongst all the words in the field
+	Term     string // The query term matched, Word or a wildcard such as "budg*"
+}
 
-		numMatches, err := binary.ReadUvarint(idx.indexRdr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read index - %w", err)
-		}
+// term returns the query term of m, Word if the match doesn't record one.
+func (m QueryWordMatch) term() string {
+	if m.Term != "" {
+		return m.Term
+	}
+	return strings.ToLower(m.Word)
+}
+
+type QueryResults struct {
+	Filename    string
+	WordMatches []QueryWordMatch
+	Score       float64  // Relevance of the result, higher is better
+	Coverage    int      // Number of different query terms found, results are ordered by this first
+	Folders     []string // Gmail labels, or the directory of the file, see Folders
+	DocumentMetadata
 
-		// Read out the matches in files
-		for range numMatches {
-			fidx, _ := binary.ReadUvarint(idx.indexRdr)
-			numoff, _ := binary.ReadUvarint(idx.indexRdr)
+	FilenameIndex int
+}
 
-			// Read out the offsets for each file
-			matchOffsets := make([]uint32, numoff)
-			for j := range numoff {
-				off, err := binary.ReadUvarint(idx.indexRdr)
-				if err != nil {
-					return nil, fmt.Errorf("error reading from index: %w", err)
-				}
-				matchOffsets[j] = uint32(off)
+// QueryIndex returns the files that contain all of querywords, in rank order.
+func (idx *Index) QueryIndex(ctx context.Context, querywords []string) ([]QueryResults, error) {
+	return idx.QueryIndexFields(ctx, querywords)
+}
 
-				qwres[qi][int(fidx)] = append(qwres[qi][int(fidx)], QueryWordMatch{query, int(matchOffsets[j])})
-			}
+// QueryIndexFields is like QueryIndex but only matches words found in one of
+// fields. If no fields are given all fields are searched.
+func (idx *Index) QueryIndexFields(ctx context.Context, querywords []string, fields ...Field) ([]QueryResults, error) {
+	querywords = NormalizeQuery(querywords)
+
+	// Query words go through the same analysis as the text of the emails, so
+	// "Budget," finds budget and an email address finds the words it was
+	// indexed as
+	terms := make([]Query, 0, len(querywords))
+	for _, query := range querywords {
+		// Skip stop words and short words, they are not in the index
+		if q := Text(query, fields...); q != nil {
+			terms = append(terms, q)
 		}
 	}
 
-	// Intersect all the query result maps which implements keyword1 AND keyword2 AND ...
-	searchresults := intersectWordResults(qwres)
+	// keyword1 AND keyword2 AND ...
+	return idx.Search(ctx, And(terms...))
+}
 
-	// Sort the combined results so that matches are in increasing order
-	for _, wordmatches := range searchresults {
-		// Sort the words in each entry by increasing offset
-		slices.SortFunc[[]QueryWordMatch](wordmatches, func(a, b QueryWordMatch) int {
-			if a.Offset < b.Offset {
-				return -1
-			} else if a.Offset > b.Offset {
-				return 1
-			}
+// Search runs the query q against the index. It returns every matching
+// file in rank order, see SearchTop for when only the best are needed. The
+// search stops early with the context's error if ctx is done.
+func (idx *Index) Search(ctx context.Context, q Query) ([]QueryResults, error) {
+	res, err := idx.SearchTop(ctx, q, -1)
+	return res.Results, err
+}
 
-			return 0
-		})
-	}
+// SearchResults are the best results of a search along with totals for all
+// the files that matched.
+type SearchResults struct {
+	Results    []QueryResults // In rank order
+	NumResults int            // Number of files that matched
+	NumMatches int            // Number of word matches in all the files that matched
+	Facets     Facets         // Breakdown of all the files that matched
+}
 
-	// Sort the results in order of decreasing matches
-	// In cases when the number of matches is the same for now sort the filename
-	// lexicographically. TODO - a better scoring criteria would consider how many
-	// of the query words are in each file and secondly how close together they are
-	results := make([]QueryResults, 0, len(searchresults))
-	for fidx, wordmatches := range searchresults {
-		results = append(results, QueryResults{idx.filenames[fidx], wordmatches, fidx})
+// SearchTop runs the query q against the index and returns the k highest
+// ranked results, or all of them if k is negative. Only the returned results
+// are sorted and have their metadata read, so it is much cheaper than Search
+// for queries that match many files. If the index has a Cache the ranking is
+// looked up there first.
+func (idx *Index) SearchTop(ctx context.Context, q Query, k int) (SearchResults, error) {
+	return idx.SearchPage(ctx, q, 0, k)
+}
+
+// SearchPage runs the query q against the index and returns up to limit
+// results starting at the offset'th highest ranked, or all of them from the
+// offset if limit is negative. The totals are for every file that matched,
+// so NumResults tells how many pages there are. Like SearchTop only the
+// results up to the end of the page are sorted.
+func (idx *Index) SearchPage(ctx context.Context, q Query, offset, limit int) (SearchResults, error) {
+	release, ok := idx.acquire()
+	if !ok {
+		return SearchResults{}, ErrClosed
 	}
-	slices.SortFunc(results, func(a, b QueryResults) int {
-		la := len(a.WordMatches)
-		lb := len(b.WordMatches)
+	defer release()
 
-		if la < lb {
-			return 1
-		} else if la > lb {
-			return -1
+	offset = max(offset, 0)
+	k := -1
+	if limit >= 0 {
+		k = offset + limit
+	}
+	r, err := idx.rank(ctx, q)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	top := r.files
+	if !r.sorted {
+		if k >= 0 && k < len(top) {
+			top = idx.selectTop(top, k)
 		}
+		slices.SortFunc(top, idx.compareRank)
+	} else if k >= 0 && k < len(top) {
+		top = top[:k]
+	}
 
-		// Same number of matches, tie-breaker: filenames lexicographically
-		return strings.Compare(a.Filename, b.Filename)
-	})
-
-	return results, nil
+	top = top[min(offset, len(top)):]
+	res := r.totals()
+	res.Results = make([]QueryResults, len(top))
+	for i, rf := range top {
+		res.Results[i] = idx.result(rf, r.matches[rf.fidx])
+	}
+	return res, nil
 }
 
-// intersectWordResults combines the search results for the individual query words
-// together into a final result set. Currently this is done by computing the
-// intersection the separate results.
-func intersectWordResults(results []map[int][]QueryWordMatch) map[int][]QueryWordMatch {
-	if len(results) == 0 {
-		return nil
+// SearchStream is like SearchPage but returns the results as an iterator
+// that ranks them as it goes, along with the totals and facets, so the
+// first results can be shown before the others are ranked. Finding the
+// highest ranked result takes one pass over the files that matched and each
+// one after it a heap removal, rather than sorting them all up front. The
+// iterator stops early once ctx is done.
+func (idx *Index) SearchStream(ctx context.Context, q Query, offset, limit int) (SearchResults, iter.Seq[QueryResults], error) {
+	release, ok := idx.acquire()
+	if !ok {
+		return SearchResults{}, nil, ErrClosed
+	}
+	offset = max(offset, 0)
+	r, err := idx.rank(ctx, q)
+	release()
+	if err != nil {
+		return SearchResults{}, nil, err
 	}
 
-	final := make(map[int][]QueryWordMatch)
-	firstMap := results[0]
-
-	for k, v := range firstMap {
-		found := true
-		temp := slices.Clone(v) // do not modify firstMap
-
-		for _, m := range results[1:] {
-			if _, ok := m[k]; ok {
-				temp = append(temp, m[k]...)
-			} else {
-				found = false
-				break
+	results := func(yield func(QueryResults) bool) {
+		files := r.files
+		next := func() (rankedFile, bool) {
+			if len(files) == 0 {
+				return rankedFile{}, false
+			}
+			rf := files[0]
+			files = files[1:]
+			return rf, true
+		}
+		if !r.sorted {
+			h := &bestHeap{rankHeap{idx: idx, files: slices.Clone(r.files)}}
+			heap.Init(h)
+			next = func() (rankedFile, bool) {
+				if h.Len() == 0 {
+					return rankedFile{}, false
+				}
+				return heap.Pop(h).(rankedFile), true
 			}
 		}
-		if found {
-			final[k] = temp
+		for n := 0; limit < 0 || n < offset+limit; n++ {
+			rf, ok := next()
+			if !ok || ctx.Err() != nil {
+				return
+			}
+			if n < offset {
+				continue
+			}
+			// Each result is a read of its own, so a caller that is slow
+			// to take the results doesn't hold up Close
+			release, ok := idx.acquire()
+			if !ok {
+				return
+			}
+			res := idx.result(rf, r.matches[rf.fidx])
+			release()
+			if !yield(res) {
+				return
+			}
 		}
 	}
+	return r.totals(), results, nil
+}
 
-	return final
+// ranking is every file that matched a query, along with the totals of the
+// search.
+type ranking struct {
+	files      []rankedFile
+	sorted     bool // files are in rank order, otherwise in no order
+	matches    map[int][]QueryWordMatch
+	numMatches int
+	facets     Facets
 }
 
-// CatalogContent returns the content and filename of an indexed file.
-func (idx *Index) CatalogContent(filenameIdx int) (content []byte, filename string, ok bool) {
-	if filenameIdx < 0 || filenameIdx >= len(idx.filenames) {
-		return
+// totals returns the results of a search without any of the files.
+func (r ranking) totals() SearchResults {
+	return SearchResults{NumResults: len(r.matches), NumMatches: r.numMatches, Facets: r.facets}
+}
+
+// rank scores the files that match q, or looks them up in the Cache. Files
+// are only sorted when they go into the cache, so that any page can be
+// answered from it. The caller must have acquired the index.
+func (idx *Index) rank(ctx context.Context, q Query) (ranking, error) {
+	if idx.closed() {
+		return ranking{}, ErrClosed
+	}
+	if entry, ok := idx.Cache.get(idx, q); ok {
+		facets := Facets{slices.Clone(entry.facets.Folders), slices.Clone(entry.facets.Senders)}
+		return ranking{entry.ranked, true, entry.matches, entry.numMatches, facets}, nil
 	}
 
-	entry := &idx.contentEntry[filenameIdx]
-	if _, err := idx.catalogRdr.Seek(int64(entry.Offset), io.SeekStart); err != nil {
-		return
+	searchresults, err := q.eval(ctx, idx)
+	if err != nil {
+		return ranking{}, err
 	}
 
-	contents := make([]byte, entry.Length)
-	var (
-		gzr *gzip.Reader
-		err error
-	)
-	if gzr, err = gzip.NewReader(idx.catalogRdr); err != nil {
-		return
+	scores, err := idx.scoreResults(ctx, searchresults)
+	if err != nil {
+		return ranking{}, err
 	}
 
-	if _, err = io.ReadFull(gzr, contents); err != nil {
-		return
+	r := ranking{matches: searchresults}
+	for _, wordmatches := range searchresults {
+		r.numMatches += len(wordmatches)
+	}
+	if r.facets, err = idx.facets(ctx, searchresults); err != nil {
+		return ranking{}, err
 	}
 
-	return contents, idx.filenames[filenameIdx], true
+	r.files = make([]rankedFile, 0, len(searchresults))
+	for fidx, wordmatches := range searchresults {
+		r.files = append(r.files, rankedFile{fidx, coverage(wordmatches), len(wordmatches), scores[fidx]})
+	}
+	if idx.Cache != nil {
+		// Rank every file so the entry can answer any k
+		slices.SortFunc(r.files, idx.compareRank)
+		r.sorted = true
+		for _, wordmatches := range searchresults {
+			sortWordMatches(wordmatches)
+		}
+		idx.Cache.add(idx, &cacheEntry{key: idx.cacheKey(q), ranked: r.files, matches: searchresults, numMatches: r.numMatches, facets: r.facets})
+		r.facets = Facets{slices.Clone(r.facets.Folders), slices.Clone(r.facets.Senders)}
+	}
+	return r, nil
 }
 
-// Prefix returns a slice of strings of words in the index that have prefix
-// as their own prefix.
-//
-// The count determines the number of matching words to return:
-//   - n > 0: at most n matches
-//   - n == 0: the result in nil (no matches).
-//   - n < 0: all matches
-func (idx *Index) Prefix(prefix string, n int) []string {
-	if idx.prefixTree == nil || n == 0 {
-		return nil
+// result returns the result for a ranked file with its word matches.
+func (idx *Index) result(rf rankedFile, wordmatches []QueryWordMatch) QueryResults {
+	if idx.Cache != nil {
+		// Cached matches are already sorted, and shared with later searches
+		wordmatches = slices.Clone(wordmatches)
+	} else {
+		sortWordMatches(wordmatches)
 	}
 
-	matches := idx.prefixTree.FindWordsWithPrefix(strings.ToLower(prefix))
-
-	// Filter out stop words
-	matches = filterFunc(matches, func(s string) bool { return !isStopWord(s) })
-
-	if n < 0 {
-		return matches
+	meta, _ := idx.metadata(rf.fidx)
+	return QueryResults{
+		Filename:         idx.filenames.At(rf.fidx),
+		WordMatches:      wordmatches,
+		Score:            rf.score,
+		Coverage:         rf.coverage,
+		Folders:          idx.folders(rf.fidx),
+		DocumentMetadata: meta,
+		FilenameIndex:    rf.fidx,
 	}
+}
 
-	return matches[:min(len(matches), n)]
+// sortWordMatches sorts the words by field and then increasing offset.
+func sortWordMatches(wordmatches []QueryWordMatch) {
+	slices.SortFunc(wordmatches, func(a, b QueryWordMatch) int {
+		if a.Field != b.Field {
+			return int(a.Field) - int(b.Field)
+		}
+		if a.Offset < b.Offset {
+			return -1
+		} else if a.Offset > b.Offset {
+			return 1
+		}
+
+		return 0
+	})
 }
 
-// buildWordOffsetsMap combines the words stringset and the word index offset
-// table into a single map from word to index offset.
-func (idx *Index) buildWordOffsetsMap() {
-	idx.wordsToOffsets = make(map[string]int64)
+type rankedFile struct {
+	fidx     int
+	coverage int // Number of different query terms in the file
+	matches  int
+	score    float64
+}
 
-	// Walk the offsets table
-	for _, wo := range idx.offsets {
-		word := idx.words[wo.WordIndex]
-		idx.wordsToOffsets[word] = wo.Offset
+// compareRank orders files so that those containing more of the different
+// query words come first, no matter how often the other files repeat the
+// words they do contain. Files with the same coverage are ordered by
+// decreasing score, then by decreasing number of matches and finally by
+// filename.
+func (idx *Index) compareRank(a, b rankedFile) int {
+	if c := cmp.Compare(b.coverage, a.coverage); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(b.score, a.score); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(b.matches, a.matches); c != 0 {
+		return c
 	}
-}
 
-// filterFunc returns a new []string with only the elements of x for which f(x)
-// returns true.
-func filterFunc(x []string, f func(string) bool) []string {
-	out := make([]string, 0, len(x))
+	// Tie-breaker: filenames lexicographically
+	return strings.Compare(idx.filenames.At(a.fidx), idx.filenames.At(b.fidx))
+}
 
-	for _, a := range x {
-		if f(a) {
-			out = append(out, a)
+// selectTop returns the k highest ranked of files, in no particular order. It
+// keeps the best so far in a heap with the lowest ranked at the root.
+func (idx *Index) selectTop(files []rankedFile, k int) []rankedFile {
+	h := &rankHeap{idx: idx, files: make([]rankedFile, 0, k)}
+	for _, rf := range files {
+		switch {
+		case len(h.files) < k:
+			heap.Push(h, rf)
+		case k > 0 && idx.compareRank(rf, h.files[0]) < 0:
+			h.files[0] = rf
+			heap.Fix(h, 0)
 		}
 	}
+	return h.files
+}
 
-	return out
+// rankHeap is a heap.Interface of files with the lowest ranked at the root.
+type rankHeap struct {
+	idx   *Index
+	files []rankedFile
 }
 
-// loadStringTable loads a serialized string table from disk and returns it
-// as []string. The order of entries in []string matches that in the file.
-func loadStringTable(filename string) ([]string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
+func (h *rankHeap) Len() int           { return len(h.files) }
+func (h *rankHeap) Less(i, j int) bool { return h.idx.compareRank(h.files[i], h.files[j]) > 0 }
+func (h *rankHeap) Swap(i, j int)      { h.files[i], h.files[j] = h.files[j], h.files[i] }
+func (h *rankHeap) Push(x any)         { h.files = append(h.files, x.(rankedFile)) }
+func (h *rankHeap) Pop() any {
+	rf := h.files[len(h.files)-1]
+	h.files = h.files[:len(h.files)-1]
+	return rf
+}
 
-	rdr := bufio.NewReader(f)
-	hdr := serializedStringSetHeader{}
-	if err = binary.Read(rdr, binary.BigEndian, &hdr); err != nil {
+// bestHeap is a heap.Interface of files with the highest ranked at the root.
+type bestHeap struct{ rankHeap }
+
+func (h *bestHeap) Less(i, j int) bool { return h.idx.compareRank(h.files[i], h.files[j]) < 0 }
+
+// ctxCheckInterval is how many matches of a word are read between checks
+// for a cancelled query.
+const ctxCheckInterval = 4096
+
+// lookupWord reads the matches of a word from the index. The matches are
+// grouped by file index. Only matches in fields are returned, or all matches
+// if fields is empty. If files is not nil only matches in those files are
+// returned, the others are skipped without decoding them.
+func (idx *Index) lookupWord(ctx context.Context, query string, fields []Field, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	if hdr.Magic != stringSetMagic || hdr.Version != 1 {
-		return nil, fmt.Errorf("unsupported string set version number %d", hdr.Version)
+	res := make(map[int][]QueryWordMatch)
+
+	offset, exists := idx.wordOffset(strings.ToLower(query))
+	if !exists {
+		return res, nil
 	}
 
-	strings := make([]string, hdr.NStrings)
-	scratch := make([]byte, hdr.MaxLen)
+	// Each lookup has its own cursor so that queries can run concurrently
+	rdr := &readerAtCursor{r: idx.indexRdr, off: offset}
 
-	for i := range hdr.NStrings {
-		slen, err := binary.ReadUvarint(rdr)
+	numMatches, err := skipWordFiles(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read out the matches in files
+	var i int
+	err = idx.matchHeaders(rdr, numMatches, files, func(h matchHeader) error {
+		// Common words have long posting lists, give up on them promptly
+		if i++; i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if (len(fields) > 0 && !slices.Contains(fields, h.field)) || (files != nil && !files.Contains(uint32(h.fidx))) {
+			return nil
+		}
+
+		// Read out the offsets, positions and lengths of the occurrences
+		var err error
+		res[h.fidx], err = h.appendOccurrences(res[h.fidx], query)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// TermFrequencies returns the number of times word occurs in each file that
+// contains it, keyed by filename index. If fields are given only occurrences
+// in those fields are counted. Unlike a query it does not decode the offsets
+// and positions of the occurrences, so it is the cheaper choice for ranking.
+func (idx *Index) TermFrequencies(word string, fields ...Field) (map[int]int, error) {
+	release, ok := idx.acquire()
+	if !ok {
+		return nil, ErrClosed
+	}
+	defer release()
+	res := make(map[int]int)
+
+	offset, exists := idx.wordOffset(strings.ToLower(word))
+	if !exists {
+		return res, nil
+	}
+
+	// Each lookup has its own cursor so that queries can run concurrently
+	rdr := &readerAtCursor{r: idx.indexRdr, off: offset}
+
+	numMatches, err := skipWordFiles(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = idx.matchHeaders(rdr, numMatches, nil, func(h matchHeader) error {
+		if len(fields) == 0 || slices.Contains(fields, h.field) {
+			res[h.fidx] += h.tf
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// matchHeader is what the index records about a match of a word besides
+// its occurrences.
+type matchHeader struct {
+	fidx   int
+	field  Field
+	tf     int         // Number of occurrences
+	occRdr io.ReaderAt // The index, or the decompressed block of the match
+	occOff int64       // Offset of the occurrences in occRdr
+}
+
+// occurrences returns a cursor at the occurrences of the match.
+func (h matchHeader) occurrences() *readerAtCursor {
+	return &readerAtCursor{r: h.occRdr, off: h.occOff}
+}
+
+// appendOccurrences reads the offsets, positions and lengths of the
+// occurrences of the match of word and appends them to matches.
+func (h matchHeader) appendOccurrences(matches []QueryWordMatch, word string) ([]QueryWordMatch, error) {
+	occRdr := h.occurrences()
+	for range h.tf {
+		off, err := binary.ReadUvarint(occRdr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading from index: %w", err)
+		}
+		pos, err := binary.ReadUvarint(occRdr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading from index: %w", err)
+		}
+		length, err := binary.ReadUvarint(occRdr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading from index: %w", err)
+		}
+
+		matches = append(matches, QueryWordMatch{word, h.field, int(off), int(length), int(pos), word})
+	}
+	return matches, nil
+}
+
+// matchHeaders calls yield with the header of each of the numMatches
+// matches of a word. rdr is positioned after the number of matches. The
+// occurrences are not read, and are only valid until yield returns. If
+// files is not nil matches in other files may be skipped, but not all of
+// them are. It stops at the first error yield returns.
+func (idx *Index) matchHeaders(rdr *readerAtCursor, numMatches uint64, files *roaring.Bitmap, yield func(matchHeader) error) error {
+	if idx.indexVersion >= 10 {
+		return idx.blockMatchHeaders(rdr, numMatches, files, yield)
+	}
+
+	// From version 9 the occurrences of all the matches follow the headers,
+	// before that each header was followed by its occurrences
+	split := idx.indexVersion >= 9
+	var occOff int64
+	if split {
+		hdrLen, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return fmt.Errorf("error reading from index: %w", err)
+		}
+		occOff = rdr.off + int64(hdrLen)
+	}
+
+	var fidx uint64
+	for range numMatches {
+		// From version 8 the filename index is the difference from the
+		// previous match
+		delta, _ := binary.ReadUvarint(rdr)
+		if idx.indexVersion >= 8 {
+			fidx += delta
+		} else {
+			fidx = delta
+		}
+		field, _ := binary.ReadUvarint(rdr)
+		tf, _ := binary.ReadUvarint(rdr)
+		occLen, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return fmt.Errorf("error reading from index: %w", err)
+		}
+
+		h := matchHeader{int(fidx), Field(field), int(tf), idx.indexRdr, occOff}
+		if split {
+			occOff += int64(occLen)
+		} else {
+			h.occOff = rdr.off
+			rdr.off += int64(occLen)
+		}
+		if err := yield(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postingBlock is an entry in the table of blocks of a word's matches.
+type postingBlock struct {
+	last       uint64 // Filename index of the last match in the block
+	off        int64  // Offset of the block in the index
+	size       int64  // Stored size of the block
+	compressed bool
+}
+
+// blockMatchHeaders is matchHeaders for the blocks of version 10 indexes.
+func (idx *Index) blockMatchHeaders(rdr *readerAtCursor, numMatches uint64, files *roaring.Bitmap, yield func(matchHeader) error) error {
+	if numMatches > uint64(idx.indexRdr.Len()) {
+		return fmt.Errorf("%d matches is out of range", numMatches)
+	}
+	blocks := make([]postingBlock, (numMatches+postingBlockSize-1)/postingBlockSize)
+	var last uint64
+	for i := range blocks {
+		delta, _ := binary.ReadUvarint(rdr)
+		size, err := binary.ReadUvarint(rdr)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error reading from index: %w", err)
+		}
+		last += delta
+		blocks[i] = postingBlock{last: last, size: int64(size >> 1), compressed: size&1 == 1}
+	}
+	off := rdr.off
+	for i := range blocks {
+		blocks[i].off = off
+		off += blocks[i].size
+	}
+
+	var raw, decoded []byte
+	readBlock := func(i int) error {
+		b := blocks[i]
+		n := min(numMatches-uint64(i)*postingBlockSize, postingBlockSize)
+
+		// A file's matches can straddle two blocks, so the block can start
+		// with the last file of the previous block
+		var first uint64
+		if i > 0 {
+			first = blocks[i-1].last
+		}
+
+		if b.size > int64(idx.indexRdr.Len()) {
+			return fmt.Errorf("posting block of %d bytes is out of range", b.size)
+		}
+		var blk io.ReaderAt = idx.indexRdr
+		start := b.off
+		if b.compressed {
+			raw = slices.Grow(raw[:0], int(b.size))[:b.size]
+			if _, err := idx.indexRdr.ReadAt(raw, b.off); err != nil {
+				return fmt.Errorf("error reading from index: %w", err)
+			}
+			var err error
+			if decoded, err = s2.Decode(decoded[:cap(decoded)], raw); err != nil {
+				return fmt.Errorf("error decompressing index: %w", err)
+			}
+			blk, start = bytes.NewReader(decoded), 0
+		}
+
+		brdr := &readerAtCursor{r: blk, off: start}
+		hdrLen, err := binary.ReadUvarint(brdr)
+		if err != nil {
+			return fmt.Errorf("error reading from index: %w", err)
+		}
+		occOff := brdr.off + int64(hdrLen)
+		mfidx := first
+		for range n {
+			delta, _ := binary.ReadUvarint(brdr)
+			field, _ := binary.ReadUvarint(brdr)
+			tf, _ := binary.ReadUvarint(brdr)
+			occLen, err := binary.ReadUvarint(brdr)
+			if err != nil {
+				return fmt.Errorf("error reading from index: %w", err)
+			}
+			mfidx += delta
+			if err := yield(matchHeader{int(mfidx), Field(field), int(tf), blk, occOff}); err != nil {
+				return err
+			}
+			occOff += int64(occLen)
+		}
+		return nil
+	}
+
+	// When there are fewer files than blocks, as when a rare word is
+	// searched for with a common one, each file gallops ahead to the block
+	// that can hold it rather than every block being checked for files
+	if files != nil && files.GetCardinality() < uint64(len(blocks)) {
+		return gallopBlocks(blocks, files, readBlock)
+	}
+
+	for i, b := range blocks {
+		var first uint64
+		if i > 0 {
+			first = blocks[i-1].last
+		}
+		if files != nil && !files.IntersectsWithInterval(first, b.last+1) {
+			continue
+		}
+		if err := readBlock(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gallopBlocks calls read with the index of each of blocks that may hold a
+// match in files, in order. A block is read if files has a file from the
+// last of the previous block to its own last, the same blocks the scan in
+// blockMatchHeaders reads.
+func gallopBlocks(blocks []postingBlock, files *roaring.Bitmap, read func(int) error) error {
+	it := files.Iterator()
+	i, next := 0, 0 // The block a file is searched for from, and the first block not yet read
+	for it.HasNext() {
+		fidx := uint64(it.Next())
+		if i = gallop(blocks, i, fidx); i == len(blocks) {
+			break
 		}
 
-		if _, err := io.ReadFull(rdr, scratch[:slen]); err != nil {
-			return nil, err
+		// The file is in this block and any that follow starting with it
+		for j := i; j < len(blocks); j++ {
+			if j >= next {
+				if err := read(j); err != nil {
+					return err
+				}
+				next = j + 1
+			}
+			if blocks[j].last != fidx {
+				break
+			}
 		}
-		strings[i] = string(scratch[:slen])
+
+		// The rest of the files up to the end of the block are in it
+		it.AdvanceIfNeeded(uint32(blocks[i].last))
+	}
+	return nil
+}
+
+// gallop returns the first of blocks from i whose last file is fidx or
+// after, or len(blocks) if there is none. It doubles the step until it
+// passes fidx and then binary searches the last step, so it takes time
+// logarithmic in the distance moved rather than the number of blocks.
+func gallop(blocks []postingBlock, i int, fidx uint64) int {
+	if i >= len(blocks) || blocks[i].last >= fidx {
+		return i
+	}
+	lo, step := i, 1 // blocks[lo].last < fidx
+	for lo+step < len(blocks) && blocks[lo+step].last < fidx {
+		lo += step
+		step *= 2
 	}
+	hi := min(lo+step, len(blocks))
+	n, _ := slices.BinarySearchFunc(blocks[lo+1:hi], fidx, func(b postingBlock, fidx uint64) int {
+		return cmp.Compare(b.last, fidx)
+	})
+	return lo + 1 + n
+}
 
-	return strings, nil
+// skipWordFiles skips over the set of files at the start of a word's entry
+// in the index and returns the number of matches that follow it.
+func skipWordFiles(rdr *readerAtCursor) (uint64, error) {
+	n, err := binary.ReadUvarint(rdr)
+	if err == nil {
+		_, err = rdr.Seek(int64(n), io.SeekCurrent)
+	}
+	if err == nil {
+		n, err = binary.ReadUvarint(rdr)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read index - %w", err)
+	}
+	return n, nil
 }
 
-func loadOffsetsTable(filename string) ([]serializedWordIndexOffset, error) {
-	f, err := os.Open(filename)
+// wordFiles returns the set of files containing word in any field, read from
+// the index without decoding the matches.
+func (idx *Index) wordFiles(word string) (*roaring.Bitmap, error) {
+	files := roaring.New()
+	offset, exists := idx.wordOffset(strings.ToLower(word))
+	if !exists {
+		return files, nil
+	}
+
+	rdr := &readerAtCursor{r: idx.indexRdr, off: offset}
+	n, err := binary.ReadUvarint(rdr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read index - %w", err)
+	}
+	if n > uint64(idx.indexRdr.Len()) {
+		return nil, fmt.Errorf("file set of %q is out of range", word)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rdr, buf); err != nil {
+		return nil, fmt.Errorf("failed to read index - %w", err)
+	}
+	if err := files.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("file set of %q is malformed - %w", word, err)
+	}
+	return files, nil
+}
+
+// intersectWordResults combines the search results for the individual query words
+// together into a final result set. Currently this is done by computing the
+// intersection the separate results.
+func intersectWordResults(results []map[int][]QueryWordMatch) map[int][]QueryWordMatch {
+	if len(results) == 0 {
+		return nil
+	}
+
+	// Only the files of the rarest result can be in all of them, and the
+	// rarer results are the likeliest to be missing a file so they are
+	// probed first. The matches of a file are only copied once it is known
+	// to be in all of them.
+	bySize := slices.Clone(results)
+	slices.SortFunc(bySize, func(a, b map[int][]QueryWordMatch) int { return len(a) - len(b) })
+	final := make(map[int][]QueryWordMatch, len(bySize[0]))
+
+next:
+	for k := range bySize[0] {
+		n := 0
+		for _, m := range bySize[1:] {
+			matches, ok := m[k]
+			if !ok {
+				continue next
+			}
+			n += len(matches)
+		}
+		n += len(bySize[0][k])
+		temp := make([]QueryWordMatch, 0, n) // do not modify the results
+		for _, m := range results {
+			temp = append(temp, m[k]...)
+		}
+		final[k] = temp
+	}
+
+	return final
+}
+
+// CatalogContent returns the content and filename of an indexed file. It
+// gives up if ctx is done before the content is decompressed, or if the
+// index has been closed. See ReadContent for why it failed.
+func (idx *Index) CatalogContent(ctx context.Context, filenameIdx int) (content []byte, filename string, ok bool) {
+	content, filename, err := idx.ReadContent(ctx, filenameIdx)
+	return content, filename, err == nil
+}
+
+// ReadContent is CatalogContent returning why it failed: the context's
+// error if ctx is done, ErrClosed, ErrNotFound for a file index that isn't
+// in the index, or a *CorruptError if the content can't be read, a
+// *ChecksumError if the catalog doesn't match its checksum.
+func (idx *Index) ReadContent(ctx context.Context, filenameIdx int) ([]byte, string, error) {
+	if filenameIdx < 0 || filenameIdx >= idx.filenames.Len() || filenameIdx >= len(idx.contentEntry) {
+		return nil, "", ErrNotFound
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	release, ok := idx.acquire()
+	if !ok {
+		return nil, "", ErrClosed
+	}
+	defer release()
+	filename := idx.filenames.At(filenameIdx)
+	contentError := func(err error) error {
+		return &CorruptError{CorpusCatalog, fmt.Errorf("content of %s: %w", filename, err)}
+	}
+
+	contents := make([]byte, idx.contentEntry[filenameIdx].Length)
+	if compressed, release, found := idx.compressedContent(filenameIdx); found {
+		// Decompress the whole email in one go
+		err := decompress(contents, compressed, idx.codec)
+		release()
+		if err != nil {
+			return nil, "", contentError(err)
+		}
+	} else {
+		dr, found := idx.openContent(filenameIdx)
+		if !found {
+			if idx.closed() {
+				return nil, "", ErrClosed
+			}
+			if rdr, _, ok := idx.contentFile(filenameIdx); ok {
+				if err := checksumError(rdr); err != nil {
+					return nil, "", err
+				}
+			}
+			return nil, "", contentError(errors.New("out of range"))
+		}
+		defer dr.Close()
+		if _, err := io.ReadFull(ctxReader{ctx, dr}, contents); err != nil {
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			return nil, "", contentError(err)
+		}
+	}
+
+	return contents, filename, nil
+}
+
+// readerAtCursor reads from r at its own offset, leaving the offset of r
+// alone. Any number of cursors can read from r at the same time.
+type readerAtCursor struct {
+	r   io.ReaderAt
+	off int64
+}
+
+func (c *readerAtCursor) Read(p []byte) (int, error) {
+	n, err := c.r.ReadAt(p, c.off)
+	c.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (c *readerAtCursor) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := c.r.ReadAt(b[:], c.off); err != nil {
+		return 0, err
+	}
+	c.off++
+	return b[0], nil
+}
+
+// Seek supports io.SeekStart and io.SeekCurrent.
+func (c *readerAtCursor) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.off
+	default:
+		return 0, fmt.Errorf("unsupported whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	c.off = offset
+	return offset, nil
+}
+
+// ctxReader is a reader that fails with the context's error once ctx is
+// done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// openContent returns a reader of the decompressed content of a file. The
+// content is decompressed as it is read. The reader must be closed after use.
+func (idx *Index) openContent(filenameIdx int) (io.ReadCloser, bool) {
+	if compressed, release, ok := idx.compressedContent(filenameIdx); ok {
+		dr, err := newDecompressor(bytes.NewReader(compressed), idx.codec)
+		if err != nil {
+			release()
+			return nil, false
+		}
+		return &contentReader{dr, release}, true
+	}
+
+	// Catalogs written before the compressed length was recorded are read
+	// until the decompressor stops
+	rdr, entry, ok := idx.contentFile(filenameIdx)
+	if !ok || entry.CompressedLength > 0 {
+		return nil, false
+	}
+	content := io.NewSectionReader(rdr, int64(entry.Offset), int64(rdr.Len())-int64(entry.Offset))
+	dr, err := newDecompressor(content, idx.codec)
+	if err != nil {
+		return nil, false
+	}
+	return dr, true
+}
+
+// contentFile returns the catalog file holding the content of a file and
+// its catalog entry.
+func (idx *Index) contentFile(filenameIdx int) (indexFile, *catalogContentEntry, bool) {
+	if filenameIdx < 0 || filenameIdx >= len(idx.contentEntry) || idx.closed() {
+		return nil, nil, false
+	}
+
+	entry := &idx.contentEntry[filenameIdx]
+	rdr := idx.catalogRdr
+	if len(idx.shardRdrs) > 0 {
+		if int(entry.Shard) >= len(idx.shardRdrs) {
+			return nil, nil, false
+		}
+		rdr = idx.shardRdrs[entry.Shard]
+	}
+	return rdr, entry, true
+}
+
+// compressedContent returns the compressed content of a file, if its length
+// is recorded in the catalog. release must be called once the content has
+// been decompressed.
+//
+// The content of a file held in memory is used where it is. Otherwise it is
+// read with a single ReadAt, which for a remote index is a single request,
+// into a pooled buffer. go-mmap doesn't give access to the mapped bytes, so
+// the content of a memory mapped file is copied from the page cache.
+func (idx *Index) compressedContent(filenameIdx int) (compressed []byte, release func(), ok bool) {
+	rdr, entry, ok := idx.contentFile(filenameIdx)
+	if !ok || entry.CompressedLength == 0 || entry.Offset+entry.CompressedLength > uint64(rdr.Len()) {
+		return nil, nil, false
+	}
+	off, n := int64(entry.Offset), int64(entry.CompressedLength)
+
+	if s, ok := rdr.(slicer); ok {
+		if compressed, ok := s.slice(off, n); ok {
+			return compressed, func() {}, true
+		}
+	}
+
+	buf := contentBuffers.Get().(*[]byte)
+	*buf = slices.Grow((*buf)[:0], int(n))[:n]
+	if _, err := rdr.ReadAt(*buf, off); err != nil {
+		contentBuffers.Put(buf)
+		return nil, nil, false
+	}
+	return *buf, func() { contentBuffers.Put(buf) }, true
+}
+
+// contentBuffers hold the compressed content of memory mapped and remote
+// files while it is decompressed.
+var contentBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// contentReader releases the compressed content once the decompressor
+// reading it is closed.
+type contentReader struct {
+	io.ReadCloser
+	release func()
+}
+
+func (c *contentReader) Close() error {
+	err := c.ReadCloser.Close()
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+	return err
+}
+
+// Metadata returns the headers of an indexed file recorded in the catalog,
+// and where its body starts in the original file.
+func (idx *Index) Metadata(filenameIdx int) (DocumentMetadata, bool) {
+	release, ok := idx.acquire()
+	if !ok {
+		return DocumentMetadata{}, false
+	}
+	defer release()
+	return idx.metadata(filenameIdx)
+}
+
+// metadata is Metadata for a caller that has acquired the index.
+func (idx *Index) metadata(filenameIdx int) (DocumentMetadata, bool) {
+	if filenameIdx < 0 || filenameIdx >= len(idx.contentEntry) || idx.closed() {
+		return DocumentMetadata{}, false
+	}
+
+	entry := &idx.contentEntry[filenameIdx]
+	if entry.MetaOffset == 0 {
+		return DocumentMetadata{}, false
+	}
+
+	buf := make([]byte, maxMetadataLen)
+	n, err := idx.catalogRdr.ReadAt(buf, int64(entry.MetaOffset))
+	if err != nil && err != io.EOF {
+		return DocumentMetadata{}, false
+	}
+
+	meta, err := decodeMetadata(buf[:n], idx.catalogVersion)
+	if err != nil {
+		return DocumentMetadata{}, false
+	}
+	return meta, true
+}
+
+// DocumentLength returns the number of words in an indexed file, counting
+// the message body and the indexed headers.
+func (idx *Index) DocumentLength(filenameIdx int) int {
+	if filenameIdx < 0 || filenameIdx >= len(idx.docLens) {
+		return 0
+	}
+	return int(idx.docLens[filenameIdx])
+}
+
+// AverageDocumentLength returns the mean number of words in the indexed files.
+func (idx *Index) AverageDocumentLength() float64 {
+	return idx.avgDocLen
+}
+
+// IndexMetadata returns information about how the index was built, such as
+// the synonyms that were applied.
+func (idx *Index) IndexMetadata() IndexMetadata {
+	return idx.meta
+}
+
+// Fingerprint identifies the contents of the index. It changes whenever the
+// index is rebuilt, so it can be used to tell whether anything derived from
+// the index, like a cached email, is still current.
+func (idx *Index) Fingerprint() string {
+	return idx.fingerprint
+}
+
+// Labels returns the Gmail labels of an indexed file. Files that did not come
+// from a Gmail Takeout export have no labels.
+func (idx *Index) Labels(filenameIdx int) []string {
+	if filenameIdx < 0 || filenameIdx+1 >= len(idx.docLabelStart) {
+		return nil
+	}
+
+	ids := idx.docLabels[idx.docLabelStart[filenameIdx]:idx.docLabelStart[filenameIdx+1]]
+	if len(ids) == 0 {
+		return nil
+	}
+	labels := make([]string, len(ids))
+	for i, id := range ids {
+		labels[i] = idx.labels[id]
+	}
+	return labels
+}
+
+// Folders returns the folder-style facets of an indexed file. For messages
+// from a Gmail Takeout export these are the message labels, for everything
+// else it is the directory the file was found in.
+func (idx *Index) Folders(filenameIdx int) []string {
+	release, ok := idx.acquire()
+	if !ok {
+		return nil
+	}
+	defer release()
+	return idx.folders(filenameIdx)
+}
+
+// folders is Folders for a caller that has acquired the index.
+func (idx *Index) folders(filenameIdx int) []string {
+	if labels := idx.Labels(filenameIdx); labels != nil {
+		return labels
+	}
+	if dir := idx.dir(filenameIdx); dir != "" {
+		return []string{dir}
+	}
+	return nil
+}
+
+// dir returns the directory of an indexed file, "" if it has none.
+func (idx *Index) dir(filenameIdx int) string {
+	if filenameIdx < 0 || filenameIdx >= idx.filenames.Len() {
+		return ""
+	}
+	dir := path.Dir(filepath.ToSlash(idx.filenames.At(filenameIdx)))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// DocumentsWithLabel returns the file indices, in increasing order, of all
+// the files that carry label. Label comparison is case insensitive.
+func (idx *Index) DocumentsWithLabel(label string) []int {
+	var docs []int
+	for fidx := range len(idx.docLabelStart) - 1 {
+		for _, id := range idx.docLabels[idx.docLabelStart[fidx]:idx.docLabelStart[fidx+1]] {
+			if strings.EqualFold(idx.labels[id], label) {
+				docs = append(docs, fidx)
+				break
+			}
+		}
+	}
+	return docs
+}
+
+// Prefix returns a slice of strings of words in the index that have prefix
+// as their own prefix.
+//
+// The count determines the number of matching words to return:
+//   - n > 0: at most n matches
+//   - n == 0: the result in nil (no matches).
+//   - n < 0: all matches
+//
+// The prefix tree is loaded in the background, calls made shortly after the
+// index is loaded wait for it.
+func (idx *Index) Prefix(prefix string, n int) []string {
+	release, ok := idx.acquire()
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	tree, err := idx.trie()
+	if err != nil || tree == nil || n == 0 {
+		return nil
+	}
+
+	matches, err := tree.FindWordsWithPrefix(strings.ToLower(prefix))
+	if err != nil {
+		return nil
+	}
+
+	// Filter out stop words
+	matches = filterFunc(matches, func(s string) bool { return !isStopWord(s) })
+
+	if n < 0 {
+		return matches
 	}
-	defer f.Close()
 
-	rdr := bufio.NewReader(f)
+	return matches[:min(len(matches), n)]
+}
+
+// shortestPrefix returns up to n of the words that start with prefix,
+// shortest first and leaving out stop words. Unlike Prefix it stops reading
+// the prefix tree once it has found them.
+func (idx *Index) shortestPrefix(prefix string, n int) []string {
+	tree, err := idx.trie()
+	if err != nil || tree == nil {
+		return nil
+	}
+	words, err := tree.shortestWithPrefix(strings.ToLower(prefix), n, func(s string) bool { return !isStopWord(s) })
+	if err != nil {
+		return nil
+	}
+	return words
+}
+
+// buildWordOffsets lays out the word index offset table by word index, so
+// that a word found in the words string table leads to its matches.
+func (idx *Index) buildWordOffsets() {
+	idx.wordOffsets = make([]int64, idx.words.Len())
+
+	// Walk the offsets table, out of range words are reported by checkIndex
+	for _, wo := range idx.offsets {
+		if int(wo.WordIndex) < len(idx.wordOffsets) {
+			idx.wordOffsets[wo.WordIndex] = wo.Offset
+		}
+	}
+}
+
+// wordOffset returns the offset of the matches of word in the search index.
+// It returns false if the word is not in the index. No valid offset is 0,
+// the search index starts with a header.
+func (idx *Index) wordOffset(word string) (int64, bool) {
+	widx, ok := idx.words.Find(word)
+	if !ok || idx.wordOffsets[widx] == 0 {
+		return 0, false
+	}
+	return idx.wordOffsets[widx], true
+}
+
+// openStringTable opens the string table name, read in place if inPlace is
+// true and it is in a format that can be.
+func (idx *Index) openStringTable(name string, inPlace bool) (*stringTable, error) {
+	t, f, err := openStringTable(idx.src, name, inPlace)
+	if f != nil {
+		idx.files.add(f)
+	}
+	return t, err
+}
+
+// readsInPlace reports whether the files of src are cheap to read a few
+// bytes at a time. The files of remote and encrypted indexes are not,
+// each read is a request or decrypts a whole chunk.
+func readsInPlace(src indexSource) bool {
+	switch src.(type) {
+	case *remoteSource, *decryptSource:
+		return false
+	}
+	return true
+}
+
+// filterFunc returns a new []string with only the elements of x for which f(x)
+// returns true.
+func filterFunc(x []string, f func(string) bool) []string {
+	out := make([]string, 0, len(x))
+
+	for _, a := range x {
+		if f(a) {
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+func loadOffsetsTable(rdr *bufio.Reader) ([]serializedWordIndexOffset, error) {
 	hdr := serializedWordOffsetHeader{}
 	if err := binary.Read(rdr, binary.BigEndian, &hdr); err != nil {
 		return nil, err
 	}
-	if hdr.Magic != wordOffsetMagic || hdr.Version != 1 {
-		return nil, fmt.Errorf("unsupported offsets version number %d", hdr.Version)
+	if err := checkHeader(hdr.Magic, wordOffsetMagic, hdr.Version, 1, 1); err != nil {
+		return nil, err
 	}
 
 	offsets := make([]serializedWordIndexOffset, hdr.NumEntries)
@@ -436,39 +1872,178 @@ func loadOffsetsTable(filename string) ([]serializedWordIndexOffset, error) {
 }
 
 // loadCatalogHeader reads in the compressed content catalog header which
-// stores the offsets and uncompressed lengths of all injested content.
-func (idx *Index) loadCatalogHeader(r io.Reader) error {
-	var hdr serializedCatalogHeader
-	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
-		return err
+// stores the offsets and lengths of all injested content. It returns the
+// number of shard files the content is stored in.
+func (idx *Index) loadCatalogHeader(r io.Reader) (int, error) {
+	var v2 serializedCatalogHeaderV2
+	if err := binary.Read(r, binary.BigEndian, &v2); err != nil {
+		return 0, err
 	}
-	if hdr.Magic != catalogMagic || hdr.Version != 1 {
-		return fmt.Errorf("unsupported catalog version number %d", hdr.Version)
+	if err := checkHeader(v2.Magic, catalogMagic, v2.Version, minCatalogVersion, catalogVersion); err != nil {
+		return 0, err
 	}
+	hdr := serializedCatalogHeader{Magic: v2.Magic, Version: v2.Version, NumEntries: v2.NumEntries}
+	if hdr.Version >= 3 {
+		if err := binary.Read(r, binary.BigEndian, &hdr.Codec); err != nil {
+			return 0, err
+		}
+	}
+	if hdr.Version >= 4 {
+		if err := binary.Read(r, binary.BigEndian, &hdr.NumShards); err != nil {
+			return 0, err
+		}
+	}
+	if hdr.Codec >= numCodecs {
+		return 0, &CorruptError{Err: fmt.Errorf("unsupported catalog codec %d", hdr.Codec)}
+	}
+	idx.codec = Codec(hdr.Codec)
 
+	idx.catalogVersion = hdr.Version
 	idx.contentEntry = make([]catalogContentEntry, hdr.NumEntries)
+	switch hdr.Version {
+	case 1:
+		entries := make([]catalogContentEntryV1, hdr.NumEntries)
+		if err := binary.Read(r, binary.BigEndian, entries); err != nil {
+			return 0, err
+		}
+		for i, e := range entries {
+			idx.contentEntry[i] = catalogContentEntry{Offset: uint64(e.Offset), Length: uint64(e.Length)}
+		}
+		return 0, nil
+	case 2, 3:
+		entries := make([]catalogContentEntryV3, hdr.NumEntries)
+		if err := binary.Read(r, binary.BigEndian, entries); err != nil {
+			return 0, err
+		}
+		for i, e := range entries {
+			idx.contentEntry[i] = catalogContentEntry{Offset: uint64(e.Offset), Length: uint64(e.Length), MetaOffset: uint64(e.MetaOffset)}
+		}
+		return 0, nil
+	case 4:
+		entries := make([]catalogContentEntryV4, hdr.NumEntries)
+		if err := binary.Read(r, binary.BigEndian, entries); err != nil {
+			return 0, err
+		}
+		for i, e := range entries {
+			idx.contentEntry[i] = catalogContentEntry{uint64(e.Offset), uint64(e.Length), 0, uint64(e.MetaOffset), e.Shard}
+		}
+		return int(hdr.NumShards), nil
+	case 5:
+		entries := make([]catalogContentEntryV5, hdr.NumEntries)
+		if err := binary.Read(r, binary.BigEndian, entries); err != nil {
+			return 0, err
+		}
+		for i, e := range entries {
+			idx.contentEntry[i] = catalogContentEntry{e.Offset, e.Length, 0, e.MetaOffset, e.Shard}
+		}
+		return int(hdr.NumShards), nil
+	}
 	if err := binary.Read(r, binary.BigEndian, idx.contentEntry); err != nil {
+		return 0, err
+	}
+	return int(hdr.NumShards), nil
+}
+
+// loadLabels loads the label string table and the per document label table.
+// Both files are optional, indexes built before label support have neither.
+func (idx *Index) loadLabels(src indexSource) error {
+	err := readIndexFile(src, LabelsStringTable, func(r *bufio.Reader) (err error) {
+		idx.labels, err = loadStringTable(r)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	return readIndexFile(src, DocumentLabels, idx.loadDocumentLabels)
+}
+
+// loadDocumentLabels reads the per document label table.
+func (idx *Index) loadDocumentLabels(rdr *bufio.Reader) error {
+	hdr := serializedLabelsHeader{}
+	if err := binary.Read(rdr, binary.BigEndian, &hdr); err != nil {
 		return err
 	}
+	if err := checkHeader(hdr.Magic, labelsMagic, hdr.Version, 1, 1); err != nil {
+		return err
+	}
+
+	idx.docLabelStart = make([]uint32, hdr.NumEntries+1)
+	for i := range hdr.NumEntries {
+		n, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return err
+		}
+		for range n {
+			id, err := binary.ReadUvarint(rdr)
+			if err != nil {
+				return err
+			}
+			if id >= uint64(len(idx.labels)) {
+				return &CorruptError{Err: fmt.Errorf("label index %d out of range", id)}
+			}
+			idx.docLabels = append(idx.docLabels, uint32(id))
+		}
+		idx.docLabelStart[i+1] = uint32(len(idx.docLabels))
+	}
+
 	return nil
 }
 
-// loadPrefixTree loads a serialized trie data structure into memory and returns
-// the Trie instance.
-func loadPrefixTree(filename string) (*compressedtrie.Tree, error) {
-	f, err := os.Open(filename)
+// loadIndexMetadata reads the index metadata. The file is optional, indexes
+// built before it was introduced have none.
+func loadIndexMetadata(src indexSource) (IndexMetadata, error) {
+	var meta IndexMetadata
+
+	err := readIndexFile(src, IndexMetadataFile, func(r *bufio.Reader) error {
+		if err := json.NewDecoder(r).Decode(&meta); err != nil {
+			return &CorruptError{Err: err}
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+	return meta, err
+}
+
+// readIndexFile opens the file name of src and reads it from the start with
+// read. Errors are turned into the load errors where they can be, see
+// fileError.
+func readIndexFile(src indexSource, name string, read func(r *bufio.Reader) error) error {
+	f, err := src.Open(name)
 	if err != nil {
-		return nil, err
+		return fileError(name, err)
 	}
 	defer f.Close()
 
-	rdr := bufio.NewReader(f)
-	trie, err := compressedtrie.DeserializeTree(rdr)
-	if err != nil {
-		return nil, err
+	return fileError(name, read(bufio.NewReader(io.NewSectionReader(f, 0, int64(f.Len())))))
+}
+
+// loadPrefixTree opens the prefix tree in f. f is closed unless the tree is
+// searched in place, in which case Close closes it.
+func (idx *Index) loadPrefixTree(f indexFile) {
+	defer close(idx.prefixTreeReady)
+
+	idx.prefixTree, idx.prefixTreeErr = OpenTrie(f, int64(f.Len()))
+	if idx.prefixTreeErr == nil && idx.prefixTree.r != nil {
+		idx.trieRdr = f
+		idx.files.add(f)
+	} else {
+		f.Close()
 	}
+}
 
-	return trie, err
+// trie returns the prefix tree, waiting for it to finish loading.
+func (idx *Index) trie() (*Trie, error) {
+	if idx.prefixTreeReady == nil {
+		return idx.prefixTree, nil
+	}
+	<-idx.prefixTreeReady
+	return idx.prefixTree, idx.prefixTreeErr
 }
 
 // This code was written by claude.ai
@@ -1,8 +1,23 @@
 package emailsearch
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/v2"
 )
 
 func TestIntersectWordResults(t *testing.T) {
@@ -91,3 +106,646 @@ func TestIntersectWordResults(t *testing.T) {
 		})
 	}
 }
+
+func TestSearchTop(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe budget.\n",
+		"2": "Subject: two\n\nThe budget and the budget forecast.\n",
+		"3": "Subject: three\n\nThe forecast.\n",
+		"4": "Subject: four\n\nThe budget forecast for the budget.\n",
+		"5": "Subject: five\n\nLunch.\n",
+	})
+
+	q := Or(Term("budget"), Term("forecast"))
+	all, err := idx.Search(t.Context(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(all))
+	}
+
+	for k := range len(all) + 2 {
+		res, err := idx.SearchTop(t.Context(), q, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.NumResults != 4 || res.NumMatches != 8 {
+			t.Errorf("k=%d: expected 4 results and 8 matches, got %d and %d", k, res.NumResults, res.NumMatches)
+		}
+		want := all[:min(k, len(all))]
+		if !slices.EqualFunc(res.Results, want, func(a, b QueryResults) bool { return a.Filename == b.Filename && a.Score == b.Score }) {
+			t.Errorf("k=%d: expected %v, got %v", k, want, res.Results)
+		}
+	}
+
+	for _, page := range []struct{ offset, limit, from, to int }{{0, 2, 0, 2}, {2, 2, 2, 4}, {3, 2, 3, 4}, {5, 2, 4, 4}, {1, -1, 1, 4}} {
+		res, err := idx.SearchPage(t.Context(), q, page.offset, page.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := all[page.from:page.to]
+		if res.NumResults != 4 || !slices.EqualFunc(res.Results, want, func(a, b QueryResults) bool { return a.Filename == b.Filename }) {
+			t.Errorf("offset=%d limit=%d: expected %v of 4, got %v of %d", page.offset, page.limit, want, res.Results, res.NumResults)
+		}
+	}
+
+	// Streamed results come in the same order, whether or not the ranking
+	// is cached
+	for _, cache := range []*QueryCache{nil, NewQueryCache(4)} {
+		idx.Cache = cache
+		for _, page := range []struct{ offset, limit, from, to int }{{0, -1, 0, 4}, {1, 2, 1, 3}, {5, 2, 4, 4}} {
+			res, results, err := idx.SearchStream(t.Context(), q, page.offset, page.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := slices.Collect(results)
+			want := all[page.from:page.to]
+			if res.NumResults != 4 || res.NumMatches != 8 || !slices.EqualFunc(got, want, func(a, b QueryResults) bool {
+				return a.Filename == b.Filename && slices.Equal(a.WordMatches, b.WordMatches)
+			}) {
+				t.Errorf("stream offset=%d limit=%d, cache %t: expected %v of 4, got %v of %d", page.offset, page.limit, cache != nil, want, got, res.NumResults)
+			}
+		}
+	}
+}
+
+func TestSearchCancelled(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe budget.\n",
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if _, err := idx.Search(ctx, Term("budget")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled search, got %v", err)
+	}
+	if _, err := idx.Search(ctx, Or(Term("budget"), Phrase("the budget"))); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled search, got %v", err)
+	}
+	if _, _, ok := idx.CatalogContent(ctx, 0); ok {
+		t.Error("expected no content with a cancelled context")
+	}
+	if _, _, ok := idx.CatalogContent(t.Context(), 0); !ok {
+		t.Error("expected content")
+	}
+
+	// ReadContent tells a cancelled read from a missing file
+	if _, _, err := idx.ReadContent(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled read, got %v", err)
+	}
+	if _, _, err := idx.ReadContent(t.Context(), 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestConcurrentSearch(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: lunch\n\nThe budget meeting is over lunch.\n",
+		"2": "Subject: budget\n\nThe quarterly budget is attached.\n",
+		"3": "Subject: travel\n\nBook the travel before the meeting.\n",
+		"4": "Subject: lunch\n\nLunch on Friday, then travel home.\n",
+	})
+
+	queries := []Query{
+		Term("budget"),
+		Term("lunch"),
+		Or(Term("travel"), Term("meeting")),
+		Phrase("budget meeting"),
+	}
+	want := make([][]QueryResults, len(queries))
+	for i, q := range queries {
+		var err error
+		if want[i], err = idx.Search(t.Context(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantContent, _, _ := idx.CatalogContent(t.Context(), 0)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				n := (g + i) % len(queries)
+				got, err := idx.Search(t.Context(), queries[n])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !reflect.DeepEqual(got, want[n]) {
+					t.Errorf("concurrent search for %s returned %v, expected %v", queries[n], got, want[n])
+					return
+				}
+				if content, _, _ := idx.CatalogContent(t.Context(), 0); !slices.Equal(content, wantContent) {
+					t.Errorf("concurrent read of content returned %q, expected %q", content, wantContent)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPrefixWhileLoading(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe budget and the budgetary review.\n",
+	})
+
+	// Prefix waits for the prefix tree, which is loading in the background
+	if got := idx.Prefix("budg", -1); !slices.Equal(got, []string{"budget", "budgetary"}) {
+		t.Errorf("expected budget and budgetary, got %v", got)
+	}
+}
+
+// downgradeIndex rewrites the search index of idx in the layout of version
+// 7, 8 or 9. Before version 10 the matches were not split into blocks, and
+// before version 9 each match header was followed by its occurrences. It
+// returns the rewritten index file.
+func downgradeIndex(t *testing.T, idx *Index, version uint32) []byte {
+	t.Helper()
+
+	data := make([]byte, idx.indexRdr.Len())
+	if _, err := idx.indexRdr.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	order := make([]int, len(idx.offsets))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return int(idx.offsets[a].Offset - idx.offsets[b].Offset) })
+
+	out := bytes.Clone(data[:idx.offsets[order[0]].Offset])
+	binary.BigEndian.PutUint32(out[4:], version)
+	for _, i := range order {
+		wo := idx.offsets[i]
+		rdr := &readerAtCursor{r: bytes.NewReader(data), off: wo.Offset}
+		start := rdr.off
+		numMatches, err := skipWordFiles(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newOffset := int64(len(out))
+		out = append(out, data[start:rdr.off]...) // Files and number of matches
+
+		var hdrs, occs []byte
+		prev := 0
+		err = idx.matchHeaders(rdr, numMatches, nil, func(h matchHeader) error {
+			occRdr := h.occurrences()
+			for range 3 * h.tf {
+				binary.ReadUvarint(occRdr)
+			}
+			occ := make([]byte, occRdr.off-h.occOff)
+			h.occRdr.ReadAt(occ, h.occOff)
+
+			fidx := h.fidx
+			if version >= 8 {
+				fidx -= prev
+			}
+			prev = h.fidx
+			hdrs = binary.AppendUvarint(hdrs, uint64(fidx))
+			hdrs = binary.AppendUvarint(hdrs, uint64(h.field))
+			hdrs = binary.AppendUvarint(hdrs, uint64(h.tf))
+			hdrs = binary.AppendUvarint(hdrs, uint64(len(occ)))
+			if version >= 9 {
+				occs = append(occs, occ...)
+			} else {
+				hdrs = append(hdrs, occ...)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version >= 9 {
+			out = binary.AppendUvarint(out, uint64(len(hdrs)))
+		}
+		out = append(out, hdrs...)
+		out = append(out, occs...)
+		idx.offsets[i].Offset = newOffset
+		idx.wordOffsets[wo.WordIndex] = newOffset
+	}
+
+	idx.indexRdr.Close()
+	idx.indexRdr = newMemFile(out)
+	idx.indexVersion = version
+	return out
+}
+
+func TestLoadOldIndexVersions(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe budget.\n",
+		"2": "Subject: two\n\nThe forecast.\n",
+		"3": "Subject: three\n\nThe budget forecast, budget.\n",
+	}
+	queries := []Query{
+		Term("budget"),
+		Term("forecast"),
+		Term("subject"),
+		And(Term("budget"), Term("forecast")),
+		Phrase("budget forecast"),
+		Term("budget", Field_Subject),
+	}
+
+	idx := buildTestIndex(t, emails)
+	want := make([][]QueryResults, len(queries))
+	for i, q := range queries {
+		var err error
+		if want[i], err = idx.Search(t.Context(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, version := range []uint32{7, 8, 9} {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			idx := buildTestIndex(t, emails)
+			downgradeIndex(t, idx, version)
+			for i, q := range queries {
+				got, err := idx.Search(t.Context(), q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want[i]) {
+					t.Errorf("%s: expected %v, got %v", q, want[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMinimal(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\nX-Gmail-Labels: Inbox\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+	idx, err := LoadIndex(dir, io.Discard, LoadOptions{Minimal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	results, err := idx.Search(t.Context(), Term("budget"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Filename != "1" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if content, _, ok := idx.CatalogContent(t.Context(), results[0].FilenameIndex); !ok || string(content) != "The quarterly budget.\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if idx.offsets != nil || idx.prefixTree != nil || idx.labels != nil {
+		t.Error("expected the tables QueryIndex doesn't need not to be loaded")
+	}
+	if prefixes := idx.Prefix("bud", -1); prefixes != nil {
+		t.Errorf("expected no prefix matches, got %v", prefixes)
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\nX-Gmail-Labels: Inbox\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+
+	idx, err := LoadIndex(dir, io.Discard, LoadOptions{InMemory: true, SkipPrefixTree: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := idx.Search(t.Context(), Term("budget"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Filename != "1" || !slices.Equal(results[0].Folders, []string{"Inbox"}) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if content, _, ok := idx.CatalogContent(t.Context(), results[0].FilenameIndex); !ok || string(content) != "The quarterly budget.\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	rdr := idx.indexRdr
+	if cf, ok := rdr.(*checkedFile); ok {
+		rdr = cf.indexFile
+	}
+	if _, ok := rdr.(memFile); !ok {
+		t.Errorf("expected the search index to be read into memory, got %T", idx.indexRdr)
+	}
+	if prefixes := idx.Prefix("bud", -1); prefixes != nil {
+		t.Errorf("expected no prefix tree, got %v", prefixes)
+	}
+	idx.Close()
+
+	// Damage the catalog, which the checksums find when loading with Strict
+	// unless they're skipped
+	catalog := filepath.Join(dir, CorpusCatalog)
+	data, err := os.ReadFile(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(catalog, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *ChecksumError
+	if _, err := LoadIndex(dir, io.Discard, LoadOptions{Strict: true}); !errors.As(err, &cerr) {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+	idx, err = LoadIndex(dir, io.Discard, LoadOptions{Strict: true, SkipChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+}
+
+func TestClose(t *testing.T) {
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, map[string]string{"1": "Subject: one\n\nThe quarterly budget.\n"})
+	idx, err := LoadIndexFromDisk(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closer io.Closer = idx
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Errorf("expected closing again to do nothing, got %v", err)
+	}
+
+	if _, err := idx.Search(t.Context(), Term("budget")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected searching a closed index to fail, got %v", err)
+	}
+	if _, err := idx.QueryIndex(t.Context(), []string{"budget"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected querying a closed index to fail, got %v", err)
+	}
+	if _, err := idx.Postings("budget"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected reading postings of a closed index to fail, got %v", err)
+	}
+	if _, _, ok := idx.CatalogContent(t.Context(), 0); ok {
+		t.Error("expected no content from a closed index")
+	}
+}
+
+func TestCloseWaitsForReads(t *testing.T) {
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, map[string]string{"1": "Subject: one\n\nThe quarterly budget.\n"})
+	idx, err := LoadIndexFromDisk(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close doesn't return while a read is under way, and no more can start
+	release, ok := idx.acquire()
+	if !ok {
+		t.Fatal("expected to start a read of an open index")
+	}
+	closed := make(chan error)
+	go func() { closed <- idx.Close() }()
+	for !idx.closed() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := idx.Search(t.Context(), Term("budget")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected a search started during Close to fail, got %v", err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a read was under way")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads racing Close either finish or fail with ErrClosed
+	idx, err = LoadIndexFromDisk(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if _, err := idx.Search(t.Context(), Term("budget")); err != nil && !errors.Is(err, ErrClosed) {
+					t.Errorf("unexpected error searching while closing: %v", err)
+				}
+				if _, _, err := idx.ReadContent(t.Context(), 0); err != nil && !errors.Is(err, ErrClosed) {
+					t.Errorf("unexpected error reading content while closing: %v", err)
+				}
+			}
+		}()
+	}
+	if err := idx.Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+type recordingLogger []string
+
+func (l *recordingLogger) Printf(format string, v ...any) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestLoadLogger(t *testing.T) {
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, map[string]string{"1": "Subject: one\n\nThe quarterly budget.\n"})
+
+	// Silent unless asked
+	idx, err := LoadIndex(dir, nil, LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	var w bytes.Buffer
+	var logger recordingLogger
+	idx, err = LoadIndex(dir, &w, LoadOptions{Logger: &logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+	if w.Len() > 0 {
+		t.Errorf("expected nothing written to w with a Logger, got %q", w.String())
+	}
+	if len(logger) == 0 || !strings.HasPrefix(logger[len(logger)-1], "Loaded labels: ") {
+		t.Errorf("unexpected messages %q", logger)
+	}
+
+	idx, err = LoadIndexFromDisk(dir, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+	if lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n"); len(lines) != len(logger) || lines[0] != logger[0] {
+		t.Errorf("expected the messages written to w a line each, got %q", w.String())
+	}
+}
+
+func TestPostingBlocks(t *testing.T) {
+	// Every email matches budget in two fields, so its matches run over
+	// several blocks and some files straddle two blocks
+	emails := make(map[string]string)
+	nfiles := postingBlockSize * 2
+	for i := range nfiles {
+		body := fmt.Sprintf("The budget for week %d, the budget is fine.\n", i)
+		if i == 3 || i == postingBlockSize+40 {
+			body += "A rare forecast.\n"
+		}
+		emails[fmt.Sprintf("%03d", i)] = fmt.Sprintf("Subject: budget %d\n\n%s", i, body)
+	}
+	idx := buildTestIndex(t, emails)
+
+	tf, err := idx.TermFrequencies("budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tf) != nfiles {
+		t.Errorf("expected budget in %d files, got %d", nfiles, len(tf))
+	}
+	for fidx, n := range tf {
+		if n != 3 {
+			t.Errorf("%s: expected budget 3 times, got %d", idx.filenames.At(fidx), n)
+		}
+	}
+
+	// Skipping blocks finds the same matches as reading all of them
+	files := roaring.BitmapOf(3, uint32(postingBlockSize+40))
+	all, err := idx.lookupWord(t.Context(), "budget", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	some, err := idx.lookupWord(t.Context(), "budget", nil, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(some) != 2 {
+		t.Errorf("expected matches in 2 files, got %d", len(some))
+	}
+	for fidx, matches := range some {
+		if !reflect.DeepEqual(matches, all[fidx]) {
+			t.Errorf("%s: expected %v, got %v", idx.filenames.At(fidx), all[fidx], matches)
+		}
+	}
+
+	res, err := idx.Search(t.Context(), And(Term("budget"), Phrase("rare forecast")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Filename != "003" || res[1].Filename != fmt.Sprintf("%03d", postingBlockSize+40) {
+		t.Errorf("expected the two files with the rare forecast, got %v", res)
+	}
+
+	// The blocks of a common word compress
+	off, _ := idx.wordOffset("budget")
+	rdr := &readerAtCursor{r: idx.indexRdr, off: off}
+	numMatches, err := skipWordFiles(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.ReadUvarint(rdr)
+	if size, _ := binary.ReadUvarint(rdr); numMatches != uint64(2*nfiles) || size&1 == 0 {
+		t.Errorf("expected %d matches in compressed blocks, got %d matches", 2*nfiles, numMatches)
+	}
+}
+
+func TestCatalogContentConcurrent(t *testing.T) {
+	emails := make(map[string]string)
+	for i := range 20 {
+		emails[fmt.Sprintf("%02d", i)] = fmt.Sprintf("Subject: %d\n\nThe budget for week %d.\n", i, i)
+	}
+	for _, codec := range []Codec{Codec_Gzip, Codec_Zstd} {
+		dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1, Codec: codec}, emails)
+
+		// Memory mapped catalogs are copied into pooled buffers, catalogs in
+		// memory are decompressed where they are
+		for _, inMemory := range []bool{false, true} {
+			idx, err := LoadIndex(dir, io.Discard, LoadOptions{InMemory: inMemory, SkipPrefixTree: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for fidx := range idx.CorpusSize {
+						content, name, ok := idx.CatalogContent(t.Context(), fidx)
+						n, _ := strconv.Atoi(name)
+						if want := fmt.Sprintf("The budget for week %d.\n", n); !ok || string(content) != want {
+							t.Errorf("%v, inMemory %t: %s has content %q, want %q", codec, inMemory, name, content, want)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			idx.Close()
+		}
+	}
+}
+
+func TestGallopBlocks(t *testing.T) {
+	// Blocks ending at every third file, with runs that straddle blocks
+	lasts := []uint64{2, 5, 5, 5, 8, 11, 20, 20, 21, 40, 41, 60}
+	blocks := make([]postingBlock, len(lasts))
+	for i, last := range lasts {
+		blocks[i].last = last
+	}
+
+	for i := range blocks {
+		for fidx := uint64(0); fidx <= 62; fidx++ {
+			want := i + slices.IndexFunc(blocks[i:], func(b postingBlock) bool { return b.last >= fidx })
+			if want < i {
+				want = len(blocks)
+			}
+			if got := gallop(blocks, i, fidx); got != want {
+				t.Errorf("gallop(%d, %d) = %d, want %d", i, fidx, got, want)
+			}
+		}
+	}
+
+	// Galloping reads the same blocks as checking every block
+	for _, set := range [][]uint32{{}, {0}, {5}, {6, 7}, {5, 20}, {3, 9, 21, 41}, {60}, {61, 100}, {0, 1, 2, 3, 4, 5, 6}} {
+		files := roaring.BitmapOf(set...)
+		var want []int
+		for i, b := range blocks {
+			var first uint64
+			if i > 0 {
+				first = blocks[i-1].last
+			}
+			if files.IntersectsWithInterval(first, b.last+1) {
+				want = append(want, i)
+			}
+		}
+		var got []int
+		gallopBlocks(blocks, files, func(i int) error {
+			got = append(got, i)
+			return nil
+		})
+		if !slices.Equal(got, want) {
+			t.Errorf("files %v: read blocks %v, want %v", set, got, want)
+		}
+	}
+}
+
+func TestGallopingSearch(t *testing.T) {
+	// A rare word with a word common enough to have many posting blocks
+	emails := make(map[string]string)
+	n := 20 * postingBlockSize
+	for i := range n {
+		emails[fmt.Sprintf("%05d", i)] = "Subject: budget\n\nThe budget.\n"
+	}
+	emails["00007"] = "Subject: budget\n\nThe budget forecast.\n"
+	emails[fmt.Sprintf("%05d", n-1)] = "Subject: budget\n\nThe budget forecast.\n"
+	idx := buildTestIndex(t, emails)
+
+	res, err := idx.Search(t.Context(), And(Term("forecast"), Term("budget")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || len(res[0].WordMatches) != 3 || len(res[1].WordMatches) != 3 {
+		t.Errorf("expected the two files with forecast and both their budgets, got %+v", res)
+	}
+}
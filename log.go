@@ -0,0 +1,32 @@
+package emailsearch
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Logger receives the messages the library writes about what it is doing,
+// such as the tables LoadIndex has loaded. A *log.Logger is a Logger, and
+// slog.NewLogLogger turns a slog.Handler into one.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// writerLogger writes each message to w on a line of its own.
+type writerLogger struct {
+	w io.Writer
+}
+
+func (l writerLogger) Printf(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	io.WriteString(l.w, msg)
+}
+
+// discardLogger drops every message.
+type discardLogger struct{}
+
+func (discardLogger) Printf(string, ...any) {}
@@ -0,0 +1,116 @@
+package emailsearch
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"iter"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// isMbox reports whether filename looks like an mbox file, such as the ones
+// produced by Google Takeout. Mbox files hold many messages and are split
+// into individual documents during injestion.
+func isMbox(filename string) bool {
+	return strings.HasSuffix(strings.ToLower(filename), ".mbox")
+}
+
+// mboxDocumentName returns the name used for the n-th (1-based) message of an
+// mbox file.
+func mboxDocumentName(filename string, n int) string {
+	return filename + "#" + strconv.Itoa(n)
+}
+
+// readMbox iterates over the messages in an mbox stream. Messages are
+// returned one at a time so that multi-gigabyte files never need to be held
+// in memory. Each message has its "From " separator line removed and any
+// mboxrd style ">From " escaping undone.
+func readMbox(r io.Reader) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		rdr := bufio.NewReaderSize(r, 64*1024)
+
+		var (
+			msg     bytes.Buffer
+			started bool
+		)
+		for {
+			line, err := rdr.ReadBytes('\n')
+			if len(line) > 0 {
+				if bytes.HasPrefix(line, []byte("From ")) {
+					if started && !yield(bytes.Clone(msg.Bytes()), nil) {
+						return
+					}
+					msg.Reset()
+					started = true
+				} else if started {
+					msg.Write(unescapeMboxLine(line))
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+
+		if started {
+			yield(bytes.Clone(msg.Bytes()), nil)
+		}
+	}
+}
+
+// unescapeMboxLine removes one level of quoting from lines of the form
+// ">From ", ">>From ", ...
+func unescapeMboxLine(line []byte) []byte {
+	if len(line) == 0 || line[0] != '>' {
+		return line
+	}
+	rest := bytes.TrimLeft(line, ">")
+	if bytes.HasPrefix(rest, []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// parseGmailLabels splits the value of an X-Gmail-Labels header into the
+// individual labels. Labels are comma separated and may be quoted when they
+// themselves contain a comma. MIME encoded-words are decoded.
+func parseGmailLabels(header string) []string {
+	var (
+		labels  []string
+		cur     strings.Builder
+		inQuote bool
+	)
+
+	dec := new(mime.WordDecoder)
+	flush := func() {
+		label := strings.TrimSpace(cur.String())
+		cur.Reset()
+		if label == "" {
+			return
+		}
+		if decoded, err := dec.DecodeHeader(label); err == nil {
+			label = decoded
+		}
+		labels = append(labels, label)
+	}
+
+	for _, r := range header {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case r == ',' && !inQuote:
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+
+	return labels
+}
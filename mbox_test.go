@@ -0,0 +1,68 @@
+package emailsearch
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadMbox(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    string
+		Expected []string
+	}{
+		{"Empty", "", nil},
+		{"One message", "From 1@xxx Mon Jan 1 2001\nSubject: a\n\nbody\n", []string{"Subject: a\n\nbody\n"}},
+		{
+			"Two messages",
+			"From 1@xxx Mon Jan 1 2001\nSubject: a\n\none\n\nFrom 2@xxx Tue Jan 2 2001\nSubject: b\n\ntwo\n",
+			[]string{"Subject: a\n\none\n\n", "Subject: b\n\ntwo\n"},
+		},
+		{
+			"Escaped From",
+			"From 1@xxx Mon Jan 1 2001\nSubject: a\n\n>From here\n>>From there\n>not a from\n",
+			[]string{"Subject: a\n\nFrom here\n>From there\n>not a from\n"},
+		},
+		{"No trailing newline", "From 1@xxx\n\nbody", []string{"\nbody"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var msgs []string
+			for msg, err := range readMbox(strings.NewReader(tc.Input)) {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				msgs = append(msgs, string(msg))
+			}
+
+			if !slices.Equal(msgs, tc.Expected) {
+				t.Errorf("Expected %q, got %q", tc.Expected, msgs)
+			}
+		})
+	}
+}
+
+func TestParseGmailLabels(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    string
+		Expected []string
+	}{
+		{"Empty", "", nil},
+		{"Single", "Inbox", []string{"Inbox"}},
+		{"Multiple", "Inbox,Important,Category Personal", []string{"Inbox", "Important", "Category Personal"}},
+		{"Quoted comma", `Inbox,"Work, Old"`, []string{"Inbox", "Work, Old"}},
+		{"Whitespace", " Inbox , Sent ", []string{"Inbox", "Sent"}},
+		{"Encoded word", "=?UTF-8?Q?Re=C3=A7us?=", []string{"Reçus"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := parseGmailLabels(tc.Input); !slices.Equal(got, tc.Expected) {
+				t.Errorf("Expected %q, got %q", tc.Expected, got)
+			}
+		})
+	}
+}
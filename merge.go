@@ -0,0 +1,154 @@
+package emailsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// MergeIndexes merges the serialized indexes in, directories or bundles,
+// into a single index written to the directory out. The indexes can be
+// built separately, e.g. one per mailbox on different machines. Filename,
+// word and label indices are renumbered and the content is stored with the
+// codec of the first index. A file may only appear in one of the indexes.
+// The synonym dictionaries of the indexes are combined, but the synonyms of
+// one index are not applied to the words of another.
+func MergeIndexes(out string, in ...string) error {
+	if len(in) == 0 {
+		return errors.New("no indexes to merge")
+	}
+
+	ib := &IndexBuilder{}
+	ib.Init()
+	if err := ib.Merge(in...); err != nil {
+		return err
+	}
+	return ib.Serialize(out)
+}
+
+// Merge loads the serialized indexes in, directories or bundles, into ib so
+// that they can be serialized as a single index in any of the forms an
+// IndexBuilder can write, see MergeIndexes. ib must have been initialized
+// and not have injested any files, its codec and synonyms are replaced.
+func (ib *IndexBuilder) Merge(in ...string) error {
+	if len(in) == 0 {
+		return errors.New("no indexes to merge")
+	}
+	return ib.mergeIndexes(in)
+}
+
+// mergeIndexes loads the indexes in into ib, see MergeIndexes. The codec and
+// catalog shard size are taken from the first index.
+func (ib *IndexBuilder) mergeIndexes(in []string) error {
+	synonyms := make(map[string][]string)
+	seen := make(map[string]string) // Filename to the index it came from
+	for i, path := range in {
+		idx, err := LoadIndexFromDisk(path, io.Discard)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", path, err)
+		}
+		if i == 0 {
+			ib.Codec = idx.codec
+			for _, shard := range idx.shardRdrs {
+				ib.MaxCatalogShardSize = max(ib.MaxCatalogShardSize, int64(shard.Len()))
+			}
+		}
+		files, err := idx.injestedFiles(ib.Codec)
+		if err == nil {
+			var failures []InjestFailure
+			failures, err = loadErrorReport(idx.src)
+			for _, f := range failures {
+				files = append(files, injestedFile{Filename: f.Filename, Err: errors.New(f.Error), Attempts: f.Attempts})
+			}
+		}
+		for word, syns := range idx.meta.Synonyms {
+			synonyms[word] = append(synonyms[word], syns...)
+		}
+		idx.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		for _, f := range files {
+			if f.Err != nil {
+				continue
+			}
+			if other, ok := seen[f.Filename]; ok {
+				return fmt.Errorf("%s is in both %s and %s", f.Filename, other, path)
+			}
+			seen[f.Filename] = path
+		}
+		ib.injested = append(ib.injested, files...)
+	}
+
+	// The occurrences of synonyms are already in the file indices, so the
+	// dictionary is only recorded and not applied again. The recorded
+	// dictionaries are already expanded, so they are only combined.
+	ib.mergeInjested()
+	ib.synonyms = sortSynonyms(synonyms)
+	return nil
+}
+
+// injestedFiles turns every file in the index back into the injested file it
+// was built from, with the content compressed with codec.
+func (idx *Index) injestedFiles(codec Codec) ([]injestedFile, error) {
+	files := make([]injestedFile, idx.filenames.Len())
+	for fidx, name := range idx.filenames.All() {
+		content, _, ok := idx.CatalogContent(context.Background(), fidx)
+		if !ok {
+			return nil, fmt.Errorf("failed to read the content of %s", name)
+		}
+		compressed, err := compress(content, codec)
+		if err != nil {
+			return nil, err
+		}
+		meta, _ := idx.Metadata(fidx)
+		files[fidx] = injestedFile{
+			Filename:   name,
+			Index:      make(fileIndex),
+			Len:        len(content),
+			Compressed: compressed,
+			Labels:     idx.Labels(fidx),
+			Meta:       meta,
+			Tokens:     idx.DocumentLength(fidx),
+			Attempts:   1,
+		}
+	}
+
+	// Invert the matches of every word back into the file indices. The
+	// matches come out in the order compareOccurrences expects.
+	for _, word := range idx.words.All() {
+		res, err := idx.lookupWord(context.Background(), word, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for fidx, matches := range res {
+			if fidx >= len(files) {
+				return nil, fmt.Errorf("word %q matches file index %d out of range", word, fidx)
+			}
+			occs := make([]occurrence, len(matches))
+			for i, m := range matches {
+				occs[i] = occurrence{m.Field, m.Offset, m.Length, m.Position}
+			}
+			files[fidx].Index[word] = occs
+		}
+	}
+	return files, nil
+}
+
+// loadErrorReport reads the files that failed injestion from the error
+// report of src. Indexes built before the report was added have none.
+func loadErrorReport(src indexSource) ([]InjestFailure, error) {
+	var failures []InjestFailure
+	err := readIndexFile(src, ErrorReport, func(r *bufio.Reader) error {
+		return json.NewDecoder(r).Decode(&failures)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return failures, err
+}
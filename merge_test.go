@@ -0,0 +1,144 @@
+package emailsearch
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serializeTestIndex builds an index of emails with ib and serializes it to a
+// new directory, which is returned.
+func serializeTestIndex(t *testing.T, ib *IndexBuilder, emails map[string]string) string {
+	t.Helper()
+
+	corpus := t.TempDir()
+	var names []string
+	for name, content := range emails {
+		if err := os.WriteFile(filepath.Join(corpus, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	ib.InputPath = corpus
+	ib.Init()
+	if err := ib.InjestFiles(names, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := ib.Serialize(out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMergeIndexes(t *testing.T) {
+	first := map[string]string{
+		"a1": "From: lay@enron.com\nSubject: Budget\nX-Gmail-Labels: Inbox\n\nThe quarterly budget is attached.\n",
+		"a2": "Subject: Lunch\n\nLunch on Friday with the lawyer?\n",
+	}
+	second := map[string]string{
+		"b1": "From: skilling@enron.com\nSubject: Re: Budget\nX-Gmail-Labels: Inbox,Important\n\nThe budget looks fine, lunch is on me.\n",
+		"b2": "Subject: Travel\n\nBook the travel before the budget meeting.\n",
+		"b3": "not an email",
+	}
+	all := map[string]string{}
+	for name, content := range first {
+		all[name] = content
+	}
+	for name, content := range second {
+		all[name] = content
+	}
+
+	synonyms := map[string][]string{"lawyer": {"attorney"}}
+	a := serializeTestIndex(t, &IndexBuilder{NThreads: 1, Synonyms: synonyms}, first)
+	b := serializeTestIndex(t, &IndexBuilder{NThreads: 1, Codec: Codec_Zstd}, second)
+	out := filepath.Join(t.TempDir(), "merged")
+	if err := MergeIndexes(out, a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	whole := buildTestIndex(t, all)
+
+	// The merged index answers queries the same as one built from every email
+	for _, q := range []string{"budget", "lunch", "budget -lunch", `"budget meeting"`, "label:important", "from:lay", "trav*"} {
+		want, err := whole.Search(t.Context(), ParseQuery(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := merged.Search(t.Context(), ParseQuery(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", q, want, got)
+		}
+	}
+
+	// The synonyms indexed in the first index are kept
+	if res, _ := merged.Search(t.Context(), Term("attorney")); len(res) != 1 || res[0].Filename != "a2" {
+		t.Errorf("expected a2 to match a synonym, got %v", res)
+	}
+
+	if merged.CorpusSize != 4 || merged.AverageDocumentLength() != whole.AverageDocumentLength() {
+		t.Errorf("expected 4 documents of average length %f, got %d of %f", whole.AverageDocumentLength(), merged.CorpusSize, merged.AverageDocumentLength())
+	}
+	for fidx := range merged.CorpusSize {
+		content, name, _ := merged.CatalogContent(t.Context(), fidx)
+		if _, body, _ := strings.Cut(all[name], "\n\n"); string(content) != body {
+			t.Errorf("%s: expected content %q, got %q", name, body, content)
+		}
+		wantMeta, _ := whole.Metadata(fidx)
+		if meta, _ := merged.Metadata(fidx); meta != wantMeta {
+			t.Errorf("%s: expected metadata %v, got %v", name, wantMeta, meta)
+		}
+		if labels := merged.Labels(fidx); !slices.Equal(labels, whole.Labels(fidx)) {
+			t.Errorf("%s: expected labels %v, got %v", name, whole.Labels(fidx), labels)
+		}
+	}
+	if merged.codec != Codec_Gzip {
+		t.Errorf("expected the codec of the first index, got %v", merged.codec)
+	}
+	if !reflect.DeepEqual(merged.IndexMetadata().Synonyms, expandSynonyms(synonyms)) {
+		t.Errorf("expected the synonyms to be kept, got %v", merged.IndexMetadata().Synonyms)
+	}
+	failures, err := loadErrorReport(merged.src)
+	if err != nil || len(failures) != 1 || failures[0].Filename != "b3" {
+		t.Errorf("expected b3 to be reported as a failure, got %v (%v)", failures, err)
+	}
+
+	// A file can only be in one index
+	if err := MergeIndexes(t.TempDir(), a, out); err == nil {
+		t.Error("expected an error merging indexes with the same files")
+	}
+
+	// Merged indexes can be written in the other forms too
+	ib := &IndexBuilder{}
+	ib.Init()
+	if err := ib.Merge(); err == nil {
+		t.Error("expected an error merging no indexes")
+	}
+	if err := ib.Merge(a, b); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "merged.bundle")
+	if err := ib.SerializeBundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+	fromBundle, err := LoadIndexFromDisk(bundle, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromBundle.Close()
+	if res, _ := fromBundle.Search(t.Context(), Term("travel")); len(res) != 1 || res[0].Filename != "b2" {
+		t.Errorf("expected b2 to be found in the merged bundle, got %v", res)
+	}
+}
@@ -0,0 +1,221 @@
+package emailsearch
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"mime"
+	"net/mail"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// IndexMetadata describes how an index was built. It is serialized as JSON
+// so that it can be inspected by users.
+type IndexMetadata struct {
+	// Analyzer describes how the text of the emails was analyzed into
+	// words. It is nil for indexes built before it was recorded.
+	Analyzer *Analyzer `json:"analyzer,omitempty"`
+
+	// Synonyms holds the synonym dictionary that was applied when the index
+	// was built. Every word maps to all of its synonyms.
+	Synonyms map[string][]string `json:"synonyms,omitempty"`
+
+	// Checksums holds the hex CRC-32C checksum of every other file of the
+	// index, keyed by filename. Indexes built before checksums were added
+	// have none and are not verified.
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	// Encrypted lists the files of the index that are encrypted, see
+	// IndexBuilder.EncryptionKey.
+	Encrypted []string `json:"encrypted,omitempty"`
+
+	// CatalogShards is the manifest of the files the email content is split
+	// into, in order, see IndexBuilder.MaxCatalogShardSize. It is empty if
+	// the content is in the catalog itself, and for indexes built before it
+	// was recorded.
+	CatalogShards []CatalogShard `json:"catalog_shards,omitempty"`
+}
+
+// CatalogShard describes one catalog shard file.
+type CatalogShard struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"` // Size of the file as stored, after any encryption
+
+	// The shard holds the content of Documents files, whose filename
+	// indices run from FirstDocument to LastDocument.
+	FirstDocument int `json:"first_document"`
+	LastDocument  int `json:"last_document"`
+	Documents     int `json:"documents"`
+}
+
+// fingerprint returns a short hash of the checksums of the index files. An
+// index built before checksums were added has a random fingerprint, so it is
+// only stable for as long as the index is loaded.
+func (m IndexMetadata) fingerprint() string {
+	h := sha256.New()
+	if len(m.Checksums) == 0 {
+		var b [16]byte
+		rand.Read(b[:])
+		h.Write(b[:])
+	}
+	for _, name := range slices.Sorted(maps.Keys(m.Checksums)) {
+		fmt.Fprintf(h, "%s %s\n", name, m.Checksums[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// DocumentMetadata holds information parsed from the headers of an email.
+type DocumentMetadata struct {
+	Date    time.Time // Zero if the email had no parsable Date header
+	From    string
+	Subject string
+	To      string
+
+	// ContentType and ContentTransferEncoding are the MIME headers of the
+	// body, which BodyParts needs to take it apart. They, and To, are empty
+	// for emails indexed before they were recorded.
+	ContentType             string
+	ContentTransferEncoding string
+
+	// BodyOffset is the byte offset of the body in the original file, just
+	// past the blank line that ends the headers, or in the message for
+	// emails split out of an mbox. The offsets of body matches and of the
+	// stored body are relative to the body, so BodyOffset plus the offset of
+	// a match is where it is in the original. A body always follows at least
+	// one line of headers, so 0 means unknown: the email was indexed before
+	// the offset was recorded, or a ContentFilter changed more than the end
+	// of its body.
+	BodyOffset int64
+}
+
+var errBadMetadata = errors.New("malformed document metadata")
+
+// maxMetadataFieldLen is the longest From, Subject or To that is stored, and
+// maxMetadataMIMELen the longest MIME header. Longer values are truncated so
+// that a record always fits in maxMetadataLen.
+const (
+	maxMetadataFieldLen = 1024
+	maxMetadataMIMELen  = 256
+)
+
+// parseMetadata extracts the document metadata from the email headers. MIME
+// encoded-words are decoded.
+func parseMetadata(h mail.Header) DocumentMetadata {
+	var meta DocumentMetadata
+
+	if date, err := h.Date(); err == nil {
+		meta.Date = date
+	}
+
+	dec := new(mime.WordDecoder)
+	meta.From = decodeHeader(dec, h.Get("From"))
+	meta.Subject = decodeHeader(dec, h.Get("Subject"))
+	meta.To = decodeHeader(dec, h.Get("To"))
+	meta.ContentType = h.Get("Content-Type")
+	meta.ContentTransferEncoding = h.Get("Content-Transfer-Encoding")
+
+	return meta
+}
+
+func decodeHeader(dec *mime.WordDecoder, value string) string {
+	if decoded, err := dec.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// appendMetadata appends the serialized form of meta to b.
+func appendMetadata(b []byte, meta DocumentMetadata) []byte {
+	var date int64
+	if !meta.Date.IsZero() {
+		date = meta.Date.Unix()
+	}
+	b = binary.AppendVarint(b, date)
+	b = appendMetadataString(b, truncateUTF8(meta.From, maxMetadataFieldLen))
+	b = appendMetadataString(b, truncateUTF8(meta.Subject, maxMetadataFieldLen))
+	b = appendMetadataString(b, truncateUTF8(meta.To, maxMetadataFieldLen))
+	b = appendMetadataString(b, truncateUTF8(meta.ContentType, maxMetadataMIMELen))
+	b = appendMetadataString(b, truncateUTF8(meta.ContentTransferEncoding, maxMetadataMIMELen))
+	b = binary.AppendUvarint(b, uint64(max(meta.BodyOffset, 0)))
+
+	return b
+}
+
+func appendMetadataString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// decodeMetadata decodes document metadata serialized by appendMetadata from
+// the front of b, which was read from a catalog of version catalogVersion.
+// Catalogs before version 7 didn't record To or the MIME headers, and before
+// version 8 the offset of the body.
+func decodeMetadata(b []byte, catalogVersion uint32) (DocumentMetadata, error) {
+	var meta DocumentMetadata
+
+	date, n := binary.Varint(b)
+	if n <= 0 {
+		return meta, errBadMetadata
+	}
+	b = b[n:]
+	if date != 0 {
+		meta.Date = time.Unix(date, 0).UTC()
+	}
+
+	from, b, err := decodeMetadataString(b)
+	if err != nil {
+		return meta, err
+	}
+	subject, b, err := decodeMetadataString(b)
+	if err != nil {
+		return meta, err
+	}
+	meta.From, meta.Subject = from, subject
+	if catalogVersion < 7 {
+		return meta, nil
+	}
+
+	for _, field := range []*string{&meta.To, &meta.ContentType, &meta.ContentTransferEncoding} {
+		if *field, b, err = decodeMetadataString(b); err != nil {
+			return meta, err
+		}
+	}
+	if catalogVersion < 8 {
+		return meta, nil
+	}
+
+	offset, n := binary.Uvarint(b)
+	if n <= 0 || offset > math.MaxInt64 {
+		return meta, errBadMetadata
+	}
+	meta.BodyOffset = int64(offset)
+
+	return meta, nil
+}
+
+func decodeMetadataString(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, errBadMetadata
+	}
+	b = b[n:]
+	return string(b[:l]), b[l:], nil
+}
@@ -0,0 +1,86 @@
+package emailsearch
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	cases := []struct {
+		Name string
+		Meta DocumentMetadata
+	}{
+		{"Empty", DocumentMetadata{}},
+		{"Full", DocumentMetadata{time.Date(2001, 5, 14, 23, 39, 0, 0, time.UTC), "phillip.allen@enron.com", "Re: budget", "john.arnold@enron.com", "text/plain", "", 412}},
+		{"Before epoch", DocumentMetadata{time.Date(1969, 1, 1, 0, 0, 0, 0, time.UTC), "a@b.com", "", "", "", "", 0}},
+		{"MIME", DocumentMetadata{From: "a@b.com", To: "c@d.com, e@f.com", ContentType: `multipart/mixed; boundary="b1"`, ContentTransferEncoding: "7bit"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := decodeMetadata(appendMetadata(nil, tc.Meta), catalogVersion)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Date.Equal(tc.Meta.Date) {
+				t.Errorf("Expected %v, got %v", tc.Meta.Date, got.Date)
+			}
+			got.Date = tc.Meta.Date
+			if got != tc.Meta {
+				t.Errorf("Expected %+v, got %+v", tc.Meta, got)
+			}
+
+			// Older catalogs only have the date, From and Subject
+			old, err := decodeMetadata(appendMetadata(nil, tc.Meta), 6)
+			if err != nil || old.From != tc.Meta.From || old.Subject != tc.Meta.Subject || old.To != "" {
+				t.Errorf("Expected the version 6 fields of %+v, got %+v (%v)", tc.Meta, old, err)
+			}
+			old, err = decodeMetadata(appendMetadata(nil, tc.Meta), 7)
+			if err != nil || old.ContentType != tc.Meta.ContentType || old.BodyOffset != 0 {
+				t.Errorf("Expected the version 7 fields of %+v, got %+v (%v)", tc.Meta, old, err)
+			}
+		})
+	}
+
+	if _, err := decodeMetadata([]byte{0, 10, 'a'}, catalogVersion); err == nil {
+		t.Error("expected error decoding truncated metadata")
+	}
+
+	long := DocumentMetadata{Subject: strings.Repeat("é", maxMetadataFieldLen)}
+	got, err := decodeMetadata(appendMetadata(nil, long), catalogVersion)
+	if err != nil || len(got.Subject) != maxMetadataFieldLen {
+		t.Errorf("expected subject truncated to %d bytes, got %d (%v)", maxMetadataFieldLen, len(got.Subject), err)
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader("Date: Mon, 14 May 2001 16:39:00 -0700 (PDT)\n" +
+		"From: phillip.allen@enron.com\n" +
+		"To: john.arnold@enron.com\n" +
+		"Content-Type: text/plain; charset=us-ascii\n" +
+		"Subject: =?UTF-8?Q?Caf=C3=A9?=\n\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := parseMetadata(msg.Header)
+	if want := time.Date(2001, 5, 14, 23, 39, 0, 0, time.UTC); !meta.Date.Equal(want) {
+		t.Errorf("Expected date %v, got %v", want, meta.Date)
+	}
+	if meta.From != "phillip.allen@enron.com" || meta.Subject != "Café" || meta.To != "john.arnold@enron.com" || meta.ContentType != "text/plain; charset=us-ascii" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+}
+
+func TestIndexFingerprint(t *testing.T) {
+	a := IndexMetadata{Checksums: map[string]string{CorpusIndex: "1234", CorpusCatalog: "5678"}}
+	b := IndexMetadata{Checksums: map[string]string{CorpusIndex: "1234", CorpusCatalog: "5679"}}
+	if a.fingerprint() != a.fingerprint() || a.fingerprint() == b.fingerprint() {
+		t.Error("expected the fingerprint to follow the checksums")
+	}
+	if (IndexMetadata{}).fingerprint() == (IndexMetadata{}).fingerprint() {
+		t.Error("expected indexes without checksums to have different fingerprints")
+	}
+}
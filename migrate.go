@@ -0,0 +1,211 @@
+package emailsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// MigrateIndex upgrades the serialized index at path, a directory, a bundle
+// or a SQLite database, to the current file format in place. Every older
+// format can be migrated. It returns false if the index is already current.
+//
+// An index whose search index is too old for LoadIndexFromDisk to read, from
+// before version 7, is rebuilt from the emails in its catalog instead. Its
+// catalog only holds the body of each email, and from catalog version 2 the
+// Date, From and Subject, so the other headers, such as To, are not indexed
+// after migrating. Rebuilding the index from the emails indexes them too.
+//
+// A bundle or database is replaced atomically. A directory is updated one
+// file at a time, with metadata.json last, so a server loading it part way
+// through fails the checksum verification rather than loading a mix of
+// formats.
+func MigrateIndex(path string) (bool, error) {
+	if isRemote(path) {
+		return false, fmt.Errorf("%s: remote indexes can not be migrated", path)
+	}
+	idx, err := LoadIndexFromDisk(path, io.Discard)
+	var verr *VersionError
+	if errors.As(err, &verr) && verr.File == CorpusIndex && verr.Got < minIndexVersion {
+		ib := &IndexBuilder{}
+		ib.Init()
+		if err := ib.reindexLegacy(path); err != nil {
+			return false, err
+		}
+		if err := writeMigrated(ib, path); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	trie, err := idx.trie()
+	if err != nil {
+		idx.Close()
+		return false, err
+	}
+	current := idx.indexVersion == indexVersion && idx.catalogVersion == catalogVersion && trie.version == trieVersion
+	idx.Close()
+	if current {
+		return false, nil
+	}
+
+	ib := &IndexBuilder{}
+	ib.Init()
+	if err := ib.mergeIndexes([]string{path}); err != nil {
+		return false, err
+	}
+	if err := writeMigrated(ib, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeMigrated serializes the migrated index ib over the index at path,
+// see MigrateIndex.
+func writeMigrated(ib *IndexBuilder, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if ok, err := isSQLite(path); err != nil {
+			return err
+		} else if ok {
+			return ib.SerializeSQLite(path)
+		}
+		return ib.SerializeBundle(path)
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := ib.Serialize(tmp); err != nil {
+		return err
+	}
+
+	// Move the new files over the old ones
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Name() != IndexMetadataFile {
+			names = append(names, e.Name())
+		}
+	}
+	names = append(names, IndexMetadataFile)
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(tmp, name), filepath.Join(path, name)); err != nil {
+			return err
+		}
+	}
+
+	// Remove catalog shards the migrated index no longer has
+	shards, err := filepath.Glob(filepath.Join(path, CorpusCatalog+".*"))
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if !slices.Contains(names, filepath.Base(shard)) {
+			if err := os.Remove(shard); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// reindexLegacy injests the emails of the index at path, whose search index
+// is too old to load, from its catalog. Only the filenames, the catalog, the
+// labels and the metadata of the index are read, see loadLegacy.
+func (ib *IndexBuilder) reindexLegacy(path string) error {
+	idx := &Index{files: &openFiles{}}
+	defer idx.Close()
+	if err := idx.loadLegacy(path); err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	ib.Codec = idx.codec
+	for _, shard := range idx.shardRdrs {
+		ib.MaxCatalogShardSize = max(ib.MaxCatalogShardSize, int64(shard.Len()))
+	}
+
+	for fidx, name := range idx.filenames.All() {
+		content, _, err := idx.ReadContent(context.Background(), fidx)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		compressed, err := compress(content, ib.Codec)
+		if err != nil {
+			return err
+		}
+
+		// The catalog has the body of the email, the indexed headers that
+		// it kept are put back
+		meta, _ := idx.metadata(fidx)
+		h := mail.Header{}
+		for name, value := range map[string]string{"From": meta.From, "To": meta.To, "Subject": meta.Subject} {
+			if value != "" {
+				h[name] = []string{value}
+			}
+		}
+		index, tokens := ib.indexEmail(h, content)
+		ib.injested = append(ib.injested, injestedFile{
+			Filename:   name,
+			Index:      index,
+			Len:        len(content),
+			Compressed: compressed,
+			Labels:     idx.Labels(fidx),
+			Meta:       meta,
+			Tokens:     tokens,
+			Attempts:   1,
+		})
+	}
+	failures, err := loadErrorReport(idx.src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	for _, f := range failures {
+		ib.injested = append(ib.injested, injestedFile{Filename: f.Filename, Err: errors.New(f.Error), Attempts: f.Attempts})
+	}
+
+	// Unlike the file indices of a merged index, the reindexed emails don't
+	// have the occurrences of synonyms yet
+	ib.synonyms = sortSynonyms(idx.meta.Synonyms)
+	ib.mergeInjested()
+	return nil
+}
+
+// loadLegacy loads the parts of the index at indexdir that an index whose
+// search index is too old to load is rebuilt from: the filenames, the
+// catalog, which is read from version 1, and the labels.
+func (idx *Index) loadLegacy(indexdir string) error {
+	var err error
+	if idx.src, err = openIndexSource(indexdir); err != nil {
+		return err
+	}
+	idx.files.add(idx.src)
+	if idx.meta, err = loadIndexMetadata(idx.src); err != nil {
+		return err
+	}
+	if err = verifyChecksums(idx.src, idx.meta.Checksums); err != nil {
+		return err
+	}
+	if idx.filenames, err = idx.openStringTable(FilenamesStringTable, false); err != nil {
+		return err
+	}
+	if err = idx.loadLabels(idx.src); err != nil {
+		return err
+	}
+	return idx.openCatalog(nil)
+}
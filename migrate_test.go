@@ -0,0 +1,234 @@
+package emailsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestMigrateIndex(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+		"3": "Subject: three\n\nThe budget lunch.\n",
+	}
+	queries := []Query{Term("budget"), And(Term("budget"), Term("lunch")), Phrase("budget lunch")}
+
+	// Small shards so that the migrated index keeps its catalog shards
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1, MaxCatalogShardSize: 1}, emails)
+	idx, err := LoadIndexFromDisk(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([][]QueryResults, len(queries))
+	for i, q := range queries {
+		if want[i], err = idx.Search(t.Context(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write the index back out as version 8, without checksums like the
+	// indexes of that time
+	index := downgradeIndex(t, idx, 8)
+	var offsets bytes.Buffer
+	if err := (&IndexBuilder{}).writeIndexOffsetsFile(idx.offsets, &offsets); err != nil {
+		t.Fatal(err)
+	}
+	meta := idx.IndexMetadata()
+	meta.Checksums = nil
+	metaJSON, _ := json.Marshal(meta)
+	idx.Close()
+	for name, data := range map[string][]byte{CorpusIndex: index, IndexWordOffsets: offsets.Bytes(), IndexMetadataFile: metaJSON} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrated, err := MigrateIndex(dir)
+	if err != nil || !migrated {
+		t.Fatalf("expected the index to be migrated, got %v", err)
+	}
+	idx, err = LoadIndexFromDisk(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if idx.indexVersion != indexVersion || len(idx.shardRdrs) != 3 || len(idx.IndexMetadata().Checksums) == 0 {
+		t.Errorf("expected a current index with 3 shards and checksums, got version %d with %d shards", idx.indexVersion, len(idx.shardRdrs))
+	}
+	for i, q := range queries {
+		got, err := idx.Search(t.Context(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("%s: expected %v, got %v", q, want[i], got)
+		}
+	}
+
+	if migrated, err := MigrateIndex(dir); err != nil || migrated {
+		t.Errorf("expected a current index to be left alone, got %v", err)
+	}
+	if tmps, _ := filepath.Glob(dir + ".*.tmp"); len(tmps) > 0 {
+		t.Errorf("expected the temporary files to be removed, found %v", tmps)
+	}
+}
+
+func TestMigrateCatalog(t *testing.T) {
+	emails := map[string]string{
+		"1": "From: lay@enron.com\nSubject: one\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+
+	// Old catalogs have shorter entries, without the compressed length and
+	// in version 4 with 32 bit fields
+	for _, version := range []uint32{4, 5} {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+			idx, err := LoadIndexFromDisk(dir, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var catalog bytes.Buffer
+			hdr := serializedCatalogHeader{catalogMagic, version, uint32(len(idx.contentEntry)), uint32(idx.codec), 0}
+			binary.Write(&catalog, binary.BigEndian, hdr)
+			var oldEntry any = catalogContentEntryV4{}
+			if version == 5 {
+				oldEntry = catalogContentEntryV5{}
+			}
+			shrink := uint64(len(idx.contentEntry) * (binary.Size(catalogContentEntry{}) - binary.Size(oldEntry)))
+			for _, e := range idx.contentEntry {
+				if version == 4 {
+					binary.Write(&catalog, binary.BigEndian, catalogContentEntryV4{uint32(e.Offset - shrink), uint32(e.Length), uint32(e.MetaOffset - shrink), e.Shard})
+				} else {
+					binary.Write(&catalog, binary.BigEndian, catalogContentEntryV5{e.Offset - shrink, e.Length, e.MetaOffset - shrink, e.Shard})
+				}
+			}
+			tableEnd := int64(binary.Size(hdr) + len(idx.contentEntry)*binary.Size(catalogContentEntry{}))
+			rest := make([]byte, int64(idx.catalogRdr.Len())-tableEnd)
+			idx.catalogRdr.ReadAt(rest, tableEnd)
+			catalog.Write(rest)
+			meta := idx.IndexMetadata()
+			meta.Checksums = nil
+			metaJSON, _ := json.Marshal(meta)
+			idx.Close()
+			for name, data := range map[string][]byte{CorpusCatalog: catalog.Bytes(), IndexMetadataFile: metaJSON} {
+				if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := func(version uint32) {
+				t.Helper()
+				idx, err := LoadIndexFromDisk(dir, io.Discard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer idx.Close()
+				if idx.catalogVersion != version {
+					t.Errorf("expected catalog version %d, got %d", version, idx.catalogVersion)
+				}
+				content, name, _ := idx.CatalogContent(t.Context(), 1)
+				if name != "2" || string(content) != "Lunch on Friday.\n" {
+					t.Errorf("unexpected content %q of %s", content, name)
+				}
+				if m, _ := idx.Metadata(0); m.From != "lay@enron.com" {
+					t.Errorf("unexpected metadata %v", m)
+				}
+				if known := idx.contentEntry[1].CompressedLength > 0; known != (version == catalogVersion) {
+					t.Errorf("catalog version %d: unexpected compressed length %d", version, idx.contentEntry[1].CompressedLength)
+				}
+			}
+			check(version)
+
+			// The index is current but the catalog is not
+			if migrated, err := MigrateIndex(dir); err != nil || !migrated {
+				t.Fatalf("expected the catalog to be migrated, got %v", err)
+			}
+			check(catalogVersion)
+		})
+	}
+}
+
+func TestMigrateLegacyIndex(t *testing.T) {
+	// The fixtures were built from the same three emails by the indexer of
+	// the time. Version 2 has a version 1 catalog, which only held the body
+	// of each email. Version 5 has a zstd compressed version 3 catalog,
+	// which held the Date, From and Subject too, and a synonym dictionary.
+	tests := []struct {
+		fixture string
+		queries map[Query][]string
+		from    string
+	}{
+		{"index-v2", map[Query][]string{
+			Term("budget"):                {"budget.eml", "invoice.eml"},
+			Phrase("summer picnic"):       {"picnic.eml"},
+			Label("Finance"):              {"budget.eml"},
+			Term("picnic", Field_Subject): nil,
+		}, ""},
+		{"index-v5", map[Query][]string{
+			Term("budget"):                {"budget.eml", "invoice.eml"},
+			Term("finances"):              {"budget.eml", "invoice.eml"},
+			Label("Social"):               {"picnic.eml"},
+			Term("picnic", Field_Subject): {"picnic.eml"},
+		}, "Billing <billing@example.org>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), tt.fixture)
+			if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", tt.fixture))); err != nil {
+				t.Fatal(err)
+			}
+			var verr *VersionError
+			if _, err := LoadIndexFromDisk(dir, io.Discard); !errors.As(err, &verr) || verr.File != CorpusIndex {
+				t.Fatalf("expected a version error loading %s, got %v", tt.fixture, err)
+			}
+
+			if migrated, err := MigrateIndex(dir); err != nil || !migrated {
+				t.Fatalf("expected the index to be migrated, got %v", err)
+			}
+			idx, err := LoadIndexFromDisk(dir, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer idx.Close()
+			if idx.indexVersion != indexVersion || idx.catalogVersion != catalogVersion {
+				t.Errorf("expected a current index, got index version %d and catalog version %d", idx.indexVersion, idx.catalogVersion)
+			}
+			if report, err := VerifyIndex(dir); err != nil || !report.OK() {
+				t.Errorf("expected the migrated index to verify, got %v %v", report, err)
+			}
+
+			for q, want := range tt.queries {
+				results, err := idx.Search(t.Context(), q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, r := range results {
+					got = append(got, r.Filename)
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, want) {
+					t.Errorf("%s: expected %v, got %v", q, want, got)
+				}
+			}
+			content, name, _ := idx.CatalogContent(t.Context(), 1)
+			if name != "invoice.eml" || !bytes.HasPrefix(content, []byte("Your invoice for June")) {
+				t.Errorf("unexpected content %q of %s", content, name)
+			}
+			if meta, _ := idx.Metadata(1); meta.From != tt.from {
+				t.Errorf("expected From %q, got %q", tt.from, meta.From)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package emailsearch
+
+import (
+	"io"
+	"iter"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Emails often carry other emails inside them, either as message/rfc822
+// MIME parts or as forwarded and replied-to text blocks like
+//
+//	-----Original Message-----
+//	From: Lay, Kenneth
+//	Sent: Monday, October 22, 2001 9:34 AM
+//	To: Skilling, Jeff
+//	Subject: Budget
+//
+// The bodies of embedded emails are part of the body of the containing email
+// and are indexed with it. Their headers, along with MIME boundaries and part
+// headers, are structure rather than content and are left out of the body
+// index. Instead the Subject, From and To of embedded emails are indexed as
+// the corresponding fields of the containing email.
+
+// bodyStructure is the result of parsing the structure of an email body.
+type bodyStructure struct {
+	skip    []wordSpan    // Spans of the body that are not content, in order
+	headers []mail.Header // Headers of the embedded emails
+}
+
+// parseBodyStructure finds the embedded emails and MIME structure in body,
+// the body of an email with header h.
+func parseBodyStructure(h mail.Header, body string) bodyStructure {
+	var bs bodyStructure
+	bs.walk(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), body, 0)
+	slices.SortFunc(bs.skip, func(a, b wordSpan) int { return a.start - b.start })
+	return bs
+}
+
+// walk examines content, which starts at offset base in the body, given its
+// MIME content type and transfer encoding.
+func (bs *bodyStructure) walk(contentType, encoding, content string, base int) {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediatype = "text/plain"
+	}
+
+	// Encoded content can't be indexed in place
+	switch strings.ToLower(encoding) {
+	case "base64":
+		bs.skipSpan(base, base+len(content))
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "":
+		bs.walkMultipart(params["boundary"], content, base)
+	case mediatype == "message/rfc822":
+		bs.walkMessage(content, base)
+	case strings.HasPrefix(mediatype, "text/"):
+		bs.walkText(content, base)
+	default:
+		bs.skipSpan(base, base+len(content)) // attachments
+	}
+}
+
+// walkMessage examines an embedded email.
+func (bs *bodyStructure) walkMessage(content string, base int) {
+	h, body, ok := splitHeader(content)
+	if !ok {
+		bs.walkText(content, base)
+		return
+	}
+
+	hdrLen := len(content) - len(body)
+	bs.skipSpan(base, base+hdrLen)
+	bs.headers = append(bs.headers, h)
+	bs.walk(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), body, base+hdrLen)
+}
+
+// walkMultipart examines the parts of multipart content. The preamble,
+// epilogue, boundary lines and part headers are skipped.
+func (bs *bodyStructure) walkMultipart(boundary, content string, base int) {
+	parts, ok := multipartSpans(boundary, content)
+	if !ok {
+		// No boundaries, treat it as text
+		bs.walkText(content, base)
+		return
+	}
+
+	prev := 0
+	for _, p := range parts {
+		bs.skipSpan(base+prev, base+p.start)
+		bs.walkPart(content[p.start:p.end], base+p.start)
+		prev = p.end
+	}
+	bs.skipSpan(base+prev, base+len(content))
+}
+
+// multipartSpans returns the spans of the parts of multipart content, or
+// false if it has no boundaries. The line break before a boundary belongs to
+// the boundary. If the closing boundary is missing the last part runs to the
+// end.
+func multipartSpans(boundary, content string) ([]wordSpan, bool) {
+	delim := "--" + boundary
+
+	var parts []wordSpan
+	partStart := -1 // Start of the current part, -1 before the first boundary
+	for line, offset := range lines(content) {
+		trimmed := strings.TrimRight(line, " \t\r\n")
+		closing := trimmed == delim+"--"
+		if trimmed != delim && !closing {
+			continue
+		}
+
+		if partStart >= 0 {
+			partEnd := offset
+			if partEnd > partStart && content[partEnd-1] == '\n' {
+				partEnd--
+				if partEnd > partStart && content[partEnd-1] == '\r' {
+					partEnd--
+				}
+			}
+			parts = append(parts, wordSpan{partStart, partEnd})
+		}
+
+		if closing {
+			return parts, true
+		}
+		partStart = offset + len(line)
+	}
+
+	if partStart < 0 {
+		return nil, false
+	}
+	return append(parts, wordSpan{partStart, len(content)}), true
+}
+
+// walkPart examines one part of multipart content.
+func (bs *bodyStructure) walkPart(part string, base int) {
+	h, body, ok := splitHeader(part)
+	if !ok {
+		bs.walkText(part, base)
+		return
+	}
+
+	hdrLen := len(part) - len(body)
+	bs.skipSpan(base, base+hdrLen)
+	bs.walk(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), body, base+hdrLen)
+}
+
+var forwardMarker = regexp.MustCompile(`(?i)^[ \t>]*(?:-{2,}[ \t]*(?:original message|forwarded message|forwarded by\b.*?)[ \t]*-*|begin forwarded message:)[ \t]*\r?\n?$`)
+
+// forwardHeaderKeys are the headers recognized in forwarded text blocks
+var forwardHeaderKeys = []string{"from", "to", "cc", "bcc", "sent", "date", "subject", "reply-to"}
+
+// walkText examines text content for forwarded and replied-to email blocks.
+func (bs *bodyStructure) walkText(content string, base int) {
+	next, stop := iter.Pull2(lines(content))
+	defer stop()
+
+	for {
+		line, offset, ok := next()
+		if !ok {
+			return
+		}
+		if !forwardMarker.MatchString(line) {
+			continue
+		}
+
+		// The marker is followed by a block of headers, which may be preceded
+		// by blank lines and ends at a blank line or a line that isn't a
+		// header.
+		start, end := offset, offset+len(line)
+		h := make(mail.Header)
+		var key string
+		for {
+			line, offset, ok = next()
+			if !ok {
+				break
+			}
+			trimmed := strings.TrimSpace(strings.TrimLeft(line, ">"))
+			if trimmed == "" {
+				if len(h) > 0 {
+					break
+				}
+				end = offset + len(line)
+				continue
+			}
+
+			if k, v, found := strings.Cut(trimmed, ":"); found && slices.Contains(forwardHeaderKeys, strings.ToLower(strings.TrimSpace(k))) {
+				key = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(k))
+				h[key] = append(h[key], strings.TrimSpace(v))
+			} else if key != "" && (line[0] == ' ' || line[0] == '\t') {
+				// Continuation of the previous header
+				vals := h[key]
+				vals[len(vals)-1] += " " + trimmed
+			} else {
+				break
+			}
+			end = offset + len(line)
+		}
+
+		bs.skipSpan(base+start, base+end)
+		if len(h) > 0 {
+			bs.headers = append(bs.headers, h)
+		}
+		if !ok {
+			return
+		}
+		if forwardMarker.MatchString(line) {
+			// A marker straight after a block, rescan from the marker
+			bs.walkText(content[offset:], base+offset)
+			return
+		}
+	}
+}
+
+// lines returns the lines of s, including their line endings, along with
+// their offsets.
+func lines(s string) iter.Seq2[string, int] {
+	return func(yield func(string, int) bool) {
+		offset := 0
+		for line := range strings.Lines(s) {
+			if !yield(line, offset) {
+				return
+			}
+			offset += len(line)
+		}
+	}
+}
+
+func (bs *bodyStructure) skipSpan(start, end int) {
+	if end > start {
+		bs.skip = append(bs.skip, wordSpan{start, end})
+	}
+}
+
+// splitHeader splits content into its header and body. It returns false if
+// content does not start with a header block.
+func splitHeader(content string) (mail.Header, string, bool) {
+	m, err := mail.ReadMessage(strings.NewReader(content))
+	if err != nil {
+		return nil, "", false
+	}
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, "", false
+	}
+	return m.Header, string(body), true
+}
+
+// dropSpans removes the occurrences in field that start inside any of spans,
+// which must be sorted and not overlap.
+func dropSpans(index fileIndex, field Field, spans []wordSpan) {
+	if len(spans) == 0 {
+		return
+	}
+
+	inSpan := func(offset int) bool {
+		i, found := slices.BinarySearchFunc(spans, offset, func(s wordSpan, off int) int { return s.start - off })
+		if found {
+			return true
+		}
+		return i > 0 && offset < spans[i-1].end
+	}
+
+	for word, occs := range index {
+		occs = slices.DeleteFunc(occs, func(o occurrence) bool { return o.Field == field && inSpan(o.Offset) })
+		if len(occs) == 0 {
+			delete(index, word)
+		} else {
+			index[word] = occs
+		}
+	}
+}
+
+// mergeFileIndex merges the occurrences of src into dst.
+func mergeFileIndex(dst, src fileIndex) {
+	for word, occs := range src {
+		dst[word] = mergeOccurrences(dst[word], occs)
+	}
+}
@@ -0,0 +1,97 @@
+package emailsearch
+
+import (
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// skipped returns the text of the body that is skipped
+func skipped(body string, spans []wordSpan) []string {
+	var out []string
+	for _, s := range spans {
+		out = append(out, body[s.start:s.end])
+	}
+	return out
+}
+
+func TestParseBodyStructureForwarded(t *testing.T) {
+	body := "Please see below.\n\n" +
+		"-----Original Message-----\n" +
+		"From: Lay, Kenneth\n" +
+		"Sent: Monday, October 22, 2001 9:34 AM\n" +
+		"To: Skilling, Jeff\n" +
+		"Subject: Quarterly\n" +
+		"  budget\n" +
+		"\n" +
+		"The numbers are in.\n"
+
+	bs := parseBodyStructure(mail.Header{}, body)
+
+	want := []string{"-----Original Message-----\nFrom: Lay, Kenneth\nSent: Monday, October 22, 2001 9:34 AM\nTo: Skilling, Jeff\nSubject: Quarterly\n  budget\n"}
+	if got := skipped(body, bs.skip); !slices.Equal(got, want) {
+		t.Errorf("expected skipped %q, got %q", want, got)
+	}
+	if len(bs.headers) != 1 {
+		t.Fatalf("expected 1 embedded header, got %d", len(bs.headers))
+	}
+	if got := bs.headers[0].Get("Subject"); got != "Quarterly budget" {
+		t.Errorf("expected subject %q, got %q", "Quarterly budget", got)
+	}
+	if got := bs.headers[0].Get("From"); got != "Lay, Kenneth" {
+		t.Errorf("expected from %q, got %q", "Lay, Kenneth", got)
+	}
+}
+
+func TestParseBodyStructureMIME(t *testing.T) {
+	h := mail.Header{"Content-Type": {`multipart/mixed; boundary="XYZ"`}}
+	body := "This is a multi-part message in MIME format.\n" +
+		"--XYZ\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Forwarding the memo.\n" +
+		"--XYZ\n" +
+		"Content-Type: message/rfc822\n" +
+		"\n" +
+		"From: jeff.skilling@enron.com\n" +
+		"Subject: Memo\n" +
+		"\n" +
+		"Memo text.\n" +
+		"--XYZ\n" +
+		"Content-Type: application/pdf\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"JVBERi0xLjQK\n" +
+		"--XYZ--\n" +
+		"epilogue\n"
+
+	bs := parseBodyStructure(h, body)
+
+	// Everything except the two pieces of text content is skipped
+	var kept strings.Builder
+	last := 0
+	for _, s := range bs.skip {
+		if s.start < last {
+			t.Fatalf("overlapping spans %v", bs.skip)
+		}
+		kept.WriteString(body[last:s.start])
+		last = s.end
+	}
+	kept.WriteString(body[last:])
+	if got, want := kept.String(), "Forwarding the memo.Memo text."; got != want {
+		t.Errorf("expected content %q, got %q", want, got)
+	}
+
+	if len(bs.headers) != 1 || bs.headers[0].Get("Subject") != "Memo" {
+		t.Errorf("expected the embedded message header, got %v", bs.headers)
+	}
+}
+
+func TestParseBodyStructurePlain(t *testing.T) {
+	body := "Nothing embedded here.\nFrom: is just text\n"
+	bs := parseBodyStructure(mail.Header{}, body)
+	if len(bs.skip) != 0 || len(bs.headers) != 0 {
+		t.Errorf("expected no structure, got %+v", bs)
+	}
+}
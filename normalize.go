@@ -0,0 +1,153 @@
+package emailsearch
+
+import (
+	"fmt"
+	"iter"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dates and numbers are written in many different ways. At index time every
+// date-like or separated number span of text is additionally indexed under a
+// canonical token, so that a single query form matches every spelling:
+//   - Dates become yyyymmdd, "Jan 3 2001", "01/03/2001" and "2001-01-03" are
+//     all indexed as "20010103".
+//   - Numbers with thousands separators lose them, "1,000,000" is indexed as
+//     "1000000".
+//
+// Query terms go through the same normalization, see NormalizeQuery.
+
+const monthPattern = `(jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sep(?:t(?:ember)?)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)`
+
+type normalizer struct {
+	re        *regexp.Regexp
+	canonical func(groups []string) (string, bool)
+}
+
+var normalizers = []normalizer{
+	// Jan 3 2001, January 3rd, 2001, Jan. 3, 2001
+	{
+		regexp.MustCompile(`(?i)\b` + monthPattern + `\.?\s+(\d{1,2})(?:st|nd|rd|th)?,?\s+(\d{4})\b`),
+		func(g []string) (string, bool) { return canonicalDate(g[3], monthNumber(g[1]), g[2]) },
+	},
+	// 3 Jan 2001, 3rd January, 2001, 03-Jan-2001, 03-Jan-01
+	{
+		regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?[\s-]+` + monthPattern + `\.?,?[\s-]+(\d{4}|\d{2})\b`),
+		func(g []string) (string, bool) { return canonicalDate(g[3], monthNumber(g[2]), g[1]) },
+	},
+	// 01/03/2001, 1/3/01 (US month first ordering)
+	{
+		regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})/(\d{4}|\d{2})\b`),
+		func(g []string) (string, bool) {
+			month, _ := strconv.Atoi(g[1])
+			return canonicalDate(g[3], month, g[2])
+		},
+	},
+	// 2001-01-03
+	{
+		regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`),
+		func(g []string) (string, bool) {
+			month, _ := strconv.Atoi(g[2])
+			return canonicalDate(g[1], month, g[3])
+		},
+	},
+	// 1,000,000
+	{
+		regexp.MustCompile(`\b\d{1,3}(?:,\d{3})+\b`),
+		func(g []string) (string, bool) { return strings.ReplaceAll(g[0], ",", ""), true },
+	},
+}
+
+// normalizedSpans returns the spans of text that have a canonical token along
+// with that token. Spans are returned in order of increasing start offset.
+func normalizedSpans(text string) iter.Seq2[wordSpan, string] {
+	return func(yield func(wordSpan, string) bool) {
+		type found struct {
+			span  wordSpan
+			token string
+		}
+		var all []found
+
+		for _, n := range normalizers {
+			for _, m := range n.re.FindAllStringSubmatchIndex(text, -1) {
+				groups := make([]string, len(m)/2)
+				for i := range groups {
+					if m[2*i] >= 0 {
+						groups[i] = text[m[2*i]:m[2*i+1]]
+					}
+				}
+				if token, ok := n.canonical(groups); ok {
+					all = append(all, found{wordSpan{m[0], m[1]}, token})
+				}
+			}
+		}
+
+		slices.SortStableFunc(all, func(a, b found) int { return a.span.start - b.span.start })
+		for _, f := range all {
+			if !yield(f.span, f.token) {
+				return
+			}
+		}
+	}
+}
+
+// NormalizeQuery replaces date-like and separated number query words with
+// their canonical tokens. Dates can span several words, "Jan 3 2001" becomes
+// the single word "20010103".
+func NormalizeQuery(words []string) []string {
+	text := strings.Join(words, " ")
+
+	var (
+		out  []string
+		last int
+	)
+	for span, token := range normalizedSpans(text) {
+		if span.start < last {
+			continue // overlaps a previous replacement
+		}
+		out = append(out, strings.Fields(text[last:span.start])...)
+		out = append(out, token)
+		last = span.end
+	}
+	if last == 0 {
+		return words
+	}
+	out = append(out, strings.Fields(text[last:])...)
+
+	return out
+}
+
+func monthNumber(name string) int {
+	months := []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	return slices.Index(months, strings.ToLower(name[:3])) + 1
+}
+
+// canonicalDate returns the yyyymmdd token for a date, two digit years are
+// mapped to 1950-2049. It returns false if the date is not valid.
+func canonicalDate(year string, month int, day string) (string, bool) {
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return "", false
+	}
+	if len(year) == 2 {
+		if y < 50 {
+			y += 2000
+		} else {
+			y += 1900
+		}
+	}
+	d, err := strconv.Atoi(day)
+	if err != nil {
+		return "", false
+	}
+
+	t := time.Date(y, time.Month(month), d, 0, 0, 0, 0, time.UTC)
+	if month < 1 || month > 12 || t.Day() != d || t.Month() != time.Month(month) {
+		return "", false
+	}
+
+	return fmt.Sprintf("%04d%02d%02d", y, month, d), true
+}
@@ -0,0 +1,61 @@
+package emailsearch
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizedSpans(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    string
+		Expected []string
+	}{
+		{"No dates", "hello world", nil},
+		{"Month day year", "Meet on Jan 3 2001 please", []string{"20010103"}},
+		{"Long month", "January 3rd, 2001", []string{"20010103"}},
+		{"Abbreviated month", "Sept. 30, 2000", []string{"20000930"}},
+		{"Day month year", "3 January 2001", []string{"20010103"}},
+		{"Dashed", "03-Jan-01", []string{"20010103"}},
+		{"US numeric", "01/03/2001", []string{"20010103"}},
+		{"Short numeric", "1/3/01", []string{"20010103"}},
+		{"ISO", "2001-01-03", []string{"20010103"}},
+		{"Invalid date", "02/30/2001", nil},
+		{"Number", "paid $1,000,000 today", []string{"1000000"}},
+		{"Not a number", "1,00", nil},
+		{"Multiple", "1,500 on 2001-01-03", []string{"1500", "20010103"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var tokens []string
+			for _, token := range normalizedSpans(tc.Input) {
+				tokens = append(tokens, token)
+			}
+			if !slices.Equal(tokens, tc.Expected) {
+				t.Errorf("Expected %v, got %v", tc.Expected, tokens)
+			}
+		})
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Input    []string
+		Expected []string
+	}{
+		{"Unchanged", []string{"budget", "forecast"}, []string{"budget", "forecast"}},
+		{"Multi word date", []string{"meeting", "Jan", "3", "2001"}, []string{"meeting", "20010103"}},
+		{"Numeric date", []string{"01/03/2001"}, []string{"20010103"}},
+		{"Number", []string{"1,000,000", "dollars"}, []string{"1000000", "dollars"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := NormalizeQuery(tc.Input); !slices.Equal(got, tc.Expected) {
+				t.Errorf("Expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package emailsearch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// BodyPart is a part of an email body to show, found by BodyParts.
+type BodyPart struct {
+	ContentType string // Media type without parameters, e.g. text/plain
+	Encoding    string // Content-Transfer-Encoding in lower case, "" if none
+	Filename    string // Name of an attachment, if it has one
+	Attachment  bool   // Not text to show inline, e.g. a PDF
+
+	Offset, Length int // Span of the encoded content in the body
+}
+
+// RFC822HeadersType is the ContentType of a part that holds the headers of
+// an embedded email.
+const RFC822HeadersType = "text/rfc822-headers"
+
+// BodyParts takes apart the MIME structure of body, the body of an email
+// with metadata meta, into the parts to show in order. Multipart containers
+// are replaced by their parts and of alternatives only the plain text one,
+// or failing that the last, is kept. An embedded email becomes a part with
+// its headers followed by the parts of its body. An email without MIME
+// headers, including those indexed before they were recorded, is one plain
+// text part.
+func BodyParts(meta DocumentMetadata, body []byte) []BodyPart {
+	var parts []BodyPart
+	walkParts(&parts, meta.ContentType, meta.ContentTransferEncoding, "", string(body), 0)
+	return parts
+}
+
+// walkParts appends the parts of content, which starts at offset base in the
+// body, to parts given its MIME headers.
+func walkParts(parts *[]BodyPart, contentType, encoding, disposition, content string, base int) {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediatype, params = "text/plain", nil
+	}
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+
+	switch {
+	case strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" && encoding != "base64":
+		spans, ok := multipartSpans(params["boundary"], content)
+		if !ok {
+			break
+		}
+		var alternatives [][]BodyPart
+		for _, span := range spans {
+			var sub []BodyPart
+			part := content[span.start:span.end]
+			if h, partBody, ok := splitHeader(part); ok {
+				hdrLen := len(part) - len(partBody)
+				walkParts(&sub, h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), h.Get("Content-Disposition"), partBody, base+span.start+hdrLen)
+			} else {
+				walkParts(&sub, "", "", "", part, base+span.start)
+			}
+			alternatives = append(alternatives, sub)
+		}
+		if mediatype != "multipart/alternative" || len(alternatives) == 0 {
+			for _, sub := range alternatives {
+				*parts = append(*parts, sub...)
+			}
+			return
+		}
+		chosen := alternatives[len(alternatives)-1]
+		for _, sub := range alternatives {
+			if len(sub) == 1 && sub[0].ContentType == "text/plain" {
+				chosen = sub
+				break
+			}
+		}
+		*parts = append(*parts, chosen...)
+		return
+	case mediatype == "message/rfc822" && encoding != "base64":
+		h, msgBody, ok := splitHeader(content)
+		if !ok {
+			break
+		}
+		hdrLen := len(content) - len(msgBody)
+		*parts = append(*parts, BodyPart{ContentType: RFC822HeadersType, Offset: base, Length: hdrLen})
+		walkParts(parts, h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), "", msgBody, base+hdrLen)
+		return
+	}
+
+	part := BodyPart{ContentType: mediatype, Encoding: encoding, Offset: base, Length: len(content)}
+	part.Filename = params["name"]
+	if disp, dparams, err := mime.ParseMediaType(disposition); err == nil {
+		if dparams["filename"] != "" {
+			part.Filename = dparams["filename"]
+		}
+		part.Attachment = disp == "attachment"
+	}
+	if !strings.HasPrefix(mediatype, "text/") {
+		part.Attachment = true
+	}
+	*parts = append(*parts, part)
+}
+
+// Decode returns the content of the part, the span of body it covers with
+// its transfer encoding undone.
+func (p BodyPart) Decode(body []byte) ([]byte, error) {
+	content := body[p.Offset : p.Offset+p.Length]
+	switch p.Encoding {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(content)))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+	}
+	return content, nil
+}
@@ -0,0 +1,69 @@
+package emailsearch
+
+import (
+	"testing"
+)
+
+func TestBodyParts(t *testing.T) {
+	body := "Preamble\n" +
+		"--outer\n" +
+		"Content-Type: multipart/alternative; boundary=inner\n" +
+		"\n" +
+		"--inner\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"The budget is attached.\n" +
+		"--inner\n" +
+		"Content-Type: text/html\n" +
+		"\n" +
+		"<p>The budget is attached.</p>\n" +
+		"--inner--\n" +
+		"--outer\n" +
+		"Content-Type: application/pdf; name=\"budget.pdf\"\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"Content-Disposition: attachment; filename=\"q3 budget.pdf\"\n" +
+		"\n" +
+		"JVBERi0x\nLjQK\n" +
+		"--outer\n" +
+		"Content-Type: message/rfc822\n" +
+		"\n" +
+		"From: lay@enron.com\n" +
+		"Subject: Forecast\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Transfer-Encoding: quoted-printable\n" +
+		"\n" +
+		"Caf=C3=A9 at noon.\n" +
+		"--outer--\n"
+	meta := DocumentMetadata{ContentType: `multipart/mixed; boundary="outer"`}
+
+	parts := BodyParts(meta, []byte(body))
+	want := []struct {
+		ContentType, Filename string
+		Attachment            bool
+		Content               string
+	}{
+		{"text/plain", "", false, "The budget is attached."},
+		{"application/pdf", "q3 budget.pdf", true, "%PDF-1.4\n"},
+		{RFC822HeadersType, "", false, "From: lay@enron.com\nSubject: Forecast\nContent-Type: text/plain\nContent-Transfer-Encoding: quoted-printable\n\n"},
+		{"text/plain", "", false, "Café at noon."},
+	}
+	if len(parts) != len(want) {
+		t.Fatalf("expected %d parts, got %+v", len(want), parts)
+	}
+	for i, p := range parts {
+		content, err := p.Decode([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := want[i]
+		if p.ContentType != w.ContentType || p.Filename != w.Filename || p.Attachment != w.Attachment || string(content) != w.Content {
+			t.Errorf("part %d: expected %+v, got %+v with content %q", i, w, p, content)
+		}
+	}
+
+	// Without MIME headers the body is one text part
+	parts = BodyParts(DocumentMetadata{}, []byte(body))
+	if len(parts) != 1 || parts[0].ContentType != "text/plain" || parts[0].Length != len(body) {
+		t.Errorf("expected the whole body as text, got %+v", parts)
+	}
+}
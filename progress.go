@@ -0,0 +1,33 @@
+package emailsearch
+
+import "time"
+
+// progress tracks how far through an operation the builder is, to report the
+// rate of progress and estimate the time remaining.
+type progress struct {
+	start time.Time
+	total int // Number of items in the operation, 0 if not known
+	done  int
+}
+
+// reset starts tracking a new operation of total items.
+func (p *progress) reset(total int) {
+	*p = progress{start: time.Now(), total: total}
+}
+
+// advance records that n more items are complete. It returns the average
+// number of items completed per second and the estimated time remaining. The
+// time remaining is 0 if the total is not known.
+func (p *progress) advance(n int) (rate float64, remaining time.Duration) {
+	p.done += n
+	elapsed := time.Since(p.start)
+	if elapsed <= 0 {
+		return 0, 0
+	}
+
+	rate = float64(p.done) / elapsed.Seconds()
+	if p.total > p.done && rate > 0 {
+		remaining = time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+	}
+	return rate, remaining
+}
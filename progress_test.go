@@ -0,0 +1,74 @@
+package emailsearch
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := progress{start: time.Now().Add(-10 * time.Second), total: 100}
+
+	rate, remaining := p.advance(20)
+	if rate < 1.9 || rate > 2.1 {
+		t.Errorf("expected rate of about 2/s, got %v", rate)
+	}
+	if remaining < 39*time.Second || remaining > 41*time.Second {
+		t.Errorf("expected about 40s remaining, got %v", remaining)
+	}
+
+	if _, remaining = p.advance(80); remaining != 0 {
+		t.Errorf("expected nothing remaining when done, got %v", remaining)
+	}
+
+	p = progress{start: time.Now().Add(-time.Second)}
+	if _, remaining = p.advance(5); remaining != 0 {
+		t.Errorf("expected no estimate for unknown total, got %v", remaining)
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	var injested []string
+	var phases []SerializePhase
+	var serialized int
+	var current SerializePhase // The phase begun and not yet ended
+	var interleaved bool
+	ib := &IndexBuilder{NThreads: 1, Progress: func(ev ProgressEvent) {
+		switch u := ev.(type) {
+		case InjestUpdate:
+			if u.Phase == 2 {
+				injested = append(injested, u.Filename)
+			}
+		case SerializeUpdate:
+			serialized++
+			switch u.Event {
+			case SerializeEvent_BeginPhase:
+				interleaved = interleaved || current != 0
+				current = u.Phase
+				phases = append(phases, u.Phase)
+			case SerializeEvent_ProgressPhase:
+				interleaved = interleaved || u.Phase != current
+			case SerializeEvent_EndPhase:
+				interleaved = interleaved || u.Phase != current
+				current = 0
+			}
+		}
+	}}
+	serializeTestIndex(t, ib, map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	})
+
+	if !slices.Equal(injested, []string{"1", "2"}) {
+		t.Errorf("expected both files to be merged, got %v", injested)
+	}
+	if len(phases) == 0 || phases[0] != SerializePhase_FilenameSet || phases[len(phases)-1] != SerializePhase_Metadata {
+		t.Errorf("expected every serialize phase, got %v", phases)
+	}
+	if interleaved {
+		t.Error("expected each phase to end before the next begins")
+	}
+	if serialized < 2*len(phases) {
+		t.Errorf("expected each phase to begin and end, got %d updates for %d phases", serialized, len(phases))
+	}
+}
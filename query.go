@@ -0,0 +1,1054 @@
+package emailsearch
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring/v2"
+)
+
+// Query is a node of a query expression tree. Queries are built with Term,
+// Text, Wildcard, Phrase, Label, Near, And, Or and Not, or parsed from a
+// string with ParseQuery or the queryparser package, and run with
+// Index.Search.
+type Query interface {
+	// eval returns the matches of the query grouped by file index
+	eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error)
+
+	String() string
+}
+
+// fileSetQuery is implemented by queries that can find the files they may
+// match from the sets of files stored for each word in the index, without
+// decoding any word matches. And uses the sets to narrow down the files
+// before its subqueries are evaluated.
+type fileSetQuery interface {
+	Query
+
+	// files returns the files the query may match, in a new bitmap owned by
+	// the caller. exact is true if the query matches all of them.
+	files(idx *Index) (files *roaring.Bitmap, exact bool, err error)
+
+	// evalFiles is eval restricted to files, files outside of it are
+	// skipped. All files are considered if files is nil.
+	evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error)
+}
+
+// queryFiles returns the files q may match and whether it matches all of
+// them, see fileSetQuery. It returns nil if q cannot tell.
+func queryFiles(idx *Index, q Query) (*roaring.Bitmap, bool, error) {
+	if fq, ok := q.(fileSetQuery); ok {
+		return fq.files(idx)
+	}
+	return nil, false, nil
+}
+
+// evalIn evaluates q, only returning the matches in files if files is not
+// nil.
+func evalIn(ctx context.Context, idx *Index, q Query, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	if fq, ok := q.(fileSetQuery); ok {
+		return fq.evalFiles(ctx, idx, files)
+	}
+	res, err := q.eval(ctx, idx)
+	if err != nil || files == nil {
+		return res, err
+	}
+	for fidx := range res {
+		if !files.Contains(uint32(fidx)) {
+			delete(res, fidx)
+		}
+	}
+	return res, nil
+}
+
+type termQuery struct {
+	word   string
+	fields []Field
+}
+
+// Term matches files containing word, which must be a word as it is stored in
+// the index. Use Text for words typed by a user, which analyzes them the same
+// way as the text of the emails. If fields are given the word must occur in
+// one of them, otherwise any field matches.
+func Term(word string, fields ...Field) Query {
+	return &termQuery{strings.ToLower(word), fields}
+}
+
+func (q *termQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+func (q *termQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	return idx.lookupWord(ctx, q.word, q.fields, files)
+}
+
+// files are the files containing the word in any field, so they are only
+// exact if the term is not restricted to fields.
+func (q *termQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	files, err := idx.wordFiles(q.word)
+	return files, len(q.fields) == 0, err
+}
+
+func (q *termQuery) String() string {
+	return fieldPrefix(q.fields) + q.word
+}
+
+// fieldPrefix returns the query string prefix restricting a term to fields,
+// e.g. "subject:".
+func fieldPrefix(fields []Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.String()
+	}
+	return strings.Join(names, ",") + ":"
+}
+
+// MaxWildcardTerms is the maximum number of index words a wildcard query
+// expands to.
+const MaxWildcardTerms = 100
+
+type wildcardQuery struct {
+	prefix string
+	fields []Field
+
+	// The expansion is found once for each index the query is run on
+	mu       sync.Mutex
+	idx      *Index
+	expanded *orQuery
+}
+
+// Wildcard matches files containing any word that starts with prefix. The
+// words are found with the prefix tree, if there are more than
+// MaxWildcardTerms of them the shortest are used. If fields are given the
+// word must occur in one of them.
+func Wildcard(prefix string, fields ...Field) Query {
+	return &wildcardQuery{prefix: strings.ToLower(prefix), fields: fields}
+}
+
+func (q *wildcardQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+// evalFiles records the wildcard as the term of every match, so a file
+// matching several of its words isn't ranked as if it matched several terms.
+func (q *wildcardQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	res, err := q.terms(idx).evalFiles(ctx, idx, files)
+	if err != nil {
+		return nil, err
+	}
+	for _, matches := range res {
+		for i := range matches {
+			matches[i].Term = q.prefix + "*"
+		}
+	}
+	return res, nil
+}
+
+func (q *wildcardQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	return q.terms(idx).files(idx)
+}
+
+// terms returns the words the wildcard expands to as an Or of terms. The
+// expansion in idx is remembered, so the files and matches of a query are
+// found from the same words without searching the prefix tree again.
+func (q *wildcardQuery) terms(idx *Index) *orQuery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.idx == idx && q.expanded != nil {
+		return q.expanded
+	}
+
+	// Prefer the words closest to the prefix
+	var words []string
+	if q.prefix != "" {
+		words = idx.shortestPrefix(q.prefix, MaxWildcardTerms)
+	}
+	terms := make([]Query, len(words))
+	for i, w := range words {
+		terms[i] = Term(w, q.fields...)
+	}
+	q.idx, q.expanded = idx, &orQuery{terms}
+	return q.expanded
+}
+
+func (q *wildcardQuery) String() string {
+	return fieldPrefix(q.fields) + q.prefix + "*"
+}
+
+type labelQuery struct {
+	label string
+}
+
+// Label matches files with the Gmail label, compared case insensitively.
+// Matching files have no word matches.
+func Label(label string) Query {
+	return &labelQuery{label}
+}
+
+func (q *labelQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+func (q *labelQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	res := make(map[int][]QueryWordMatch)
+	for _, fidx := range idx.DocumentsWithLabel(q.label) {
+		if files == nil || files.Contains(uint32(fidx)) {
+			res[fidx] = nil
+		}
+	}
+	return res, nil
+}
+
+func (q *labelQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	files := roaring.New()
+	for _, fidx := range idx.DocumentsWithLabel(q.label) {
+		files.Add(uint32(fidx))
+	}
+	return files, true, nil
+}
+
+func (q *labelQuery) String() string {
+	if strings.ContainsAny(q.label, " \t") {
+		return `label:"` + q.label + `"`
+	}
+	return "label:" + q.label
+}
+
+type phraseQuery struct {
+	words  []string // Lowercased words, "" for words not in the index
+	fields []Field
+}
+
+// Phrase matches files containing the words of text next to each other and in
+// order. Words that are not in the index, such as stop words, must still be
+// present but can be any word. If fields are given the phrase must occur in
+// one of them.
+func Phrase(text string, fields ...Field) Query {
+	return newPhrase(text, fields)
+}
+
+func newPhrase(text string, fields []Field) *phraseQuery {
+	q := &phraseQuery{fields: fields}
+	for span := range splitText(text) {
+		word := strings.ToLower(text[span.start:span.end])
+		if !indexable(word) {
+			word = ""
+		}
+		q.words = append(q.words, word)
+	}
+	return q
+}
+
+func (q *phraseQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+func (q *phraseQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	// The indexed words of the phrase and their positions in it
+	var (
+		words []string
+		rel   []int
+	)
+	for i, w := range q.words {
+		if w != "" {
+			words = append(words, w)
+			rel = append(rel, i)
+		}
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	// Only the files containing every word can contain the phrase
+	candidates, _, err := q.files(idx)
+	if err != nil {
+		return nil, err
+	}
+	if files != nil {
+		candidates.And(files)
+	}
+	if candidates.IsEmpty() {
+		return nil, nil
+	}
+
+	// The words are all read from the same candidates, so they are read at
+	// the same time
+	results := make([]map[int][]QueryWordMatch, len(words))
+	err = idx.forEachConcurrently(ctx, len(words), func(ctx context.Context, i int) (err error) {
+		results[i], err = idx.lookupWord(ctx, words[i], q.fields, candidates)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type fieldPos struct {
+		field Field
+		pos   int
+	}
+
+	final := make(map[int][]QueryWordMatch)
+	for fidx := range intersectWordResults(results) {
+		// The positions of every word but the first
+		at := make([]map[fieldPos]QueryWordMatch, len(words))
+		for i := 1; i < len(words); i++ {
+			at[i] = make(map[fieldPos]QueryWordMatch)
+			for _, m := range results[i][fidx] {
+				at[i][fieldPos{m.Field, m.Position}] = m
+			}
+		}
+
+		// Check each occurrence of the first word for the rest of the phrase
+		var matches []QueryWordMatch
+	next:
+		for _, first := range results[0][fidx] {
+			phrase := []QueryWordMatch{first}
+			for i := 1; i < len(words); i++ {
+				m, ok := at[i][fieldPos{first.Field, first.Position + rel[i] - rel[0]}]
+				if !ok {
+					continue next
+				}
+				phrase = append(phrase, m)
+			}
+			matches = append(matches, phrase...)
+		}
+		if len(matches) > 0 {
+			final[fidx] = matches
+		}
+	}
+
+	return final, nil
+}
+
+// files are the files containing every indexed word of the phrase, they are
+// not exact as the words may not be next to each other.
+func (q *phraseQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	var files *roaring.Bitmap
+	for _, w := range q.words {
+		if w == "" {
+			continue
+		}
+		f, err := idx.wordFiles(w)
+		if err != nil {
+			return nil, false, err
+		}
+		if files == nil {
+			files = f
+		} else {
+			files.And(f)
+		}
+	}
+	if files == nil {
+		// A phrase of words that are not in the index matches nothing
+		return roaring.New(), true, nil
+	}
+	return files, false, nil
+}
+
+func (q *phraseQuery) String() string {
+	words := make([]string, len(q.words))
+	for i, w := range q.words {
+		words[i] = cmp.Or(w, "*")
+	}
+	return fieldPrefix(q.fields) + `"` + strings.Join(words, " ") + `"`
+}
+
+type nearQuery struct {
+	distance int
+	queries  []Query
+}
+
+// Near matches files where every one of queries matches within distance words
+// of the others, in any order and in the same field. Distance is measured
+// between word positions, so "wire transfer" is distance 1.
+func Near(distance int, queries ...Query) Query {
+	return &nearQuery{max(distance, 0), queries}
+}
+
+func (q *nearQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+func (q *nearQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	candidates, _, err := q.files(idx)
+	if err != nil {
+		return nil, err
+	}
+	if candidates == nil {
+		candidates = files
+	} else if files != nil {
+		candidates.And(files)
+	}
+	results, err := evalNarrowing(ctx, idx, q.queries, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	final := make(map[int][]QueryWordMatch)
+	for fidx := range intersectWordResults(results) {
+		// Every match tagged with the query it came from, in position order
+		type event struct {
+			m     QueryWordMatch
+			query int
+		}
+		var events []event
+		for i, res := range results {
+			for _, m := range res[fidx] {
+				events = append(events, event{m, i})
+			}
+		}
+		slices.SortFunc(events, func(a, b event) int {
+			if a.m.Field != b.m.Field {
+				return int(a.m.Field) - int(b.m.Field)
+			}
+			return a.m.Position - b.m.Position
+		})
+
+		// Every event in a span of no more than distance words holding a
+		// match from every query is part of the match, including repeats of
+		// a query. The longest span starting at each event is slid over the
+		// events, every shorter span is inside one of them.
+		keep := make([]bool, len(events))
+		counts := make([]int, len(q.queries))
+		covered := 0
+		r, kept := 0, 0 // The end of the span, and of the events kept so far
+		for l, e := range events {
+			// Spans don't cross fields
+			for r < len(events) && events[r].m.Field == e.m.Field && events[r].m.Position-e.m.Position <= q.distance {
+				if counts[events[r].query]++; counts[events[r].query] == 1 {
+					covered++
+				}
+				r++
+			}
+			if covered == len(q.queries) {
+				for i := max(l, kept); i < r; i++ {
+					keep[i] = true
+				}
+				kept = r
+			}
+			if counts[e.query]--; counts[e.query] == 0 {
+				covered--
+			}
+		}
+
+		var matches []QueryWordMatch
+		for i, e := range events {
+			if keep[i] {
+				matches = append(matches, e.m)
+			}
+		}
+		if len(matches) > 0 {
+			final[fidx] = matches
+		}
+	}
+
+	return final, nil
+}
+
+// files are the files every subquery may match, they are not exact as the
+// matches may be too far apart. It is nil if any of them cannot tell.
+func (q *nearQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	var files *roaring.Bitmap
+	for _, sub := range q.queries {
+		f, _, err := queryFiles(idx, sub)
+		if err != nil || f == nil {
+			return nil, false, err
+		}
+		if files == nil {
+			files = f
+		} else {
+			files.And(f)
+		}
+	}
+	if files == nil {
+		return roaring.New(), true, nil
+	}
+	return files, false, nil
+}
+
+func (q *nearQuery) String() string {
+	return "(" + joinQueries(q.queries, fmt.Sprintf(" NEAR/%d ", q.distance)) + ")"
+}
+
+type andQuery struct {
+	queries []Query
+}
+
+// And matches files that match every one of queries. Any of queries that are
+// Not queries instead exclude the files they match.
+func And(queries ...Query) Query {
+	return &andQuery{queries}
+}
+
+func (q *andQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+func (q *andQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	include, _ := q.split()
+
+	// Narrow down the files before decoding any matches, the subqueries then
+	// skip the matches in every other file
+	candidates, exact, exclude, err := q.narrow(idx)
+	if err != nil {
+		return nil, err
+	}
+	if candidates == nil {
+		candidates = files
+	} else if files != nil {
+		candidates.And(files)
+	}
+	if candidates != nil && candidates.IsEmpty() {
+		return make(map[int][]QueryWordMatch), nil
+	}
+
+	// When the candidates are exactly the files every subquery matches,
+	// evaluating one can't narrow them for the next, so they are evaluated
+	// at the same time
+	var results []map[int][]QueryWordMatch
+	if exact && candidates != nil {
+		results, err = evalConcurrently(ctx, idx, include, candidates)
+	} else {
+		results, err = evalNarrowing(ctx, idx, include, candidates)
+	}
+	if err != nil {
+		return nil, err
+	}
+	final := intersectWordResults(results)
+	if len(final) == 0 {
+		return make(map[int][]QueryWordMatch), nil
+	}
+
+	// Subtract the files matching the excluded queries that narrow could
+	// not, only the files that are left need to be checked
+	survivors := resultFiles(final)
+	for _, sub := range exclude {
+		res, err := evalIn(ctx, idx, sub, survivors)
+		if err != nil {
+			return nil, err
+		}
+		for fidx := range res {
+			delete(final, fidx)
+			survivors.Remove(uint32(fidx))
+		}
+	}
+
+	return final, nil
+}
+
+func (q *andQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	files, exact, rest, err := q.narrow(idx)
+	return files, exact && len(rest) == 0, err
+}
+
+// split separates the queries files must match from the Not queries whose
+// files are excluded.
+func (q *andQuery) split() (include, exclude []Query) {
+	for _, sub := range q.queries {
+		if not, ok := sub.(*notQuery); ok {
+			exclude = append(exclude, not.query)
+		} else {
+			include = append(include, sub)
+		}
+	}
+	return include, exclude
+}
+
+// narrow finds the files q may match from the file sets of its subqueries.
+// The excluded queries without an exact file set are returned in rest,
+// they must be evaluated to subtract their files. files is nil if none of
+// the included queries have a file set, and exact is true if they all have
+// exact file sets so that files, before rest is subtracted, are exactly
+// the files matching all of them.
+func (q *andQuery) narrow(idx *Index) (files *roaring.Bitmap, exact bool, rest []Query, err error) {
+	include, exclude := q.split()
+
+	exact = true
+	var sets []*roaring.Bitmap
+	for _, sub := range include {
+		f, ex, err := queryFiles(idx, sub)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		if f == nil {
+			exact = false
+			continue
+		}
+		exact = exact && ex
+		sets = append(sets, f)
+	}
+	if len(sets) == 0 {
+		return nil, false, exclude, nil
+	}
+
+	// Intersect from the rarest set up, so the intersection is never larger
+	// than it and stops as soon as it is empty
+	slices.SortFunc(sets, func(a, b *roaring.Bitmap) int {
+		return cmp.Compare(a.GetCardinality(), b.GetCardinality())
+	})
+	files = sets[0]
+	for _, f := range sets[1:] {
+		if files.IsEmpty() {
+			break
+		}
+		files.And(f)
+	}
+
+	for _, sub := range exclude {
+		f, ex, err := queryFiles(idx, sub)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		if f != nil && ex {
+			files.AndNot(f)
+		} else {
+			rest = append(rest, sub)
+		}
+	}
+	return files, exact, rest, nil
+}
+
+func (q *andQuery) String() string {
+	return joinQueries(q.queries, " ")
+}
+
+type orQuery struct {
+	queries []Query
+}
+
+// Or matches files that match any of queries. Files matching more of them
+// have more matches and so rank higher.
+func Or(queries ...Query) Query {
+	return &orQuery{queries}
+}
+
+func (q *orQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return q.evalFiles(ctx, idx, nil)
+}
+
+func (q *orQuery) evalFiles(ctx context.Context, idx *Index, files *roaring.Bitmap) (map[int][]QueryWordMatch, error) {
+	results := make([]map[int][]QueryWordMatch, 0, len(q.queries))
+	for _, sub := range q.queries {
+		res, err := evalIn(ctx, idx, sub, files)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return unionWordResults(results), nil
+}
+
+// files is the union of the files of the subqueries. It is nil if any of
+// them cannot tell.
+func (q *orQuery) files(idx *Index) (*roaring.Bitmap, bool, error) {
+	files, exact := roaring.New(), true
+	for _, sub := range q.queries {
+		f, ex, err := queryFiles(idx, sub)
+		if err != nil || f == nil {
+			return nil, false, err
+		}
+		files.Or(f)
+		exact = exact && ex
+	}
+	return files, exact, nil
+}
+
+func (q *orQuery) String() string {
+	return "(" + joinQueries(q.queries, " OR ") + ")"
+}
+
+type notQuery struct {
+	query Query
+}
+
+// Not excludes the files matching query from an And query. On its own, or
+// anywhere other than directly inside an And, it matches nothing.
+func Not(query Query) Query {
+	return &notQuery{query}
+}
+
+func (q *notQuery) eval(ctx context.Context, idx *Index) (map[int][]QueryWordMatch, error) {
+	return nil, nil
+}
+
+func (q *notQuery) String() string {
+	return "-" + subqueryString(q.query)
+}
+
+// evalNarrowing evaluates queries whose results are to be intersected. The
+// files each query matches narrow down the files the following queries are
+// evaluated in, so the matches of a common word are only decoded in the
+// files that are still candidates. Once no file is left it stops early and
+// returns no results. files is the files to start from, nil for all of them.
+func evalNarrowing(ctx context.Context, idx *Index, queries []Query, files *roaring.Bitmap) ([]map[int][]QueryWordMatch, error) {
+	results := make([]map[int][]QueryWordMatch, 0, len(queries))
+	for _, q := range queries {
+		res, err := evalIn(ctx, idx, q, files)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) == 0 {
+			return nil, nil
+		}
+		results = append(results, res)
+		files = resultFiles(res)
+	}
+	return results, nil
+}
+
+// evalConcurrently evaluates queries in files, which must not be nil, up to
+// idx.QueryThreads at a time. Each query reads the index with its own
+// cursors. Like evalNarrowing it returns nil as soon as one of them matches
+// nothing.
+func evalConcurrently(ctx context.Context, idx *Index, queries []Query, files *roaring.Bitmap) ([]map[int][]QueryWordMatch, error) {
+	results := make([]map[int][]QueryWordMatch, len(queries))
+	err := idx.forEachConcurrently(ctx, len(queries), func(ctx context.Context, i int) error {
+		res, err := evalIn(ctx, idx, queries[i], files)
+		if err == nil && len(res) == 0 {
+			err = errNoMatches
+		}
+		results[i] = res
+		return err
+	})
+	if errors.Is(err, errNoMatches) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// forEachConcurrently calls f with each of 0 to n-1, up to idx.QueryThreads
+// at a time, and returns the first error. The context f is called with is
+// canceled once a call fails, and the rest are not started.
+func (idx *Index) forEachConcurrently(ctx context.Context, n int, f func(ctx context.Context, i int) error) error {
+	threads := idx.QueryThreads
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	if threads == 1 || n <= 1 {
+		for i := range n {
+			if err := f(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	sem := make(chan struct{}, threads)
+	var wg sync.WaitGroup
+	for i := range n {
+		sem <- struct{}{}
+		if fctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := f(fctx, i); err != nil {
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return context.Cause(fctx)
+}
+
+// errNoMatches stops the evaluation of the other queries once one of them
+// matches nothing.
+var errNoMatches = errors.New("no matches")
+
+// resultFiles returns the files of res in a new bitmap.
+func resultFiles(res map[int][]QueryWordMatch) *roaring.Bitmap {
+	files := roaring.New()
+	for fidx := range res {
+		files.Add(uint32(fidx))
+	}
+	return files
+}
+
+func joinQueries(queries []Query, sep string) string {
+	parts := make([]string, len(queries))
+	for i, q := range queries {
+		parts[i] = subqueryString(q)
+	}
+	return strings.Join(parts, sep)
+}
+
+// subqueryString returns the query string of a query nested in another. An
+// And is put in parentheses, the other queries already group themselves.
+func subqueryString(q Query) string {
+	if _, ok := q.(*andQuery); ok {
+		return "(" + q.String() + ")"
+	}
+	return q.String()
+}
+
+// unionWordResults combines the search results of queries into one result
+// set holding every file matched by any of them.
+func unionWordResults(results []map[int][]QueryWordMatch) map[int][]QueryWordMatch {
+	final := make(map[int][]QueryWordMatch)
+	for _, res := range results {
+		for fidx, matches := range res {
+			final[fidx] = append(final[fidx], matches...)
+		}
+	}
+	return final
+}
+
+// ParseQuery parses a query string. Words separated by spaces must all match,
+// and words joined with OR match if any of them do, so
+//
+//	budget invoice OR receipt
+//
+// matches files containing "budget" and at least one of "invoice" or
+// "receipt". OR binds tighter than the implicit AND. A word starting with a
+// "-" excludes the files that contain it, "meeting -lunch" matches files that
+// contain "meeting" but not "lunch". Words in double quotes, "wire transfer",
+// are a phrase and must appear together in that order. Phrases can be used
+// anywhere a word can. Words joined with NEAR/n must appear within n words of
+// each other, "budget NEAR/5 forecast". NEAR on its own allows
+// DefaultNearDistance words and binds tighter than OR. A word ending in "*"
+// matches any word starting with it, "litigat*" matches "litigation" and
+// "litigated", see Wildcard. A word or phrase prefixed with a field name,
+// "from:lay" or subject:"wire transfer", only matches in that field, and
+// "label:inbox" matches files with the Gmail label. A word made up of several
+// index words, like an email address, is searched for as a phrase. Dates and
+// numbers outside of phrases are normalized the same way as at index time.
+// Words that are never indexed, short words and stop words, are ignored.
+//
+// ParseQuery never fails, it makes the best of malformed input. The
+// queryparser package parses the same syntax along with parentheses for
+// grouping, and reports malformed queries instead.
+//
+// Deprecated: Use queryparser.Parse, which the search server and the
+// indexer use, so that queries mean the same everywhere.
+func ParseQuery(s string) Query {
+	var (
+		and   []Query
+		group []Query // Words joined by OR
+		join  bool    // The previous word was OR
+		neg   bool    // The previous word was a lone -
+		near  int     // Distance of the preceding NEAR, 0 if there wasn't one
+	)
+	flush := func() {
+		switch len(group) {
+		case 0:
+		case 1:
+			and = append(and, group[0])
+		default:
+			and = append(and, Or(group...))
+		}
+		group = nil
+	}
+
+	for tok := range tokenizeQuery(s) {
+		word := tok.text
+		if !tok.phrase {
+			if word == "OR" {
+				join = len(group) > 0
+				continue
+			}
+			if d, ok := parseNear(word); ok {
+				if len(group) > 0 {
+					join, near = true, d
+				}
+				continue
+			}
+			if word == "-" {
+				// A lone - negates the next word or phrase. Normalization also
+				// splits the - from a negated date or number.
+				neg = true
+				continue
+			}
+		}
+		if !join || neg {
+			flush()
+		}
+		join = false
+
+		var sc queryScope
+		if tok.phrase {
+			sc, _ = cutScope(tok.prefix)
+		} else {
+			sc, word = cutScope(word)
+		}
+		negated := neg || sc.negated
+		neg = false
+
+		q := parseTerm(word, tok.phrase, sc)
+		if q == nil {
+			continue // Nothing in the index to look up
+		}
+
+		switch {
+		case negated:
+			and = append(and, Not(q))
+		case near > 0 && len(group) > 0:
+			// Extend a chain of NEARs with the same distance
+			last := group[len(group)-1]
+			if n, ok := last.(*nearQuery); ok && n.distance == near {
+				n.queries = append(n.queries, q)
+			} else {
+				group[len(group)-1] = Near(near, last, q)
+			}
+		default:
+			group = append(group, q)
+		}
+		near = 0
+	}
+	flush()
+
+	return And(and...)
+}
+
+// DefaultNearDistance is the distance in words of a NEAR without a distance
+// in a query string.
+const DefaultNearDistance = 10
+
+// parseNear parses the query word NEAR or NEAR/n, returning the distance.
+func parseNear(word string) (int, bool) {
+	if word == "NEAR" {
+		return DefaultNearDistance, true
+	}
+	n, ok := strings.CutPrefix(word, "NEAR/")
+	if !ok {
+		return 0, false
+	}
+	d, err := strconv.Atoi(n)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// queryScope is the part of a query word before the term itself, e.g. the
+// "-subject:" of "-subject:budget".
+type queryScope struct {
+	negated bool
+	fields  []Field
+	label   bool
+}
+
+// cutScope splits the negation and field name from the front of a query word.
+func cutScope(word string) (queryScope, string) {
+	var sc queryScope
+	if rest, ok := strings.CutPrefix(word, "-"); ok {
+		sc.negated, word = true, rest
+	}
+	if name, rest, ok := strings.Cut(word, ":"); ok {
+		if f, err := ParseField(name); err == nil {
+			sc.fields, word = []Field{f}, rest
+		} else if strings.EqualFold(name, "label") {
+			sc.label, word = true, rest
+		}
+	}
+	return sc, word
+}
+
+// parseTerm returns the query for a word or phrase of a query string, or nil
+// if it has nothing that can be looked up.
+func parseTerm(word string, phrase bool, sc queryScope) Query {
+	if sc.label {
+		if word == "" {
+			return nil
+		}
+		return Label(word)
+	}
+
+	if prefix, ok := strings.CutSuffix(word, "*"); ok && !phrase {
+		if prefix == "" {
+			return nil
+		}
+		return Wildcard(prefix, sc.fields...)
+	}
+
+	return Text(word, sc.fields...)
+}
+
+// Text returns the query for text typed into a query string, which has been
+// through NormalizeQuery. Text that is a single index word is a Term, and
+// text that splits into several index words, like an email address, is a
+// Phrase. It returns nil if text has no words that are indexed.
+func Text(text string, fields ...Field) Query {
+	// The canonical tokens of dates and numbers are indexed whole
+	if text != "" && strings.Trim(text, "0123456789") == "" {
+		return Term(text, fields...)
+	}
+
+	p := newPhrase(text, fields)
+	switch {
+	case !slices.ContainsFunc(p.words, func(w string) bool { return w != "" }):
+		return nil
+	case len(p.words) == 1:
+		return Term(p.words[0], fields...)
+	}
+	return p
+}
+
+type queryToken struct {
+	text   string
+	phrase bool   // text is the contents of a quoted phrase
+	prefix string // Negation and field name before a phrase, e.g. "-subject:"
+}
+
+// tokenizeQuery splits a query string into words and quoted phrases. A
+// missing closing quote ends the phrase at the end of the string.
+func tokenizeQuery(s string) iter.Seq[queryToken] {
+	return func(yield func(queryToken) bool) {
+		for s != "" {
+			before, rest, quoted := strings.Cut(s, `"`)
+			words := strings.Fields(before)
+
+			// A negation or field name attached to the phrase
+			var prefix string
+			if n := len(words); quoted && n > 0 && !strings.HasSuffix(before, " ") {
+				if last := words[n-1]; last == "-" || strings.HasSuffix(last, ":") {
+					prefix, words = last, words[:n-1]
+				}
+			}
+
+			for _, word := range NormalizeQuery(words) {
+				if !yield(queryToken{text: word}) {
+					return
+				}
+			}
+			if !quoted {
+				return
+			}
+
+			phrase, after, _ := strings.Cut(rest, `"`)
+			if !yield(queryToken{text: phrase, phrase: true, prefix: prefix}) {
+				return
+			}
+			s = after
+		}
+	}
+}
+
+// indexable reports whether a lowercased word can be in the index. Short
+// words and stop words are not indexed.
+func indexable(word string) bool {
+	return len(word) >= minWordLength && !isStopWord(word)
+}
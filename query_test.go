@@ -0,0 +1,385 @@
+package emailsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/v2"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		Query    string
+		Expected string
+	}{
+		{"budget", "budget"},
+		{"Budget forecast", "budget forecast"},
+		{"invoice OR receipt", "(invoice OR receipt)"},
+		{"budget invoice OR receipt OR bill", "budget (invoice OR receipt OR bill)"},
+		{"the budget", "budget"},
+		{"invoice OR the", "invoice"},
+		{"OR budget", "budget"},
+		{"budget or forecast", "budget forecast"},
+		{"Jan 3 2001 OR 1,000", "(20010103 OR 1000)"},
+		{"meeting -lunch", "meeting -lunch"},
+		{"meeting -Lunch OR dinner", "meeting -lunch dinner"},
+		{"invoice OR receipt -lunch", "(invoice OR receipt) -lunch"},
+		{"meeting -1,000", "meeting -1000"},
+		{"meeting -the -", "meeting"},
+		{`"wire transfer" budget`, `"wire transfer" budget`},
+		{`"Bank of America" OR budget`, `("bank * america" OR budget)`},
+		{`budget -"wire transfer"`, `budget -"wire transfer"`},
+		{`"budget"`, `budget`},
+		{`"of the" budget`, `budget`},
+		{`"wire transfer`, `"wire transfer"`},
+		{"budget NEAR/5 forecast", "(budget NEAR/5 forecast)"},
+		{"budget NEAR forecast", "(budget NEAR/10 forecast)"},
+		{"budget NEAR/3 forecast NEAR/3 report", "(budget NEAR/3 forecast NEAR/3 report)"},
+		{"budget NEAR/3 forecast OR report", "((budget NEAR/3 forecast) OR report)"},
+		{`lunch budget NEAR/2 "wire transfer"`, `lunch (budget NEAR/2 "wire transfer")`},
+		{"budget NEAR the forecast", "budget forecast"},
+		{"NEAR/2 budget", "budget"},
+		{"budget NEAR/x forecast", `budget "near *" forecast`},
+		{"from:lay subject:budget report", "from:lay subject:budget report"},
+		{`Subject:"wire transfer" -to:kenneth`, `subject:"wire transfer" -to:kenneth`},
+		{`budget -subject:"wire transfer"`, `budget -subject:"wire transfer"`},
+		{"from:kenneth.lay@enron.com", `from:"kenneth lay enron com"`},
+		{"from:lay OR to:lay", "(from:lay OR to:lay)"},
+		{"subject:lit*", "subject:lit*"},
+		{`label:inbox label:"Category Updates"`, `label:inbox label:"Category Updates"`},
+		{"unknown:word", `"unknown word"`},
+		{"subject:", ""},
+		{"litigat* OR Lawsuit*", "(litigat* OR lawsuit*)"},
+		{"budget -litigat* *", "budget -litigat*"},
+		{"budget NEAR/2 fore*", "(budget NEAR/2 fore*)"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Query, func(t *testing.T) {
+			if got := ParseQuery(tc.Query).String(); got != tc.Expected {
+				t.Errorf("expected %q, got %q", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nPlease pay the invoice.\n",
+		"2": "Subject: two\n\nHere is your receipt.\n",
+		"3": "Subject: three\n\nThe invoice and the receipt.\n",
+		"4": "Subject: four\n\nLunch on Friday?\n",
+	})
+
+	cases := []struct {
+		Name     string
+		Query    Query
+		Expected []string // In rank order
+	}{
+		{"Or", Or(Term("invoice"), Term("receipt")), []string{"3", "1", "2"}},
+		{"And", And(Term("invoice"), Term("receipt")), []string{"3"}},
+		{"Nested", And(Or(Term("invoice"), Term("lunch")), Term("pay")), []string{"1"}},
+		{"Field", Or(Term("four", Field_Subject), Term("receipt", Field_Subject)), []string{"4"}},
+		{"Parsed", ParseQuery("invoice OR lunch"), []string{"4", "1", "3"}}, // lunch is rarer
+		{"Not", And(Term("invoice"), Not(Term("receipt"))), []string{"1"}},
+		{"Not Or", And(Or(Term("invoice"), Term("receipt")), Not(Term("pay"))), []string{"3", "2"}},
+		{"Not group", And(Term("invoice"), Not(Or(Term("pay"), Term("lunch")))), []string{"3"}},
+		{"Only Not", Not(Term("receipt")), nil},
+		{"Parsed Not", ParseQuery("invoice -pay"), []string{"3"}},
+		{"Phrase", Phrase("pay the invoice"), []string{"1"}},
+		{"Phrase order", Phrase("invoice pay"), nil},
+		{"Phrase stop word", Phrase("invoice and the receipt"), []string{"3"}},
+		{"Phrase wildcard", Phrase("invoice or the receipt"), []string{"3"}},
+		{"Phrase field", Phrase("three", Field_Body), nil},
+		{"Near", Near(2, Term("pay"), Term("invoice")), []string{"1"}},
+		{"Near any order", Near(2, Term("invoice"), Term("pay")), []string{"1"}},
+		{"Near too far", Near(1, Term("pay"), Term("invoice")), nil},
+		{"Near three", Near(3, Term("invoice"), Term("receipt"), Term("and")), nil},
+		{"Near phrase", Near(1, Phrase("the invoice"), Term("receipt")), nil},
+		{"Parsed near", ParseQuery("invoice NEAR/3 receipt"), []string{"3"}},
+		{"Wildcard", Wildcard("rec"), []string{"2", "3"}},
+		{"Wildcard none", Wildcard("xyz"), nil},
+		{"Wildcard field", Wildcard("thr", Field_Subject), []string{"3"}},
+		{"Parsed wildcard", ParseQuery("inv* -pa*"), []string{"3"}},
+		{"Parsed phrase", ParseQuery(`"your receipt" OR "pay the"`), []string{"2", "1"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			results, err := idx.Search(t.Context(), tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Filename)
+			}
+			if !slices.Equal(got, tc.Expected) {
+				t.Errorf("expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestWildcardExpansionCap(t *testing.T) {
+	// abca ... abcz, abcaa, abcab, ...
+	var (
+		body  strings.Builder
+		words []string
+	)
+	for i := range MaxWildcardTerms + 5 {
+		word := "abc"
+		if i >= 26 {
+			word += string(rune('a' + (i-26)/26))
+		}
+		word += string(rune('a' + i%26))
+		words = append(words, word)
+		fmt.Fprintf(&body, "%s ", word)
+	}
+	idx := buildTestIndex(t, map[string]string{"1": "Subject: many\n\n" + body.String() + "\n"})
+
+	results, err := idx.Search(t.Context(), Wildcard("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+
+	found := make(map[string]bool)
+	for _, m := range results[0].WordMatches {
+		found[m.Word] = true
+	}
+	if len(found) != MaxWildcardTerms {
+		t.Errorf("expected %d words, got %d", MaxWildcardTerms, len(found))
+	}
+	// The shortest words and then the first alphabetically are kept
+	if !found[words[0]] || !found[words[MaxWildcardTerms-1]] || found[words[MaxWildcardTerms]] {
+		t.Errorf("expected the first %d words to be kept, got %v", MaxWildcardTerms, found)
+	}
+	// The expansion is found once for each index
+	q := Wildcard("abc").(*wildcardQuery)
+	if first := q.terms(idx); q.terms(idx) != first || len(first.queries) != MaxWildcardTerms {
+		t.Errorf("expected the expansion to be kept, got %d terms", len(first.queries))
+	}
+}
+
+func TestSearchFields(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "From: kenneth.lay@enron.com\nTo: jeff.skilling@enron.com\nSubject: Budget review\n\nPlease see attached.\n",
+		"2": "From: jeff.skilling@enron.com\nTo: kenneth.lay@enron.com\nSubject: Re: lunch\n\nThe budget looks fine.\n",
+	})
+
+	cases := []struct {
+		Query    string
+		Expected []string
+	}{
+		{"budget", []string{"1", "2"}},
+		{"subject:budget", []string{"1"}},
+		{"body:budget", []string{"2"}},
+		{"from:kenneth", []string{"1"}},
+		{"to:kenneth budget", []string{"2"}},
+		{"budget -from:kenneth", []string{"2"}},
+		{"from:kenneth.lay@enron.com", []string{"1"}},
+		{`subject:"budget review"`, []string{"1"}},
+		{"subject:bud*", []string{"1"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Query, func(t *testing.T) {
+			results, err := idx.Search(t.Context(), ParseQuery(tc.Query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Filename)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tc.Expected) {
+				t.Errorf("expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestNearMatches(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nbudget forecast forecast lunch forecast\n",
+	})
+
+	// Every repeat of a word within distance of the others is matched, the
+	// last forecast is too far from budget
+	results, err := idx.Search(t.Context(), Near(2, Term("budget"), Term("forecast")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	var offsets []int
+	for _, m := range results[0].WordMatches {
+		offsets = append(offsets, m.Offset)
+	}
+	if want := []int{0, 7, 16}; !slices.Equal(offsets, want) {
+		t.Errorf("expected matches at %v, got %v", want, offsets)
+	}
+}
+
+func TestQueryFiles(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nPlease pay the invoice.\n",
+		"2": "Subject: two\n\nHere is your receipt.\n",
+		"3": "Subject: three\n\nThe invoice and the receipt.\n",
+		"4": "Subject: four\n\nLunch on Friday?\n",
+	})
+
+	// The files of a query must include every file it matches, and be
+	// exactly those files if the query says so
+	queries := []Query{
+		Term("invoice"),
+		Term("missing"),
+		Term("three", Field_Body),
+		Or(Term("invoice"), Term("lunch")),
+		And(Term("invoice"), Term("receipt")),
+		And(Term("invoice"), Not(Term("pay"))),
+		And(Or(Term("invoice"), Term("receipt")), Not(Term("pay", Field_Subject))),
+		Phrase("pay the invoice"),
+		Phrase("invoice pay"),
+		Wildcard("rec"),
+		Near(2, Term("pay"), Term("invoice")),
+		And(Term("invoice"), Near(2, Term("pay"), Term("invoice"))),
+	}
+	for _, q := range queries {
+		t.Run(q.String(), func(t *testing.T) {
+			res, err := q.eval(t.Context(), idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, exact, err := queryFiles(idx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files == nil {
+				if _, ok := q.(fileSetQuery); ok {
+					t.Error("expected a file set")
+				}
+				return
+			}
+			for fidx := range res {
+				if !files.Contains(uint32(fidx)) {
+					t.Errorf("file %d matched but is not in the file set %v", fidx, files)
+				}
+			}
+			if exact && int(files.GetCardinality()) != len(res) {
+				t.Errorf("expected the exact file set %v to have %d files", files, len(res))
+			}
+		})
+	}
+}
+
+func TestEvalNarrowing(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nPlease pay the invoice.\n",
+		"2": "Subject: two\n\nThe invoice is late.\n",
+		"3": "Subject: three\n\nAnother invoice, pay it.\n",
+		"4": "Subject: four\n\nInvoice invoice invoice.\n",
+	})
+
+	// The matches of the common word are only decoded in the files the
+	// phrase matched
+	results, err := evalNarrowing(t.Context(), idx, []Query{Phrase("pay the invoice"), Term("invoice", Field_Body)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || len(results[0]) != 1 || len(results[1]) != 1 {
+		t.Fatalf("expected both results to have only the phrase's file, got %v", results)
+	}
+	for fidx := range results[1] {
+		if _, ok := results[0][fidx]; !ok {
+			t.Errorf("file %d was decoded but the phrase didn't match it", fidx)
+		}
+	}
+
+	// Nothing is left after a query that matches nothing
+	if results, err := evalNarrowing(t.Context(), idx, []Query{Term("missing"), Term("invoice")}, nil); err != nil || results != nil {
+		t.Errorf("expected no results, got %v (%v)", results, err)
+	}
+
+	// Excluded queries without an exact file set are checked in the files
+	// that are left
+	for _, tc := range []struct {
+		q    Query
+		want int
+	}{
+		{And(Term("invoice"), Not(Phrase("pay the invoice"))), 3},
+		{And(Term("invoice"), Not(Near(1, Term("pay"), Term("invoice")))), 3},
+		{And(Term("invoice"), Near(3, Term("pay"), Term("invoice"))), 2},
+	} {
+		res, err := tc.q.eval(t.Context(), idx)
+		if err != nil || len(res) != tc.want {
+			t.Errorf("%s: expected %d files, got %v (%v)", tc.q, tc.want, res, err)
+		}
+	}
+}
+
+func TestEvalConcurrently(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nPlease pay the invoice by Friday.\n",
+		"2": "Subject: two\n\nThe invoice is late, pay it by Friday.\n",
+		"3": "Subject: three\n\nAnother invoice, pay it.\n",
+		"4": "Subject: four\n\nInvoice invoice invoice.\n",
+	})
+
+	// The terms are read at the same time, and find what reading them one
+	// after another does
+	queries := []Query{
+		And(Term("invoice"), Term("pay"), Term("friday")),
+		And(Term("invoice"), Term("pay"), Not(Term("friday"))),
+		And(Term("invoice"), Term("missing")),
+		Phrase("pay the invoice by friday"),
+	}
+	for _, q := range queries {
+		idx.QueryThreads = 1
+		want, err := idx.Search(t.Context(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.QueryThreads = 4
+		got, err := idx.Search(t.Context(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", q, got, want)
+		}
+	}
+
+	// A term that matches nothing stops the rest
+	files := roaring.BitmapOf(0, 1, 2, 3)
+	if results, err := evalConcurrently(t.Context(), idx, []Query{Term("invoice"), Term("missing")}, files); err != nil || results != nil {
+		t.Errorf("expected no results, got %v (%v)", results, err)
+	}
+
+	// Errors are returned, and the context's error once it is done
+	errBoom := errors.New("boom")
+	err := idx.forEachConcurrently(t.Context(), 8, func(ctx context.Context, i int) error {
+		if i == 3 {
+			return errBoom
+		}
+		return nil
+	})
+	if !errors.Is(err, errBoom) {
+		t.Errorf("expected the failure to be returned, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := evalConcurrently(ctx, idx, []Query{Term("invoice"), Term("pay")}, files); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+}
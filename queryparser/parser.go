@@ -0,0 +1,522 @@
+// Package queryparser parses query strings into emailsearch queries. It
+// supports the syntax of the deprecated emailsearch.ParseQuery, adds
+// grouping with parentheses, and reports malformed queries instead of
+// guessing at them.
+//
+//	from:lay "wire transfer" (budget OR forecast) -lunch
+//
+// Terms separated by spaces must all match. Terms joined with OR match if any
+// of them do, and terms joined with NEAR/n must be within n words of each
+// other. NEAR binds tighter than OR, which binds tighter than the implicit
+// AND. A "-" before a term or group excludes the files it matches. A field
+// name before a term, phrase or group, "subject:(budget OR forecast)",
+// restricts it to that field, and "label:inbox" matches files with the Gmail
+// label. A term ending in "*" matches every word starting with it.
+package queryparser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/chriskillpack/emailsearch"
+)
+
+// SyntaxError describes a malformed query.
+type SyntaxError struct {
+	Query  string // The query string
+	Offset int    // Byte offset of the problem in Query
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at column %d", e.Msg, e.Offset+1)
+}
+
+// Parse parses the query string s. Words that are never indexed, short words
+// and stop words, are ignored, so a valid query can be empty, which matches
+// nothing. A malformed query returns a *SyntaxError.
+func Parse(s string) (emailsearch.Query, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{query: s, tokens: tokens}
+	q, err := p.parseAnd(nil)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	if q.query == nil {
+		return emailsearch.And(), nil
+	}
+	if q.negated {
+		// Not on its own matches nothing, it needs an And to subtract from
+		return emailsearch.And(q.query), nil
+	}
+	return q.query, nil
+}
+
+type parser struct {
+	query  string
+	tokens []token
+	pos    int
+}
+
+// node is a parsed query. query is nil if the terms it was parsed from are not
+// indexed.
+type node struct {
+	query   emailsearch.Query
+	negated bool // query is a Not
+	tok     token
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, a ...any) error {
+	return &SyntaxError{Query: p.query, Offset: tok.offset, Msg: fmt.Sprintf(format, a...)}
+}
+
+// parseAnd parses terms up to the end of the query or a closing parenthesis.
+func (p *parser) parseAnd(fields []emailsearch.Field) (node, error) {
+	first := p.peek()
+
+	var nodes []node
+	for {
+		if tok := p.peek(); tok.kind == tokEOF || tok.kind == tokClose {
+			break
+		}
+		n, err := p.parseOr(fields)
+		if err != nil {
+			return node{}, err
+		}
+		if n.query != nil {
+			nodes = append(nodes, n)
+		}
+	}
+
+	switch len(nodes) {
+	case 0:
+		return node{tok: first}, nil
+	case 1:
+		// A lone negation stays negated so that an enclosing And subtracts it
+		return nodes[0], nil
+	}
+	and := make([]emailsearch.Query, len(nodes))
+	for i, n := range nodes {
+		and[i] = n.query
+	}
+	return node{query: emailsearch.And(and...), tok: first}, nil
+}
+
+// parseOr parses terms joined by OR.
+func (p *parser) parseOr(fields []emailsearch.Field) (node, error) {
+	first, err := p.parseNear(fields)
+	if err != nil {
+		return node{}, err
+	}
+
+	or := []node{first}
+	for p.peek().isWord("OR") {
+		op := p.next()
+		if !p.peek().startsTerm() {
+			return node{}, p.errorf(op, "missing term after OR")
+		}
+		n, err := p.parseNear(fields)
+		if err != nil {
+			return node{}, err
+		}
+		or = append(or, n)
+	}
+	if len(or) == 1 {
+		return first, nil
+	}
+
+	queries, err := p.operands(or, "OR")
+	if err != nil {
+		return node{}, err
+	}
+	switch len(queries) {
+	case 0:
+		return node{tok: first.tok}, nil
+	case 1:
+		return node{query: queries[0], tok: first.tok}, nil
+	}
+	return node{query: emailsearch.Or(queries...), tok: first.tok}, nil
+}
+
+// parseNear parses terms joined by NEAR. A chain of NEARs with the same
+// distance is a single Near query.
+func (p *parser) parseNear(fields []emailsearch.Field) (node, error) {
+	first, err := p.parseUnary(fields)
+	if err != nil {
+		return node{}, err
+	}
+
+	var (
+		near     = []node{first}
+		distance int
+	)
+	for {
+		op := p.peek()
+		d, ok, err := p.nearDistance(op)
+		if err != nil {
+			return node{}, err
+		}
+		if !ok {
+			break
+		}
+		p.next()
+		if !p.peek().startsTerm() {
+			return node{}, p.errorf(op, "missing term after %s", op.text)
+		}
+		n, err := p.parseUnary(fields)
+		if err != nil {
+			return node{}, err
+		}
+
+		if distance != 0 && d != distance {
+			// A different distance starts a new Near around the chain so far
+			chain, err := p.near(distance, near)
+			if err != nil {
+				return node{}, err
+			}
+			near = []node{chain}
+		}
+		near = append(near, n)
+		distance = d
+	}
+	if len(near) == 1 {
+		return first, nil
+	}
+	return p.near(distance, near)
+}
+
+func (p *parser) near(distance int, nodes []node) (node, error) {
+	queries, err := p.operands(nodes, "NEAR")
+	if err != nil {
+		return node{}, err
+	}
+	switch len(queries) {
+	case 0:
+		return node{tok: nodes[0].tok}, nil
+	case 1:
+		return node{query: queries[0], tok: nodes[0].tok}, nil
+	}
+	return node{query: emailsearch.Near(distance, queries...), tok: nodes[0].tok}, nil
+}
+
+// operands returns the queries of the operands of op, leaving out those that
+// have nothing to look up. Negated operands are an error, they only make sense
+// in an And.
+func (p *parser) operands(nodes []node, op string) ([]emailsearch.Query, error) {
+	var queries []emailsearch.Query
+	for _, n := range nodes {
+		if n.negated {
+			return nil, p.errorf(n.tok, "cannot use a negated term with %s", op)
+		}
+		if n.query != nil {
+			queries = append(queries, n.query)
+		}
+	}
+	return queries, nil
+}
+
+// nearDistance reports whether tok is NEAR or NEAR/n and returns the
+// distance.
+func (p *parser) nearDistance(tok token) (int, bool, error) {
+	if tok.kind != tokWord {
+		return 0, false, nil
+	}
+	if tok.text == "NEAR" {
+		return emailsearch.DefaultNearDistance, true, nil
+	}
+	n, ok := strings.CutPrefix(tok.text, "NEAR/")
+	if !ok {
+		return 0, false, nil
+	}
+	d, err := strconv.Atoi(n)
+	if err != nil || d <= 0 {
+		return 0, false, p.errorf(tok, "invalid NEAR distance %q", n)
+	}
+	return d, true, nil
+}
+
+// parseUnary parses a term, phrase or group, along with any negation and
+// field name in front of it.
+func (p *parser) parseUnary(fields []emailsearch.Field) (node, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokEOF:
+		return node{}, p.errorf(tok, "missing term")
+	case tok.kind == tokClose:
+		return node{}, p.errorf(tok, `unexpected ")"`)
+	case tok.isOperator():
+		return node{}, p.errorf(tok, "missing term before %s", tok.text)
+	case tok.isWord("-"):
+		if !p.peek().startsTerm() {
+			return node{}, p.errorf(tok, `missing term after "-"`)
+		}
+		n, err := p.parseUnary(fields)
+		if err != nil {
+			return node{}, err
+		}
+		if n.negated {
+			return node{}, p.errorf(tok, "cannot negate a negated term")
+		}
+		return p.negate(node{query: n.query, tok: tok}), nil
+	}
+
+	sc, text, err := p.cutScope(tok)
+	if err != nil {
+		return node{}, err
+	}
+	if sc.fields != nil {
+		fields = sc.fields
+	}
+
+	var n node
+	switch tok.kind {
+	case tokOpen:
+		if sc.label {
+			return node{}, p.errorf(tok, "label: cannot be applied to a group")
+		}
+		if p.peek().kind == tokClose {
+			return node{}, p.errorf(tok, "empty parentheses")
+		}
+		if n, err = p.parseAnd(fields); err != nil {
+			return node{}, err
+		}
+		if p.next().kind != tokClose {
+			return node{}, p.errorf(tok, `missing ")" to close "("`)
+		}
+	case tokPhrase:
+		n = node{query: p.term(sc, fields, text, true)}
+	default:
+		if text == "" {
+			return node{}, p.errorf(tok, "missing term after %q", tok.text)
+		}
+		if text == "*" {
+			return node{}, p.errorf(tok, `missing prefix before "*"`)
+		}
+		n = node{query: p.term(sc, fields, text, false)}
+	}
+	n.tok = tok
+
+	if sc.negated {
+		if n.negated {
+			return node{}, p.errorf(tok, "cannot negate a negated term")
+		}
+		return p.negate(n), nil
+	}
+	return n, nil
+}
+
+func (p *parser) negate(n node) node {
+	if n.query == nil {
+		return n
+	}
+	return node{query: emailsearch.Not(n.query), negated: true, tok: n.tok}
+}
+
+// term returns the query for a word or phrase, or nil if it has nothing that
+// can be looked up.
+func (p *parser) term(sc scope, fields []emailsearch.Field, text string, phrase bool) emailsearch.Query {
+	if sc.label {
+		return emailsearch.Label(text)
+	}
+	if prefix, ok := strings.CutSuffix(text, "*"); ok && !phrase {
+		return emailsearch.Wildcard(prefix, fields...)
+	}
+	return emailsearch.Text(text, fields...)
+}
+
+// scope is the part of a token before the term itself, e.g. the "-subject:"
+// of "-subject:budget".
+type scope struct {
+	negated bool
+	fields  []emailsearch.Field
+	label   bool
+}
+
+// cutScope splits the negation and field name from the front of a token,
+// returning the rest of the token. Words in front of a colon that are not
+// field names are part of the term, e.g. "re:budget".
+func (p *parser) cutScope(tok token) (scope, string, error) {
+	var sc scope
+
+	text := tok.text
+	if tok.kind != tokWord {
+		text = tok.prefix
+	}
+	if rest, ok := strings.CutPrefix(text, "-"); ok {
+		sc.negated, text = true, rest
+	}
+	if name, rest, ok := strings.Cut(text, ":"); ok {
+		if f, err := emailsearch.ParseField(name); err == nil {
+			sc.fields, text = []emailsearch.Field{f}, rest
+		} else if strings.EqualFold(name, "label") {
+			sc.label, text = true, rest
+		} else if tok.kind != tokWord {
+			return sc, "", p.errorf(tok, "unknown field %q", name)
+		}
+	}
+
+	if tok.kind != tokWord {
+		return sc, tok.text, nil
+	}
+	return sc, text, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokPhrase // text is the contents of a quoted phrase
+	tokOpen   // (
+	tokClose  // )
+
+	// tokPrefix is a negation or field name attached to the next token, it is
+	// only used within lex
+	tokPrefix
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	prefix string // Negation and field name directly before a phrase or group, e.g. "-subject:"
+	offset int    // Byte offset of the token in the query string
+}
+
+func (t token) isWord(w string) bool {
+	return t.kind == tokWord && t.text == w
+}
+
+// isOperator reports whether t is OR or NEAR.
+func (t token) isOperator() bool {
+	return t.isWord("OR") || t.isWord("NEAR") || t.kind == tokWord && strings.HasPrefix(t.text, "NEAR/")
+}
+
+// startsTerm reports whether t can start a term, phrase or group.
+func (t token) startsTerm() bool {
+	return t.kind != tokEOF && t.kind != tokClose && !t.isOperator()
+}
+
+// lex splits a query string into tokens, ending with a tokEOF. Runs of words
+// go through emailsearch.NormalizeQuery, so dates and numbers are matched
+// the same way they were indexed.
+func lex(s string) ([]token, error) {
+	var (
+		tokens []token
+		words  []token // Run of words waiting to be normalized
+	)
+	flush := func() {
+		tokens = append(tokens, normalize(s, words)...)
+		words = nil
+	}
+
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			flush()
+			kind := tokOpen
+			if r == ')' {
+				kind = tokClose
+			}
+			tokens = append(tokens, token{kind: kind, text: string(r), offset: i})
+			i++
+		case r == '"':
+			flush()
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, &SyntaxError{Query: s, Offset: i, Msg: "missing closing quote"}
+			}
+			tokens = append(tokens, token{kind: tokPhrase, text: s[i+1 : i+1+end], offset: i})
+			i += end + 2
+		default:
+			end := strings.IndexFunc(s[i:], func(r rune) bool { return unicode.IsSpace(r) || strings.ContainsRune(`()"`, r) })
+			if end < 0 {
+				end = len(s) - i
+			}
+			word := token{kind: tokWord, text: s[i : i+end], offset: i}
+			i += end
+
+			// A negation or field name attached to a phrase or group
+			if i < len(s) && (s[i] == '"' || s[i] == '(') && (word.text == "-" || strings.HasSuffix(word.text, ":")) {
+				flush()
+				tokens = append(tokens, token{kind: tokPrefix, prefix: word.text, offset: word.offset})
+				continue
+			}
+			words = append(words, word)
+		}
+	}
+	flush()
+
+	// Attach the prefixes to the phrase or group that follows them
+	out := tokens[:0]
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind == tokPrefix {
+			next := tokens[i+1]
+			next.prefix, next.offset = tokens[i].prefix, tokens[i].offset
+			out = append(out, next)
+			i++
+			continue
+		}
+		out = append(out, tokens[i])
+	}
+
+	return append(out, token{kind: tokEOF, offset: len(s)}), nil
+}
+
+// normalize runs words, a run of word tokens from s, through
+// emailsearch.NormalizeQuery. Words replaced by a canonical token give it
+// their offset.
+func normalize(s string, words []token) []token {
+	if len(words) == 0 {
+		return nil
+	}
+
+	texts := make([]string, len(words))
+	for i, w := range words {
+		texts[i] = w.text
+	}
+	normalized := emailsearch.NormalizeQuery(texts)
+	if len(normalized) == len(words) && strings.Join(normalized, " ") == strings.Join(texts, " ") {
+		return words
+	}
+
+	// Find each normalized word in s, a canonical token is placed where the
+	// text it replaced starts
+	tokens := make([]token, len(normalized))
+	offset := words[0].offset
+	end := words[len(words)-1].offset + len(words[len(words)-1].text)
+	for i, w := range normalized {
+		tokens[i] = token{kind: tokWord, text: w, offset: offset}
+		if j := strings.Index(s[offset:end], w); j >= 0 {
+			tokens[i].offset = offset + j
+			offset += j + len(w)
+		}
+		for offset < end && s[offset] == ' ' {
+			offset++
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,107 @@
+package queryparser
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		Query    string
+		Expected string
+	}{
+		{"budget", "budget"},
+		{"Budget forecast", "budget forecast"},
+		{"", ""},
+		{"the of", ""},
+		{"invoice OR receipt", "(invoice OR receipt)"},
+		{"budget invoice OR receipt OR bill", "budget (invoice OR receipt OR bill)"},
+		{"invoice OR the", "invoice"},
+		{"budget or forecast", "budget forecast"},
+		{"Jan 3 2001 OR 1,000", "(20010103 OR 1000)"},
+		{"meeting -lunch", "meeting -lunch"},
+		{"meeting -1,000", "meeting -1000"},
+		{"-lunch", "-lunch"},
+		{"meeting - lunch", "meeting -lunch"},
+		{`"wire transfer" budget`, `"wire transfer" budget`},
+		{`"Bank of America" OR budget`, `("bank * america" OR budget)`},
+		{`budget -"wire transfer"`, `budget -"wire transfer"`},
+		{"budget NEAR/5 forecast", "(budget NEAR/5 forecast)"},
+		{"budget NEAR forecast", "(budget NEAR/10 forecast)"},
+		{"budget NEAR/3 forecast NEAR/3 report", "(budget NEAR/3 forecast NEAR/3 report)"},
+		{"budget NEAR/3 forecast NEAR/5 report", "((budget NEAR/3 forecast) NEAR/5 report)"},
+		{"budget NEAR/3 forecast OR report", "((budget NEAR/3 forecast) OR report)"},
+		{"from:lay subject:budget report", "from:lay subject:budget report"},
+		{`Subject:"wire transfer" -to:kenneth`, `subject:"wire transfer" -to:kenneth`},
+		{"from:kenneth.lay@enron.com", `from:"kenneth lay enron com"`},
+		{`label:inbox label:"Category Updates"`, `label:inbox label:"Category Updates"`},
+		{"unknown:word", `"unknown word"`},
+		{"litigat* OR Lawsuit*", "(litigat* OR lawsuit*)"},
+
+		// Grouping
+		{`from:lay "wire transfer" (budget OR forecast) -lunch`, `from:lay "wire transfer" (budget OR forecast) -lunch`},
+		{"(budget forecast) OR report", "((budget forecast) OR report)"},
+		{"((budget))", "budget"},
+		{"meeting -(lunch OR dinner)", "meeting -(lunch OR dinner)"},
+		{"subject:(budget OR forecast) report", "(subject:budget OR subject:forecast) report"},
+		{"subject:(budget body:forecast)", "subject:budget body:forecast"},
+		{"-subject:(lunch dinner) meeting", "-(subject:lunch subject:dinner) meeting"},
+		{"(budget OR forecast) NEAR/4 report", "((budget OR forecast) NEAR/4 report)"},
+		{"(the) budget", "budget"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Query, func(t *testing.T) {
+			q, err := Parse(tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := q.String(); got != tc.Expected {
+				t.Errorf("expected %q, got %q", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		Query    string
+		Expected string
+	}{
+		{"(budget", `missing ")" to close "(" at column 1`},
+		{"budget)", `unexpected ")" at column 7`},
+		{"budget ()", "empty parentheses at column 8"},
+		{`"wire transfer`, "missing closing quote at column 1"},
+		{"OR budget", "missing term before OR at column 1"},
+		{"budget OR", "missing term after OR at column 8"},
+		{"budget OR OR forecast", "missing term after OR at column 8"},
+		{"budget NEAR/x forecast", `invalid NEAR distance "x" at column 8`},
+		{"NEAR/2 budget", "missing term before NEAR/2 at column 1"},
+		{"budget NEAR", "missing term after NEAR at column 8"},
+		{"meeting -", `missing term after "-" at column 9`},
+		{"budget OR -lunch", "cannot use a negated term with OR at column 11"},
+		{"budget NEAR/2 -lunch", "cannot use a negated term with NEAR at column 15"},
+		{"- -lunch", "cannot negate a negated term at column 1"},
+		{"subject:", `missing term after "subject:" at column 1`},
+		{"budget *", `missing prefix before "*" at column 8`},
+		{`unknown:"wire transfer"`, `unknown field "unknown" at column 1`},
+		{"label:(inbox OR sent)", "label: cannot be applied to a group at column 1"},
+		{"(budget OR)", "missing term after OR at column 9"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Query, func(t *testing.T) {
+			_, err := Parse(tc.Query)
+			var serr *SyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("expected a SyntaxError, got %v", err)
+			}
+			if serr.Query != tc.Query {
+				t.Errorf("expected the query %q in the error, got %q", tc.Query, serr.Query)
+			}
+			if got := err.Error(); got != tc.Expected {
+				t.Errorf("expected %q, got %q", tc.Expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package emailsearch
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Ranking is the function used to score and order search results.
+type Ranking uint8
+
+const (
+	// Ranking_TFIDF weights the frequency of each query word in an email by
+	// how rare the word is across the corpus.
+	Ranking_TFIDF Ranking = iota
+	// Ranking_BM25 is Okapi BM25, which also normalizes for the length of
+	// each email. It is tuned with BM25Parameters.
+	Ranking_BM25
+
+	numRankings = iota
+)
+
+var rankingNames = [numRankings]string{"tfidf", "bm25"}
+
+func (r Ranking) String() string {
+	if int(r) < len(rankingNames) {
+		return rankingNames[r]
+	}
+	return fmt.Sprintf("Ranking(%d)", r)
+}
+
+// ParseRanking returns the Ranking with the given name, e.g. "bm25". Names
+// are case insensitive.
+func ParseRanking(name string) (Ranking, error) {
+	for i, n := range rankingNames {
+		if strings.EqualFold(n, name) {
+			return Ranking(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ranking %q", name)
+}
+
+// BM25Parameters tune Ranking_BM25.
+type BM25Parameters struct {
+	K1 float64 // How quickly repeated words stop adding to the score
+	B  float64 // How much to normalize for email length, from 0 (none) to 1 (fully)
+}
+
+// DefaultBM25 are the commonly used BM25 parameters.
+var DefaultBM25 = BM25Parameters{K1: 1.2, B: 0.75}
+
+// DefaultProximity is the default weight of the proximity boost, see
+// Index.Proximity.
+const DefaultProximity = 0.5
+
+// scoreResults scores each file of a query result with the ranking function
+// of the index. Every query word found in a file contributes to the score of
+// the file based on how often it occurs in the file and how many files in
+// the corpus contain it.
+func (idx *Index) scoreResults(ctx context.Context, searchresults map[int][]QueryWordMatch) (map[int]float64, error) {
+	dfs := make(map[string]int)
+	scores := make(map[int]float64, len(searchresults))
+	for fidx, wordmatches := range searchresults {
+		tfs := make(map[string]int)
+		for _, m := range wordmatches {
+			tfs[strings.ToLower(m.Word)]++
+		}
+
+		var score float64
+		for word, tf := range tfs {
+			df, ok := dfs[word]
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				var err error
+				if df, err = idx.documentFrequency(word); err != nil {
+					return nil, err
+				}
+				dfs[word] = df
+			}
+			score += idx.termScore(fidx, tf, df)
+		}
+		scores[fidx] = score * (1 + idx.Proximity*proximity(wordmatches))
+	}
+
+	return scores, nil
+}
+
+// coverage returns the number of different query terms in wordmatches. A
+// wildcard is one term however many words it matches.
+func coverage(wordmatches []QueryWordMatch) int {
+	words := make(map[string]bool)
+	for _, m := range wordmatches {
+		words[m.term()] = true
+	}
+	return len(words)
+}
+
+// termScore is the contribution to the score of file fidx of a word that
+// occurs tf times in the file and is found in df files.
+func (idx *Index) termScore(fidx, tf, df int) float64 {
+	switch idx.Ranking {
+	case Ranking_BM25:
+		k1, b := idx.BM25.K1, idx.BM25.B
+		norm := 1.0
+		if idx.avgDocLen > 0 {
+			norm = 1 - b + b*float64(idx.DocumentLength(fidx))/idx.avgDocLen
+		}
+		return bm25IDF(idx.CorpusSize, df) * float64(tf) * (k1 + 1) / (float64(tf) + k1*norm)
+	default:
+		// Dampen the term frequency with a logarithm so that repeating one
+		// word has diminishing returns
+		return (1 + math.Log(float64(tf))) * inverseDocumentFrequency(idx.CorpusSize, df)
+	}
+}
+
+// documentFrequency returns the number of files that contain word. It is the
+// size of the word's file set, so the posting list isn't read.
+func (idx *Index) documentFrequency(word string) (int, error) {
+	files, err := idx.wordFiles(word)
+	if err != nil {
+		return 0, err
+	}
+	return int(files.GetCardinality()), nil
+}
+
+// inverseDocumentFrequency weights a word found in df of n files. It is
+// always positive so a word in every file still counts for something.
+func inverseDocumentFrequency(n, df int) float64 {
+	return math.Log(1 + float64(n)/float64(max(df, 1)))
+}
+
+// bm25IDF is the BM25 weight of a word found in df of n files. Like
+// inverseDocumentFrequency it is always positive.
+func bm25IDF(n, df int) float64 {
+	return math.Log(1 + (float64(n-df)+0.5)/(float64(df)+0.5))
+}
+
+// proximity measures how close together the different query terms in
+// wordmatches are, from 0 when no two different terms share a field to 1
+// when all of them appear next to each other. It looks for the smallest run
+// of words in each field that contains every query term found in that field.
+func proximity(wordmatches []QueryWordMatch) float64 {
+	numWords := coverage(wordmatches)
+	if numWords < 2 {
+		return 0
+	}
+
+	matches := slices.Clone(wordmatches)
+	slices.SortFunc(matches, func(a, b QueryWordMatch) int {
+		if a.Field != b.Field {
+			return int(a.Field) - int(b.Field)
+		}
+		return a.Position - b.Position
+	})
+
+	var best float64
+	for start := 0; start < len(matches); {
+		end := start + 1
+		for end < len(matches) && matches[end].Field == matches[start].Field {
+			end++
+		}
+		field := matches[start:end]
+		start = end
+
+		fieldWords := make(map[string]bool)
+		for _, m := range field {
+			fieldWords[m.term()] = true
+		}
+		n := len(fieldWords)
+		if n < 2 {
+			continue
+		}
+
+		// Slide a window over the matches, keeping it as short as possible
+		// while it contains all n words
+		span := math.MaxInt
+		counts := make(map[string]int)
+		lo := 0
+		for _, m := range field {
+			counts[m.term()]++
+			for len(counts) == n {
+				span = min(span, m.Position-field[lo].Position)
+				w := field[lo].term()
+				if counts[w]--; counts[w] == 0 {
+					delete(counts, w)
+				}
+				lo++
+			}
+		}
+
+		// How many of the query words are close, and how much extra space
+		// there is between them
+		covered := float64(n-1) / float64(numWords-1)
+		slack := max(span-(n-1), 0)
+		best = max(best, covered/float64(1+slack))
+	}
+
+	return best
+}
@@ -0,0 +1,204 @@
+package emailsearch
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTFIDFRanking(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nEnergy energy energy energy energy.\n",
+		"2": "Subject: two\n\nThe energy merger.\n",
+		"3": "Subject: three\n\nEnergy prices.\n",
+		"4": "Subject: four\n\nMore energy.\n",
+	})
+
+	// Repeating the common word should not outrank the rare word
+	results, err := idx.Search(t.Context(), ParseQuery("energy OR merger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[0].Filename != "2" || results[1].Filename != "1" {
+		t.Errorf("expected 2 and then 1 to rank highest, got %+v", results)
+	}
+}
+
+func TestDocumentFrequency(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: energy\n\nEnergy energy prices.\n",
+		"2": "Subject: two\n\nThe energy merger.\n",
+		"3": "Subject: three\n\nPrices.\n",
+	})
+
+	// The size of the file set is the number of files with the word in any
+	// field, as counted from the posting list
+	for _, word := range []string{"energy", "prices", "merger", "missing"} {
+		tfs, err := idx.TermFrequencies(word)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if df, err := idx.documentFrequency(word); err != nil || df != len(tfs) {
+			t.Errorf("%s: expected %d files, got %d (%v)", word, len(tfs), df, err)
+		}
+	}
+}
+
+func TestCoverageRanking(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\n" + strings.Repeat("Energy ", 50) + "\n",
+		"2": "Subject: two\n\nThe energy merger was approved by the board.\n",
+		"3": "Subject: three\n\nThe merger and the board.\n",
+		"4": "Subject: four\n\nThe board.\n",
+	})
+
+	// More of the different query words beats repeating one of them, for
+	// every ranking function
+	for _, ranking := range []Ranking{Ranking_TFIDF, Ranking_BM25} {
+		idx.Ranking = ranking
+		results, err := idx.Search(t.Context(), ParseQuery("energy OR merger OR board"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.Filename)
+		}
+		if !slices.Equal(got, []string{"2", "3", "1", "4"}) {
+			t.Errorf("%s: expected results 2, 3, 1, 4, got %v", ranking, got)
+		}
+		if results[0].Coverage != 3 || results[1].Coverage != 2 {
+			t.Errorf("%s: unexpected coverage %d, %d", ranking, results[0].Coverage, results[1].Coverage)
+		}
+	}
+}
+
+func TestWildcardCoverage(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe budget, budgetary and budgeted figures.\n",
+		"2": "Subject: two\n\nThe budget for the merger.\n",
+	})
+
+	// A wildcard is one query term however many of its words match
+	results, err := idx.Search(t.Context(), Or(Wildcard("budg"), Term("merger")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Filename != "2" {
+		t.Fatalf("expected 2 to rank first, got %v", results)
+	}
+	if results[0].Coverage != 2 || results[1].Coverage != 1 {
+		t.Errorf("unexpected coverage %d, %d", results[0].Coverage, results[1].Coverage)
+	}
+	for _, m := range results[1].WordMatches {
+		if m.Term != "budg*" {
+			t.Errorf("expected term budg* for %s, got %q", m.Word, m.Term)
+		}
+	}
+}
+
+func TestBM25Ranking(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe merger was discussed at length during the quarterly board meeting with analysts.\n",
+		"2": "Subject: two\n\nMerger approved.\n",
+		"3": "Subject: three\n\nLunch on Friday?\n",
+	})
+
+	search := func() []string {
+		t.Helper()
+		results, err := idx.Search(t.Context(), Term("merger"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range results {
+			if r.Score <= 0 {
+				t.Errorf("expected a positive score for %s, got %v", r.Filename, r.Score)
+			}
+			got = append(got, r.Filename)
+		}
+		return got
+	}
+
+	// TF-IDF ignores the length of the emails so they tie
+	if got := search(); !slices.Equal(got, []string{"1", "2"}) {
+		t.Errorf("expected [1 2], got %v", got)
+	}
+
+	// BM25 prefers the shorter email
+	idx.Ranking = Ranking_BM25
+	if got := search(); !slices.Equal(got, []string{"2", "1"}) {
+		t.Errorf("expected [2 1], got %v", got)
+	}
+
+	// Unless length normalization is turned off
+	idx.BM25.B = 0
+	if got := search(); !slices.Equal(got, []string{"1", "2"}) {
+		t.Errorf("expected [1 2], got %v", got)
+	}
+}
+
+func TestParseRanking(t *testing.T) {
+	for r := range Ranking(numRankings) {
+		got, err := ParseRanking(strings.ToUpper(r.String()))
+		if err != nil || got != r {
+			t.Errorf("expected %v, got %v (%v)", r, got, err)
+		}
+	}
+	if _, err := ParseRanking("pagerank"); err == nil {
+		t.Error("expected an error for an unknown ranking")
+	}
+}
+
+func TestProximity(t *testing.T) {
+	match := func(word string, field Field, pos int) QueryWordMatch {
+		return QueryWordMatch{Word: word, Field: field, Position: pos}
+	}
+
+	cases := []struct {
+		Name     string
+		Matches  []QueryWordMatch
+		Expected float64
+	}{
+		{"One word", []QueryWordMatch{match("a", Field_Body, 0), match("a", Field_Body, 1)}, 0},
+		{"Adjacent", []QueryWordMatch{match("a", Field_Body, 4), match("b", Field_Body, 5)}, 1},
+		{"Gap", []QueryWordMatch{match("a", Field_Body, 4), match("b", Field_Body, 8)}, 0.25},
+		{"Closest pair", []QueryWordMatch{match("a", Field_Body, 0), match("b", Field_Body, 10), match("a", Field_Body, 11)}, 1},
+		{"Different fields", []QueryWordMatch{match("a", Field_Subject, 0), match("b", Field_Body, 0)}, 0},
+		{"Partial", []QueryWordMatch{match("a", Field_Body, 0), match("b", Field_Body, 1), match("c", Field_Subject, 0)}, 0.5},
+		{"Three", []QueryWordMatch{match("c", Field_Body, 2), match("a", Field_Body, 0), match("b", Field_Body, 1)}, 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := proximity(tc.Matches); got != tc.Expected {
+				t.Errorf("expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestProximityRanking(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe budget was late. Separately, the forecast changed.\n",
+		"2": "Subject: two\n\nThe forecast changed. Separately, the budget was late.\n",
+		"3": "Subject: three\n\nThe budget forecast changed.\n",
+	})
+
+	results, err := idx.Search(t.Context(), ParseQuery("budget forecast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Filename != "3" {
+		t.Fatalf("expected 3 to rank highest, got %+v", results)
+	}
+
+	// Without the boost the shorter email has no advantage under TF-IDF
+	idx.Proximity = 0
+	if results, err = idx.Search(t.Context(), ParseQuery("budget forecast")); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Score != results[2].Score {
+		t.Errorf("expected equal scores without the proximity boost, got %v and %v", results[0].Score, results[2].Score)
+	}
+}
@@ -0,0 +1,161 @@
+package emailsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IndexWatcher holds the current generation of an index and swaps in a new
+// generation when the index is reloaded, so that a server picks up a rebuilt
+// index without restarting. Queries hold the generation they started with
+// until they finish, the old generation is only closed once the last of
+// them has.
+type IndexWatcher struct {
+	// Load loads a generation of the index from path. It defaults to
+	// LoadIndexFromDisk, set it to load an encrypted index for example.
+	Load func(path string) (*Index, error)
+
+	path     string
+	modTime  time.Time  // Of the generation being served, see indexModTime
+	reloadMu sync.Mutex // Held for the whole of a reload
+
+	mu  sync.Mutex
+	cur *generation
+}
+
+// generation is an index and the number of callers using it.
+type generation struct {
+	idx     *Index
+	refs    int
+	retired bool
+	idle    chan struct{} // Closed when a retired generation has no references
+}
+
+// NewIndexWatcher returns an IndexWatcher serving idx, which was loaded
+// from path.
+func NewIndexWatcher(path string, idx *Index) *IndexWatcher {
+	w := &IndexWatcher{path: path, cur: &generation{idx: idx, idle: make(chan struct{})}}
+	w.modTime, _ = indexModTime(path)
+	return w
+}
+
+// Acquire returns the current generation of the index and a function to
+// call once the caller has finished with it.
+func (w *IndexWatcher) Acquire() (*Index, func()) {
+	w.mu.Lock()
+	g := w.cur
+	g.refs++
+	w.mu.Unlock()
+
+	return g.idx, sync.OnceFunc(func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		g.refs--
+		if g.retired && g.refs == 0 {
+			close(g.idle)
+		}
+	})
+}
+
+// Reload loads the index at path, or the path of the current generation if
+// path is "", and swaps it in. The new generation takes on the ranking
+// settings, query cache and QueryThreads of the current one. If it fails to
+// load the current generation is kept. Reload returns once every caller has
+// released the old generation and it has been closed.
+func (w *IndexWatcher) Reload(path string) error {
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	if path == "" {
+		path = w.path
+	}
+	modTime, _ := indexModTime(path)
+	load := w.Load
+	if load == nil {
+		load = func(path string) (*Index, error) { return LoadIndexFromDisk(path, io.Discard) }
+	}
+	idx, err := load(path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	old := w.cur
+	idx.Ranking, idx.BM25, idx.Proximity = old.idx.Ranking, old.idx.BM25, old.idx.Proximity
+	idx.Cache, idx.QueryThreads = old.idx.Cache, old.idx.QueryThreads
+	w.cur = &generation{idx: idx, idle: make(chan struct{})}
+	w.path, w.modTime = path, modTime
+	old.retired = true
+	if old.refs == 0 {
+		close(old.idle)
+	}
+	w.mu.Unlock()
+
+	<-old.idle
+	old.idx.Close()
+	return nil
+}
+
+// Watch reloads the index whenever it changes on disk, checking every
+// interval, until ctx is done. An index directory changes when its
+// metadata.json does, which is written last, and a bundle or SQLite
+// database when the file does. It writes a line to out for every reload and
+// every failure to reload. Remote indexes can't be watched.
+func (w *IndexWatcher) Watch(ctx context.Context, interval time.Duration, out io.Writer) error {
+	if isRemote(w.path) {
+		return fmt.Errorf("%s: remote indexes can not be watched", w.path)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var failed time.Time // Not retried until it changes again
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		w.reloadMu.Lock()
+		path := w.path
+		modTime, err := indexModTime(path)
+		changed := err == nil && !modTime.Equal(w.modTime) && !modTime.Equal(failed)
+		w.reloadMu.Unlock()
+		if !changed {
+			continue // A missing index is likely being replaced
+		}
+		if err := w.Reload(path); err != nil {
+			fmt.Fprintf(out, "Failed to reload index %s: %s\n", path, err)
+			failed = modTime
+			continue
+		}
+		fmt.Fprintf(out, "Reloaded index %s\n", path)
+	}
+}
+
+// Close closes the current generation. The watcher can't be used after.
+func (w *IndexWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cur.idx.Close()
+}
+
+// indexModTime returns the modification time of the index at path.
+func indexModTime(path string) (time.Time, error) {
+	if isRemote(path) {
+		return time.Time{}, errors.New("remote index")
+	}
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		fi, err = os.Stat(filepath.Join(path, IndexMetadataFile))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,180 @@
+package emailsearch
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndexWatcher(t *testing.T) {
+	build := func(emails map[string]string) *IndexBuilder {
+		t.Helper()
+		ib := &IndexBuilder{}
+		ib.Init()
+		if err := ib.mergeIndexes([]string{serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)}); err != nil {
+			t.Fatal(err)
+		}
+		return ib
+	}
+	path := filepath.Join(t.TempDir(), "index.bundle")
+	if err := build(map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"}).SerializeBundle(path); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndexFromDisk(path, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Ranking, idx.QueryThreads = Ranking_BM25, 3
+	w := NewIndexWatcher(path, idx)
+	defer w.Close()
+
+	search := func(idx *Index, word string) int {
+		t.Helper()
+		results, err := idx.QueryIndex(t.Context(), []string{word})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results)
+	}
+
+	// A query holding the old generation keeps it open through a reload
+	old, release := w.Acquire()
+	if err := build(map[string]string{"2": "Subject: two\n\nDinner on Saturday.\n"}).SerializeBundle(path); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan error)
+	go func() { reloaded <- w.Reload("") }()
+
+	var cur *Index
+	for cur == nil || cur == old {
+		var r func()
+		cur, r = w.Acquire()
+		r()
+	}
+	if search(old, "lunch") != 1 || search(cur, "dinner") != 1 || search(cur, "lunch") != 0 {
+		t.Error("expected each generation to search its own index")
+	}
+	if cur.Ranking != Ranking_BM25 || cur.QueryThreads != 3 {
+		t.Error("expected the ranking and query threads to carry over to the new generation")
+	}
+	select {
+	case <-reloaded:
+		t.Fatal("expected the reload to wait for the old generation to be released")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed load keeps the current generation
+	if err := w.Reload(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error reloading a missing index")
+	}
+	if idx, release := w.Acquire(); idx != cur {
+		t.Error("expected the current generation to be kept")
+	} else {
+		release()
+	}
+
+	// Watch reloads when the bundle is replaced
+	ctx, cancel := context.WithCancel(t.Context())
+	var out syncBuffer
+	done := make(chan struct{})
+	go func() {
+		w.Watch(ctx, time.Millisecond, &out)
+		close(done)
+	}()
+	if err := build(map[string]string{"3": "Subject: three\n\nBreakfast on Sunday.\n"}).SerializeBundle(path); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour) // In case the file system's timestamps are coarse
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), "Reloaded"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the index to be reloaded, got %q", out.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	idx, release = w.Acquire()
+	defer release()
+	if search(idx, "breakfast") != 1 {
+		t.Error("expected the watched index to be reloaded")
+	}
+}
+
+func TestIndexWatcherRebuildInPlace(t *testing.T) {
+	build := func(emails map[string]string) *IndexBuilder {
+		t.Helper()
+		ib := &IndexBuilder{}
+		ib.Init()
+		if err := ib.mergeIndexes([]string{serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)}); err != nil {
+			t.Fatal(err)
+		}
+		return ib
+	}
+	dir := t.TempDir()
+	if err := build(map[string]string{"1": "Subject: one\n\nLunch on Friday.\n"}).Serialize(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndexFromDisk(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewIndexWatcher(dir, idx)
+	defer w.Close()
+
+	// The generation being served keeps reading its own files while the
+	// index is rebuilt into the same directory
+	old, release := w.Acquire()
+	if err := build(map[string]string{"2": "Subject: two\n\nDinner on Saturday, a longer email than before.\n"}).Serialize(dir); err != nil {
+		t.Fatal(err)
+	}
+	results, err := old.QueryIndex(t.Context(), []string{"lunch"})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected the old generation to find lunch, got %v (%v)", results, err)
+	}
+	if content, _, err := old.ReadContent(t.Context(), results[0].FilenameIndex); err != nil || string(content) != "Lunch on Friday.\n" {
+		t.Errorf("expected the old content, got %q (%v)", content, err)
+	}
+	release()
+
+	if err := w.Reload(""); err != nil {
+		t.Fatal(err)
+	}
+	cur, release := w.Acquire()
+	defer release()
+	if results, err := cur.QueryIndex(t.Context(), []string{"dinner"}); err != nil || len(results) != 1 {
+		t.Errorf("expected the rebuilt index to find dinner, got %v (%v)", results, err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("expected no temporary files, got %v", tmp)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to use from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
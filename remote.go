@@ -0,0 +1,384 @@
+package emailsearch
+
+import (
+	"cmp"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An index can be loaded straight from a web server or S3 compatible object
+// storage, so that a container can start searching without first copying
+// the index to local disk. LoadIndexFromDisk accepts
+//
+//	https://example.com/email_index           a directory, one URL per file
+//	https://example.com/email_index.bundle    a bundle
+//	s3://bucket/email_index                   either of the above in S3
+//
+// The files are read with ranged GETs in blocks of remoteBlockSize, which
+// are kept in a cache shared by all the files of the index. The small files
+// are read in full when the index is loaded, but only the parts of the
+// search index and the catalog that queries touch are fetched. Because of
+// this their checksums are not verified, that would download them whole.
+//
+// S3 requests are signed with the credentials in the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, or
+// sent unsigned if there are none, for public buckets. The region is taken
+// from AWS_REGION or AWS_DEFAULT_REGION. AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL select another S3 compatible service, which is addressed
+// with path style URLs.
+
+// RemoteCacheSize is the most bytes of a remote index kept in memory.
+var RemoteCacheSize int64 = 256 << 20
+
+// remoteBlockSize is the unit remote files are fetched and cached in.
+const remoteBlockSize = 256 << 10
+
+// isRemote reports whether path is the URL of a remote index.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "s3://")
+}
+
+// remoteSource is an index fetched over HTTP. The files are either at URLs
+// under base, or in the bundle at base.
+type remoteSource struct {
+	base   *url.URL
+	client *http.Client
+	signer *s3Signer // nil unless the index is in S3
+	cache  *blockCache
+	bundle *bundleSource
+}
+
+func openRemote(path string) (*remoteSource, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &remoteSource{base: u, client: http.DefaultClient, cache: newBlockCache(RemoteCacheSize)}
+	if u.Scheme == "s3" {
+		if r.base, r.signer, err = s3Location(u); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.HasSuffix(u.Path, ".bundle") {
+		f, err := r.openURL(r.base)
+		if err != nil {
+			return nil, err
+		}
+		if r.bundle, err = newBundleSource(path, f); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *remoteSource) Open(name string) (indexFile, error) {
+	if r.bundle != nil {
+		return r.bundle.Open(name)
+	}
+	return r.openURL(r.base.JoinPath(name))
+}
+
+func (r *remoteSource) Close() error {
+	return nil
+}
+
+// openURL returns the remote file at u, fetching its size.
+func (r *remoteSource) openURL(u *url.URL) (*remoteFile, error) {
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, &fs.PathError{Op: "open", Path: u.Redacted(), Err: fs.ErrNotExist}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", u.Redacted(), resp.Status)
+	case resp.ContentLength < 0:
+		return nil, fmt.Errorf("%s: size is unknown", u.Redacted())
+	}
+	return &remoteFile{src: r, url: u.String(), size: resp.ContentLength}, nil
+}
+
+func (r *remoteSource) do(req *http.Request) (*http.Response, error) {
+	if r.signer != nil {
+		r.signer.sign(req, time.Now())
+	}
+	return r.client.Do(req)
+}
+
+// remoteChecksums returns the checksums of the files that are read in full
+// when src is loaded. Files of other sources are all verified.
+func remoteChecksums(src indexSource, checksums map[string]string) map[string]string {
+	if _, ok := src.(*remoteSource); !ok {
+		return checksums
+	}
+	eager, _ := splitChecksums(checksums)
+	return eager
+}
+
+// remoteFile is a file of a remote index, read through the block cache.
+type remoteFile struct {
+	src  *remoteSource
+	url  string
+	size int64
+}
+
+func (f *remoteFile) Len() int     { return int(f.size) }
+func (f *remoteFile) Close() error { return nil }
+
+func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), f.size)
+
+	// Gather the blocks, fetching each run of missing blocks with one request
+	first, last := off/remoteBlockSize, (end-1)/remoteBlockSize
+	blocks := make([][]byte, last-first+1)
+	for b := first; b <= last; {
+		if blocks[b-first] = f.src.cache.get(f.url, b); blocks[b-first] != nil {
+			b++
+			continue
+		}
+		run := b + 1
+		for run <= last && f.src.cache.get(f.url, run) == nil {
+			run++
+		}
+		fetched, err := f.fetch(b, run)
+		if err != nil {
+			return 0, err
+		}
+		copy(blocks[b-first:], fetched)
+		b = run
+	}
+
+	n := 0
+	for i, block := range blocks {
+		start := int64(0)
+		if i == 0 {
+			start = off % remoteBlockSize
+		}
+		n += copy(p[n:end-off], block[start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch reads blocks [first, last) of the file and adds them to the cache.
+func (f *remoteFile) fetch(first, last int64) ([][]byte, error) {
+	start, end := first*remoteBlockSize, min(last*remoteBlockSize, f.size)
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end-1, 10))
+	resp, err := f.src.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// A server that ignores the range sends the whole file, which is only
+	// what was asked for if that is the whole file
+	if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && start == 0 && end == f.size) {
+		return nil, fmt.Errorf("%s: range request failed: %s", f.url, resp.Status)
+	}
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.url, err)
+	}
+
+	blocks := slices.Collect(slices.Chunk(data, remoteBlockSize))
+	for i, block := range blocks {
+		f.src.cache.add(f.url, first+int64(i), block)
+	}
+	return blocks, nil
+}
+
+// blockCache is a least recently used cache of the blocks of files, those
+// fetched from a remote index or decrypted from an encrypted one.
+type blockCache struct {
+	mu      sync.Mutex
+	size    int64 // Bytes of blocks in the cache
+	max     int64
+	order   *list.List // Of *cachedBlock, most recently used at the front
+	entries map[blockKey]*list.Element
+}
+
+type blockKey struct {
+	file  string
+	block int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache(max int64) *blockCache {
+	return &blockCache{max: max, order: list.New(), entries: make(map[blockKey]*list.Element)}
+}
+
+func (c *blockCache) get(file string, block int64) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[blockKey{file, block}]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBlock).data
+}
+
+func (c *blockCache) add(file string, block int64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := blockKey{file, block}
+	if _, ok := c.entries[key]; ok {
+		return // Fetched by another reader at the same time
+	}
+	c.entries[key] = c.order.PushFront(&cachedBlock{key, data})
+	c.size += int64(len(data))
+	for c.size > c.max && c.order.Len() > 1 {
+		oldest := c.order.Remove(c.order.Back()).(*cachedBlock)
+		delete(c.entries, oldest.key)
+		c.size -= int64(len(oldest.data))
+	}
+}
+
+// s3Location returns the HTTPS URL of the S3 location u, s3://bucket/key,
+// and a signer for requests to it.
+func s3Location(u *url.URL) (*url.URL, *s3Signer, error) {
+	if u.Host == "" {
+		return nil, nil, fmt.Errorf("%s: no bucket", u)
+	}
+	region := cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+
+	var base *url.URL
+	if endpoint := cmp.Or(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad S3 endpoint: %w", err)
+		}
+		base = e.JoinPath(u.Host, u.Path)
+	} else {
+		base = &url.URL{Scheme: "https", Host: u.Host + ".s3." + region + ".amazonaws.com", Path: u.Path}
+	}
+
+	var signer *s3Signer
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		signer = &s3Signer{
+			accessKey:    key,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			region:       region,
+		}
+	}
+	return base, signer, nil
+}
+
+// s3Signer signs requests to S3 with AWS Signature Version 4.
+type s3Signer struct {
+	accessKey, secretKey, sessionToken string
+	region                             string
+}
+
+// unsignedPayload is the payload hash of requests that don't sign their
+// body, which a GET has none of anyway
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (s *s3Signer) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// The host, the range and every x-amz header are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscapePath escapes path the way AWS signatures expect, every byte but
+// the unreserved characters and slashes is percent encoded.
+func awsEscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,261 @@
+package emailsearch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// RepairIndex regenerates the files of the serialized index at path, a
+// directory or a bundle, that can be derived from the others, when they are
+// missing or damaged: the word offsets table is found again by walking
+// corpus.index, and the prefix tree is rebuilt from the words string table.
+// It returns the names of the files it replaced, none if they were intact.
+// The checksums in metadata.json are updated to match.
+//
+// The files they are derived from, corpus.index and the words string table,
+// have to be intact and in the current format, otherwise the index has to
+// be rebuilt from the emails. Encrypted indexes and SQLite databases can't
+// be repaired.
+func RepairIndex(path string) ([]string, error) {
+	if isRemote(path) {
+		return nil, fmt.Errorf("%s: remote indexes can not be repaired", path)
+	}
+	src, err := openIndexSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	if _, ok := src.(*sqliteSource); ok {
+		return nil, fmt.Errorf("%s: SQLite databases can not be repaired", path)
+	}
+
+	meta, err := loadIndexMetadata(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Encrypted) > 0 {
+		return nil, fmt.Errorf("%s: encrypted indexes can not be repaired", path)
+	}
+	sources := make(map[string]string)
+	for _, name := range []string{CorpusIndex, WordsStringTable} {
+		if sum, ok := meta.Checksums[name]; ok {
+			sources[name] = sum
+		}
+	}
+	if err := verifyChecksums(src, sources); err != nil {
+		return nil, fmt.Errorf("%s can not be repaired: %w", path, err)
+	}
+
+	var words []string
+	err = readIndexFile(src, WordsStringTable, func(r *bufio.Reader) (err error) {
+		words, err = loadStringTable(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := findWordOffsets(src, words)
+	if err != nil {
+		return nil, fmt.Errorf("%s can not be repaired: %w", path, err)
+	}
+
+	// Regenerate the files and keep those that differ from what is there
+	var buf bytes.Buffer
+	if err := (&IndexBuilder{}).writeIndexOffsetsFile(offsets, &buf); err != nil {
+		return nil, err
+	}
+	regenerated := map[string][]byte{IndexWordOffsets: bytes.Clone(buf.Bytes())}
+	buf.Reset()
+	if _, err := NewTrie(words).WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	regenerated[QueryPrefixTree] = buf.Bytes()
+
+	var repaired []string
+	for _, name := range slices.Sorted(maps.Keys(regenerated)) {
+		var current []byte
+		err := readIndexFile(src, name, func(r *bufio.Reader) (err error) {
+			current, err = io.ReadAll(r)
+			return err
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil && bytes.Equal(current, regenerated[name]) {
+			delete(regenerated, name)
+			continue
+		}
+		repaired = append(repaired, name)
+		if meta.Checksums != nil {
+			meta.Checksums[name] = formatChecksum(crc32.Checksum(regenerated[name], crcTable))
+		}
+	}
+	if len(repaired) == 0 {
+		return nil, nil
+	}
+
+	metaJSON, err := json.MarshalIndent(&meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	regenerated[IndexMetadataFile] = append(metaJSON, '\n')
+
+	if b, ok := src.(*bundleSource); ok {
+		err = rewriteBundle(b, regenerated)
+	} else {
+		err = replaceFiles(path, regenerated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
+
+// findWordOffsets walks the entries of corpus.index, which are written in
+// sorted word order, to find where the matches of each of words start.
+func findWordOffsets(src indexSource, words []string) ([]serializedWordIndexOffset, error) {
+	f, err := src.Open(CorpusIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var header serializedIndexHeader
+	if err := binary.Read(bufio.NewReader(&readerAtCursor{r: f}), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != indexMagic || header.Version != indexVersion {
+		return nil, fmt.Errorf("%s version %d is not the current format, the index has to be rebuilt", CorpusIndex, header.Version)
+	}
+	if header.NumEntries != uint64(len(words)) {
+		return nil, fmt.Errorf("%s has %d words but %s has %d", CorpusIndex, header.NumEntries, WordsStringTable, len(words))
+	}
+
+	order := make([]int, len(words))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return strings.Compare(words[a], words[b]) })
+
+	offsets := make([]serializedWordIndexOffset, len(words))
+	rdr := &readerAtCursor{r: f, off: int64(binary.Size(header)) + 4*int64(header.CorpusSize)}
+	for _, widx := range order {
+		offsets[widx] = serializedWordIndexOffset{uint32(widx), rdr.off}
+
+		// Skip over the files, the table of blocks and the blocks
+		numMatches, err := skipWordFiles(rdr)
+		if err != nil {
+			return nil, fmt.Errorf("word %q: %w", words[widx], err)
+		}
+		if numMatches > uint64(f.Len()) {
+			return nil, fmt.Errorf("word %q: %d matches is out of range", words[widx], numMatches)
+		}
+		var size uint64
+		for range (numMatches + postingBlockSize - 1) / postingBlockSize {
+			if _, err := binary.ReadUvarint(rdr); err != nil {
+				return nil, fmt.Errorf("word %q: %w", words[widx], err)
+			}
+			n, err := binary.ReadUvarint(rdr)
+			if err != nil {
+				return nil, fmt.Errorf("word %q: %w", words[widx], err)
+			}
+			size += n >> 1
+		}
+		if rdr.off += int64(size); rdr.off > int64(f.Len()) {
+			return nil, fmt.Errorf("word %q runs past the end of %s", words[widx], CorpusIndex)
+		}
+	}
+	if rdr.off != int64(f.Len()) {
+		return nil, fmt.Errorf("%s has more entries than %s has words", CorpusIndex, WordsStringTable)
+	}
+	return offsets, nil
+}
+
+// replaceFiles writes files into the index directory dir, each to a
+// temporary file that is then renamed over the old one. metadata.json is
+// written last, so a server loading the index part way through fails the
+// checksum verification.
+func replaceFiles(dir string, files map[string][]byte) error {
+	names := slices.Sorted(maps.Keys(files))
+	names = slices.DeleteFunc(names, func(name string) bool { return name == IndexMetadataFile })
+	names = append(names, IndexMetadataFile)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, files[name], 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteBundle writes a copy of the bundle b with files in place of its
+// own, or added to them, and swaps it in.
+func rewriteBundle(b *bundleSource, files map[string][]byte) error {
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails harmlessly once renamed
+	defer f.Close()
+
+	// Keep the files in the order they were written
+	entries := slices.SortedFunc(maps.Values(b.files), func(a, b bundleEntry) int { return int(a.offset - b.offset) })
+	names := make([]string, 0, len(entries)+len(files))
+	for _, e := range entries {
+		if e.name != IndexMetadataFile {
+			names = append(names, e.name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if _, ok := b.files[name]; !ok && name != IndexMetadataFile {
+			names = append(names, name)
+		}
+	}
+	names = append(names, IndexMetadataFile)
+
+	bw := bufio.NewWriter(f)
+	bfs := NewBundleFS(bw)
+	for _, name := range names {
+		err := writeFile(bfs, name, func(w io.Writer) error {
+			if data, ok := files[name]; ok {
+				_, err := w.Write(data)
+				return err
+			}
+			e := b.files[name]
+			_, err := io.Copy(w, io.NewSectionReader(b.f, e.offset, e.length))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := bfs.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), b.path)
+}
@@ -0,0 +1,96 @@
+package emailsearch
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepairIndex(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+		"3": "Subject: three\n\nThe budget lunch.\n",
+	}
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+	bundle := filepath.Join(t.TempDir(), "index.bundle")
+	ib := &IndexBuilder{}
+	ib.Init()
+	if err := ib.mergeIndexes([]string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.SerializeBundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []Query{Term("budget"), And(Term("budget"), Term("lunch")), Phrase("budget lunch")}
+	search := func(path string) [][]QueryResults {
+		t.Helper()
+		idx, err := LoadIndexFromDisk(path, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idx.Close()
+		results := make([][]QueryResults, len(queries))
+		for i, q := range queries {
+			if results[i], err = idx.Search(t.Context(), q); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if words := idx.Prefix("bud", 10); !reflect.DeepEqual(words, []string{"budget"}) {
+			t.Errorf("%s: expected the prefix tree to find budget, got %v", path, words)
+		}
+		return results
+	}
+	want := search(dir)
+
+	if repaired, err := RepairIndex(dir); err != nil || len(repaired) > 0 {
+		t.Errorf("expected an intact index to be left alone, got %v %v", repaired, err)
+	}
+
+	// Damage the files in the directory, and drop them from the bundle
+	if err := os.Remove(filepath.Join(dir, IndexWordOffsets)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, QueryPrefixTree), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := openBundle(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(src.files, IndexWordOffsets)
+	delete(src.files, QueryPrefixTree)
+	err = rewriteBundle(src, map[string][]byte{})
+	src.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{dir, bundle} {
+		repaired, err := RepairIndex(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if expected := []string{QueryPrefixTree, IndexWordOffsets}; !reflect.DeepEqual(repaired, expected) {
+			t.Errorf("%s: expected %v to be repaired, got %v", path, expected, repaired)
+		}
+		if report, err := VerifyIndex(path); err != nil || !report.OK() {
+			t.Errorf("%s: expected the repaired index to verify, got %v %v", path, report, err)
+		}
+		if got := search(path); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", path, want, got)
+		}
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(filepath.Dir(bundle), "*.tmp")); len(tmps) > 0 {
+		t.Errorf("expected the temporary files to be removed, found %v", tmps)
+	}
+
+	// What the files are derived from can't be repaired
+	os.WriteFile(filepath.Join(dir, WordsStringTable), []byte("garbage"), 0644)
+	if _, err := RepairIndex(dir); err == nil {
+		t.Error("expected a damaged words string table to fail")
+	}
+}
@@ -1,6 +1,13 @@
 package emailsearch
 
-import "iter"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+)
 
 // A unordered Set.
 type Set[E comparable] struct {
@@ -13,6 +20,15 @@ func NewSet[E comparable]() *Set[E] {
 	}
 }
 
+// NewSetFrom returns a new set holding the elements of items.
+func NewSetFrom[E comparable](items []E) *Set[E] {
+	s := &Set[E]{elems: make(map[E]struct{}, len(items))}
+	for _, item := range items {
+		s.Insert(item)
+	}
+	return s
+}
+
 func (s *Set[E]) Insert(item E) {
 	s.elems[item] = struct{}{}
 }
@@ -26,6 +42,16 @@ func (s *Set[E]) Has(item E) bool {
 	return has
 }
 
+// Len returns the number of elements in the set.
+func (s *Set[E]) Len() int {
+	return len(s.elems)
+}
+
+// Clear removes all the elements from the set.
+func (s *Set[E]) Clear() {
+	clear(s.elems)
+}
+
 func (s *Set[E]) Elems() iter.Seq[E] {
 	return func(yield func(E) bool) {
 		for k := range s.elems {
@@ -72,3 +98,114 @@ func (s *Set[E]) Difference(a *Set[E]) *Set[E] {
 
 	return r
 }
+
+const setMagic uint32 = 'S'<<24 | 'E'<<16 | 'T'<<8 | 'S'
+
+type serializedSetHeader struct {
+	Magic   uint32
+	Version uint32 // currently 1
+	NElems  uint64
+
+	// Followed by the elements in no particular order. Strings are stored as
+	// their byte length (uvarint) and then their bytes, ints and uints as
+	// varints and uvarints, and other fixed size types as their big endian
+	// encoding.
+}
+
+// MarshalBinary encodes the set. The elements have to be strings, ints,
+// uints or of a fixed size, such as the sized integer types or structs of
+// them, otherwise an error is returned.
+func (s *Set[E]) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	hdr := serializedSetHeader{Magic: setMagic, Version: 1, NElems: uint64(len(s.elems))}
+	if err := binary.Write(&buf, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+
+	var e E
+	size := binary.Size(e)
+	for k := range s.elems {
+		// Switch on a pointer to match the element type, not the dynamic
+		// type of an interface element
+		switch p := any(&k).(type) {
+		case *string:
+			buf.Write(binary.AppendUvarint(nil, uint64(len(*p))))
+			buf.WriteString(*p)
+		case *int:
+			buf.Write(binary.AppendVarint(nil, int64(*p)))
+		case *uint:
+			buf.Write(binary.AppendUvarint(nil, uint64(*p)))
+		default:
+			if size < 0 {
+				return nil, fmt.Errorf("elements of type %T can not be serialized", e)
+			}
+			if err := binary.Write(&buf, binary.BigEndian, k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the elements of the set with those encoded in
+// data by MarshalBinary.
+func (s *Set[E]) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var hdr serializedSetHeader
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if err := checkHeader(hdr.Magic, setMagic, hdr.Version, 1, 1); err != nil {
+		return err
+	}
+	// Every element takes at least a byte, unless it is of zero size
+	if hdr.NElems > uint64(r.Len()) && hdr.NElems > 1 {
+		return fmt.Errorf("%w: %d elements in %d bytes", ErrCorrupt, hdr.NElems, r.Len())
+	}
+
+	elems := make(map[E]struct{}, hdr.NElems)
+	for range hdr.NElems {
+		var k E
+		switch p := any(&k).(type) {
+		case *string:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if n > uint64(r.Len()) {
+				return io.ErrUnexpectedEOF
+			}
+			b := make([]byte, n)
+			r.Read(b)
+			*p = string(b)
+		case *int:
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return err
+			}
+			if v < math.MinInt || v > math.MaxInt {
+				return fmt.Errorf("%w: %d is out of range", ErrCorrupt, v)
+			}
+			*p = int(v)
+		case *uint:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if v > math.MaxUint {
+				return fmt.Errorf("%w: %d is out of range", ErrCorrupt, v)
+			}
+			*p = uint(v)
+		default:
+			if err := binary.Read(r, binary.BigEndian, p); err != nil {
+				return err
+			}
+		}
+		elems[k] = struct{}{}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d bytes after the elements", ErrCorrupt, r.Len())
+	}
+	s.elems = elems
+	return nil
+}
@@ -1,6 +1,8 @@
 package emailsearch
 
 import (
+	"errors"
+	"slices"
 	"sort"
 	"testing"
 )
@@ -176,3 +178,89 @@ func compareSliceToSet[E comparable](t *testing.T, expected []E, set *Set[E]) bo
 
 	return true
 }
+
+func TestSetFromLenClear(t *testing.T) {
+	s := NewSetFrom([]int{3, 1, 3, 2})
+	if s.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", s.Len())
+	}
+	for _, e := range []int{1, 2, 3} {
+		if !s.Has(e) {
+			t.Errorf("expected the set to contain %d", e)
+		}
+	}
+
+	s.Clear()
+	if s.Len() != 0 || s.Has(1) {
+		t.Error("expected the cleared set to be empty")
+	}
+	s.Insert(4)
+	if s.Len() != 1 {
+		t.Errorf("Len() = %d after inserting into a cleared set, want 1", s.Len())
+	}
+}
+
+func TestSetMarshalBinary(t *testing.T) {
+	roundTrip := func(t *testing.T, in, out interface {
+		MarshalBinary() ([]byte, error)
+		UnmarshalBinary([]byte) error
+	}) {
+		t.Helper()
+		data, err := in.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := out.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("int", func(t *testing.T) {
+		in := NewSetFrom([]int{0, -5, 1 << 40})
+		out := NewSetFrom([]int{7})
+		roundTrip(t, in, out)
+		got := slices.Sorted(out.Elems())
+		if want := []int{-5, 0, 1 << 40}; !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("string", func(t *testing.T) {
+		in := NewSetFrom([]string{"", "budget", "quarterly report"})
+		var out Set[string]
+		roundTrip(t, in, &out)
+		got := slices.Sorted(out.Elems())
+		if want := []string{"", "budget", "quarterly report"}; !slices.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("fixed size", func(t *testing.T) {
+		type pair struct{ File, Field uint32 }
+		in := NewSetFrom([]pair{{1, 2}, {3, 4}})
+		out := NewSet[pair]()
+		roundTrip(t, in, out)
+		if out.Len() != 2 || !out.Has(pair{1, 2}) || !out.Has(pair{3, 4}) {
+			t.Errorf("got %v", slices.Collect(out.Elems()))
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		if _, err := NewSetFrom([]any{"a"}).MarshalBinary(); err == nil {
+			t.Error("expected elements of an interface type to fail")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		data, err := NewSetFrom([]string{"budget"}).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewSet[string]().UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Error("expected truncated data to fail")
+		}
+		if err := NewSet[string]().UnmarshalBinary(append(data, 0)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("expected trailing data to be corrupt, got %v", err)
+		}
+	})
+}
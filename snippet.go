@@ -0,0 +1,128 @@
+package emailsearch
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Snippet is an excerpt of the body of an email, to preview a search result.
+type Snippet struct {
+	Text    string           // The excerpt
+	Offset  int              // Byte offset of Text in the body
+	Matches []QueryWordMatch // The body matches within Text, with offsets relative to Text
+}
+
+// Snippet returns an excerpt of about width bytes of the body of a file,
+// centered on the cluster of matches that contains the most query words. The
+// excerpt starts and ends on word boundaries. If there are no body matches
+// the excerpt is the start of the body. Only as much of the content as the
+// excerpt needs is decompressed.
+func (idx *Index) Snippet(filenameIdx int, matches []QueryWordMatch, width int) (Snippet, bool) {
+	if filenameIdx < 0 || filenameIdx >= len(idx.contentEntry) || width <= 0 {
+		return Snippet{}, false
+	}
+	release, ok := idx.acquire()
+	if !ok {
+		return Snippet{}, false
+	}
+	defer release()
+	length := int(idx.contentEntry[filenameIdx].Length)
+
+	var body []QueryWordMatch
+	for _, m := range matches {
+		if m.Field == Field_Body && m.Offset+m.Length <= length {
+			body = append(body, m)
+		}
+	}
+	slices.SortFunc(body, func(a, b QueryWordMatch) int { return a.Offset - b.Offset })
+
+	// Place the window so the best cluster is in the middle
+	cluster := bestCluster(body, width)
+	start, end := 0, min(width, length)
+	if len(cluster) > 0 {
+		first, last := cluster[0].Offset, cluster[len(cluster)-1].Offset+cluster[len(cluster)-1].Length
+		start = max(first-(width-(last-first))/2, 0)
+		end = min(start+width, length)
+		start = max(end-width, 0)
+	}
+
+	dr, ok := idx.openContent(filenameIdx)
+	if !ok {
+		return Snippet{}, false
+	}
+	defer dr.Close()
+
+	// Read a little beyond the window to find the end of the last word
+	buf := make([]byte, min(end+snippetSlop, length))
+	if _, err := io.ReadFull(dr, buf); err != nil {
+		return Snippet{}, false
+	}
+
+	// Trim partial words from either end, without cutting into the cluster
+	clusterStart, clusterEnd := end, start
+	if len(cluster) > 0 {
+		clusterStart, clusterEnd = cluster[0].Offset, cluster[len(cluster)-1].Offset+cluster[len(cluster)-1].Length
+	}
+	if start > 0 && !isSpace(buf[start-1]) {
+		if i := bytes.IndexFunc(buf[start:clusterStart], isSpaceRune); i >= 0 {
+			start += i
+		}
+	}
+	if end < len(buf) && !isSpace(buf[end]) {
+		if i := bytes.IndexFunc(buf[end:], isSpaceRune); i >= 0 {
+			end += i
+		} else if len(buf) == length {
+			end = length
+		} else if i := bytes.LastIndexFunc(buf[clusterEnd:end], isSpaceRune); i >= 0 {
+			end = clusterEnd + i
+		}
+	}
+	text := strings.TrimRightFunc(string(buf[start:end]), isSpaceRune)
+	trimmed := strings.TrimLeftFunc(text, isSpaceRune)
+	start += len(text) - len(trimmed)
+	text = trimmed
+
+	snip := Snippet{Text: text, Offset: start}
+	for _, m := range body {
+		if m.Offset >= start && m.Offset+m.Length <= start+len(text) {
+			m.Offset -= start
+			snip.Matches = append(snip.Matches, m)
+		}
+	}
+	return snip, true
+}
+
+// snippetSlop is how far past the end of a snippet to look for the end of
+// the last word.
+const snippetSlop = 32
+
+// bestCluster returns the run of matches, sorted by offset, that fits within
+// width bytes and contains the most different words, preferring the most
+// matches and then the earliest.
+func bestCluster(matches []QueryWordMatch, width int) []QueryWordMatch {
+	var (
+		best                []QueryWordMatch
+		bestWords, bestSize int
+	)
+	for i := range matches {
+		words := make(map[string]bool)
+		j := i
+		for ; j < len(matches) && matches[j].Offset+matches[j].Length-matches[i].Offset <= width; j++ {
+			words[strings.ToLower(matches[j].Word)] = true
+		}
+		if len(words) > bestWords || (len(words) == bestWords && j-i > bestSize) {
+			best, bestWords, bestSize = matches[i:j], len(words), j-i
+		}
+	}
+	return best
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func isSpaceRune(r rune) bool {
+	return r < 0x80 && isSpace(byte(r))
+}
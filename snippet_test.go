@@ -0,0 +1,75 @@
+package emailsearch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnippet(t *testing.T) {
+	filler := strings.Repeat("nothing to see here. ", 20)
+	body := filler + "The quarterly budget was approved. " + filler + "Please review the budget forecast today. " + filler
+	idx := buildTestIndex(t, map[string]string{"1": "Subject: budget\n\n" + body})
+
+	results, err := idx.Search(t.Context(), ParseQuery("budget forecast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+
+	snip, ok := idx.Snippet(results[0].FilenameIndex, results[0].WordMatches, 60)
+	if !ok {
+		t.Fatal("expected a snippet")
+	}
+	if !strings.Contains(snip.Text, "budget forecast") {
+		t.Errorf("expected the snippet to contain the cluster, got %q", snip.Text)
+	}
+	if len(snip.Text) > 60+snippetSlop {
+		t.Errorf("snippet is too long, %d bytes", len(snip.Text))
+	}
+	if body[snip.Offset:snip.Offset+len(snip.Text)] != snip.Text {
+		t.Errorf("snippet offset %d does not locate %q in the body", snip.Offset, snip.Text)
+	}
+	for _, s := range []string{snip.Text[:1], snip.Text[len(snip.Text)-1:]} {
+		if s == " " {
+			t.Errorf("expected the snippet to be trimmed, got %q", snip.Text)
+		}
+	}
+	if start := snip.Offset; start > 0 && body[start-1] != ' ' {
+		t.Errorf("expected the snippet to start on a word boundary, got %q", snip.Text)
+	}
+	if end := snip.Offset + len(snip.Text); end < len(body) && body[end] != ' ' && body[end] != '\n' {
+		t.Errorf("expected the snippet to end on a word boundary, got %q", snip.Text)
+	}
+
+	if len(snip.Matches) != 2 {
+		t.Fatalf("expected 2 matches in the snippet, got %+v", snip.Matches)
+	}
+	for _, m := range snip.Matches {
+		if got := snip.Text[m.Offset : m.Offset+m.Length]; !strings.EqualFold(got, m.Word) {
+			t.Errorf("expected match %q at offset %d, got %q", m.Word, m.Offset, got)
+		}
+	}
+
+	// Without matches the snippet is the start of the body
+	snip, ok = idx.Snippet(results[0].FilenameIndex, nil, 30)
+	if !ok || snip.Offset != 0 || !strings.HasPrefix(body, snip.Text) {
+		t.Errorf("expected the start of the body, got %+v", snip)
+	}
+
+	// A snippet wider than the email is all of it
+	short := buildTestIndex(t, map[string]string{"1": "Subject: short\n\nA short budget.\n"})
+	results, err = short.Search(t.Context(), Term("budget"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snip, ok = short.Snippet(results[0].FilenameIndex, results[0].WordMatches, 200)
+	if !ok || snip.Text != "A short budget." {
+		t.Errorf("expected the whole body, got %+v", snip)
+	}
+
+	if _, ok := idx.Snippet(-1, nil, 60); ok {
+		t.Error("expected no snippet for an invalid file index")
+	}
+}
@@ -0,0 +1,199 @@
+package emailsearch
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite" // Registers the sqlite driver
+)
+
+// An index can also be stored in a SQLite database, so that it can be
+// backed up, inspected and updated with standard SQLite tooling. Every file
+// of the index is a row of the index_files table:
+//
+//	CREATE TABLE index_files (name TEXT PRIMARY KEY, data BLOB NOT NULL)
+//
+// e.g. `SELECT name, length(data) FROM index_files` lists the files, and
+// metadata.json can be queried with SQLite's JSON functions. SQLite limits a
+// blob to 1GB, larger catalogs must be sharded with MaxCatalogShardSize.
+// LoadIndexFromDisk accepts a database as well as a directory or bundle.
+// Files are read into memory when the index is loaded, rather than memory
+// mapped, so a database index uses more memory than the other forms.
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS index_files (name TEXT PRIMARY KEY, data BLOB NOT NULL)`
+
+// sqliteMagic starts every SQLite database file
+const sqliteMagic = "SQLite format 3\x00"
+
+// SQLiteFS is a WriteFS that writes the files of an index into a SQLite
+// database, replacing any index already in it. The files are written in a
+// single transaction, which Close commits.
+type SQLiteFS struct {
+	tx *sql.Tx
+}
+
+// NewSQLiteFS returns a SQLiteFS that writes to db.
+func NewSQLiteFS(db *sql.DB) (*SQLiteFS, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(sqliteSchema); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM index_files`); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &SQLiteFS{tx: tx}, nil
+}
+
+func (s *SQLiteFS) Create(name string) (io.WriteCloser, error) {
+	return &sqliteFile{s: s, name: name}, nil
+}
+
+// Close commits the files to the database. It does not close the database.
+func (s *SQLiteFS) Close() error {
+	return s.tx.Commit()
+}
+
+// sqliteFile buffers a file until it is closed, SQLite writes a blob in one
+// go.
+type sqliteFile struct {
+	s      *SQLiteFS
+	name   string
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (f *sqliteFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	return f.buf.Write(p)
+}
+
+func (f *sqliteFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	_, err := f.s.tx.Exec(`INSERT OR REPLACE INTO index_files (name, data) VALUES (?, ?)`, f.name, f.buf.Bytes())
+	return err
+}
+
+// SerializeSQLite writes the index files into a SQLite database at path.
+// The database is written to a temporary file that then replaces path, so
+// a search server never sees a partly written index.
+func (ib *IndexBuilder) SerializeSQLite(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp) // Fails harmlessly once renamed
+
+	db, err := sql.Open("sqlite", tmp)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sfs, err := NewSQLiteFS(db)
+	if err != nil {
+		return err
+	}
+	if err := ib.SerializeTo(sfs); err != nil {
+		sfs.tx.Rollback()
+		return err
+	}
+	if err := sfs.Close(); err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// isSQLite reports whether the file at path is a SQLite database.
+func isSQLite(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(sqliteMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil // Too short to be a database
+	}
+	return string(magic) == sqliteMagic, nil
+}
+
+// sqliteSource is an index stored in a SQLite database.
+type sqliteSource struct {
+	path string
+	db   *sql.DB
+}
+
+func openSQLite(path string) (*sqliteSource, error) {
+	db, err := sql.Open("sqlite", "file:"+url.PathEscape(path)+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &sqliteSource{path: path, db: db}, nil
+}
+
+func (s *sqliteSource) Open(name string) (indexFile, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM index_files WHERE name = ?`, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &fs.PathError{Op: "open", Path: s.path + ":" + name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return newMemFile(data), nil
+}
+
+func (s *sqliteSource) Close() error {
+	return s.db.Close()
+}
+
+// memFile is a file of an index held in memory.
+type memFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newMemFile(data []byte) memFile {
+	return memFile{bytes.NewReader(data), data}
+}
+
+func (m memFile) Len() int     { return int(m.Size()) }
+func (m memFile) Close() error { return nil }
+
+// slice returns the n bytes at off without copying them.
+func (m memFile) slice(off, n int64) ([]byte, bool) {
+	if off < 0 || n < 0 || off+n > int64(len(m.data)) {
+		return nil, false
+	}
+	return m.data[off : off+n], true
+}
@@ -0,0 +1,64 @@
+package emailsearch
+
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLite(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\n\nThe quarterly budget presentation.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+	dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1, MaxCatalogShardSize: 1}, emails)
+	ib := &IndexBuilder{}
+	ib.Init()
+	if err := ib.mergeIndexes([]string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "index db.sqlite") // Space to check the path is escaped
+	if err := ib.SerializeSQLite(path); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := LoadIndexFromDisk(path, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := idx.QueryIndex(t.Context(), []string{"lunch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Filename != "2" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	content, _, ok := idx.CatalogContent(t.Context(), results[0].FilenameIndex)
+	if !ok || string(content) != "Lunch on Friday.\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if len(idx.shardRdrs) != 2 || len(idx.IndexMetadata().Checksums) == 0 {
+		t.Errorf("expected 2 shards and checksums, got %d shards", len(idx.shardRdrs))
+	}
+	idx.Close()
+
+	// The files are rows that standard tooling can get at
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM index_files WHERE name = ?`, CorpusIndex).Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected a row for %s, got %d (%v)", CorpusIndex, n, err)
+	}
+
+	// Writing over a database replaces the index in it
+	if err := ib.SerializeSQLite(path); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := VerifyIndex(path); err != nil || !report.OK() {
+		t.Errorf("expected the database to verify, got %v (%v)", report, err)
+	}
+}
@@ -0,0 +1,142 @@
+package emailsearch
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// IndexStats describes the memory used by a loaded index. The sizes of the
+// in memory tables are estimates, they count the data and the slice and
+// string headers that hold it but not allocator overhead.
+type IndexStats struct {
+	Filenames   TableStats // The filenames string table
+	Words       TableStats // The words string table
+	WordOffsets TableStats // The word offsets table and the map of words to offsets
+	Labels      TableStats // The labels string table and the labels of every document
+	Documents   TableStats // The catalog entries and document lengths
+	Facets      TableStats // The sender and directory of every document, for facets
+	TrieNodes   int        // Nodes in the prefix tree
+	Trie        int64      // Bytes of the prefix tree, 0 if it is searched in place
+
+	// Files holds the size of each file that is read in place rather than
+	// loaded, by name. They are memory mapped, so they use page cache rather
+	// than heap. A SQLite index, or one loaded with LoadOptions.InMemory,
+	// holds them in memory instead.
+	Files map[string]int64
+}
+
+// TableStats is the number of entries in a table and the bytes it uses.
+type TableStats struct {
+	Entries int
+	Bytes   int64
+}
+
+// mapEntryBytes estimates the bytes used by each entry of a map of strings to
+// an int, a string header, the value and the bucket overhead.
+const mapEntryBytes = int64(unsafe.Sizeof("")+unsafe.Sizeof(int64(0))) * 5 / 4
+
+// Stats returns the memory used by idx. The prefix tree and the facets only
+// count once they have finished loading in the background.
+func (idx *Index) Stats() IndexStats {
+	s := IndexStats{
+		Filenames: idx.filenames.stats(),
+		Words:     idx.words.stats(),
+		WordOffsets: TableStats{
+			Entries: len(idx.offsets),
+			Bytes:   int64(len(idx.offsets))*int64(unsafe.Sizeof(serializedWordIndexOffset{})) + 8*int64(len(idx.wordOffsets)),
+		},
+		Labels: stringsStats(idx.labels),
+		Documents: TableStats{
+			Entries: len(idx.contentEntry),
+			Bytes:   int64(len(idx.contentEntry))*int64(unsafe.Sizeof(catalogContentEntry{})) + 4*int64(len(idx.docLens)),
+		},
+		Files: make(map[string]int64),
+	}
+	s.Labels.Bytes += 4 * int64(len(idx.docLabelStart)+len(idx.docLabels))
+
+	loaded := idx.prefixTreeReady == nil
+	if !loaded {
+		select {
+		case <-idx.prefixTreeReady:
+			loaded = true
+		default:
+		}
+	}
+	if trie := idx.prefixTree; loaded && trie != nil {
+		s.TrieNodes = int(trie.numNodes)
+		s.Trie = int64(len(trie.nodes))*int64(unsafe.Sizeof(trieNode{})) + int64(len(trie.labels))
+		if idx.trieRdr != nil {
+			s.Files[QueryPrefixTree] = int64(idx.trieRdr.Len())
+		}
+	}
+
+	if idx.facetColsReady != nil {
+		select {
+		case <-idx.facetColsReady:
+			if cols := idx.facetCols; cols != nil {
+				s.Facets = stringsStats(cols.senderNames)
+				dirs := stringsStats(cols.dirNames)
+				s.Facets.Entries = len(cols.senders)
+				s.Facets.Bytes += dirs.Bytes + 4*int64(len(cols.senders)+len(cols.dirs))
+			}
+		default:
+		}
+	}
+
+	if idx.filenames != nil && idx.filenames.r != nil {
+		s.Files[FilenamesStringTable] = idx.filenames.size
+	}
+	if idx.words != nil && idx.words.r != nil {
+		s.Files[WordsStringTable] = idx.words.size
+	}
+	if idx.indexRdr != nil {
+		s.Files[CorpusIndex] = int64(idx.indexRdr.Len())
+	}
+	if idx.catalogRdr != nil {
+		s.Files[CorpusCatalog] = int64(idx.catalogRdr.Len())
+	}
+	for n, shard := range idx.shardRdrs {
+		s.Files[CatalogShardName(n)] = int64(shard.Len())
+	}
+	return s
+}
+
+// stats returns the size of the table if it is in memory, with the map to
+// find strings in it. A table read in place only counts as a file.
+func (t *stringTable) stats() TableStats {
+	if t == nil || t.r != nil {
+		return TableStats{Entries: t.Len()}
+	}
+	s := stringsStats(t.strs)
+	s.Bytes += int64(len(t.lookup)) * mapEntryBytes
+	return s
+}
+
+func stringsStats(strs []string) TableStats {
+	t := TableStats{Entries: len(strs), Bytes: int64(len(strs)) * int64(unsafe.Sizeof(""))}
+	for _, s := range strs {
+		t.Bytes += int64(len(s))
+	}
+	return t
+}
+
+// HeapBytes returns the bytes of the tables loaded into memory.
+func (s IndexStats) HeapBytes() int64 {
+	return s.Filenames.Bytes + s.Words.Bytes + s.WordOffsets.Bytes + s.Labels.Bytes + s.Documents.Bytes + s.Facets.Bytes + s.Trie
+}
+
+// FileBytes returns the bytes of the files read in place.
+func (s IndexStats) FileBytes() int64 {
+	var n int64
+	for _, size := range s.Files {
+		n += size
+	}
+	return n
+}
+
+func (s IndexStats) String() string {
+	return fmt.Sprintf("%s in memory (filenames %s, words %s, word offsets %s, labels %s, documents %s, facets %s, prefix tree %s), %s of files mapped",
+		memPretty(uint64(s.HeapBytes())), memPretty(uint64(s.Filenames.Bytes)), memPretty(uint64(s.Words.Bytes)),
+		memPretty(uint64(s.WordOffsets.Bytes)), memPretty(uint64(s.Labels.Bytes)), memPretty(uint64(s.Documents.Bytes)),
+		memPretty(uint64(s.Facets.Bytes)), memPretty(uint64(s.Trie)), memPretty(uint64(s.FileBytes())))
+}
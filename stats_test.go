@@ -0,0 +1,35 @@
+package emailsearch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\nX-Gmail-Labels: Inbox\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+	}
+	idx := buildTestIndex(t, emails)
+	idx.trie() // Wait for the prefix tree to load
+	s := idx.Stats()
+
+	if s.Filenames.Entries != 2 || s.Words.Entries != idx.words.Len() || s.WordOffsets.Entries != idx.words.Len() || s.Documents.Entries != 2 {
+		t.Errorf("unexpected entry counts %+v", s)
+	}
+	if s.Labels.Entries != 1 {
+		t.Errorf("expected 1 label, got %d", s.Labels.Entries)
+	}
+	if s.Words.Bytes != 0 || s.Files[WordsStringTable] <= int64(len("quarterly")) || s.TrieNodes == 0 || s.Trie != 0 || s.Files[QueryPrefixTree] == 0 {
+		t.Errorf("expected the tables to take space, got %+v", s)
+	}
+	if s.Files[CorpusIndex] != int64(idx.indexRdr.Len()) || s.Files[CorpusCatalog] != int64(idx.catalogRdr.Len()) {
+		t.Errorf("unexpected file sizes %v", s.Files)
+	}
+	if s.HeapBytes() < s.Words.Bytes || s.FileBytes() != s.Files[CorpusIndex]+s.Files[CorpusCatalog]+s.Files[QueryPrefixTree]+s.Files[FilenamesStringTable]+s.Files[WordsStringTable] {
+		t.Errorf("unexpected totals %d and %d", s.HeapBytes(), s.FileBytes())
+	}
+	if str := s.String(); !strings.Contains(str, "in memory") {
+		t.Errorf("unexpected summary %q", str)
+	}
+}
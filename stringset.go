@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"io"
 	"math"
 	"os"
+	"slices"
+	"strings"
 )
 
 var errTooBigToSave = errors.New("the capacity of the stringset exceeds disk format")
@@ -14,18 +17,18 @@ const stringSetMagic uint32 = 'S'<<24 | 'T'<<16 | 'R'<<8 | 'S'
 
 type serializedStringSetHeader struct {
 	Magic    uint32
-	Version  uint32 // currently 1
+	Version  uint32 // currently 2
 	NStrings uint32
 	MaxLen   uint16
 
-	// Followed by each string one after the other
-	// Each string is of the form byte length (int16) and then the bytes of the string
-	// Strings are stored as UTF-8
+	// Followed by the offsets of the strings, their sorted order and the
+	// strings, see stringtable.go
 }
 
 type StringSet struct {
 	strings map[string]int
-	index   int
+	order   []string // The strings in insertion order, "" where removed
+	maxlen  int
 }
 
 func NewStringSet() *StringSet {
@@ -39,12 +42,28 @@ func (ss *StringSet) Insert(s string) int {
 	if idx, ok := ss.strings[s]; ok {
 		return idx
 	}
-	idx := ss.index
+	idx := len(ss.order)
 	ss.strings[s] = idx
-	ss.index = ss.index + 1
+	ss.order = append(ss.order, s)
+	ss.maxlen = max(ss.maxlen, len(s))
 	return idx
 }
 
+// Remove a string from the set and return the index it had. Returns false if
+// the string is not in the set. The indices of the other strings don't
+// change, and the index is not reused, so that references to them, like the
+// file indices in the postings, stay valid. The removed string is left as an
+// empty string when the set is flattened or serialized.
+func (ss *StringSet) Remove(s string) (int, bool) {
+	idx, ok := ss.strings[s]
+	if !ok {
+		return 0, false
+	}
+	delete(ss.strings, s)
+	ss.order[idx] = ""
+	return idx, true
+}
+
 // Return the index of a string in the set. Returns false if the word is not
 // in the set.
 func (ss *StringSet) Index(s string) (int, bool) {
@@ -52,52 +71,76 @@ func (ss *StringSet) Index(s string) (int, bool) {
 	return idx, ok
 }
 
+// Len returns the number of strings in the set.
+func (ss *StringSet) Len() int {
+	return len(ss.strings)
+}
+
 // Flattens the set and returns it as an array of strings in insertion order
 func (ss *StringSet) Flatten() ([]string, int) {
-	maxlen := 0
-	sa := make([]string, len(ss.strings))
-	for str, index := range ss.strings {
-		sa[index] = str
-		maxlen = max(maxlen, len(str))
-	}
-
-	return sa, maxlen
+	return slices.Clone(ss.order), ss.maxlen
 }
 
 // Persists the stringset to filepath. The format is binary.
 func (ss *StringSet) Serialize(outpath string) error {
-	strings, maxlen := ss.Flatten()
-
-	if len(strings) > math.MaxUint32 || maxlen >= math.MaxUint16 {
-		return errTooBigToSave
-	}
-
 	f, err := os.Create(outpath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	wr := bufio.NewWriter(f)
+	if err := ss.SerializeTo(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// SerializeTo writes the set to w in the same format as Serialize. The
+// strings are streamed to w as they are encoded, nothing is copied.
+func (ss *StringSet) SerializeTo(w io.Writer) error {
+	if len(ss.order) > math.MaxUint32 || ss.maxlen >= math.MaxUint16 {
+		return errTooBigToSave
+	}
+
+	wr := bufio.NewWriter(w)
 
 	hdr := serializedStringSetHeader{
 		Magic:    stringSetMagic,
-		Version:  1,
-		NStrings: uint32(len(strings)),
-		MaxLen:   uint16(maxlen),
+		Version:  stringTableVersion,
+		NStrings: uint32(len(ss.order)),
+		MaxLen:   uint16(ss.maxlen),
 	}
 	if err := binary.Write(wr, binary.BigEndian, &hdr); err != nil {
 		return err
 	}
 
-	scratch := [binary.MaxVarintLen16]byte{}
-	for _, str := range strings {
-		// Write out length as a varint
-		n := binary.PutUvarint(scratch[:], uint64(len(str)))
-		if _, err := wr.Write(scratch[0:n]); err != nil {
+	// The offset of each string in the string data, and the end
+	scratch := [8]byte{}
+	var off uint64
+	for i := 0; i <= len(ss.order); i++ {
+		binary.BigEndian.PutUint64(scratch[:], off)
+		if _, err := wr.Write(scratch[:]); err != nil {
 			return err
 		}
+		if i < len(ss.order) {
+			off += uint64(len(ss.order[i]))
+		}
+	}
+
+	// The indices of the strings in sorted order
+	sorted := make([]uint32, len(ss.order))
+	for i := range sorted {
+		sorted[i] = uint32(i)
+	}
+	slices.SortFunc(sorted, func(a, b uint32) int { return strings.Compare(ss.order[a], ss.order[b]) })
+	for _, i := range sorted {
+		binary.BigEndian.PutUint32(scratch[:], i)
+		if _, err := wr.Write(scratch[:4]); err != nil {
+			return err
+		}
+	}
 
+	for _, str := range ss.order {
 		// The WriteString only writes out the contents of the string, there is
 		// no preceding fields or trailing zero byte.
 		if _, err := wr.WriteString(str); err != nil {
@@ -105,5 +148,5 @@ func (ss *StringSet) Serialize(outpath string) error {
 		}
 	}
 
-	return wr.Flush() // close will be called after in the defer
+	return wr.Flush()
 }
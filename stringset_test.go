@@ -0,0 +1,48 @@
+package emailsearch
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestStringSetRemove(t *testing.T) {
+	ss := NewStringSet()
+	for _, s := range []string{"a.eml", "b.eml", "c.eml"} {
+		ss.Insert(s)
+	}
+
+	if idx, ok := ss.Remove("b.eml"); !ok || idx != 1 {
+		t.Errorf("Remove(b.eml) = %d, %t, want 1, true", idx, ok)
+	}
+	if _, ok := ss.Remove("b.eml"); ok {
+		t.Error("expected removing a string twice to fail")
+	}
+	if _, ok := ss.Index("b.eml"); ok {
+		t.Error("expected the removed string to not be in the set")
+	}
+	if ss.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", ss.Len())
+	}
+
+	// The other strings keep their indices and new ones get fresh indices
+	if idx, _ := ss.Index("c.eml"); idx != 2 {
+		t.Errorf("Index(c.eml) = %d, want 2", idx)
+	}
+	if idx := ss.Insert("b.eml"); idx != 3 {
+		t.Errorf("Insert(b.eml) = %d, want 3", idx)
+	}
+
+	var buf bytes.Buffer
+	if err := ss.SerializeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadStringTable(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.eml", "", "c.eml", "b.eml"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,298 @@
+package emailsearch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// String table format, written by StringSet.SerializeTo
+//
+// 0x00: u32 Magic 'STRS'
+// 0x04: u32 Version number (currently 2)
+// 0x08: u32 Number of strings (N)
+// 0x0C: u16 Byte length of the longest string
+// 0x0E: u64 Offset of string 0 in the string data
+// ....: u64 Offset of string N-1, then the length of the string data
+// ....: u32 Index of the first string in sorted order
+// ....: u32 Index of the last string in sorted order
+// ....: String data, the strings one after the other in UTF-8
+//
+// A string is found by its index or, with the sorted order, by binary
+// search, without reading the others. Version 1 tables have neither table,
+// each string is preceded by its byte length as a uvarint, so they have to
+// be read in full. All integers are big endian.
+
+const stringTableVersion = 2
+
+var serializedStringSetHeaderSize = int64(binary.Size(serializedStringSetHeader{}))
+
+// stringTable is a loaded string table. The strings are either read into
+// memory, or read from the file as they are needed.
+type stringTable struct {
+	strs   []string       // The strings, if they are in memory
+	lookup map[string]int // Index of each of strs
+
+	r      io.ReaderAt // Otherwise the table is read in place from r
+	n      int         // Number of strings in r
+	sorted int64       // Offset of the sorted order in r
+	data   int64       // Offset of the string data in r
+	size   int64       // Size of r
+}
+
+// newStringTable returns a table of strs held in memory.
+func newStringTable(strs []string) *stringTable {
+	t := &stringTable{strs: strs, lookup: make(map[string]int, len(strs))}
+	for i, s := range strs {
+		t.lookup[s] = i
+	}
+	return t
+}
+
+// openStringTable opens the string table name of src. If inPlace is true
+// a version 2 table is read in place, and the file is returned to be closed
+// with the index. Otherwise the table is read into memory.
+func openStringTable(src indexSource, name string, inPlace bool) (*stringTable, indexFile, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return nil, nil, fileError(name, err)
+	}
+
+	var hdr serializedStringSetHeader
+	err = binary.Read(io.NewSectionReader(f, 0, serializedStringSetHeaderSize), binary.BigEndian, &hdr)
+	if err == nil {
+		err = checkHeader(hdr.Magic, stringSetMagic, hdr.Version, 1, stringTableVersion)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fileError(name, err)
+	}
+
+	if !inPlace || hdr.Version < 2 {
+		defer f.Close()
+		strs, err := loadStringTable(bufio.NewReader(io.NewSectionReader(f, 0, int64(f.Len()))))
+		if err != nil {
+			return nil, nil, fileError(name, err)
+		}
+		return newStringTable(strs), nil, nil
+	}
+
+	t, err := readStringTableInPlace(f, hdr)
+	if err != nil {
+		f.Close()
+		return nil, nil, fileError(name, err)
+	}
+	return t, f, nil
+}
+
+// readStringTableInPlace returns the version 2 table in f, with header hdr,
+// to be read in place. The offsets and the sorted order are checked to be
+// in range, so that reading a string can't fail later.
+func readStringTableInPlace(f indexFile, hdr serializedStringSetHeader) (*stringTable, error) {
+	n := int64(hdr.NStrings)
+	t := &stringTable{r: f, n: int(n), size: int64(f.Len())}
+	t.sorted = serializedStringSetHeaderSize + 8*(n+1)
+	t.data = t.sorted + 4*n
+	if t.data > t.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rdr := bufio.NewReader(io.NewSectionReader(f, serializedStringSetHeaderSize, t.data-serializedStringSetHeaderSize))
+	var (
+		b    [8]byte
+		prev uint64
+	)
+	for i := range n + 1 {
+		if _, err := io.ReadFull(rdr, b[:]); err != nil {
+			return nil, err
+		}
+		off := binary.BigEndian.Uint64(b[:])
+		if (i == 0 && off != 0) || off < prev || off-prev > uint64(hdr.MaxLen) {
+			return nil, &CorruptError{Err: fmt.Errorf("offset of string %d is out of range", i)}
+		}
+		prev = off
+	}
+	if prev != uint64(t.size-t.data) {
+		return nil, &CorruptError{Err: fmt.Errorf("%d bytes of strings, expected %d", t.size-t.data, prev)}
+	}
+	for range n {
+		if _, err := io.ReadFull(rdr, b[:4]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(b[:]) >= uint32(n) {
+			return nil, &CorruptError{Err: errors.New("sorted order is out of range")}
+		}
+	}
+	return t, nil
+}
+
+// Len returns the number of strings in the table. A nil table is empty.
+func (t *stringTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	if t.r == nil {
+		return len(t.strs)
+	}
+	return t.n
+}
+
+// At returns string i of the table.
+func (t *stringTable) At(i int) string {
+	if t.r == nil {
+		return t.strs[i]
+	}
+	return string(t.appendAt(nil, i))
+}
+
+// appendAt appends the bytes of string i of a table read in place to b.
+// The offsets were checked when the table was opened, so reads only fail
+// if the file changes, and then the string is empty.
+func (t *stringTable) appendAt(b []byte, i int) []byte {
+	var offs [16]byte
+	if _, err := t.r.ReadAt(offs[:], serializedStringSetHeaderSize+8*int64(i)); err != nil {
+		return b
+	}
+	start, end := binary.BigEndian.Uint64(offs[:]), binary.BigEndian.Uint64(offs[8:])
+	b = slices.Grow(b, int(end-start))
+	s := b[len(b) : len(b)+int(end-start)]
+	if _, err := t.r.ReadAt(s, t.data+int64(start)); err != nil {
+		return b
+	}
+	return b[:len(b)+len(s)]
+}
+
+// sortedAt returns the index of the i'th string in sorted order of a table
+// read in place.
+func (t *stringTable) sortedAt(i int) int {
+	var b [4]byte
+	if _, err := t.r.ReadAt(b[:], t.sorted+4*int64(i)); err != nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(b[:]))
+}
+
+// Find returns the index of s in the table, and false if it isn't there.
+func (t *stringTable) Find(s string) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+	if t.r == nil {
+		i, ok := t.lookup[s]
+		return i, ok
+	}
+
+	// Binary search the sorted order, reading each string into scratch
+	var scratch [64]byte
+	lo, hi := 0, t.n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		i := t.sortedAt(mid)
+		str := t.appendAt(scratch[:0], i)
+		switch {
+		case string(str) == s:
+			return i, true
+		case string(str) < s:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+// All returns the index and string of every entry in the table, in index
+// order.
+func (t *stringTable) All() iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
+		for i := range t.Len() {
+			if !yield(i, t.At(i)) {
+				return
+			}
+		}
+	}
+}
+
+// sortedOrder returns the indices of the strings in sorted order.
+func (t *stringTable) sortedOrder() []int {
+	order := make([]int, t.Len())
+	if t.r != nil {
+		for i := range order {
+			order[i] = t.sortedAt(i)
+		}
+		return order
+	}
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return strings.Compare(t.strs[a], t.strs[b]) })
+	return order
+}
+
+// loadStringTable loads a serialized string table and returns it as
+// []string. The order of entries in []string matches that in the file.
+func loadStringTable(rdr *bufio.Reader) ([]string, error) {
+	hdr := serializedStringSetHeader{}
+	if err := binary.Read(rdr, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+
+	if err := checkHeader(hdr.Magic, stringSetMagic, hdr.Version, 1, stringTableVersion); err != nil {
+		return nil, err
+	}
+
+	strings := make([]string, hdr.NStrings)
+	scratch := make([]byte, hdr.MaxLen)
+
+	if hdr.Version >= 2 {
+		// The lengths come from the offsets, the sorted order isn't needed
+		lens := make([]uint16, hdr.NStrings)
+		var b [8]byte
+		var prev uint64
+		for i := range int(hdr.NStrings) + 1 {
+			if _, err := io.ReadFull(rdr, b[:]); err != nil {
+				return nil, err
+			}
+			off := binary.BigEndian.Uint64(b[:])
+			if (i == 0 && off != 0) || off < prev || off-prev > uint64(hdr.MaxLen) {
+				return nil, &CorruptError{Err: fmt.Errorf("offset of string %d is out of range", i)}
+			}
+			if i > 0 {
+				lens[i-1] = uint16(off - prev)
+			}
+			prev = off
+		}
+		if _, err := rdr.Discard(4 * int(hdr.NStrings)); err != nil {
+			return nil, err
+		}
+		for i, n := range lens {
+			if _, err := io.ReadFull(rdr, scratch[:n]); err != nil {
+				return nil, err
+			}
+			strings[i] = string(scratch[:n])
+		}
+		return strings, nil
+	}
+
+	for i := range hdr.NStrings {
+		slen, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return nil, err
+		}
+		if slen > uint64(hdr.MaxLen) {
+			return nil, &CorruptError{Err: fmt.Errorf("string %d is longer than the longest string", i)}
+		}
+
+		if _, err := io.ReadFull(rdr, scratch[:slen]); err != nil {
+			return nil, err
+		}
+		strings[i] = string(scratch[:slen])
+	}
+
+	return strings, nil
+}
@@ -0,0 +1,131 @@
+package emailsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// tableStrings returns the strings of t in index order.
+func tableStrings(t *stringTable) []string {
+	strs := make([]string, 0, t.Len())
+	for _, s := range t.All() {
+		strs = append(strs, s)
+	}
+	return strs
+}
+
+// writeStringTable serializes strs to name in a new directory and returns
+// the directory as an index source.
+func writeStringTable(t *testing.T, name string, strs ...string) dirSource {
+	ss := NewStringSet()
+	for _, s := range strs {
+		ss.Insert(s)
+	}
+	var buf bytes.Buffer
+	if err := ss.SerializeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dirSource(dir)
+}
+
+func TestStringTable(t *testing.T) {
+	strs := []string{"forecast", "budget", "lunch", "", "zebra", "apple"}
+	src := writeStringTable(t, WordsStringTable, strs...)
+
+	for _, inPlace := range []bool{false, true} {
+		table, f, err := openStringTable(src, WordsStringTable, inPlace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inPlace != (f != nil) {
+			t.Errorf("inPlace %t: expected the file to be kept only when read in place", inPlace)
+		}
+
+		if got := tableStrings(table); !slices.Equal(got, strs) {
+			t.Errorf("inPlace %t: got %q, want %q", inPlace, got, strs)
+		}
+		for i, s := range strs {
+			if got := table.At(i); got != s {
+				t.Errorf("inPlace %t: At(%d) = %q, want %q", inPlace, i, got, s)
+			}
+			if got, ok := table.Find(s); !ok || got != i {
+				t.Errorf("inPlace %t: Find(%q) = %d, %t, want %d, true", inPlace, s, got, ok, i)
+			}
+		}
+		for _, s := range []string{"aardvark", "budgets", "zzz"} {
+			if _, ok := table.Find(s); ok {
+				t.Errorf("inPlace %t: expected Find(%q) to fail", inPlace, s)
+			}
+		}
+
+		var sorted []string
+		for _, i := range table.sortedOrder() {
+			sorted = append(sorted, table.At(i))
+		}
+		if !slices.IsSorted(sorted) || len(sorted) != len(strs) {
+			t.Errorf("inPlace %t: expected the strings in sorted order, got %q", inPlace, sorted)
+		}
+
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func TestStringTableVersion1(t *testing.T) {
+	// Version 1 tables are read into memory even when asked to read in place
+	strs := []string{"budget", "forecast"}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, serializedStringSetHeader{stringSetMagic, 1, uint32(len(strs)), 8})
+	for _, s := range strs {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		buf.WriteString(s)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, WordsStringTable), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, f, err := openStringTable(dirSource(dir), WordsStringTable, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Error("expected a version 1 table to be read into memory")
+	}
+	if got := tableStrings(table); !slices.Equal(got, strs) {
+		t.Errorf("got %q, want %q", got, strs)
+	}
+}
+
+func TestStringTableCorrupt(t *testing.T) {
+	src := writeStringTable(t, WordsStringTable, "budget", "forecast")
+	path := filepath.Join(string(src), WordsStringTable)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the second string past the end of the string data
+	binary.BigEndian.PutUint64(data[serializedStringSetHeaderSize+8:], 1000)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inPlace := range []bool{false, true} {
+		_, _, err := openStringTable(src, WordsStringTable, inPlace)
+		var cerr *CorruptError
+		if !errors.As(err, &cerr) || cerr.File != WordsStringTable {
+			t.Errorf("inPlace %t: expected a CorruptError for %s, got %v", inPlace, WordsStringTable, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package emailsearch
+
+import (
+	"iter"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Suggestion is a correction for a misspelled query word.
+type Suggestion struct {
+	Word       string // The query word, which is not in the index
+	Correction string // The index word it was probably meant to be
+}
+
+// Suggest returns corrections for the words of q that are not in the index,
+// for a "did you mean" prompt. Words that are excluded with Not, wildcards
+// and labels are not corrected. The correction for a word is the index word
+// with the fewest edits from it, preferring the word found in the most files
+// when there is a choice. Corrections are looked for in the prefix tree
+// amongst words with the same first letter, misspellings of the first letter
+// are not corrected. Words with no close index word have no suggestion.
+func (idx *Index) Suggest(q Query) ([]Suggestion, error) {
+	release, ok := idx.acquire()
+	if !ok {
+		return nil, ErrClosed
+	}
+	defer release()
+
+	var suggestions []Suggestion
+	for word := range queryWords(q) {
+		if _, exists := idx.wordOffset(word); exists {
+			continue
+		}
+		if slices.ContainsFunc(suggestions, func(s Suggestion) bool { return s.Word == word }) {
+			continue
+		}
+
+		correction, err := idx.correct(word)
+		if err != nil {
+			return nil, err
+		}
+		if correction != "" {
+			suggestions = append(suggestions, Suggestion{word, correction})
+		}
+	}
+	return suggestions, nil
+}
+
+// correct returns the closest index word to word, or "" if none are close.
+func (idx *Index) correct(word string) (string, error) {
+	tree, err := idx.trie()
+	if err != nil {
+		return "", err
+	}
+	if tree == nil || strings.ContainsFunc(word, func(r rune) bool { return r < 'a' || r > 'z' }) {
+		return "", nil // Only words made of letters are corrected
+	}
+
+	// Allow more edits as words get longer
+	maxEdits := 1
+	if len(word) > 4 {
+		maxEdits = 2
+	}
+
+	var (
+		best      []string
+		bestEdits = maxEdits + 1
+	)
+	candidates, err := tree.FindWordsWithPrefix(word[:1])
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range candidates {
+		if abs(len(candidate)-len(word)) > maxEdits || !indexable(candidate) {
+			continue
+		}
+		switch d := editDistance(word, candidate, maxEdits); {
+		case d < bestEdits:
+			best, bestEdits = []string{candidate}, d
+		case d == bestEdits:
+			best = append(best, candidate)
+		}
+	}
+	if len(best) == 0 {
+		return "", nil
+	}
+
+	// The most common of the closest words
+	slices.Sort(best)
+	var (
+		correction string
+		bestDF     = -1
+	)
+	for _, candidate := range best {
+		df, err := idx.documentFrequency(candidate)
+		if err != nil {
+			return "", err
+		}
+		if df > bestDF {
+			correction, bestDF = candidate, df
+		}
+	}
+	return correction, nil
+}
+
+// editDistance returns the number of single letter insertions, deletions,
+// substitutions and swaps of neighboring letters to turn a into b. Distances
+// over limit are reported as limit+1.
+func editDistance(a, b string, limit int) int {
+	// Three rows of the optimal string alignment distance matrix
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return min(prev[len(b)], limit+1)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// queryWords returns the index words that q looks up to find matches. The
+// words of Not queries are left out.
+func queryWords(q Query) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		var walk func(q Query) bool
+		walk = func(q Query) bool {
+			switch q := q.(type) {
+			case *termQuery:
+				return yield(q.word)
+			case *phraseQuery:
+				for _, w := range q.words {
+					if w != "" && !yield(w) {
+						return false
+					}
+				}
+			case *nearQuery:
+				return walkAll(q.queries, walk)
+			case *andQuery:
+				return walkAll(q.queries, walk)
+			case *orQuery:
+				return walkAll(q.queries, walk)
+			}
+			return true
+		}
+		walk(q)
+	}
+}
+
+func walkAll(queries []Query, walk func(Query) bool) bool {
+	for _, q := range queries {
+		if !walk(q) {
+			return false
+		}
+	}
+	return true
+}
+
+// CorrectQuery applies suggestions to the query string s, replacing each
+// misspelled word with its correction.
+func CorrectQuery(s string, suggestions []Suggestion) string {
+	for _, sug := range suggestions {
+		re := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(sug.Word) + `\b`)
+		s = re.ReplaceAllLiteralString(s, sug.Correction)
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+package emailsearch
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		A, B     string
+		Expected int
+	}{
+		{"budget", "budget", 0},
+		{"budgat", "budget", 1},
+		{"budet", "budget", 1},
+		{"buddget", "budget", 1},
+		{"bugdet", "budget", 1},
+		{"bdugte", "budget", 2},
+		{"forecast", "budget", 3}, // Over the limit
+		{"", "abc", 3},
+	}
+
+	for _, tc := range cases {
+		if got := editDistance(tc.A, tc.B, 2); got != tc.Expected {
+			t.Errorf("editDistance(%q, %q) expected %d, got %d", tc.A, tc.B, tc.Expected, got)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	idx := buildTestIndex(t, map[string]string{
+		"1": "Subject: one\n\nThe budget forecast.\n",
+		"2": "Subject: two\n\nThe budget meeting.\n",
+		"3": "Subject: three\n\nThe budge was small. Lunch with Kenneth.\n",
+	})
+
+	cases := []struct {
+		Query    Query
+		Expected []Suggestion
+	}{
+		{ParseQuery("budget forecast"), nil},
+		{ParseQuery("budgat forcast"), []Suggestion{{"budgat", "budget"}, {"forcast", "forecast"}}},
+		{ParseQuery("bugdet"), []Suggestion{{"bugdet", "budget"}}},
+		// budge and budget are both one edit away, budget is more common
+		{ParseQuery("budgez"), []Suggestion{{"budgez", "budget"}}},
+		{ParseQuery("meting OR lunhc"), []Suggestion{{"meting", "meeting"}, {"lunhc", "lunch"}}},
+		{ParseQuery(`"budget forcast"`), []Suggestion{{"forcast", "forecast"}}},
+		{ParseQuery("budget -lunhc"), nil},
+		{ParseQuery("budg*"), nil},
+		{ParseQuery("zzzzzz"), nil},
+		{ParseQuery("budgat budgat"), []Suggestion{{"budgat", "budget"}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Query.String(), func(t *testing.T) {
+			got, err := idx.Suggest(tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.Expected) {
+				t.Errorf("expected %v, got %v", tc.Expected, got)
+			}
+		})
+	}
+}
+
+func TestCorrectQuery(t *testing.T) {
+	got := CorrectQuery(`Budgat subject:forcast -"budgat"`, []Suggestion{{"budgat", "budget"}, {"forcast", "forecast"}})
+	if want := `budget subject:forecast -"budget"`; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
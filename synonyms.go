@@ -0,0 +1,112 @@
+package emailsearch
+
+import (
+	"bufio"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ParseSynonyms reads a synonym dictionary from r. Each line holds a group of
+// comma separated words that are synonyms of each other, for example
+//
+//	attorney, lawyer, counsel
+//
+// Blank lines and lines starting with # are ignored. Every word of a group
+// is keyed to the other words of the group, and a word in several groups to
+// the words of all of them, in the form IndexBuilder.Synonyms takes. Groups
+// that share a word are not synonyms of each other.
+func ParseSynonyms(r io.Reader) (map[string][]string, error) {
+	synonyms := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var group []string
+		for _, word := range strings.Split(line, ",") {
+			if word = strings.TrimSpace(word); word != "" {
+				group = append(group, word)
+			}
+		}
+		for _, word := range group {
+			synonyms[word] = append(synonyms[word], group...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sortSynonyms(synonyms), nil
+}
+
+// expandSynonyms turns a synonym map into a symmetric, lowercased one. If
+// "attorney" lists "lawyer" then "lawyer" will list "attorney", but words
+// listed by the same word are not linked to each other, ParseSynonyms keys
+// a group on each of its words for that. Words never list themselves and
+// the lists are sorted.
+func expandSynonyms(synonyms map[string][]string) map[string][]string {
+	linked := make(map[string][]string)
+	for word, syns := range synonyms {
+		word = strings.ToLower(word)
+		for _, syn := range syns {
+			syn = strings.ToLower(syn)
+			linked[word] = append(linked[word], syn)
+			linked[syn] = append(linked[syn], word)
+		}
+	}
+	return sortSynonyms(linked)
+}
+
+// sortSynonyms returns synonyms with the lists sorted, without duplicates and
+// without the words themselves.
+func sortSynonyms(synonyms map[string][]string) map[string][]string {
+	sorted := make(map[string][]string, len(synonyms))
+	for word, syns := range synonyms {
+		set := NewSetFrom(syns)
+		set.Remove(word)
+		if set.Len() > 0 {
+			sorted[word] = slices.Sorted(set.Elems())
+		}
+	}
+	return sorted
+}
+
+// injectSynonyms adds the occurrences of every word in index that has
+// synonyms to the occurrences of those synonyms.
+func injectSynonyms(index fileIndex, synonyms map[string][]string) {
+	if len(synonyms) == 0 {
+		return
+	}
+
+	// Expand from a snapshot of the index so that injected occurrences are
+	// not themselves expanded.
+	orig := maps.Clone(index)
+	for word, occs := range orig {
+		for _, syn := range synonyms[word] {
+			index[syn] = mergeOccurrences(index[syn], occs)
+		}
+	}
+}
+
+// mergeOccurrences merges two lists of occurrences sorted by
+// compareOccurrences into a new sorted list without duplicates.
+func mergeOccurrences(a, b []occurrence) []occurrence {
+	out := make([]occurrence, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch c := compareOccurrences(a[0], b[0]); {
+		case c < 0:
+			out, a = append(out, a[0]), a[1:]
+		case c > 0:
+			out, b = append(out, b[0]), b[1:]
+		default:
+			out, a, b = append(out, a[0]), a[1:], b[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
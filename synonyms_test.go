@@ -0,0 +1,74 @@
+package emailsearch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSynonyms(t *testing.T) {
+	input := "# legal\nattorney, lawyer,counsel\n\ninvoice,bill\nbank, shore\nbank, lender\n"
+	synonyms, err := ParseSynonyms(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every word of a line lists the others, and lines that share a word
+	// are not synonyms of each other
+	expected := map[string][]string{
+		"attorney": {"counsel", "lawyer"},
+		"lawyer":   {"attorney", "counsel"},
+		"counsel":  {"attorney", "lawyer"},
+		"invoice":  {"bill"},
+		"bill":     {"invoice"},
+		"bank":     {"lender", "shore"},
+		"shore":    {"bank"},
+		"lender":   {"bank"},
+	}
+	if !reflect.DeepEqual(synonyms, expected) {
+		t.Errorf("Expected %v, got %v", expected, synonyms)
+	}
+	if got := expandSynonyms(synonyms); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the parsed dictionary to expand to itself, got %v", got)
+	}
+}
+
+func TestExpandSynonyms(t *testing.T) {
+	expanded := expandSynonyms(map[string][]string{
+		"Attorney": {"lawyer", "counsel"},
+		"lawyer":   {"lawyer"},
+		"invoice":  {"bill"},
+		"bill":     {"check"},
+	})
+
+	// Every word is linked back to the words that list it, but words listed
+	// by the same word are not linked to each other
+	expected := map[string][]string{
+		"attorney": {"counsel", "lawyer"},
+		"lawyer":   {"attorney"},
+		"counsel":  {"attorney"},
+		"invoice":  {"bill"},
+		"bill":     {"check", "invoice"},
+		"check":    {"bill"},
+	}
+	if !reflect.DeepEqual(expanded, expected) {
+		t.Errorf("Expected %v, got %v", expected, expanded)
+	}
+}
+
+func TestInjectSynonyms(t *testing.T) {
+	index := fileIndex{
+		"attorney": {{Field_Body, 0, 8, 0}, {Field_Body, 30, 8, 6}},
+		"lawyer":   {{Field_Body, 10, 6, 2}},
+	}
+	injectSynonyms(index, expandSynonyms(map[string][]string{"attorney": {"lawyer", "counsel"}}))
+
+	expected := fileIndex{
+		"attorney": {{Field_Body, 0, 8, 0}, {Field_Body, 10, 6, 2}, {Field_Body, 30, 8, 6}},
+		"lawyer":   {{Field_Body, 0, 8, 0}, {Field_Body, 10, 6, 2}, {Field_Body, 30, 8, 6}},
+		"counsel":  {{Field_Body, 0, 8, 0}, {Field_Body, 30, 8, 6}},
+	}
+	if !reflect.DeepEqual(index, expected) {
+		t.Errorf("Expected %v, got %v", expected, index)
+	}
+}
@@ -0,0 +1,512 @@
+package emailsearch
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Trie is a compact prefix tree of words, used to find the words that start
+// with a prefix. Chains of nodes with a single child are merged into one
+// node whose edge is labelled with several bytes. The nodes are kept in a
+// single slice, the children of a node are next to each other and ordered
+// by the first byte of their labels, and all the labels share one byte
+// slice. This takes a small fraction of the memory of a tree of nodes with
+// maps of children, and the serialized form is the same two slices.
+//
+// Because the nodes are a fixed size and refer to their children by
+// position, a serialized trie can be searched where it is without reading
+// it into memory, see OpenTrie.
+type Trie struct {
+	nodes  []trieNode // nodes[0] is the root, which has an empty label
+	labels []byte
+	words  int
+
+	// A trie opened in place is read from r instead of nodes and labels
+	r         io.ReaderAt
+	numNodes  uint32
+	labelsLen uint32
+
+	version uint32 // Format version the trie was read from
+}
+
+// trieNode is a node of a Trie. Its layout is also its serialized form.
+type trieNode struct {
+	LabelOffset uint32 // Label is labels[LabelOffset:LabelOffset+LabelLen]
+	FirstChild  uint32 // Children are nodes[FirstChild:FirstChild+NumChildren]
+	LabelLen    uint16
+	NumChildren uint16
+	First       byte // First byte of the label, so children are searched without reading labels
+	Terminal    bool // A word ends at this node
+}
+
+// trieNodeV1 is a node of a version 1 trie, which had no First byte.
+type trieNodeV1 struct {
+	LabelOffset uint32
+	FirstChild  uint32
+	LabelLen    uint16
+	NumChildren uint16
+	Terminal    bool
+}
+
+const trieMagic uint32 = 'T'<<24 | 'R'<<16 | 'I'<<8 | 'E'
+
+// Version 1 is the first version, earlier indexes used a different format
+// Version 2 adds the first byte of the label to each node
+const (
+	trieVersion    = 2
+	minTrieVersion = 1
+)
+
+// Prefix tree format
+//
+// 0x00: u32 Magic 'TRIE'
+// 0x04: u32 Version number (currently 2)
+// 0x08: u32 Number of words
+// 0x0C: u32 Number of nodes (N)
+// 0x10: u32 Length of all the labels in bytes (L)
+// 0x14: Node 0, 14 bytes: u32 label offset, u32 first child, u16 label
+//       length, u16 number of children, u8 first byte of the label, u8 1
+//       if a word ends at the node
+// ....: Node N-1
+// ....: L bytes of labels
+//
+// Node i is at 0x14 + 14*i, so a lookup can follow the first child field
+// of each node straight to its children. All integers are big endian.
+
+type serializedTrieHeader struct {
+	Magic     uint32
+	Version   uint32
+	NumWords  uint32
+	NumNodes  uint32
+	LabelsLen uint32
+}
+
+var (
+	serializedTrieHeaderSize = int64(binary.Size(serializedTrieHeader{}))
+	trieNodeSize             = int64(binary.Size(trieNode{}))
+)
+
+// maxTrieLabel is the longest label a node can have. Longer runs of single
+// child nodes are split.
+const maxTrieLabel = 1<<16 - 1
+
+// NewTrie returns a Trie of words. Duplicate words are ignored.
+func NewTrie(words []string) *Trie {
+	sorted := slices.Clone(words)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	t := &Trie{nodes: []trieNode{{}}, words: len(sorted), version: trieVersion}
+
+	// Build the tree breadth first so that the children of each node can be
+	// appended together. Each pending node covers the words in sorted[lo:hi],
+	// which all share their first depth bytes.
+	type pending struct {
+		node, lo, hi, depth int
+	}
+	queue := []pending{{0, 0, len(sorted), 0}}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		lo := p.lo
+		if lo < p.hi && len(sorted[lo]) == p.depth {
+			t.nodes[p.node].Terminal = true
+			lo++
+		}
+		if lo == p.hi {
+			continue
+		}
+
+		t.nodes[p.node].FirstChild = uint32(len(t.nodes))
+		for lo < p.hi {
+			// The words with the same next byte become one child
+			b := sorted[lo][p.depth]
+			hi := lo + 1
+			for hi < p.hi && sorted[hi][p.depth] == b {
+				hi++
+			}
+
+			// Its label runs to the end of what the words have in common,
+			// which for sorted words is what the first and last share
+			first, last := sorted[lo], sorted[hi-1]
+			end := p.depth + 1
+			for end < len(first) && end < len(last) && first[end] == last[end] && end-p.depth < maxTrieLabel {
+				end++
+			}
+
+			t.nodes = append(t.nodes, trieNode{
+				LabelOffset: uint32(len(t.labels)),
+				LabelLen:    uint16(end - p.depth),
+				First:       b,
+			})
+			t.labels = append(t.labels, first[p.depth:end]...)
+			t.nodes[p.node].NumChildren++
+			queue = append(queue, pending{len(t.nodes) - 1, lo, hi, end})
+
+			lo = hi
+		}
+	}
+
+	t.numNodes, t.labelsLen = uint32(len(t.nodes)), uint32(len(t.labels))
+	return t
+}
+
+// node returns node i, reading it if the trie is opened in place.
+func (t *Trie) node(i uint32) (trieNode, error) {
+	if t.r == nil {
+		return t.nodes[i], nil
+	}
+	var b [14]byte // trieNodeSize
+	if _, err := t.r.ReadAt(b[:], serializedTrieHeaderSize+int64(i)*trieNodeSize); err != nil {
+		return trieNode{}, fmt.Errorf("prefix tree node %d: %w", i, err)
+	}
+	n := trieNode{
+		LabelOffset: binary.BigEndian.Uint32(b[0:]),
+		FirstChild:  binary.BigEndian.Uint32(b[4:]),
+		LabelLen:    binary.BigEndian.Uint16(b[8:]),
+		NumChildren: binary.BigEndian.Uint16(b[10:]),
+		First:       b[12],
+		Terminal:    b[13] != 0,
+	}
+	if !n.valid(i, t.numNodes, t.labelsLen) {
+		return trieNode{}, fmt.Errorf("prefix tree node %d is malformed", i)
+	}
+	return n, nil
+}
+
+// valid reports whether n, node i of a trie of numNodes nodes and
+// labelsLen bytes of labels, is in range. Children always come after their
+// parent, so lookups cannot loop.
+func (n trieNode) valid(i, numNodes, labelsLen uint32) bool {
+	return uint64(n.LabelOffset)+uint64(n.LabelLen) <= uint64(labelsLen) &&
+		uint64(n.FirstChild)+uint64(n.NumChildren) <= uint64(numNodes) &&
+		(n.NumChildren == 0 || n.FirstChild > i) &&
+		(i == 0 || n.LabelLen > 0)
+}
+
+// label returns the label of n.
+func (t *Trie) label(n trieNode) ([]byte, error) {
+	if t.r == nil {
+		return t.labels[n.LabelOffset : n.LabelOffset+uint32(n.LabelLen)], nil
+	}
+	label := make([]byte, n.LabelLen)
+	off := serializedTrieHeaderSize + int64(t.numNodes)*trieNodeSize + int64(n.LabelOffset)
+	if _, err := t.r.ReadAt(label, off); err != nil {
+		return nil, fmt.Errorf("prefix tree label: %w", err)
+	}
+	return label, nil
+}
+
+// Len returns the number of words in the trie.
+func (t *Trie) Len() int {
+	return t.words
+}
+
+// Words returns the number of words in the trie, the same as Len.
+func (t *Trie) Words() int {
+	return t.words
+}
+
+// Delete removes word from the trie and reports whether it was there. The
+// nodes along the word are kept, so they still take space, and a trie that
+// has had many words deleted is best rebuilt with NewTrie. A trie opened in
+// place can't be changed.
+func (t *Trie) Delete(word string) (bool, error) {
+	if t.r != nil {
+		return false, errors.New("prefix tree is opened in place")
+	}
+	if len(t.nodes) == 0 {
+		return false, nil
+	}
+
+	i := uint32(0)
+	for rest := word; rest != ""; {
+		node := t.nodes[i]
+		children := t.nodes[node.FirstChild : node.FirstChild+uint32(node.NumChildren)]
+		c, found := slices.BinarySearchFunc(children, rest[0], func(n trieNode, b byte) int {
+			return int(n.First) - int(b)
+		})
+		if !found {
+			return false, nil
+		}
+		i = node.FirstChild + uint32(c)
+		label := t.labels[t.nodes[i].LabelOffset : t.nodes[i].LabelOffset+uint32(t.nodes[i].LabelLen)]
+		if !strings.HasPrefix(rest, string(label)) {
+			return false, nil
+		}
+		rest = rest[len(label):]
+	}
+	if !t.nodes[i].Terminal {
+		return false, nil
+	}
+	t.nodes[i].Terminal = false
+	t.words--
+	return true, nil
+}
+
+// FindWordsWithPrefix returns the words that start with prefix, in sorted
+// order. A word counts as its own prefix. An error is only returned for a
+// trie opened in place that can't be read.
+func (t *Trie) FindWordsWithPrefix(prefix string) ([]string, error) {
+	node, word, ok, err := t.find(prefix)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	var words []string
+	if err := t.collect(node, word, &words); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
+// shortestWithPrefix returns up to n of the words that start with prefix and
+// that keep accepts, shortest first and then in sorted order. The tree is
+// searched shortest path first and the search stops once n words are found,
+// so a short prefix doesn't read every word under it.
+func (t *Trie) shortestWithPrefix(prefix string, n int, keep func(string) bool) ([]string, error) {
+	node, word, ok, err := t.find(prefix)
+	if !ok || err != nil || n <= 0 {
+		return nil, err
+	}
+
+	// Every word under a node is longer than the path to it, so the words
+	// come out of the queue in order
+	q := &triePathQueue{{node, string(word)}}
+	var words []string
+	for q.Len() > 0 && len(words) < n {
+		p := heap.Pop(q).(triePath)
+		if p.node.Terminal && keep(p.word) {
+			words = append(words, p.word)
+		}
+		for i := range uint32(p.node.NumChildren) {
+			child, err := t.node(p.node.FirstChild + i)
+			if err != nil {
+				return nil, err
+			}
+			label, err := t.label(child)
+			if err != nil {
+				return nil, err
+			}
+			heap.Push(q, triePath{child, p.word + string(label)})
+		}
+	}
+	return words, nil
+}
+
+// triePath is a node of a trie and the path to it, including its label.
+type triePath struct {
+	node trieNode
+	word string
+}
+
+// triePathQueue is a heap of paths, shortest and then least first.
+type triePathQueue []triePath
+
+func (q triePathQueue) Len() int { return len(q) }
+func (q triePathQueue) Less(i, j int) bool {
+	return cmp.Or(len(q[i].word)-len(q[j].word), strings.Compare(q[i].word, q[j].word)) < 0
+}
+func (q triePathQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *triePathQueue) Push(x any)   { *q = append(*q, x.(triePath)) }
+func (q *triePathQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
+
+// find walks down to the node that covers prefix. It returns the node, the
+// path to it including its label, and false if no word starts with prefix.
+func (t *Trie) find(prefix string) (trieNode, []byte, bool, error) {
+	if t.numNodes == 0 {
+		return trieNode{}, nil, false, nil
+	}
+
+	// word is the path so far
+	node, err := t.node(0)
+	if err != nil {
+		return trieNode{}, nil, false, err
+	}
+	word := make([]byte, 0, 64)
+	for rest := prefix; rest != ""; {
+		// Binary search the children for the one starting with rest[0]
+		lo, hi := node.FirstChild, node.FirstChild+uint32(node.NumChildren)
+		var child trieNode
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			if child, err = t.node(mid); err != nil {
+				return trieNode{}, nil, false, err
+			}
+			if child.First < rest[0] {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo == node.FirstChild+uint32(node.NumChildren) {
+			return trieNode{}, nil, false, nil
+		}
+		if node, err = t.node(lo); err != nil {
+			return trieNode{}, nil, false, err
+		}
+		if node.First != rest[0] {
+			return trieNode{}, nil, false, nil
+		}
+		label, err := t.label(node)
+		if err != nil {
+			return trieNode{}, nil, false, err
+		}
+		if len(rest) <= len(label) {
+			// prefix ends part way along this edge
+			if !strings.HasPrefix(string(label), rest) {
+				return trieNode{}, nil, false, nil
+			}
+			word = append(word, label...)
+			break
+		}
+		if !strings.HasPrefix(rest, string(label)) {
+			return trieNode{}, nil, false, nil
+		}
+		word = append(word, label...)
+		rest = rest[len(label):]
+	}
+	return node, word, true, nil
+}
+
+// collect appends the words under node to words in sorted order. word is
+// the path to node including its label.
+func (t *Trie) collect(node trieNode, word []byte, words *[]string) error {
+	if node.Terminal {
+		*words = append(*words, string(word))
+	}
+	for i := range uint32(node.NumChildren) {
+		child, err := t.node(node.FirstChild + i)
+		if err != nil {
+			return err
+		}
+		label, err := t.label(child)
+		if err != nil {
+			return err
+		}
+		if err := t.collect(child, append(word, label...), words); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTo serializes the trie to w. A trie opened in place can't be
+// written.
+func (t *Trie) WriteTo(w io.Writer) (int64, error) {
+	if t.r != nil {
+		return 0, errors.New("prefix tree is opened in place")
+	}
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	hdr := serializedTrieHeader{
+		Magic:     trieMagic,
+		Version:   trieVersion,
+		NumWords:  uint32(t.words),
+		NumNodes:  uint32(len(t.nodes)),
+		LabelsLen: uint32(len(t.labels)),
+	}
+	if err := binary.Write(cw, binary.BigEndian, hdr); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.BigEndian, t.nodes); err != nil {
+		return cw.n, err
+	}
+	if _, err := cw.Write(t.labels); err != nil {
+		return cw.n, err
+	}
+	return cw.n, bw.Flush()
+}
+
+// ReadTrie reads a trie serialized with WriteTo into memory.
+func ReadTrie(r io.Reader) (*Trie, error) {
+	var hdr serializedTrieHeader
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic != trieMagic || hdr.Version < minTrieVersion || hdr.Version > trieVersion {
+		return nil, fmt.Errorf("unsupported prefix tree version number %d", hdr.Version)
+	}
+
+	t := &Trie{
+		nodes:     make([]trieNode, hdr.NumNodes),
+		labels:    make([]byte, hdr.LabelsLen),
+		words:     int(hdr.NumWords),
+		numNodes:  hdr.NumNodes,
+		labelsLen: hdr.LabelsLen,
+		version:   hdr.Version,
+	}
+	if hdr.Version == 1 {
+		v1 := make([]trieNodeV1, hdr.NumNodes)
+		if err := binary.Read(r, binary.BigEndian, v1); err != nil {
+			return nil, err
+		}
+		for i, n := range v1 {
+			t.nodes[i] = trieNode{LabelOffset: n.LabelOffset, FirstChild: n.FirstChild, LabelLen: n.LabelLen, NumChildren: n.NumChildren, Terminal: n.Terminal}
+		}
+	} else if err := binary.Read(r, binary.BigEndian, t.nodes); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, t.labels); err != nil {
+		return nil, err
+	}
+
+	// Check the tree is well formed so that lookups cannot go out of range or
+	// loop
+	for i, n := range t.nodes {
+		if !n.valid(uint32(i), hdr.NumNodes, hdr.LabelsLen) {
+			return nil, fmt.Errorf("prefix tree node %d is malformed", i)
+		}
+		if hdr.Version == 1 && i > 0 {
+			t.nodes[i].First = t.labels[n.LabelOffset]
+		}
+	}
+	return t, nil
+}
+
+// OpenTrie opens the trie serialized with WriteTo in the size bytes of r,
+// which is searched in place rather than read into memory. Each node is
+// checked as it is read. r must stay open while the trie is in use. Version
+// 1 tries, which can't be searched in place, are read into memory.
+func OpenTrie(r io.ReaderAt, size int64) (*Trie, error) {
+	var hdr serializedTrieHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, size), binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic == trieMagic && hdr.Version == 1 {
+		return ReadTrie(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+	}
+	if hdr.Magic != trieMagic || hdr.Version != trieVersion {
+		return nil, fmt.Errorf("unsupported prefix tree version number %d", hdr.Version)
+	}
+	if want := serializedTrieHeaderSize + int64(hdr.NumNodes)*trieNodeSize + int64(hdr.LabelsLen); size != want {
+		return nil, fmt.Errorf("prefix tree is %d bytes, expected %d", size, want)
+	}
+	return &Trie{r: r, words: int(hdr.NumWords), numNodes: hdr.NumNodes, labelsLen: hdr.LabelsLen, version: hdr.Version}, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,206 @@
+package emailsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTrie(t *testing.T) {
+	words := []string{
+		"budget", "budgetary", "budgets", "bud", "buddy", "brief", "a", "ab",
+		"abc", "zebra", "café", "cafe", "caffeine", strings.Repeat("x", maxTrieLabel+10),
+		"budget", // duplicate
+	}
+	trie := NewTrie(words)
+	if trie.Len() != len(words)-1 {
+		t.Errorf("expected %d words, got %d", len(words)-1, trie.Len())
+	}
+
+	// Prefix lookups agree with checking every word
+	check := func(t *testing.T, trie *Trie) {
+		t.Helper()
+		sorted := slices.Compact(slices.Sorted(slices.Values(words)))
+		for _, prefix := range []string{"", "b", "bu", "bud", "budg", "budgeta", "budgetx", "c", "caf", "café", "a", "abcd", "q", "xxx", strings.Repeat("x", maxTrieLabel+5)} {
+			var want []string
+			for _, w := range sorted {
+				if strings.HasPrefix(w, prefix) {
+					want = append(want, w)
+				}
+			}
+			got, err := trie.FindWordsWithPrefix(prefix)
+			if err != nil || !slices.Equal(got, want) {
+				t.Errorf("prefix %.10q: expected %.60q, got %.60q (%v)", prefix, want, got, err)
+			}
+		}
+	}
+	check(t, trie)
+
+	// The serialized trie finds the same words
+	var buf bytes.Buffer
+	n, err := trie.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+	read, err := ReadTrie(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, read)
+	if read.Len() != trie.Len() {
+		t.Errorf("expected %d words after reading, got %d", trie.Len(), read.Len())
+	}
+
+	// It can be searched in place too
+	opened, err := OpenTrie(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.nodes != nil {
+		t.Error("expected the trie to be searched in place")
+	}
+	check(t, opened)
+
+	// Version 1 tries, without the first byte of each label, still load
+	v1 := writeTrieV1(t, trie)
+	read, err = ReadTrie(bytes.NewReader(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, read)
+	if opened, err = OpenTrie(bytes.NewReader(v1), int64(len(v1))); err != nil || opened.nodes == nil {
+		t.Fatalf("expected a version 1 trie to be read into memory, got %v", err)
+	}
+	check(t, opened)
+
+	// A node that points back at its parent is rejected, when read or when it
+	// is reached in place
+	data := bytes.Clone(buf.Bytes())
+	copy(data[20+4:], []byte{0, 0, 0, 0}) // Root's first child
+	if _, err := ReadTrie(bytes.NewReader(data)); err == nil {
+		t.Error("expected an error reading a malformed trie")
+	}
+	opened, err = OpenTrie(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opened.FindWordsWithPrefix("b"); err == nil {
+		t.Error("expected an error searching a malformed trie")
+	}
+	if _, err := OpenTrie(bytes.NewReader(data[:len(data)-1]), int64(len(data)-1)); err == nil {
+		t.Error("expected an error opening a truncated trie")
+	}
+	if _, err := ReadTrie(bytes.NewReader([]byte("not a trie at all, no"))); err == nil {
+		t.Error("expected an error reading something that is not a trie")
+	}
+
+	empty := NewTrie(nil)
+	if got, err := empty.FindWordsWithPrefix(""); got != nil || err != nil {
+		t.Errorf("expected no words in an empty trie, got %v (%v)", got, err)
+	}
+}
+
+// writeTrieV1 serializes trie in the version 1 format.
+func writeTrieV1(t *testing.T, trie *Trie) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	hdr := serializedTrieHeader{trieMagic, 1, uint32(trie.words), uint32(len(trie.nodes)), uint32(len(trie.labels))}
+	nodes := make([]trieNodeV1, len(trie.nodes))
+	for i, n := range trie.nodes {
+		nodes[i] = trieNodeV1{n.LabelOffset, n.FirstChild, n.LabelLen, n.NumChildren, n.Terminal}
+	}
+	for _, v := range []any{hdr, nodes, trie.labels} {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestTrieShortestWithPrefix(t *testing.T) {
+	words := []string{"bud", "budget", "budgets", "budgeted", "buddy", "bus", "b", "apple", "bu", "budge"}
+	trie := NewTrie(words)
+	var buf bytes.Buffer
+	if _, err := trie.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenTrie(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keep := func(s string) bool { return s != "bus" }
+	for _, tr := range []*Trie{trie, opened} {
+		for _, tc := range []struct {
+			Prefix string
+			N      int
+			Want   []string
+		}{
+			{"bu", 4, []string{"bu", "bud", "buddy", "budge"}},
+			{"bu", 100, []string{"bu", "bud", "buddy", "budge", "budget", "budgets", "budgeted"}},
+			{"budg", 2, []string{"budge", "budget"}},
+			{"", 3, []string{"b", "bu", "bud"}},
+			{"c", 3, nil},
+			{"bu", 0, nil},
+		} {
+			got, err := tr.shortestWithPrefix(tc.Prefix, tc.N, keep)
+			if err != nil || !slices.Equal(got, tc.Want) {
+				t.Errorf("%q, %d: expected %v, got %v (%v)", tc.Prefix, tc.N, tc.Want, got, err)
+			}
+		}
+	}
+}
+
+func TestTrieDelete(t *testing.T) {
+	trie := NewTrie([]string{"bud", "budget", "budgets", "brief", ""})
+	if trie.Words() != 5 {
+		t.Errorf("Words() = %d, want 5", trie.Words())
+	}
+
+	for _, tc := range []struct {
+		word string
+		want bool
+	}{
+		{"budget", true},
+		{"budget", false}, // already deleted
+		{"budg", false},   // part way along an edge
+		{"budgetary", false},
+		{"zebra", false},
+		{"", true},
+	} {
+		if got, err := trie.Delete(tc.word); err != nil || got != tc.want {
+			t.Errorf("Delete(%q) = %t, %v, want %t", tc.word, got, err, tc.want)
+		}
+	}
+	if trie.Words() != 3 {
+		t.Errorf("Words() = %d after deleting, want 3", trie.Words())
+	}
+	got, err := trie.FindWordsWithPrefix("")
+	if want := []string{"brief", "bud", "budgets"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("got %q (%v), want %q", got, err, want)
+	}
+
+	// The words that are left survive serialization
+	var buf bytes.Buffer
+	if _, err := trie.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenTrie(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := opened.FindWordsWithPrefix("bu"); err != nil || !slices.Equal(got, []string{"bud", "budgets"}) {
+		t.Errorf("got %q (%v) from the serialized trie", got, err)
+	}
+	if opened.Words() != 3 {
+		t.Errorf("Words() = %d for the serialized trie, want 3", opened.Words())
+	}
+	if _, err := opened.Delete("bud"); err == nil {
+		t.Error("expected deleting from a trie opened in place to fail")
+	}
+}
@@ -0,0 +1,408 @@
+package emailsearch
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring/v2"
+)
+
+// maxVerifyProblems is the most problems VerifyIndex reports, a badly
+// damaged index could otherwise have one for every word.
+const maxVerifyProblems = 100
+
+// IndexProblem is an inconsistency found by VerifyIndex.
+type IndexProblem struct {
+	File    string // The index file with the problem, e.g. corpus.index, or "" for the whole index
+	Message string
+}
+
+func (p IndexProblem) String() string {
+	if p.File == "" {
+		return p.Message
+	}
+	return p.File + ": " + p.Message
+}
+
+// VerifyReport lists the problems VerifyIndex found in an index.
+type VerifyReport struct {
+	Problems  []IndexProblem
+	Truncated bool // There were too many problems to list them all
+}
+
+// Error lists the problems, a report is the error LoadIndex returns when
+// LoadOptions.Strict finds problems.
+func (r *VerifyReport) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "index has %d problems", len(r.Problems))
+	if r.Truncated {
+		b.WriteString(" or more")
+	}
+	for _, p := range r.Problems {
+		b.WriteString("\n\t")
+		b.WriteString(p.String())
+	}
+	return b.String()
+}
+
+// OK reports whether the index has no problems.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(file, format string, a ...any) {
+	if len(r.Problems) == maxVerifyProblems {
+		r.Truncated = true
+		return
+	}
+	r.Problems = append(r.Problems, IndexProblem{file, fmt.Sprintf(format, a...)})
+}
+
+// VerifyIndex checks that the files of the serialized index at path, a
+// directory or a bundle, are intact and agree with each other. Every file's
+// checksum is checked, and if they all match the files are cross-checked:
+// the word offsets point at words in corpus.index, every match is in a file
+// that exists, the catalog entries are in range and don't overlap, and the
+// prefix tree holds the same words as the words string table. Only the
+// checksums of an encrypted index are checked. An error is only returned if
+// the index cannot be opened at all, everything else is a problem in the
+// report.
+func VerifyIndex(path string) (*VerifyReport, error) {
+	src, err := openIndexSource(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	meta, err := loadIndexMetadata(src)
+	if err != nil {
+		report.add(IndexMetadataFile, "%s", err)
+	}
+
+	// The contents of a damaged file can't be trusted to check the rest
+	for _, name := range slices.Sorted(maps.Keys(meta.Checksums)) {
+		if err := verifyChecksums(src, map[string]string{name: meta.Checksums[name]}); err != nil {
+			var cerr *ChecksumError
+			if errors.As(err, &cerr) {
+				report.add(name, "checksum does not match")
+			} else {
+				report.add(name, "%s", err)
+			}
+		}
+	}
+	src.Close()
+	if !report.OK() {
+		return report, nil
+	}
+	// Only the checksums of an encrypted index can be checked without the key
+	if len(meta.Encrypted) > 0 {
+		return report, nil
+	}
+
+	idx, err := LoadIndex(path, io.Discard, LoadOptions{SkipChecksums: true})
+	if err != nil {
+		report.add("", "index does not load: %s", err)
+		return report, nil
+	}
+	defer idx.Close()
+
+	idx.checkIndex(report, true)
+	return report, nil
+}
+
+// checkIndex checks that the loaded files of idx agree with each other. If
+// deep is false every match, email and word of the prefix tree isn't read,
+// only the tables that point at them are checked, see LoadOptions.Strict.
+func (idx *Index) checkIndex(r *VerifyReport, deep bool) {
+	// Catalogs from version 5 were only ever written with version 10 search
+	// indexes, a mix comes from files of different builds
+	if idx.catalogVersion >= 5 && idx.indexVersion < 10 {
+		r.add("", "%s version %d was not written with %s version %d", CorpusCatalog, idx.catalogVersion, CorpusIndex, idx.indexVersion)
+	}
+	if idx.CorpusSize != idx.filenames.Len() {
+		r.add(CorpusIndex, "corpus size is %d but there are %d files", idx.CorpusSize, idx.filenames.Len())
+	}
+	if len(idx.offsets) != idx.words.Len() {
+		r.add(IndexWordOffsets, "has %d entries but %s has %d words", len(idx.offsets), WordsStringTable, idx.words.Len())
+	}
+
+	if deep {
+		verifySortedOrder(r, FilenamesStringTable, idx.filenames)
+		verifySortedOrder(r, WordsStringTable, idx.words)
+	}
+	idx.verifyWords(r, deep)
+	idx.verifyCatalog(r, deep)
+	idx.verifyShardManifest(r)
+	if idx.prefixTreeReady != nil {
+		if deep {
+			idx.verifyPrefixTree(r)
+		} else if trie, err := idx.trie(); err != nil {
+			r.add(QueryPrefixTree, "%s", err)
+		} else if trie.Len() != idx.words.Len() {
+			r.add(QueryPrefixTree, "has %d words but %s has %d", trie.Len(), WordsStringTable, idx.words.Len())
+		}
+	}
+	if len(idx.docLabelStart) > 0 && len(idx.docLabelStart) != idx.filenames.Len()+1 {
+		r.add(DocumentLabels, "has labels for %d files, expected %d", len(idx.docLabelStart)-1, idx.filenames.Len())
+	}
+}
+
+// verifyWords checks the word offsets, and if deep is true the matches of
+// every word.
+func (idx *Index) verifyWords(r *VerifyReport, deep bool) {
+
+	// The entries start after the header and the document lengths
+	start := int64(binary.Size(serializedIndexHeader{})) + 4*int64(len(idx.docLens))
+	end := int64(idx.indexRdr.Len())
+	seen := make([]bool, idx.words.Len())
+	for _, wo := range idx.offsets {
+		if int(wo.WordIndex) >= idx.words.Len() {
+			r.add(IndexWordOffsets, "word index %d out of range", wo.WordIndex)
+			continue
+		}
+		word := idx.words.At(int(wo.WordIndex))
+		if seen[wo.WordIndex] {
+			r.add(IndexWordOffsets, "word %q has more than one offset", word)
+			continue
+		}
+		seen[wo.WordIndex] = true
+		if wo.Offset < start || wo.Offset >= end {
+			r.add(IndexWordOffsets, "offset %d of word %q is outside of %s", wo.Offset, word, CorpusIndex)
+			continue
+		}
+		if !deep {
+			continue
+		}
+		if err := idx.verifyWord(word, wo.Offset); err != nil {
+			r.add(CorpusIndex, "word %q: %s", word, err)
+		}
+	}
+}
+
+// verifyWord checks the matches of word, whose entry is at offset.
+func (idx *Index) verifyWord(word string, offset int64) error {
+	files, err := idx.wordFiles(word)
+	if err != nil {
+		return err
+	}
+	rdr := &readerAtCursor{r: idx.indexRdr, off: offset}
+	numMatches, err := skipWordFiles(rdr)
+	if err != nil {
+		return err
+	}
+
+	matched := roaring.New()
+	prev := 0
+	err = idx.matchHeaders(rdr, numMatches, nil, func(h matchHeader) error {
+		if h.fidx >= idx.filenames.Len() {
+			return fmt.Errorf("match in file index %d out of range", h.fidx)
+		}
+		if h.fidx < prev {
+			return errors.New("matches are not in file order")
+		}
+		prev = h.fidx
+		matched.Add(uint32(h.fidx))
+
+		occRdr := h.occurrences()
+		for range 3 * h.tf {
+			if _, err := binary.ReadUvarint(occRdr); err != nil {
+				return fmt.Errorf("occurrences in %s are truncated", idx.filenames.At(h.fidx))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !matched.Equals(files) {
+		return errors.New("set of files does not match the matches")
+	}
+	return nil
+}
+
+// verifyCatalog checks that the catalog entries are in range and don't
+// overlap, and if deep is true that the content and metadata can be
+// decoded.
+func (idx *Index) verifyCatalog(r *VerifyReport, deep bool) {
+	if len(idx.contentEntry) != idx.filenames.Len() {
+		r.add(CorpusCatalog, "has %d entries but there are %d files", len(idx.contentEntry), idx.filenames.Len())
+		return
+	}
+
+	tableEnd := catalogTableEnd(idx.catalogVersion, len(idx.contentEntry))
+	catalogLen := int64(idx.catalogRdr.Len())
+
+	// Content start offsets by shard, to look for overlaps
+	type content struct {
+		offset uint64
+		fidx   int
+	}
+	starts := make([][]content, max(len(idx.shardRdrs), 1))
+	for fidx, e := range idx.contentEntry {
+		name := idx.filenames.At(fidx)
+		switch {
+		case idx.catalogVersion == 1:
+			// Catalogs had no metadata before version 2
+		case e.MetaOffset < uint64(tableEnd) || e.MetaOffset >= uint64(catalogLen):
+			r.add(CorpusCatalog, "metadata of %s is out of range", name)
+		case deep:
+			if _, ok := idx.Metadata(fidx); !ok {
+				r.add(CorpusCatalog, "metadata of %s is malformed", name)
+			}
+		}
+
+		file, rdr := CorpusCatalog, idx.catalogRdr
+		if len(idx.shardRdrs) > 0 {
+			if int(e.Shard) >= len(idx.shardRdrs) {
+				r.add(CorpusCatalog, "content of %s is in shard %d which does not exist", name, e.Shard)
+				continue
+			}
+			file, rdr = CatalogShardName(int(e.Shard)), idx.shardRdrs[e.Shard]
+		} else if e.Offset < uint64(tableEnd) {
+			r.add(CorpusCatalog, "content of %s overlaps the entries table", name)
+			continue
+		}
+		if e.Offset >= uint64(rdr.Len()) || e.Offset+e.CompressedLength > uint64(rdr.Len()) {
+			r.add(file, "content of %s is out of range", name)
+			continue
+		}
+		shard := 0
+		if len(idx.shardRdrs) > 0 {
+			shard = int(e.Shard)
+		}
+		starts[shard] = append(starts[shard], content{e.Offset, fidx})
+
+		if !deep {
+			continue
+		}
+		if _, _, ok := idx.CatalogContent(context.Background(), fidx); !ok {
+			r.add(file, "content of %s can not be decompressed", name)
+		}
+	}
+
+	// Content is stored back to back, so two files starting at the same
+	// offset overlap. Where the compressed length is known, or the content
+	// is uncompressed, content must also end before the next starts.
+	for shard, s := range starts {
+		slices.SortFunc(s, func(a, b content) int { return cmp.Compare(a.offset, b.offset) })
+		for i := 1; i < len(s); i++ {
+			prev := s[i-1]
+			overlap := s[i].offset == prev.offset
+			if e := idx.contentEntry[prev.fidx]; e.CompressedLength > 0 {
+				overlap = prev.offset+e.CompressedLength > s[i].offset
+			} else if idx.codec == Codec_None {
+				overlap = prev.offset+e.Length > s[i].offset
+			}
+			if overlap {
+				file := CorpusCatalog
+				if len(idx.shardRdrs) > 0 {
+					file = CatalogShardName(shard)
+				}
+				r.add(file, "content of %s and %s overlap", idx.filenames.At(prev.fidx), idx.filenames.At(s[i].fidx))
+			}
+		}
+	}
+}
+
+// verifyShardManifest checks the catalog shards against the manifest in the
+// index metadata: that each has the recorded size, unless it is encrypted
+// and its stored size isn't known, and holds the content of the recorded
+// files.
+func (idx *Index) verifyShardManifest(r *VerifyReport) {
+	manifest := idx.meta.CatalogShards
+	if len(manifest) == 0 {
+		return
+	}
+	if len(manifest) != len(idx.shardRdrs) {
+		r.add(CorpusCatalog, "has %d shards but %s lists %d", len(idx.shardRdrs), IndexMetadataFile, len(manifest))
+		return
+	}
+
+	docs := make([]int, len(manifest))
+	for n, shard := range manifest {
+		if shard.Name != CatalogShardName(n) {
+			r.add(IndexMetadataFile, "shard %d is named %s, expected %s", n, shard.Name, CatalogShardName(n))
+		}
+		if !slices.Contains(idx.meta.Encrypted, shard.Name) && int64(idx.shardRdrs[n].Len()) != shard.Size {
+			r.add(CatalogShardName(n), "is %d bytes but %s records %d", idx.shardRdrs[n].Len(), IndexMetadataFile, shard.Size)
+		}
+	}
+	for fidx, e := range idx.contentEntry {
+		if e.MetaOffset == 0 || int(e.Shard) >= len(manifest) {
+			continue // No content, or reported by verifyCatalog
+		}
+		shard := manifest[e.Shard]
+		if fidx < shard.FirstDocument || fidx > shard.LastDocument {
+			r.add(CatalogShardName(int(e.Shard)), "holds the content of %s, outside its files %d to %d", idx.filenames.At(fidx), shard.FirstDocument, shard.LastDocument)
+		}
+		docs[e.Shard]++
+	}
+	for n, shard := range manifest {
+		if docs[n] != shard.Documents {
+			r.add(CatalogShardName(n), "holds the content of %d files but %s records %d", docs[n], IndexMetadataFile, shard.Documents)
+		}
+	}
+}
+
+// verifySortedOrder checks that the sorted order of the string table t, the
+// file name, is every string once in sorted order, otherwise strings can't be
+// found in it.
+func verifySortedOrder(r *VerifyReport, name string, t *stringTable) {
+	if t == nil || t.r == nil {
+		return // Not read from the file
+	}
+	seen := make([]bool, t.Len())
+	var prev string
+	for i, idx := range t.sortedOrder() {
+		if seen[idx] {
+			r.add(name, "string %d is in the sorted order more than once", idx)
+			return
+		}
+		seen[idx] = true
+		s := t.At(idx)
+		if i > 0 && s < prev {
+			r.add(name, "%q is out of order after %q", s, prev)
+			return
+		}
+		prev = s
+	}
+}
+
+// verifyPrefixTree checks that the prefix tree holds the same words as the
+// words string table.
+func (idx *Index) verifyPrefixTree(r *VerifyReport) {
+	trie, err := idx.trie()
+	if err != nil {
+		r.add(QueryPrefixTree, "%s", err)
+		return
+	}
+
+	got, err := trie.FindWordsWithPrefix("")
+	if err != nil {
+		r.add(QueryPrefixTree, "%s", err)
+		return
+	}
+	want := make([]string, 0, idx.words.Len())
+	for _, widx := range idx.words.sortedOrder() {
+		want = append(want, idx.words.At(widx))
+	}
+	for i, j := 0, 0; i < len(got) || j < len(want); {
+		switch {
+		case j == len(want) || (i < len(got) && got[i] < want[j]):
+			r.add(QueryPrefixTree, "has word %q which is not in %s", got[i], WordsStringTable)
+			i++
+		case i == len(got) || want[j] < got[i]:
+			r.add(QueryPrefixTree, "is missing word %q", want[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package emailsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyIndex(t *testing.T) {
+	emails := map[string]string{
+		"1": "Subject: one\nX-Gmail-Labels: Inbox\n\nThe quarterly budget.\n",
+		"2": "Subject: two\n\nLunch on Friday.\n",
+		"3": "Subject: three\n\nThe budget lunch.\n",
+	}
+
+	// Replace the files of the index at dir with files, and drop the
+	// checksums so that the cross checks run
+	damage := func(t *testing.T, dir string, files map[string][]byte) {
+		t.Helper()
+		idx, err := LoadIndexFromDisk(dir, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := idx.IndexMetadata()
+		idx.Close()
+		meta.Checksums = nil
+		files[IndexMetadataFile], _ = json.Marshal(meta)
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hasProblem := func(t *testing.T, report *VerifyReport, file string) {
+		t.Helper()
+		for _, p := range report.Problems {
+			if p.File == file {
+				return
+			}
+		}
+		t.Errorf("expected a problem with %s, got %v", file, report.Problems)
+	}
+
+	for _, ib := range []*IndexBuilder{{NThreads: 1}, {NThreads: 1, MaxCatalogShardSize: 1}, {NThreads: 1, Codec: Codec_None}} {
+		dir := serializeTestIndex(t, ib, emails)
+		report, err := VerifyIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Errorf("expected no problems, got %v", report.Problems)
+		}
+	}
+
+	t.Run("checksum", func(t *testing.T) {
+		dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+		catalog := filepath.Join(dir, CorpusCatalog)
+		data, err := os.ReadFile(catalog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-1] ^= 0xff
+		if err := os.WriteFile(catalog, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := VerifyIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 1 {
+			t.Errorf("expected only the catalog checksum to fail, got %v", report.Problems)
+		}
+		hasProblem(t, report, CorpusCatalog)
+	})
+
+	t.Run("word offsets", func(t *testing.T) {
+		dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+		idx, err := LoadIndexFromDisk(dir, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets := idx.offsets
+		offsets[0].Offset = int64(idx.indexRdr.Len()) + 10
+		idx.Close()
+		var buf bytes.Buffer
+		if err := (&IndexBuilder{}).writeIndexOffsetsFile(offsets, &buf); err != nil {
+			t.Fatal(err)
+		}
+		damage(t, dir, map[string][]byte{IndexWordOffsets: buf.Bytes()})
+
+		report, err := VerifyIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasProblem(t, report, IndexWordOffsets)
+	})
+
+	t.Run("prefix tree", func(t *testing.T) {
+		dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+		idx, err := LoadIndexFromDisk(dir, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		words := append(tableStrings(idx.words)[1:], "zzyzx") // One missing, one extra
+		idx.Close()
+		var buf bytes.Buffer
+		if _, err := NewTrie(words).WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		damage(t, dir, map[string][]byte{QueryPrefixTree: buf.Bytes()})
+
+		report, err := VerifyIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 2 {
+			t.Errorf("expected a missing and an extra word, got %v", report.Problems)
+		}
+		hasProblem(t, report, QueryPrefixTree)
+	})
+
+	t.Run("strict load", func(t *testing.T) {
+		dir := serializeTestIndex(t, &IndexBuilder{NThreads: 1}, emails)
+		if idx, err := LoadIndex(dir, io.Discard, LoadOptions{Strict: true}); err != nil {
+			t.Fatalf("expected an intact index to load, got %v", err)
+		} else {
+			idx.Close()
+		}
+
+		idx, err := LoadIndexFromDisk(dir, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets := idx.offsets[:len(idx.offsets)-1]
+		offsets[0].Offset = int64(idx.indexRdr.Len()) + 10
+		words := append(tableStrings(idx.words), "zzyzx")
+		idx.Close()
+		var offsetsBuf, trieBuf bytes.Buffer
+		if err := (&IndexBuilder{}).writeIndexOffsetsFile(offsets, &offsetsBuf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewTrie(words).WriteTo(&trieBuf); err != nil {
+			t.Fatal(err)
+		}
+		damage(t, dir, map[string][]byte{IndexWordOffsets: offsetsBuf.Bytes(), QueryPrefixTree: trieBuf.Bytes()})
+
+		if _, err := LoadIndexFromDisk(dir, io.Discard); err == nil || !strings.Contains(err.Error(), WordsStringTable) {
+			t.Errorf("expected an error naming the mismatched files, got %v", err)
+		}
+		_, err = LoadIndex(dir, io.Discard, LoadOptions{Strict: true})
+		var report *VerifyReport
+		if !errors.As(err, &report) {
+			t.Fatalf("expected a report of the problems, got %v", err)
+		}
+		if len(report.Problems) != 3 {
+			t.Errorf("expected the count, the offset and the prefix tree to be wrong, got %v", err)
+		}
+		hasProblem(t, report, IndexWordOffsets)
+		hasProblem(t, report, QueryPrefixTree)
+	})
+}
@@ -0,0 +1,103 @@
+package emailsearch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// WalkedFile is a file found by Walk.
+type WalkedFile struct {
+	Name string // Relative to the root of the walk
+	Size int64
+}
+
+// errWalkLimit stops a walk once it has found enough files.
+var errWalkLimit = errors.New("walk limit reached")
+
+// Walk finds the files under root that ib accepts and sends each to files
+// as soon as it is found, closing files when it is done. Directories that
+// ib excludes are not read. Up to workers directories are read at once, as
+// on network filesystems such as NFS each read waits on a round trip. The
+// files are sent in no particular order, which is why limit, if it is not
+// negative, stops the walk after an arbitrary limit files. Walk stops at the
+// first error reading a directory, or once ctx is done.
+//
+// Walk is usually run alongside InjestStream, so that emails are injested
+// while the rest are found.
+func (ib *IndexBuilder) Walk(ctx context.Context, root string, workers, limit int, files chan<- WalkedFile) error {
+	defer close(files)
+
+	wctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	var (
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, max(workers, 1))
+		found atomic.Int64
+	)
+	var readDir func(dir string)
+	readDir = func(dir string) {
+		defer wg.Done()
+
+		// Only the read itself holds a worker, the directories found are
+		// each read in their own goroutine as workers come free
+		select {
+		case sem <- struct{}{}:
+		case <-wctx.Done():
+			return
+		}
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		<-sem
+		if err != nil {
+			stop(err)
+			return
+		}
+
+		for _, d := range entries {
+			if wctx.Err() != nil {
+				return
+			}
+			name := filepath.Join(dir, d.Name())
+			if d.IsDir() {
+				if !ib.ExcludesDir(name) {
+					wg.Add(1)
+					go readDir(name)
+				}
+				continue
+			}
+			if !ib.Accept(name) {
+				continue
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				stop(err)
+				return
+			}
+			if limit >= 0 && found.Add(1) > int64(limit) {
+				stop(errWalkLimit)
+				return
+			}
+			select {
+			case files <- WalkedFile{name, info.Size()}:
+			case <-wctx.Done():
+				return
+			}
+		}
+	}
+	wg.Add(1)
+	go readDir(".")
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := context.Cause(wctx); err != nil && err != errWalkLimit {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package emailsearch
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeTree writes files, relative paths to contents, under a new directory
+// and returns it.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// walkFiles runs Walk and returns the names of the files it found, sorted, and
+// the size of each.
+func walkFiles(t *testing.T, ib *IndexBuilder, root string, workers, limit int) ([]string, map[string]int64, error) {
+	t.Helper()
+	files := make(chan WalkedFile)
+	done := make(chan error, 1)
+	go func() { done <- ib.Walk(t.Context(), root, workers, limit, files) }()
+
+	var names []string
+	sizes := make(map[string]int64)
+	for f := range files {
+		names = append(names, filepath.ToSlash(f.Name))
+		sizes[filepath.ToSlash(f.Name)] = f.Size
+	}
+	slices.Sort(names)
+	return names, sizes, <-done
+}
+
+func TestWalk(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"lay/inbox/1.":          "one",
+		"lay/inbox/2.":          "two!",
+		"lay/deleted_items/3.":  "three",
+		"skilling/sent/4.":      "four",
+		"skilling/sent/notes.x": "notes",
+		"5.":                    "five",
+	})
+
+	ib := &IndexBuilder{ExcludePatterns: []string{"*/deleted_items", "*.x"}}
+	for _, workers := range []int{1, 4} {
+		names, sizes, err := walkFiles(t, ib, root, workers, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"5.", "lay/inbox/1.", "lay/inbox/2.", "skilling/sent/4."}; !slices.Equal(names, want) {
+			t.Errorf("%d workers: found %v, want %v", workers, names, want)
+		}
+		if sizes["lay/inbox/2."] != 4 {
+			t.Errorf("%d workers: expected the size of the file, got %d", workers, sizes["lay/inbox/2."])
+		}
+	}
+
+	// The walk stops after the limit
+	names, _, err := walkFiles(t, ib, root, 4, 2)
+	if err != nil || len(names) != 2 {
+		t.Errorf("expected 2 files, got %v (%v)", names, err)
+	}
+
+	if _, _, err := walkFiles(t, ib, filepath.Join(root, "missing"), 4, -1); err == nil {
+		t.Error("expected walking a missing directory to fail")
+	}
+}
+
+func TestInjestStream(t *testing.T) {
+	emails := map[string]string{
+		"a/1": "Subject: one\n\nThe quarterly budget.\n",
+		"a/2": "Subject: two\n\n" + strings.Repeat("More words. ", 100) + "Lunch on Friday.\n",
+		"b/3": "Subject: three\n\nThe budget forecast.\n",
+	}
+	root := writeTree(t, emails)
+
+	ib := &IndexBuilder{NThreads: 2, InputPath: root}
+	ib.Init()
+	files := make(chan WalkedFile)
+	walked := make(chan error, 1)
+	go func() { walked <- ib.Walk(t.Context(), root, 2, -1, files) }()
+	if err := ib.InjestStream(files); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-walked; err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if err := ib.Serialize(out); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// The files are in filename order whatever order they were found in, and
+	// each was read in full
+	if got := tableStrings(idx.filenames); !slices.Equal(got, []string{"a/1", "a/2", "b/3"}) {
+		t.Errorf("unexpected filenames %v", got)
+	}
+	res, err := idx.Search(t.Context(), Term("friday"))
+	if err != nil || len(res) != 1 || res[0].Filename != "a/2" {
+		t.Errorf("expected to find the end of a/2, got %v (%v)", res, err)
+	}
+
+	// A failure stops injestion without blocking the sender
+	ib = &IndexBuilder{NThreads: 1, InputPath: root, ErrorPolicy: ErrorPolicy_FailFast}
+	ib.Init()
+	files = make(chan WalkedFile)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(files)
+		for _, name := range []string{"missing", "a/1", "a/2", "b/3"} {
+			files <- WalkedFile{Name: name}
+		}
+	}()
+	if err := ib.InjestStream(files); err == nil {
+		t.Error("expected the missing file to fail injestion")
+	}
+	<-sent
+}
@@ -0,0 +1,111 @@
+package emailsearch
+
+import (
+	"hash/maphash"
+	"math"
+	"slices"
+	"sync/atomic"
+)
+
+// wordIndexShards is the number of maps the word index is split across.
+const wordIndexShards = 64
+
+// wordIndex is the global index for all the files in the corpus. It is
+// split across maps by the hash of the word, so that growing the index
+// rehashes one small map at a time instead of the whole vocabulary, and the
+// words merged into one shard stay close together in memory.
+type wordIndex struct {
+	seed   maphash.Seed
+	shards [wordIndexShards]map[string][]match
+}
+
+func newWordIndex() *wordIndex {
+	wi := &wordIndex{seed: maphash.MakeSeed()}
+	for i := range wi.shards {
+		wi.shards[i] = make(map[string][]match)
+	}
+	return wi
+}
+
+func (wi *wordIndex) shard(word string) map[string][]match {
+	return wi.shards[maphash.String(wi.seed, word)%wordIndexShards]
+}
+
+// add appends m to the matches of word.
+func (wi *wordIndex) add(word string, m match) {
+	shard := wi.shard(word)
+	shard[word] = append(shard[word], m)
+}
+
+// get returns the matches of word.
+func (wi *wordIndex) get(word string) []match {
+	return wi.shard(word)[word]
+}
+
+// len returns the number of words in the index.
+func (wi *wordIndex) len() int {
+	n := 0
+	for _, shard := range wi.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+// sortedWords returns the words of the index in sorted order.
+func (wi *wordIndex) sortedWords() []string {
+	words := make([]string, 0, wi.len())
+	for _, shard := range wi.shards {
+		for word := range shard {
+			words = append(words, word)
+		}
+	}
+	slices.Sort(words)
+	return words
+}
+
+// grow makes room for the index to hold n words without growing its maps
+// again, if the words are spread evenly across the shards.
+func (wi *wordIndex) grow(n int) {
+	per := n / wordIndexShards
+	for i, shard := range wi.shards {
+		if len(shard) >= per/2 {
+			continue // Already close enough to its size to not be worth a copy
+		}
+		grown := make(map[string][]match, per)
+		for word, matches := range shard {
+			grown[word] = matches
+		}
+		wi.shards[i] = grown
+	}
+}
+
+// estimateVocabulary estimates the number of distinct words in a corpus of
+// tokens words with Heaps' law, V = K * N^β. K = 44 and β = 0.49 were
+// measured on the Reuters RCV1 news corpus, see "Introduction to Information
+// Retrieval", section 5.1.1. It is only used to size maps up front.
+func estimateVocabulary(tokens int) int {
+	return int(44 * math.Pow(float64(tokens), 0.49))
+}
+
+// sizeEstimate keeps a running ratio of the number of entries in the maps
+// built for some input to the size of that input, to size the next map
+// before it is filled. It is safe for concurrent use.
+type sizeEstimate struct {
+	entries, size atomic.Int64
+}
+
+// record notes that an input of size gave entries map entries.
+func (e *sizeEstimate) record(size, entries int) {
+	e.size.Add(int64(size))
+	e.entries.Add(int64(entries))
+}
+
+// hint returns the expected number of entries for an input of size, 0 until
+// something has been recorded.
+func (e *sizeEstimate) hint(size int) int {
+	total := e.size.Load()
+	if total == 0 {
+		return 0
+	}
+	return int(float64(size) * float64(e.entries.Load()) / float64(total))
+}
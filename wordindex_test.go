@@ -0,0 +1,49 @@
+package emailsearch
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestWordIndex(t *testing.T) {
+	wi := newWordIndex()
+	var want []string
+	for i := range 1000 {
+		word := fmt.Sprintf("word%04d", i)
+		want = append(want, word)
+		wi.add(word, match{FilenameStringIndex: i})
+	}
+	wi.add("word0007", match{FilenameStringIndex: 1000})
+
+	// Growing keeps the words that are already in the index
+	wi.grow(100000)
+	if wi.len() != 1000 {
+		t.Errorf("len() = %d, want 1000", wi.len())
+	}
+	if got := wi.sortedWords(); !slices.Equal(got, want) {
+		t.Errorf("sortedWords() = %.40q..., want %.40q...", got, want)
+	}
+	if got := wi.get("word0007"); len(got) != 2 || got[0].FilenameStringIndex != 7 || got[1].FilenameStringIndex != 1000 {
+		t.Errorf("get(word0007) = %+v", got)
+	}
+	if got := wi.get("missing"); got != nil {
+		t.Errorf("get(missing) = %+v, want nil", got)
+	}
+}
+
+func TestSizeEstimate(t *testing.T) {
+	var e sizeEstimate
+	if e.hint(1000) != 0 {
+		t.Error("expected no hint before anything is recorded")
+	}
+	e.record(1000, 100)
+	e.record(3000, 200)
+	if got := e.hint(2000); got != 150 {
+		t.Errorf("hint(2000) = %d, want 150", got)
+	}
+
+	if v := estimateVocabulary(1_000_000); v < 10000 || v > 100000 {
+		t.Errorf("expected a vocabulary of tens of thousands of words for a million tokens, got %d", v)
+	}
+}
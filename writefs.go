@@ -0,0 +1,129 @@
+package emailsearch
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WriteFS is a destination for the files of a serialized index. Serialize
+// creates each file with Create, writes it in full and then closes it. A
+// file is only complete once Close has returned without error, so writers
+// that upload to object storage can commit the object in Close.
+type WriteFS interface {
+	Create(name string) (io.WriteCloser, error)
+}
+
+// WriteFSFunc adapts a function to a WriteFS.
+type WriteFSFunc func(name string) (io.WriteCloser, error)
+
+func (f WriteFSFunc) Create(name string) (io.WriteCloser, error) {
+	return f(name)
+}
+
+// DirFS is a WriteFS that writes files into a local directory. The directory
+// must exist. Each file is written to a temporary file that replaces the old
+// one when it is closed, so an index loaded from the directory keeps reading
+// the files it has open, and memory mapped, while it is rebuilt.
+type DirFS string
+
+func (d DirFS) Create(name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp(string(d), name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{f: f, path: filepath.Join(string(d), name)}, nil
+}
+
+// dirFile is a file of a DirFS. It is renamed over the file it replaces
+// when it is closed, unless writing it failed.
+type dirFile struct {
+	f    *os.File
+	path string
+	err  error // The first write error
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *dirFile) Close() error {
+	err := f.err
+	if err == nil {
+		err = f.f.Chmod(0644)
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.f.Name())
+	}
+	return err
+}
+
+// TarFS is a WriteFS that writes files into a tar stream. Tar headers hold
+// the size of each file, so files are buffered in memory until they are
+// closed. Close must be called after serialization to finish the stream.
+type TarFS struct {
+	ModTime time.Time // Modification time recorded for each file
+
+	tw *tar.Writer
+}
+
+// NewTarFS returns a TarFS that writes a tar stream to w.
+func NewTarFS(w io.Writer) *TarFS {
+	return &TarFS{ModTime: time.Now(), tw: tar.NewWriter(w)}
+}
+
+func (t *TarFS) Create(name string) (io.WriteCloser, error) {
+	return &tarFile{fs: t, name: name}, nil
+}
+
+// Close writes the tar footer. It does not close the underlying writer.
+func (t *TarFS) Close() error {
+	return t.tw.Close()
+}
+
+type tarFile struct {
+	bytes.Buffer
+	fs   *TarFS
+	name string
+}
+
+func (f *tarFile) Close() error {
+	hdr := &tar.Header{
+		Name:    f.name,
+		Mode:    0644,
+		Size:    int64(f.Len()),
+		ModTime: f.fs.ModTime,
+	}
+	if err := f.fs.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := f.WriteTo(f.fs.tw)
+	return err
+}
+
+// writeFile creates the file name in fsys, writes it with write and then
+// closes it.
+func writeFile(fsys WriteFS, name string, write func(w io.Writer) error) error {
+	f, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
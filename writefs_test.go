@@ -0,0 +1,92 @@
+package emailsearch
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSerializeToTar(t *testing.T) {
+	corpus := t.TempDir()
+	if err := os.WriteFile(filepath.Join(corpus, "1."), []byte("Subject: one\n\nThe quarterly budget presentation.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ib := &IndexBuilder{NThreads: 1, InputPath: corpus}
+	ib.Init()
+	if err := ib.InjestFiles([]string{"1."}, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	tfs := NewTarFS(buf)
+	if err := ib.SerializeTo(tfs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unpack the tar stream and check the index loads from it
+	out := t.TempDir()
+	var names []string
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(out, hdr.Name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{FilenamesStringTable, WordsStringTable, CorpusIndex, IndexWordOffsets, CorpusCatalog, QueryPrefixTree} {
+		if !slices.Contains(names, want) {
+			t.Errorf("tar stream is missing %s", want)
+		}
+	}
+
+	idx, err := LoadIndexFromDisk(out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	results, err := idx.QueryIndex(t.Context(), []string{"budget"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Filename != "1." {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriter) Close() error              { return nil }
+
+func TestSerializeToError(t *testing.T) {
+	ib := &IndexBuilder{NThreads: 1}
+	ib.Init()
+
+	fsys := WriteFSFunc(func(name string) (io.WriteCloser, error) {
+		return failingWriter{}, nil
+	})
+	if err := ib.SerializeTo(fsys); err == nil {
+		t.Errorf("expected write error")
+	}
+}